@@ -19,14 +19,26 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
 
 	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/analyse"
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/config"
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/diff"
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/fakeserver"
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/rest"
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/scaffold"
 	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/util"
 	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/version"
 	"github.com/spf13/afero"
 	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v2"
 )
 
 func main() {
@@ -75,7 +87,17 @@ func buildCli(fs afero.Fs) *cli.App {
 	    derran analyse -e='envs.yaml' -c='config.yaml' -se='dev' C:\Temp
 	`
 	analyseCommand := getAnalyseCommand(fs)
-	app.Commands = []*cli.Command{&analyseCommand}
+	fakeServerCommand := getFakeServerCommand(fs)
+	preflightCommand := getPreflightCommand(fs)
+	generateDataCommand := getGenerateDataCommand(fs)
+	discoverCommand := getDiscoverCommand(fs)
+	initCommand := getInitCommand(fs)
+	explainCommand := getExplainCommand(fs)
+	queryCommand := getQueryCommand(fs)
+	whatIfCommand := getWhatIfCommand(fs)
+	diffCommand := getDiffCommand(fs)
+	app.Commands = []*cli.Command{&initCommand, &analyseCommand, &preflightCommand, &explainCommand, &discoverCommand,
+		&queryCommand, &whatIfCommand, &diffCommand, &fakeServerCommand, &generateDataCommand}
 
 	return app
 }
@@ -103,7 +125,11 @@ func getAnalyseCommand(fs afero.Fs) cli.Command {
 			&cli.BoolFlag{
 				Name:    "dry-run",
 				Aliases: []string{"d"},
-				Usage:   "validate connectivity to environments, but don't execute anything",
+				Usage:   "validate the files and check the environments' tokens and data online, but don't analyse anything",
+			},
+			&cli.BoolFlag{
+				Name:  "explain",
+				Usage: "print the queries, slicing and formulas of the run instead of running it, without sending any request",
 			},
 			&cli.PathFlag{
 				Name:      "environments",
@@ -124,6 +150,87 @@ func getAnalyseCommand(fs afero.Fs) cli.Command {
 				Usage:   "Specific environment (from list) to analyse",
 				Aliases: []string{"se"},
 			},
+			&cli.IntFlag{
+				Name:  "retries",
+				Usage: "number of times a request failing with a network, server or rate limit error is retried",
+				Value: rest.DefaultRetries,
+			},
+			&cli.StringFlag{
+				Name:  "rate-limit-strategy",
+				Usage: "rate limiting strategy for all environments, one of sleep, token-bucket or adaptive (overrides environments file)",
+			},
+			&cli.IntFlag{
+				Name:  "rate-limit",
+				Usage: "requests per minute allowed by the token-bucket strategy for all environments (overrides environments file)",
+			},
+			&cli.IntFlag{
+				Name:    "parallelism",
+				Usage:   "maximum number of errors analysed at the same time across all environments",
+				Value:   analyse.DefaultParallelism,
+				Aliases: []string{"p"},
+			},
+			&cli.IntFlag{
+				Name:  "environment-parallelism",
+				Usage: "maximum number of errors analysed at the same time within one environment",
+				Value: analyse.DefaultEnvironmentParallelism,
+			},
+			&cli.DurationFlag{
+				Name:  "request-timeout",
+				Usage: "time limit for a single request to an environment",
+				Value: rest.DefaultRequestTimeout,
+			},
+			&cli.DurationFlag{
+				Name:  "timeout",
+				Usage: "time limit for the whole analysis, after which reports are written for the errors analysed so far (default: no limit)",
+			},
+			&cli.BoolFlag{
+				Name:  "resume",
+				Usage: "resume the run recorded by the checkpoint in the output directory, skipping the work already done",
+			},
+			&cli.BoolFlag{
+				Name:    "cache",
+				Usage:   "cache query responses on disk and reuse them in later runs",
+				EnvVars: []string{"DERRAN_CACHE"},
+			},
+			&cli.BoolFlag{
+				Name:  "no-cache",
+				Usage: "disable the query cache, even if enabled by DERRAN_CACHE",
+			},
+			&cli.BoolFlag{
+				Name:  "refresh",
+				Usage: "replace cached query responses instead of reusing them",
+			},
+			&cli.PathFlag{
+				Name:      "cache-dir",
+				Usage:     "directory of the query cache",
+				Value:     defaultCacheDir(),
+				TakesFile: true,
+			},
+			&cli.DurationFlag{
+				Name:  "cache-ttl",
+				Usage: "how long cached query responses are reused",
+				Value: rest.DefaultCacheTTL,
+			},
+			&cli.PathFlag{
+				Name:      "offline",
+				Usage:     "directory of USQL exports to analyse instead of querying the environments",
+				TakesFile: true,
+			},
+			&cli.PathFlag{
+				Name:      "record",
+				Usage:     "record all requests and their responses, without tokens, in the given directory",
+				TakesFile: true,
+			},
+			&cli.PathFlag{
+				Name:      "replay",
+				Usage:     "serve responses from the requests recorded in the given directory instead of querying the environments",
+				TakesFile: true,
+			},
+			&cli.StringFlag{
+				Name:  "replay-match",
+				Usage: "how requests are matched against recorded ones, ignore (their timeframe) or relative (to the start of the run)",
+				Value: rest.IgnoreTimestamps,
+			},
 		},
 		Action: func(ctx *cli.Context) error {
 			if ctx.NArg() > 1 {
@@ -139,15 +246,799 @@ func getAnalyseCommand(fs afero.Fs) cli.Command {
 				outputDir = "."
 			}
 
+			// The first SIGINT or SIGTERM stops the analysis gracefully, a second one terminates immediately
+			runCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			go func() {
+				<-runCtx.Done()
+				stop()
+			}()
+
+			options := analyse.Options{
+				Retries:                ctx.Int("retries"),
+				RateLimitStrategy:      ctx.String("rate-limit-strategy"),
+				RateLimit:              ctx.Int("rate-limit"),
+				Parallelism:            ctx.Int("parallelism"),
+				EnvironmentParallelism: ctx.Int("environment-parallelism"),
+				RequestTimeout:         ctx.Duration("request-timeout"),
+				Timeout:                ctx.Duration("timeout"),
+				Resume:                 ctx.Bool("resume"),
+				Cache:                  (ctx.Bool("cache") || ctx.Bool("refresh")) && !ctx.Bool("no-cache"),
+				CacheDir:               ctx.Path("cache-dir"),
+				CacheTTL:               ctx.Duration("cache-ttl"),
+				RefreshCache:           ctx.Bool("refresh"),
+				Offline:                ctx.Path("offline"),
+				Record:                 ctx.Path("record"),
+				Replay:                 ctx.Path("replay"),
+				ReplayMatch:            ctx.String("replay-match"),
+			}
+
+			if ctx.Bool("explain") {
+				return analyse.Explain(runCtx, outputDir, fs, ctx.Path("environments"), ctx.Path("config"),
+					ctx.String("specific-environment"), false, options)
+			}
+
 			return analyse.Analyse(
+				runCtx,
 				ctx.Bool("dry-run"),
 				outputDir,
 				fs,
 				ctx.Path("environments"),
 				ctx.Path("config"),
 				ctx.String("specific-environment"),
+				options,
+			)
+		},
+	}
+	return command
+}
+
+func getPreflightCommand(fs afero.Fs) cli.Command {
+	command := cli.Command{
+		Name:      "preflight",
+		Usage:     "checks that the environments accept their tokens and hold the data referenced by the configurations",
+		UsageText: "preflight [command options]",
+		Before: func(c *cli.Context) error {
+			return util.SetupLogging(c.Bool("verbose"))
+		},
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:    "verbose",
+				Aliases: []string{"v"},
+			},
+			&cli.PathFlag{
+				Name:      "environments",
+				Usage:     "YAML file containing details of Dynatrace environments",
+				Value:     "environments.yaml",
+				Aliases:   []string{"e"},
+				TakesFile: true,
+			},
+			&cli.PathFlag{
+				Name:      "config",
+				Usage:     "YAML file containing configurations for error analysis",
+				Value:     "config.yaml",
+				Aliases:   []string{"c"},
+				TakesFile: true,
+			},
+			&cli.StringFlag{
+				Name:    "specific-environment",
+				Usage:   "Specific environment (from list) to check",
+				Aliases: []string{"se"},
+			},
+			&cli.IntFlag{
+				Name:  "retries",
+				Usage: "number of times a request failing with a network, server or rate limit error is retried",
+				Value: rest.DefaultRetries,
+			},
+			&cli.DurationFlag{
+				Name:  "request-timeout",
+				Usage: "time limit for a single request to an environment",
+				Value: rest.DefaultRequestTimeout,
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			runCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			return analyse.Analyse(
+				runCtx,
+				true,
+				".",
+				fs,
+				ctx.Path("environments"),
+				ctx.Path("config"),
+				ctx.String("specific-environment"),
+				analyse.Options{
+					Retries:        ctx.Int("retries"),
+					RequestTimeout: ctx.Duration("request-timeout"),
+				},
+			)
+		},
+	}
+	return command
+}
+
+func getExplainCommand(fs afero.Fs) cli.Command {
+	command := cli.Command{
+		Name:      "explain",
+		Usage:     "prints the queries, slicing and formulas of a run, without sending any request",
+		UsageText: "explain [command options]",
+		Before: func(c *cli.Context) error {
+			return util.SetupLogging(c.Bool("verbose"))
+		},
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:    "verbose",
+				Aliases: []string{"v"},
+			},
+			&cli.PathFlag{
+				Name:      "environments",
+				Usage:     "YAML file containing details of Dynatrace environments",
+				Value:     "environments.yaml",
+				Aliases:   []string{"e"},
+				TakesFile: true,
+			},
+			&cli.PathFlag{
+				Name:      "config",
+				Usage:     "YAML file containing configurations for error analysis",
+				Value:     "config.yaml",
+				Aliases:   []string{"c"},
+				TakesFile: true,
+			},
+			&cli.StringFlag{
+				Name:    "specific-environment",
+				Usage:   "Specific environment (from list) to explain",
+				Aliases: []string{"se"},
+			},
+			&cli.BoolFlag{
+				Name:  "query-plan",
+				Usage: "also execute each query with explain=true and print the environment's query plan (USQL only)",
+			},
+			&cli.IntFlag{
+				Name:  "retries",
+				Usage: "number of times a request failing with a network, server or rate limit error is retried",
+				Value: rest.DefaultRetries,
+			},
+			&cli.DurationFlag{
+				Name:  "request-timeout",
+				Usage: "time limit for a single request to an environment",
+				Value: rest.DefaultRequestTimeout,
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			runCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			return analyse.Explain(
+				runCtx,
+				".",
+				fs,
+				ctx.Path("environments"),
+				ctx.Path("config"),
+				ctx.String("specific-environment"),
+				ctx.Bool("query-plan"),
+				analyse.Options{
+					Retries:        ctx.Int("retries"),
+					RequestTimeout: ctx.Duration("request-timeout"),
+				},
+			)
+		},
+	}
+	return command
+}
+
+func getDiscoverCommand(fs afero.Fs) cli.Command {
+	command := cli.Command{
+		Name:      "discover",
+		Usage:     "suggests configuration values from the recent sessions of an environment",
+		UsageText: "discover [command options]",
+		Before: func(c *cli.Context) error {
+			return util.SetupLogging(c.Bool("verbose"))
+		},
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:    "verbose",
+				Aliases: []string{"v"},
+			},
+			&cli.PathFlag{
+				Name:      "environments",
+				Usage:     "YAML file containing details of Dynatrace environments",
+				Value:     "environments.yaml",
+				Aliases:   []string{"e"},
+				TakesFile: true,
+			},
+			&cli.StringFlag{
+				Name:     "environment",
+				Usage:    "environment (from list) to discover",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:  "application",
+				Usage: "only sample the sessions of this application, by display name or entity ID",
+			},
+			&cli.PathFlag{
+				Name:      "output",
+				Usage:     "file the starter configuration is written to, which must not exist yet",
+				Value:     "discovered-config.yaml",
+				Aliases:   []string{"o"},
+				TakesFile: true,
+			},
+			&cli.IntFlag{
+				Name:  "retries",
+				Usage: "number of times a request failing with a network, server or rate limit error is retried",
+				Value: rest.DefaultRetries,
+			},
+			&cli.DurationFlag{
+				Name:  "request-timeout",
+				Usage: "time limit for a single request to an environment",
+				Value: rest.DefaultRequestTimeout,
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			runCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			return analyse.Discover(
+				runCtx,
+				fs,
+				ctx.Path("environments"),
+				ctx.String("environment"),
+				ctx.String("application"),
+				ctx.Path("output"),
+				analyse.Options{
+					Retries:        ctx.Int("retries"),
+					RequestTimeout: ctx.Duration("request-timeout"),
+				},
+			)
+		},
+	}
+	return command
+}
+
+func getQueryCommand(fs afero.Fs) cli.Command {
+	command := cli.Command{
+		Name:      "query",
+		Usage:     "runs an ad-hoc query against an environment and prints its results",
+		UsageText: "query [command options] <query>",
+		ArgsUsage: "<query>",
+		Before: func(c *cli.Context) error {
+			return util.SetupStderrLogging(c.Bool("verbose"))
+		},
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:    "verbose",
+				Aliases: []string{"v"},
+			},
+			&cli.PathFlag{
+				Name:      "environments",
+				Usage:     "YAML file containing details of Dynatrace environments",
+				Value:     "environments.yaml",
+				Aliases:   []string{"e"},
+				TakesFile: true,
+			},
+			&cli.StringFlag{
+				Name:     "environment",
+				Usage:    "environment (from list) to query, with USQL or with DQL for Grail environments",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:    "output",
+				Usage:   "format of the results, one of table, csv or json (shaped like USQL API responses, readable by --offline)",
+				Value:   analyse.QueryFormatTable,
+				Aliases: []string{"o"},
+			},
+			&cli.StringFlag{
+				Name:  "last",
+				Usage: "query the period before now, such as 30m, 2h or 7d",
+				Value: "2h",
+			},
+			&cli.StringFlag{
+				Name:  "from",
+				Usage: "query from this time instead, an RFC 3339 timestamp, a date and time such as 2006-01-02 15:04 or milliseconds",
+			},
+			&cli.StringFlag{
+				Name:  "to",
+				Usage: "query until this time instead of now, in the format of --from",
+			},
+			&cli.BoolFlag{
+				Name:  "no-slicing",
+				Usage: "query the timeframe at once, even if the results are extrapolated or reach the row limit",
+			},
+			&cli.IntFlag{
+				Name:  "retries",
+				Usage: "number of times a request failing with a network, server or rate limit error is retried",
+				Value: rest.DefaultRetries,
+			},
+			&cli.StringFlag{
+				Name:  "rate-limit-strategy",
+				Usage: "rate limiting strategy, one of sleep, token-bucket or adaptive (overrides environments file)",
+			},
+			&cli.IntFlag{
+				Name:  "rate-limit",
+				Usage: "requests per minute allowed by the token-bucket strategy (overrides environments file)",
+			},
+			&cli.DurationFlag{
+				Name:  "request-timeout",
+				Usage: "time limit for a single request to an environment",
+				Value: rest.DefaultRequestTimeout,
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			if ctx.NArg() != 1 {
+				return fmt.Errorf("expected exactly one query, quoted as one argument")
+			}
+
+			runCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			return analyse.Query(
+				runCtx,
+				fs,
+				ctx.Path("environments"),
+				ctx.String("environment"),
+				ctx.Args().First(),
+				analyse.Timeframe{
+					Last: ctx.String("last"),
+					From: ctx.String("from"),
+					To:   ctx.String("to"),
+				},
+				ctx.String("output"),
+				!ctx.Bool("no-slicing"),
+				analyse.Options{
+					Retries:           ctx.Int("retries"),
+					RateLimitStrategy: ctx.String("rate-limit-strategy"),
+					RateLimit:         ctx.Int("rate-limit"),
+					RequestTimeout:    ctx.Duration("request-timeout"),
+				},
+			)
+		},
+	}
+	return command
+}
+
+func getWhatIfCommand(fs afero.Fs) cli.Command {
+	command := cli.Command{
+		Name:      "whatif",
+		Usage:     "recomputes the reports of a run with other use case properties, without querying the environments",
+		UsageText: "whatif [command options] <run directory>",
+		ArgsUsage: "<run directory>",
+		Before: func(c *cli.Context) error {
+			return util.SetupLogging(c.Bool("verbose"))
+		},
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:    "verbose",
+				Aliases: []string{"v"},
+			},
+			&cli.StringSliceFlag{
+				Name:  "property",
+				Usage: "property overriding the one of the run as key=value, e.g. margin=25 or users_calling_in=40, may be repeated",
+			},
+			&cli.PathFlag{
+				Name:      "config",
+				Usage:     "alternative config file, whose configurations override the use cases and properties of the run's configurations with the same IDs",
+				Aliases:   []string{"c"},
+				TakesFile: true,
+			},
+			&cli.PathFlag{
+				Name:    "output",
+				Usage:   "directory the recomputed reports are written to (default: <run directory>_whatif)",
+				Aliases: []string{"o"},
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			if ctx.NArg() != 1 {
+				return fmt.Errorf("expected exactly one run directory, the output directory of derran analyse")
+			}
+			properties, err := scaffold.ParseProperties(ctx.StringSlice("property"))
+			if err != nil {
+				return err
+			}
+
+			runDir := ctx.Args().First()
+			outputDir := ctx.Path("output")
+			if outputDir == "" {
+				outputDir = filepath.Clean(runDir) + "_whatif"
+			}
+
+			return analyse.WhatIf(fs, runDir, outputDir, ctx.Path("config"), properties)
+		},
+	}
+	return command
+}
+
+func getDiffCommand(fs afero.Fs) cli.Command {
+	command := cli.Command{
+		Name:      "diff",
+		Usage:     "compares the reports of two runs and lists new, resolved and changed errors",
+		UsageText: "diff [command options] <run A> <run B>",
+		ArgsUsage: "<run A> <run B>",
+		Before: func(c *cli.Context) error {
+			return util.SetupLogging(c.Bool("verbose"))
+		},
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:    "verbose",
+				Aliases: []string{"v"},
+			},
+			&cli.StringFlag{
+				Name:    "format",
+				Usage:   "format of the differences, one of table (printed), markdown or xlsx (written to --output)",
+				Value:   diff.FormatTable,
+				Aliases: []string{"f"},
+			},
+			&cli.PathFlag{
+				Name:      "output",
+				Usage:     "file the differences are written to in markdown or xlsx format (default: diff.md or diff.xlsx)",
+				Aliases:   []string{"o"},
+				TakesFile: true,
+			},
+			&cli.BoolFlag{
+				Name:  "all",
+				Usage: "also list the errors which didn't change",
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			if ctx.NArg() != 2 {
+				return fmt.Errorf("expected two runs, each an output directory, a report or its stats file")
+			}
+
+			format, output := ctx.String("format"), ctx.Path("output")
+			if output == "" && format == diff.FormatMarkdown {
+				output = "diff.md"
+			} else if output == "" {
+				output = "diff.xlsx"
+			}
+
+			return diff.Diff(fs, ctx.Args().Get(0), ctx.Args().Get(1), format, output, ctx.Bool("all"), os.Stdout)
+		},
+	}
+	return command
+}
+
+func getInitCommand(fs afero.Fs) cli.Command {
+	command := cli.Command{
+		Name:      "init",
+		Usage:     "writes an environments file and a config file, asking for the details not given by flags",
+		UsageText: "init [command options]",
+		Before: func(c *cli.Context) error {
+			return util.SetupLogging(c.Bool("verbose"))
+		},
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:    "verbose",
+				Aliases: []string{"v"},
+			},
+			&cli.PathFlag{
+				Name:      "environments",
+				Usage:     "environments file to write",
+				Value:     "environments.yaml",
+				Aliases:   []string{"e"},
+				TakesFile: true,
+			},
+			&cli.PathFlag{
+				Name:      "config",
+				Usage:     "config file to write",
+				Value:     "config.yaml",
+				Aliases:   []string{"c"},
+				TakesFile: true,
+			},
+			&cli.BoolFlag{
+				Name:  "non-interactive",
+				Usage: "don't ask for details, use the defaults of those not given by flags",
+			},
+			&cli.BoolFlag{
+				Name:  "force",
+				Usage: "overwrite existing files",
+			},
+			&cli.StringFlag{
+				Name:  "environment-id",
+				Usage: "ID of the environment (default: prod)",
+			},
+			&cli.StringFlag{
+				Name:  "url",
+				Usage: "URL of the environment",
+			},
+			&cli.StringFlag{
+				Name:  "data-source",
+				Usage: "data source of user sessions, usql or grail (default: usql)",
+			},
+			&cli.StringFlag{
+				Name:  "auth",
+				Usage: "authentication, one of api-token, mission-control, platform-token or oauth",
+			},
+			&cli.StringFlag{
+				Name:  "token-name",
+				Usage: "environment variable holding the token (default: DT_<ENVIRONMENT ID>_TOKEN)",
+			},
+			&cli.StringFlag{
+				Name:  "mc-ua-name",
+				Usage: "environment variable holding the user agent of the Mission Control session",
+			},
+			&cli.StringFlag{
+				Name:  "mc-cookie-name",
+				Usage: "environment variable holding the cookie of the Mission Control session",
+			},
+			&cli.StringFlag{
+				Name:  "oauth-client-id",
+				Usage: "ID of the OAuth client",
+			},
+			&cli.StringFlag{
+				Name:  "oauth-client-secret-name",
+				Usage: "environment variable holding the secret of the OAuth client",
+			},
+			&cli.StringFlag{
+				Name:  "oauth-scope",
+				Usage: "scopes of the OAuth client",
+			},
+			&cli.StringFlag{
+				Name:  "oauth-resource",
+				Usage: "account or environment URN to request OAuth access for",
+			},
+			&cli.StringFlag{
+				Name:  "config-id",
+				Usage: "ID of the configuration (default: <environment id>-errors)",
+			},
+			&cli.StringFlag{
+				Name:  "config-name",
+				Usage: "name of the configuration",
+			},
+			&cli.StringSliceFlag{
+				Name:  "use-case",
+				Usage: "use case of the configuration, may be repeated (default: lost_basket)",
+			},
+			&cli.StringSliceFlag{
+				Name:  "property",
+				Usage: "property of the configuration as key=value, e.g. conversion=\"Loading of page /confirmation\", may be repeated",
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			properties, err := scaffold.ParseProperties(ctx.StringSlice("property"))
+			if err != nil {
+				return err
+			}
+
+			return scaffold.Init(
+				fs,
+				ctx.Path("environments"),
+				ctx.Path("config"),
+				scaffold.Answers{
+					EnvironmentId:         ctx.String("environment-id"),
+					EnvironmentUrl:        ctx.String("url"),
+					DataSource:            ctx.String("data-source"),
+					Auth:                  ctx.String("auth"),
+					TokenName:             ctx.String("token-name"),
+					MCUserAgentName:       ctx.String("mc-ua-name"),
+					MCCookieName:          ctx.String("mc-cookie-name"),
+					OAuthClientId:         ctx.String("oauth-client-id"),
+					OAuthClientSecretName: ctx.String("oauth-client-secret-name"),
+					OAuthScope:            ctx.String("oauth-scope"),
+					OAuthResource:         ctx.String("oauth-resource"),
+					ConfigId:              ctx.String("config-id"),
+					ConfigName:            ctx.String("config-name"),
+					UseCases:              ctx.StringSlice("use-case"),
+					Properties:            properties,
+				},
+				!ctx.Bool("non-interactive"),
+				ctx.Bool("force"),
+				os.Stdin,
+				os.Stdout,
 			)
 		},
 	}
 	return command
 }
+
+func getFakeServerCommand(fs afero.Fs) cli.Command {
+	command := cli.Command{
+		Name:      "fake-server",
+		Usage:     "serves the USQL API of a fake Dynatrace environment, for tests and demos",
+		UsageText: "fake-server [command options]",
+		Before: func(c *cli.Context) error {
+			return util.SetupLogging(c.Bool("verbose"))
+		},
+		Flags: append([]cli.Flag{
+			&cli.BoolFlag{
+				Name:    "verbose",
+				Aliases: []string{"v"},
+			},
+			&cli.StringFlag{
+				Name:  "listen",
+				Usage: "address the server listens on",
+				Value: "127.0.0.1:8080",
+			},
+			&cli.PathFlag{
+				Name:      "dataset",
+				Usage:     "USQL table JSON file of the sessions to serve, instead of generated ones",
+				TakesFile: true,
+			},
+			&cli.StringSliceFlag{
+				Name:  "token",
+				Usage: "API token accepted by the server, may be repeated (default: any token)",
+			},
+			&cli.StringSliceFlag{
+				Name:  "token-scope",
+				Usage: "scope of the tokens returned by the token lookup API, may be repeated (default: DTAQLAccess)",
+			},
+			&cli.IntFlag{
+				Name:  "rate-limit",
+				Usage: "requests per minute served before responding with HTTP 429 (default: no limit)",
+			},
+			&cli.IntFlag{
+				Name:  "sample-limit",
+				Usage: "sessions a query runs over before its results are extrapolated (default: never extrapolate)",
+			},
+		}, generateFlags()...),
+		Action: func(ctx *cli.Context) error {
+			var dataset *fakeserver.Dataset
+			var err error
+			if ctx.Path("dataset") != "" {
+				dataset, err = fakeserver.LoadDataset(fs, ctx.Path("dataset"))
+			} else {
+				dataset, err = generateDataset(ctx, fs)
+			}
+			if err != nil {
+				return err
+			}
+
+			server := &http.Server{
+				Addr: ctx.String("listen"),
+				Handler: fakeserver.NewServer(dataset, fakeserver.Options{
+					Tokens:            ctx.StringSlice("token"),
+					RequestsPerMinute: ctx.Int("rate-limit"),
+					SampleLimit:       ctx.Int("sample-limit"),
+					TokenScopes:       ctx.StringSlice("token-scope"),
+				}),
+			}
+
+			runCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			go func() {
+				<-runCtx.Done()
+				shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				server.Shutdown(shutdownCtx)
+			}()
+
+			util.Log.Info("Serving %d sessions at http://%s", dataset.Sessions(), server.Addr)
+			if err := server.ListenAndServe(); err != http.ErrServerClosed {
+				return err
+			}
+			util.Log.Info("Server stopped")
+			return nil
+		},
+	}
+	return command
+}
+
+func getGenerateDataCommand(fs afero.Fs) cli.Command {
+	command := cli.Command{
+		Name:      "generate-data",
+		Usage:     "generates a dataset of realistic user sessions, for demos and training",
+		UsageText: "generate-data [command options] [output directory]",
+		ArgsUsage: "[output directory]",
+		Before: func(c *cli.Context) error {
+			return util.SetupLogging(c.Bool("verbose"))
+		},
+		Flags: append([]cli.Flag{
+			&cli.BoolFlag{
+				Name:    "verbose",
+				Aliases: []string{"v"},
+			},
+			&cli.PathFlag{
+				Name:      "config",
+				Aliases:   []string{"c"},
+				Usage:     "YAML file of configurations to also write the exports of, for offline analysis",
+				TakesFile: true,
+			},
+			&cli.BoolFlag{
+				Name:  "print-profile",
+				Usage: "print the default profile, as a starting point for your own, and exit",
+			},
+		}, generateFlags()...),
+		Action: func(ctx *cli.Context) error {
+			if ctx.Bool("print-profile") {
+				data, err := yaml.Marshal(fakeserver.DefaultProfile())
+				if err != nil {
+					return err
+				}
+				fmt.Print(string(data))
+				return nil
+			}
+
+			if ctx.NArg() > 1 {
+				fmt.Println("Error: Too many arguments! Either specify a relative path to the output directory, or omit it for using the current directory.")
+				cli.ShowCommandHelpAndExit(ctx, "generate-data", 1)
+			}
+			outputDir := "."
+			if ctx.Args().Present() {
+				outputDir = ctx.Args().First()
+			}
+
+			var configs map[string]config.Config
+			if ctx.Path("config") != "" {
+				var errs []error
+				if configs, errs = config.LoadConfigList(ctx.Path("config"), fs); len(errs) > 0 {
+					for _, err := range errs {
+						util.Log.Error("\t%s", err)
+					}
+					return fmt.Errorf("failed to load configurations from %s", ctx.Path("config"))
+				}
+			}
+
+			now := time.Now()
+			dataset, err := generateDataset(ctx, fs)
+			if err != nil {
+				return err
+			}
+			if err := fs.MkdirAll(outputDir, 0755); err != nil {
+				return err
+			}
+			path := filepath.Join(outputDir, "dataset.json")
+			if err := fakeserver.WriteDataset(fs, dataset, path); err != nil {
+				return err
+			}
+			util.Log.Info("Generated %d sessions in %s", dataset.Sessions(), path)
+
+			for id, configuration := range configs {
+				for _, env := range configuration.GetEnvironments() {
+					dir := filepath.Join(outputDir, env, id)
+					if err := fakeserver.WriteOfflineExports(fs, dataset, configuration, dir, now); err != nil {
+						return err
+					}
+					util.Log.Info("Wrote the exports of configuration %s in environment %s to %s", id, env, dir)
+				}
+			}
+			return nil
+		},
+	}
+	return command
+}
+
+// generateFlags returns the flags which control the generation of sessions
+func generateFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.PathFlag{
+			Name:      "profile",
+			Usage:     "YAML file describing the sessions to generate (default: a travel booking website)",
+			TakesFile: true,
+		},
+		&cli.Int64Flag{
+			Name:  "seed",
+			Usage: "seed of the generated sessions, the same seed always generates the same sessions",
+			Value: 1,
+		},
+		&cli.IntFlag{
+			Name:  "sessions",
+			Usage: "number of sessions generated",
+			Value: 20000,
+		},
+		&cli.IntFlag{
+			Name:  "days",
+			Usage: "number of days up to now over which sessions are generated",
+			Value: 14,
+		},
+	}
+}
+
+// generateDataset generates sessions as specified by the generate flags
+func generateDataset(ctx *cli.Context, fs afero.Fs) (*fakeserver.Dataset, error) {
+	profile := fakeserver.DefaultProfile()
+	if ctx.Path("profile") != "" {
+		var err error
+		if profile, err = fakeserver.LoadProfile(fs, ctx.Path("profile")); err != nil {
+			return nil, err
+		}
+	}
+
+	return fakeserver.GenerateDataset(profile, ctx.Int64("seed"), ctx.Int("sessions"), ctx.Int("days"), time.Now())
+}
+
+// defaultCacheDir returns the directory of the query cache within the user's cache directory, or within the
+// current directory if the user has none
+func defaultCacheDir() string {
+	if dir, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(dir, "derran")
+	}
+	return ".derran-cache"
+}
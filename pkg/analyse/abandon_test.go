@@ -0,0 +1,95 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+package analyse
+
+import (
+	"testing"
+
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/config"
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/rest"
+)
+
+// abandonTestSession returns a session of a user in the format of util.UnpackSession, which got an error at the
+// given start time
+func abandonTestSession(userId string, startTime float64) []interface{} {
+	return []interface{}{userId, startTime, startTime + 60000, []interface{}{"Loading of page /"}, "Desktop Browser",
+		"Windows", []interface{}{"easyTravel"}, "Error"}
+}
+
+func TestCalculateAbandonStatsLostUsers(t *testing.T) {
+	configs, errs := config.NewConfigurations(map[string]map[string]interface{}{
+		"cfg": {
+			"name":      "cfg",
+			"use_cases": []interface{}{"incurred_costs"},
+			"properties": map[interface{}]interface{}{
+				"error_prop":    "errormessage",
+				"conversion":    "Loading of page /confirmation",
+				"cost_of_error": 10,
+			},
+		},
+	})
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+
+	tests := []struct {
+		name       string
+		abandoned  []interface{}
+		converted  []interface{}
+		wantLost   int
+		wantSaved  int
+		wantShared int
+	}{
+		{
+			name:      "converted by sessions in another order",
+			abandoned: []interface{}{abandonTestSession("a", 1000), abandonTestSession("b", 1000)},
+			converted: []interface{}{abandonTestSession("b", 2000), abandonTestSession("a", 2000)},
+			wantSaved: 2,
+		},
+		{
+			name: "more abandoned than converted sessions",
+			abandoned: []interface{}{abandonTestSession("a", 1000), abandonTestSession("b", 1000),
+				abandonTestSession("c", 1000)},
+			converted: []interface{}{abandonTestSession("c", 2000)},
+			wantLost:  2,
+			wantSaved: 1,
+		},
+		{
+			name:      "converted before the error",
+			abandoned: []interface{}{abandonTestSession("a", 2000)},
+			converted: []interface{}{abandonTestSession("a", 1000)},
+			wantLost:  1,
+		},
+		{
+			name:      "no converted sessions",
+			abandoned: []interface{}{abandonTestSession("a", 1000), abandonTestSession("a", 3000)},
+			wantLost:  2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stats := calculateAbandonStats(configs["cfg"], rest.EnvironmentError{Name: "Error"}, test.abandoned, test.converted)
+			if stats["lost_users"] != test.wantLost || stats["saved_users"] != test.wantSaved || stats["shared_users"] != test.wantShared {
+				t.Errorf("got %v lost, %v saved and %v shared users, expected %d, %d and %d", stats["lost_users"],
+					stats["saved_users"], stats["shared_users"], test.wantLost, test.wantSaved, test.wantShared)
+			}
+		})
+	}
+}
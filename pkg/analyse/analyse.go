@@ -20,9 +20,12 @@
 package analyse
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"path/filepath"
 	"sort"
+	"sync"
 	"time"
 
 	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/config"
@@ -37,9 +40,21 @@ import (
 // Analysis is done configuration by configuration running through all referenced environments, unless a
 // specific environment is specified. Reporting is done once all the data is collected and the reporting
 // output will group together reports in environment folders, with each report representing a configuration.
-func Analyse(dryRun bool, outputDir string, fs afero.Fs, environmentsFile string, configFile string, specificEnvironment string) error {
+// Once the context is done, or the run times out, no further errors are analysed and reports are written for
+// the errors analysed so far, marked as partial. A dry run doesn't analyse anything, but checks online that the
+// environments accept their tokens and hold the data the configurations reference.
+func Analyse(ctx context.Context, dryRun bool, outputDir string, fs afero.Fs, environmentsFile string, configFile string, specificEnvironment string,
+	options Options) error {
 	environments, envErrors := environment.LoadEnvironmentList(specificEnvironment, environmentsFile, fs)
 	configs, configErrors := config.LoadConfigList(configFile, fs)
+	rateLimiters, rateLimitErrors := createRateLimiters(environments, options)
+	envErrors = append(envErrors, rateLimitErrors...)
+
+	var environmentIds []string
+	for id := range environments {
+		environmentIds = append(environmentIds, id)
+	}
+	pool := newWorkerPool(environmentIds, options.Parallelism, options.EnvironmentParallelism)
 
 	outputDir = filepath.Clean(outputDir)
 
@@ -54,15 +69,94 @@ func Analyse(dryRun bool, outputDir string, fs afero.Fs, environmentsFile string
 		deploymentErrors[issue] = append(deploymentErrors[issue], err)
 	}
 
+	if dryRun && len(deploymentErrors) == 0 {
+		if options.Offline != "" {
+			util.Log.Info("Skipping online checks of environments for the offline analysis of %s", options.Offline)
+		} else {
+			for i, err := range preflight(ctx, configs, environments, rateLimiters, fs, options) {
+				issue := fmt.Sprintf("preflight-issue-%d", i)
+				deploymentErrors[issue] = append(deploymentErrors[issue], err)
+			}
+		}
+	}
+
 	if !dryRun && len(deploymentErrors) == 0 {
+		if options.Timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, options.Timeout)
+			defer cancel()
+		}
+
+		if options.Offline != "" {
+			util.Log.Info("Analysing USQL exports in %s instead of querying the environments", options.Offline)
+		}
+
+		progress, err := loadCheckpoint(fs, outputDir, options.Resume, util.NewTimelineProvider().Now())
+		if err != nil {
+			return err
+		}
+
+		if options.Record != "" || options.Replay != "" {
+			if options.fixtures, err = createFixtures(fs, progress, options); err != nil {
+				return err
+			}
+			if options.Cache {
+				// responses served from the cache would be missing from the recording
+				util.Log.Warn("The query cache is disabled while recording or replaying fixtures")
+				options.Cache = false
+			}
+		}
+
+		if options.Cache {
+			if options.cache, err = rest.NewQueryCache(fs, options.CacheDir, options.CacheTTL, options.RefreshCache); err != nil {
+				return err
+			}
+			util.Log.Info("Caching query responses in %s for %s", options.CacheDir, options.CacheTTL)
+		}
+
 		for _, configuration := range configs {
-			errors := execute(configuration, environments, outputDir, fs)
+			if ctx.Err() != nil {
+				break
+			}
+			errors := execute(ctx, configuration, environments, rateLimiters, pool, progress, outputDir, fs, options)
 
 			for i, err := range errors {
 				issue := fmt.Sprintf("%s-execution-issue-%d", configuration.GetId(), i)
 				deploymentErrors[issue] = append(deploymentErrors[issue], err)
 			}
 		}
+
+		if err := ctx.Err(); err != nil {
+			reason := "was interrupted"
+			if err == context.DeadlineExceeded {
+				reason = "timed out"
+			}
+			deploymentErrors["run-interrupted"] = append(deploymentErrors["run-interrupted"],
+				fmt.Errorf("the analysis %s, reports only include the errors analysed until then and are marked as partial", reason))
+		}
+
+		if options.cache != nil {
+			hits, misses := options.cache.Stats()
+			util.Log.Info("Query cache: %d hits, %d misses", hits, misses)
+		}
+
+		if options.fixtures != nil {
+			requests, unmatched := options.fixtures.Stats()
+			if options.Replay != "" {
+				util.Log.Info("Fixtures: %d requests replayed, %d unmatched", requests, unmatched)
+			} else {
+				util.Log.Info("Fixtures: %d requests recorded in %s", requests, options.Record)
+			}
+		}
+
+		// the checkpoint is only needed to resume a run which did not complete
+		if len(deploymentErrors) == 0 {
+			if err := progress.remove(); err != nil {
+				util.Log.Warn("Failed to remove checkpoint: %s", err)
+			}
+		} else if progress.saved {
+			util.Log.Info("Progress was saved to %s, use --resume to continue the run", progress.path)
+		}
 	}
 
 	util.Log.Info("Deployment summary:")
@@ -83,78 +177,374 @@ func Analyse(dryRun bool, outputDir string, fs afero.Fs, environmentsFile string
 	return nil
 }
 
-func execute(config config.Config, environments map[string]environment.Environment, outputDir string, fs afero.Fs) (errorList []error) {
-	util.Log.Info("Running configuration %s", config.GetId())
+// Options holds the optional settings of an analysis run
+type Options struct {
+	// Retries is the number of times a request failing with a transient error is retried
+	Retries int
+	// RateLimitStrategy overrides the rate limiting strategy of all environments, if not empty
+	RateLimitStrategy string
+	// RateLimit overrides the requests per minute of all environments, if not 0
+	RateLimit int
+	// Parallelism is the maximum number of errors analysed at the same time across all environments
+	Parallelism int
+	// EnvironmentParallelism is the maximum number of errors analysed at the same time within one environment
+	EnvironmentParallelism int
+	// RequestTimeout is the time limit for a single request
+	RequestTimeout time.Duration
+	// Timeout is the time limit for the whole run, or 0 for no limit
+	Timeout time.Duration
+	// Resume continues the run recorded by the checkpoint in the output directory, if any
+	Resume bool
+	// Cache enables the on-disk cache of query responses
+	Cache bool
+	// CacheDir is the directory of the query cache
+	CacheDir string
+	// CacheTTL is how long cached query responses are reused
+	CacheTTL time.Duration
+	// RefreshCache replaces cached query responses instead of reusing them
+	RefreshCache bool
+	// Offline is the directory of USQL exports to analyse instead of querying the environments, if not empty
+	Offline string
+	// Record is the directory which requests and their responses are recorded to, if not empty
+	Record string
+	// Replay is the directory of recorded requests to serve responses from instead of querying the environments,
+	// if not empty
+	Replay string
+	// ReplayMatch is how requests are matched against the recorded ones, one of rest.IgnoreTimestamps or
+	// rest.RelativeTimestamps
+	ReplayMatch string
+
+	cache    rest.QueryCache
+	fixtures rest.Fixtures
+	// clock paces and retries the requests of clients, the current time if nil
+	clock util.TimelineProvider
+	// withoutCredentials creates clients which don't need the credentials of the environments, as they send no
+	// request
+	withoutCredentials bool
+}
+
+// createFixtures creates the fixtures which requests are recorded to or replayed from. Timeframes are relative
+// to the reference time of the run, so that a resumed run still matches the requests recorded originally.
+func createFixtures(fs afero.Fs, progress *checkpoint, options Options) (rest.Fixtures, error) {
+	if options.Record != "" && options.Replay != "" {
+		return nil, fmt.Errorf("requests cannot be recorded and replayed at the same time")
+	}
+	if options.Offline != "" {
+		return nil, fmt.Errorf("requests cannot be recorded or replayed in offline mode")
+	}
 
-	for _, env := range config.GetEnvironments() {
-		util.Log.Info("\tAnalysing environment %s", env)
+	referenceTime := progress.timeline().NowMillis()
+	if options.Replay != "" {
+		return rest.NewFixtures(fs, options.Replay, rest.ReplayFixtures, options.ReplayMatch, referenceTime)
+	}
 
-		environment := environments[env]
-		var client rest.DynatraceClient
+	util.Log.Info("Recording requests and their responses in %s", options.Record)
+	return rest.NewFixtures(fs, options.Record, rest.RecordFixtures, options.ReplayMatch, referenceTime)
+}
 
-		apiToken, err := environment.GetToken()
-		if err != nil {
-			return append(errorList, err)
+// createRateLimiters creates one rate limiting strategy per environment, as specified in the environments file
+// unless overridden by the options. The strategies are shared by all configurations run against an environment,
+// so that the environment's rate limit is respected across the whole run.
+func createRateLimiters(environments map[string]environment.Environment,
+	options Options) (rateLimiters map[string]rest.RateLimitStrategy, errorList []error) {
+
+	rateLimiters = make(map[string]rest.RateLimitStrategy)
+	for id, env := range environments {
+		strategy := env.GetRateLimitStrategy()
+		if options.RateLimitStrategy != "" {
+			strategy = options.RateLimitStrategy
+		}
+		rateLimit := env.GetRateLimit()
+		if options.RateLimit != 0 {
+			rateLimit = options.RateLimit
 		}
 
-		mcUA, err := environment.GetMCUserAgent()
+		rateLimiter, err := rest.NewRateLimitStrategy(strategy, rateLimit)
 		if err != nil {
-			return append(errorList, err)
+			errorList = append(errorList, fmt.Errorf("environment %s: %w", id, err))
+			continue
 		}
+		rateLimiters[id] = rateLimiter
+	}
+
+	return rateLimiters, errorList
+}
+
+func execute(ctx context.Context, config config.Config, environments map[string]environment.Environment, rateLimiters map[string]rest.RateLimitStrategy,
+	pool *workerPool, progress *checkpoint, outputDir string, fs afero.Fs, options Options) (errorList []error) {
+	util.Log.Info("Running configuration %s", config.GetId())
+
+	envs := config.GetEnvironments()
+	envErrors := make([][]error, len(envs))
+
+	var wg sync.WaitGroup
+	for i, env := range envs {
+		details, ok := environments[env]
+		if !ok {
+			util.Log.Debug("\tSkipping environment %s, which was not loaded", env)
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, env string, details environment.Environment) {
+			defer wg.Done()
+			envErrors[i] = executeEnvironment(ctx, config, env, details, rateLimiters[env], pool, progress, outputDir, fs, options)
+		}(i, env, details)
+	}
+	wg.Wait()
+
+	// errors are collected in the order environments are referenced by the configuration
+	for _, errs := range envErrors {
+		errorList = append(errorList, errs...)
+	}
+
+	return errorList
+}
+
+// executeEnvironment analyses the errors of one environment, in parallel within the limits of the worker pool,
+// and creates the environment's report. Results are collected in the order in which errors were found. If the
+// context is done before all errors are analysed, the report holds the errors analysed so far and is marked as partial.
+// Progress is recorded in the checkpoint, and work recorded by a previous run is not repeated.
+func executeEnvironment(ctx context.Context, config config.Config, env string, environment environment.Environment, rateLimiter rest.RateLimitStrategy,
+	pool *workerPool, progress *checkpoint, outputDir string, fs afero.Fs, options Options) (errorList []error) {
+
+	log := newTaskLogger(env, rest.EnvironmentError{})
+
+	recorded := progress.entry(config, env)
+	if recorded.Reported {
+		log.Info("Already reported by the resumed run, skipping")
+		return errorList
+	}
+	log.Info("Analysing environment")
+
+	client, err := createClient(config, env, environment, rateLimiter, progress, fs, options)
+	if err != nil {
+		return append(errorList, fmt.Errorf("environment %s: %w", env, err))
+	}
 
-		mcCookie, err := environment.GetMCCookie()
+	environmentErrors := recorded.Errors
+	if !recorded.ErrorsFound {
+		err = pool.run(ctx, env, func() (err error) {
+			environmentErrors, err = client.FetchErrors(ctx, config)
+			return err
+		})
+		if err != nil && ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+			log.Info("Interrupted before any error was found, no report created")
+			return errorList
+		}
 		if err != nil {
-			return append(errorList, err)
+			return append(errorList, fmt.Errorf("environment %s: %w", env, err))
+		}
+		if err := progress.errorsFound(config, env, environmentErrors); err != nil {
+			log.Warn("Failed to save checkpoint: %s", err)
 		}
+	}
+	log.Info("Found %d errors to analyse", len(environmentErrors))
+
+	results := make([]map[string]interface{}, len(environmentErrors))
+	errs := make([]error, len(environmentErrors))
 
-		client, err = rest.NewDynatraceClient(environment.GetEnvironmentUrl(), apiToken, mcUA, mcCookie)
+	var wg sync.WaitGroup
+	for i, envErr := range environmentErrors {
+		if previous, ok := recorded.Results[i]; ok {
+			newTaskLogger(env, envErr).Debug("Already analysed by the resumed run, skipping")
+			results[i] = previous
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, envErr rest.EnvironmentError) {
+			defer wg.Done()
+			errs[i] = pool.run(ctx, env, func() (err error) {
+				results[i], err = analyseError(ctx, client, config, envErr, progress.timeline(), newTaskLogger(env, envErr))
+				if err == nil {
+					if err := progress.errorAnalysed(config, env, i, results[i]); err != nil {
+						newTaskLogger(env, envErr).Warn("Failed to save checkpoint: %s", err)
+					}
+				}
+				return err
+			})
+		}(i, envErr)
+	}
+	wg.Wait()
+
+	// errors which were not analysed because of the interruption are not reported individually
+	interrupted := ctx.Err() != nil
+	reportData := make(map[string]map[string]interface{})
+	for i, envErr := range environmentErrors {
+		if errs[i] != nil {
+			if !interrupted || !errors.Is(errs[i], ctx.Err()) {
+				errorList = append(errorList, fmt.Errorf("environment %s, error %s: %w", env, envErr.Name, errs[i]))
+			}
+			continue
+		}
+		reportData[reportKey(config, envErr)] = results[i]
+	}
+	if len(errorList) > 0 && !interrupted {
+		return errorList
+	}
+	if interrupted {
+		if len(reportData) == 0 {
+			log.Info("Interrupted before any error was analysed, no report created")
+			return errorList
+		}
+		log.Info("Interrupted, creating partial report with %d of %d errors", len(reportData), len(environmentErrors))
+	}
+
+	if err := report.CreateReport(environment, config, reportData, outputDir, fs, interrupted); err != nil {
+		return append(errorList, fmt.Errorf("environment %s: %w", env, err))
+	}
+	// the stats allow recomputing the report's values and comparing runs without querying the environment again
+	if err := report.CreateStats(environment, config, reportData, outputDir, fs, interrupted, progress.timeline().Now()); err != nil {
+		return append(errorList, fmt.Errorf("environment %s: %w", env, err))
+	}
+	log.Info("Report created")
+
+	if !interrupted {
+		// the partial report of an interrupted run is outdated once the run is resumed and completed
+		removed, err := report.RemovePartialReports(environment, config, outputDir, fs)
 		if err != nil {
-			return append(errorList, err)
+			log.Warn("Failed to remove partial report: %s", err)
+		}
+		for _, path := range removed {
+			log.Info("Removed partial report %s", path)
 		}
 
-		environmentErrors, err := client.FetchErrors(config)
+		if err := progress.reported(config, env); err != nil {
+			log.Warn("Failed to save checkpoint: %s", err)
+		}
+	}
+
+	return errorList
+}
+
+// createClient creates the client which retrieves the data of an environment. In offline mode, data is read
+// from the exports of the configuration and environment within the offline directory instead.
+func createClient(config config.Config, env string, dtEnvironment environment.Environment, rateLimiter rest.RateLimitStrategy,
+	progress *checkpoint, fs afero.Fs, options Options) (rest.DynatraceClient, error) {
+
+	if options.Offline != "" {
+		return rest.NewOfflineClient(fs, filepath.Join(options.Offline, env, config.GetId()))
+	}
+
+	auth, err := createAuthenticator(dtEnvironment, options)
+	if err != nil {
+		return nil, err
+	}
+
+	clientOptions := []rest.ClientOption{
+		rest.WithRetries(options.Retries), rest.WithRateLimitStrategy(rateLimiter), rest.WithRequestTimeout(options.RequestTimeout),
+		rest.WithTimelineProvider(progress.timeline()), rest.WithQueryCache(options.cache),
+	}
+	if options.fixtures != nil {
+		clientOptions = append(clientOptions, rest.WithFixtures(options.fixtures))
+	}
+	if options.clock != nil {
+		clientOptions = append(clientOptions, rest.WithClock(options.clock))
+	}
+
+	if dtEnvironment.GetDataSource() == environment.DataSourceGrail {
+		return rest.NewGrailClient(dtEnvironment.GetEnvironmentUrl(), auth, clientOptions...)
+	}
+	return rest.NewDynatraceClient(dtEnvironment.GetEnvironmentUrl(), auth, clientOptions...)
+}
+
+// createAuthenticator creates the Authenticator of the type chosen for the environment. Recorded fixtures don't
+// hold tokens, so a replay doesn't need them either and authenticates with a placeholder instead, as do clients
+// which send no request.
+func createAuthenticator(dtEnvironment environment.Environment, options Options) (rest.Authenticator, error) {
+	auth := dtEnvironment.GetAuth()
+	if options.Replay != "" || options.withoutCredentials {
+		if auth.Type == environment.AuthApiToken || auth.Type == environment.AuthMissionControl {
+			return rest.NewApiTokenAuthenticator("dt0c01.replayed.token")
+		}
+		return rest.NewPlatformTokenAuthenticator("replayed")
+	}
+
+	if auth.Type == environment.AuthOAuth {
+		secret, err := dtEnvironment.GetOAuthClientSecret()
 		if err != nil {
-			return append(errorList, err)
+			return nil, err
 		}
-		reportData := make(map[string]map[string]interface{})
-		for _, envErr := range environmentErrors {
-			util.Log.Info("\t\tAnalysisng error %s", envErr)
-			userSessions, err := client.FetchSessionsByError(config, envErr)
+		return rest.NewOAuthAuthenticator(rest.OAuthClient{
+			SSOUrl:       auth.SSOUrl,
+			ClientId:     auth.ClientId,
+			ClientSecret: secret,
+			Scope:        auth.Scope,
+			Resource:     auth.Resource,
+		})
+	}
 
-			if err != nil {
-				return append(errorList, err)
-			}
+	token, err := dtEnvironment.GetToken()
+	if err != nil {
+		return nil, err
+	}
 
-			util.Log.Debug(fmt.Sprintf("\t\tLoaded %d user sessions!", len(userSessions)))
-			results, err := analyseSessions(userSessions, envErr, config)
+	switch auth.Type {
+	case environment.AuthMissionControl:
+		mcUA, err := dtEnvironment.GetMCUserAgent()
+		if err != nil {
+			return nil, err
+		}
+		mcCookie, err := dtEnvironment.GetMCCookie()
+		if err != nil {
+			return nil, err
+		}
+		return rest.NewMissionControlAuthenticator(token, mcUA, mcCookie)
+	case environment.AuthPlatformToken:
+		return rest.NewPlatformTokenAuthenticator(token)
+	default:
+		return rest.NewApiTokenAuthenticator(token)
+	}
+}
 
-			if err != nil {
-				return append(errorList, err)
-			}
+// analyseError fetches the sessions impacted by an error and analyses them, including the cohort analysis
+// if requested by the configuration
+func analyseError(ctx context.Context, client rest.DynatraceClient, config config.Config, envErr rest.EnvironmentError,
+	timer util.TimelineProvider, log taskLogger) (results map[string]interface{}, err error) {
 
-			reportData[envErr] = results
+	log.Info("Analysing error")
+	userSessions, err := client.FetchSessionsByError(ctx, config, envErr)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debug("Loaded %d user sessions", len(userSessions))
+	results, err = analyseSessions(userSessions, envErr, config, log)
+	if err != nil {
+		return nil, err
+	}
 
+	if weeks, ok := config.GetProperty("cohort_weeks").(int); ok && weeks > 0 {
+		cohortResults, err := analyseCohort(ctx, client, config, envErr, weeks, timer, log)
+		if err != nil {
+			return nil, err
 		}
-		if err := report.CreateReport(environment, config, reportData, outputDir, fs); err != nil {
-			return append(errorList, err)
+
+		for k, v := range cohortResults {
+			results[k] = v
 		}
 	}
 
-	return errorList
+	return results, nil
 }
 
-func analyseSessions(userSessions []interface{}, envErr string,
-	config config.Config) (results map[string]interface{}, err error) {
+func analyseSessions(userSessions []interface{}, envErr rest.EnvironmentError,
+	config config.Config, log taskLogger) (results map[string]interface{}, err error) {
 
 	conversion := config.GetProperty("conversion").(string)
+	conversionMatch, _ := config.GetProperty("conversion_match").(string)
 	isLostBasket := config.HasUseCase("lost_basket")
-	errorAndAbandon, errorAndConvert, convert := splitUserSessions(envErr, conversion, isLostBasket, userSessions)
+	errorAndAbandon, errorAndConvert, convert := splitUserSessions(envErr, conversion, conversionMatch, isLostBasket, userSessions)
 
 	totalWithError := len(errorAndAbandon) + len(errorAndConvert)
-	util.Log.Info("\t\t\t%d users got the error", totalWithError)
-	util.Log.Info("\t\t\t%d users got the error and abandoned", len(errorAndAbandon))
+	log.Info("%d users got the error", totalWithError)
+	log.Info("%d users got the error and abandoned", len(errorAndAbandon))
 
-	stats := calculateAbandonStats(config, errorAndAbandon, convert)
+	stats := calculateAbandonStats(config, envErr, errorAndAbandon, convert)
+	if sharedUsers := stats["shared_users"].(int); sharedUsers > 0 {
+		log.Info("%d lost users are attributed to errors from earlier error properties", sharedUsers)
+	}
 	lostTimes := stats["lost_times"].([]int64)
 	lostBaskets := stats["lost_baskets"].(float64)
 	lostUsers := stats["lost_users"].(int)
@@ -184,16 +574,47 @@ func analyseSessions(userSessions []interface{}, envErr string,
 		}
 	}
 	results = make(map[string]interface{})
-	totalImpact := 0
+	results["error_name"] = envErr.Name
+	results["error_source"] = envErr.Label
 	results["impacted_users"] = totalWithError
 	results["lost_users"] = stats["lost_users"]
+	results["shared_users"] = stats["shared_users"]
 	results["unconverted_users"] = len(errorAndAbandon)
-	results["user_breakdown"] = [3]interface{}{
-		[2]interface{}{"Mobile", stats["lost_mobile"]},
-		[2]interface{}{"Desktop", stats["lost_desktop"]},
-		[2]interface{}{"Tablet", stats["lost_tablet"]},
+	if isPlatformBreakdown(config, stats) {
+		lostPlatforms := stats["lost_platforms"].(map[string]int)
+		results["user_breakdown"] = []interface{}{
+			[]interface{}{"iOS", lostPlatforms["iOS"]},
+			[]interface{}{"Android", lostPlatforms["Android"]},
+			[]interface{}{"Web", lostPlatforms["Web"]},
+		}
+		if lostPlatforms["Other"] > 0 {
+			results["user_breakdown"] = append(results["user_breakdown"].([]interface{}), []interface{}{"Other", lostPlatforms["Other"]})
+		}
+	} else {
+		results["user_breakdown"] = []interface{}{
+			[]interface{}{"Mobile", stats["lost_mobile"]},
+			[]interface{}{"Desktop", stats["lost_desktop"]},
+			[]interface{}{"Tablet", stats["lost_tablet"]},
+		}
 	}
 	results["date_breakdown"] = dateBreakdown
+	results["application_breakdown"] = applicationBreakdown(isLostBasket, append(errorAndAbandon, errorAndConvert...),
+		stats["lost_applications"].(map[string]int))
+
+	results["lost_baskets"] = lostBaskets
+	for k, v := range useCaseValues(config, lostUsers, lostBaskets) {
+		results[k] = v
+	}
+
+	return results, nil
+}
+
+// useCaseValues computes the values of a configuration's use cases and their projections from the users lost to an
+// error and the value of their baskets, before the multiplication factor. They are computed apart from the analysis
+// of the sessions, so that they can be recomputed with other properties without analysing the sessions again.
+func useCaseValues(config config.Config, lostUsers int, lostBaskets float64) (results map[string]interface{}) {
+	results = make(map[string]interface{})
+	totalImpact := 0
 
 	if config.HasUseCase("lost_basket") {
 		var multiFactor int = 1
@@ -219,7 +640,7 @@ func analyseSessions(userSessions []interface{}, envErr string,
 	if config.HasUseCase("agent_hours") {
 		usersCalling := config.GetProperty("users_calling_in").(int)
 		callLength := config.GetProperty("length_of_call").(int)
-		callCost := config.GetProperty("cost_of_call").(float64)
+		callCost, _ := config.GetProperty("cost_of_call").(float64)
 
 		lostAgentHoursMin := (lostUsers / 100) * usersCalling * callLength
 		lostAgentHoursHr := float64(lostAgentHoursMin / 60)
@@ -251,26 +672,122 @@ func analyseSessions(userSessions []interface{}, envErr string,
 
 	results["total_impact"] = totalImpact
 
-	return results, nil
+	return results
+}
+
+// reportKey returns the key of an error's data within the report. When errors are read from several error
+// properties, the same error name could come from more than one property, so the key includes the label.
+func reportKey(configuration config.Config, envErr rest.EnvironmentError) string {
+	source := configuration.GetProperty("error_source")
+	if errorProps, ok := configuration.GetProperty("error_prop").([]config.ErrorProperty); ok && len(errorProps) > 1 &&
+		(source == nil || source == "session_property") {
+		return envErr.Label + " - " + envErr.Name
+	}
+
+	return envErr.Name
+}
+
+// hasEarlierError checks whether a session also hit an error from any of the sources listed before the given one
+func hasEarlierError(sessionErrs [][]string, order int) bool {
+	for i := 0; i < order && i < len(sessionErrs); i++ {
+		if len(sessionErrs[i]) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isPlatformBreakdown decides whether lost users are broken down by platform (iOS, Android, Web) rather than
+// by browser channel (Mobile, Desktop, Tablet). Platforms are used for mobile and custom applications, as well
+// as whenever lost users come from sessions that have no browser, i.e. from a mix of application types.
+func isPlatformBreakdown(config config.Config, stats map[string]interface{}) bool {
+	switch config.GetProperty("application_type") {
+	case "mobile", "custom":
+		return true
+	case "web":
+		return false
+	}
+
+	lostPlatforms := stats["lost_platforms"].(map[string]int)
+	return lostPlatforms["iOS"]+lostPlatforms["Android"]+lostPlatforms["Other"] > 0
+}
+
+// platformOf returns the platform of a session. Sessions with a browser type are web sessions,
+// otherwise the OS family tells the mobile platforms apart.
+func platformOf(browserType string, osFamily string) string {
+	if browserType != "" {
+		return "Web"
+	}
+
+	switch osFamily {
+	case "iOS", "Android":
+		return osFamily
+	default:
+		return "Other"
+	}
 }
 
-func splitUserSessions(envErr string, conversion string, isLostBasket bool, userSessions []interface{}) (
+// applicationBreakdown counts the impacted and lost users per application. The breakdown is
+// sorted by the number of lost users, so that the application carrying the impact comes first.
+func applicationBreakdown(isLostBasket bool, errorSessions []interface{},
+	lostApplications map[string]int) (breakdown []interface{}) {
+
+	impactedApplications := make(map[string]int)
+	for _, session := range errorSessions {
+		sDetails := util.UnpackSession(isLostBasket, session.([]interface{}))
+		impactedApplications[sDetails["application"].(string)]++
+	}
+
+	applications := make([]string, 0, len(impactedApplications))
+	for application := range impactedApplications {
+		applications = append(applications, application)
+	}
+	sort.Slice(applications, func(a, b int) bool {
+		lostA, lostB := lostApplications[applications[a]], lostApplications[applications[b]]
+		if lostA != lostB {
+			return lostA > lostB
+		}
+		return applications[a] < applications[b]
+	})
+
+	for _, application := range applications {
+		label := application
+		if label == "" {
+			label = "Unknown"
+		}
+		breakdown = append(breakdown, []interface{}{label, impactedApplications[application], lostApplications[application]})
+	}
+
+	return breakdown
+}
+
+func splitUserSessions(envErr rest.EnvironmentError, conversion string, conversionMatch string, isLostBasket bool, userSessions []interface{}) (
 	errorAndAbandon []interface{}, errorAndConvert []interface{}, convert []interface{}) {
 
 	for i := 0; i < len(userSessions); i++ {
 		var converted bool
 		session := userSessions[i].([]interface{})
 		sDetails := util.UnpackSession(isLostBasket, session)
-		sessionErr := sDetails["error"].(string)
+		sessionErrs := sDetails["errors"].([][]string)
 		sessionActions := sDetails["actions"].([]string)
 
 		for _, action := range sessionActions {
-			if action == conversion {
+			if util.MatchesConversion(action, conversion, conversionMatch) {
 				converted = true
 			}
 		}
 
-		if sessionErr == envErr {
+		hasError := false
+		if envErr.Order < len(sessionErrs) {
+			for _, sessionErr := range sessionErrs[envErr.Order] {
+				if sessionErr == envErr.Name {
+					hasError = true
+				}
+			}
+		}
+
+		if hasError {
 			if converted {
 				errorAndConvert = append(errorAndConvert, session)
 			} else {
@@ -286,18 +803,24 @@ func splitUserSessions(envErr string, conversion string, isLostBasket bool, user
 	return errorAndAbandon, errorAndConvert, convert
 }
 
-func calculateAbandonStats(config config.Config, errorAndAbandon []interface{},
+// calculateAbandonStats works out which of the users who abandoned after an error did not return to convert
+// later on. When an error source shares lost sessions with error sources listed before it, these sessions
+// are attributed to the earlier sources, so that the same lost users are not counted for several errors.
+func calculateAbandonStats(config config.Config, envErr rest.EnvironmentError, errorAndAbandon []interface{},
 	convert []interface{}) (stats map[string]interface{}) {
 	var (
 		savedBaskets float64
 		lostBaskets  float64
 		savedUsers   int
+		sharedUsers  int
 		lostUsers    int
 		lostMobile   int
 		lostDesktop  int
 		lostTablet   int
 		lostTimes    []int64
 	)
+	lostPlatforms := make(map[string]int)
+	lostApplications := make(map[string]int)
 	isLostBasket := config.HasUseCase("lost_basket")
 	for i := 0; i < len(errorAndAbandon); i++ {
 		var saved bool
@@ -307,10 +830,13 @@ func calculateAbandonStats(config config.Config, errorAndAbandon []interface{},
 		userId := sDetails["userId"].(string)
 		startTime := sDetails["startTime"].(int64)
 		browserType := sDetails["browserType"].(string)
+		osFamily := sDetails["osFamily"].(string)
 		basketValue := sDetails["basketValue"].(float64)
+		application := sDetails["application"].(string)
+		sessionErrs := sDetails["errors"].([][]string)
 
 		for i2 := 0; i2 < len(convert); i2++ {
-			convertedSession := convert[i].([]interface{})
+			convertedSession := convert[i2].([]interface{})
 			csDetails := util.UnpackSession(isLostBasket, convertedSession)
 			convertedId := csDetails["userId"].(string)
 			convertedStartTime := csDetails["startTime"].(int64)
@@ -326,9 +852,12 @@ func calculateAbandonStats(config config.Config, errorAndAbandon []interface{},
 			if isLostBasket {
 				savedBaskets += basketValue
 			}
+		} else if hasEarlierError(sessionErrs, envErr.Order) {
+			sharedUsers++
 		} else {
 			lostUsers++
 			lostTimes = append(lostTimes, startTime)
+			lostApplications[application]++
 
 			if isLostBasket {
 				lostBaskets += basketValue
@@ -340,6 +869,7 @@ func calculateAbandonStats(config config.Config, errorAndAbandon []interface{},
 			} else if browserType == "Tablet Browser" {
 				lostTablet++
 			}
+			lostPlatforms[platformOf(browserType, osFamily)]++
 		}
 	}
 
@@ -347,11 +877,14 @@ func calculateAbandonStats(config config.Config, errorAndAbandon []interface{},
 	stats["lost_baskets"] = lostBaskets
 	stats["saved_baskets"] = savedBaskets
 	stats["saved_users"] = savedUsers
+	stats["shared_users"] = sharedUsers
 	stats["lost_users"] = lostUsers
 	stats["lost_mobile"] = lostMobile
 	stats["lost_desktop"] = lostDesktop
 	stats["lost_tablet"] = lostTablet
+	stats["lost_platforms"] = lostPlatforms
 	stats["lost_times"] = lostTimes
+	stats["lost_applications"] = lostApplications
 
 	return stats
 }
@@ -0,0 +1,393 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+package analyse
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/360EntSecGroup-Skylar/excelize"
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/fakeserver"
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/report"
+	"github.com/spf13/afero"
+)
+
+const (
+	testToken      = "dt0c01.test.token"
+	testSessions   = 4000
+	testDays       = 5
+	testConversion = "Loading of page /confirmation"
+)
+
+// fakeClock is a TimelineProvider whose current time only advances when sleeping, so that waiting for the rate
+// limit of the fake server to reset takes no time
+type fakeClock struct {
+	mutex sync.Mutex
+	now   time.Time
+	slept time.Duration
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) NowMillis() int64 {
+	return f.Now().UnixNano() / int64(time.Millisecond)
+}
+
+func (f *fakeClock) GetDaysBeforeMillis(days int) int64 {
+	return f.Now().AddDate(0, 0, -days).UnixNano() / int64(time.Millisecond)
+}
+
+func (f *fakeClock) Sleep(duration time.Duration) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.now = f.now.Add(duration)
+	f.slept += duration
+}
+
+func (f *fakeClock) SleepContext(ctx context.Context, duration time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	f.Sleep(duration)
+	return nil
+}
+
+// serverStats counts the requests served by the fake server
+type serverStats struct {
+	mutex           sync.Mutex
+	sessionQueries  int
+	tooManyRequests int
+}
+
+// statusRecorder records the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// countRequests wraps the handler of the fake server to count the queries fetching sessions and the responses
+// with HTTP 429
+func countRequests(handler http.Handler, stats *serverStats) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler.ServeHTTP(recorder, r)
+
+		stats.mutex.Lock()
+		defer stats.mutex.Unlock()
+		if recorder.status == http.StatusTooManyRequests {
+			stats.tooManyRequests++
+		} else if strings.HasPrefix(r.URL.Query().Get("query"), "SELECT internalUserId, startTime") {
+			stats.sessionQueries++
+		}
+	})
+}
+
+// expectedStats are the users of an error counted straight from the sessions of a dataset
+type expectedStats struct {
+	impactedUsers    int
+	unconvertedUsers int
+}
+
+// expectStats counts the sessions of real users of the application which captured each error, and those of them
+// which didn't convert, as the analysis does over the sessions fetched for an error
+func expectStats(t *testing.T, dataset *fakeserver.Dataset, application string) map[string]expectedStats {
+	table := dataset.Table()
+	columns := make(map[string]int)
+	for i, column := range table["columnNames"].([]string) {
+		columns[column] = i
+	}
+
+	expected := make(map[string]expectedStats)
+	for _, row := range table["values"].([]interface{}) {
+		session := row.([]interface{})
+		errorName, _ := session[columns["stringProperties.errormessage"]].(string)
+		if session[columns["userType"]] != "REAL_USER" || errorName == "" ||
+			!contains(session[columns["useraction.application"]], application) {
+			continue
+		}
+
+		stats := expected[errorName]
+		stats.impactedUsers++
+		if !contains(session[columns["useraction.name"]], testConversion) {
+			stats.unconvertedUsers++
+		}
+		expected[errorName] = stats
+	}
+	if len(expected) == 0 {
+		t.Fatal("the dataset holds no errors")
+	}
+	return expected
+}
+
+// contains tells whether a list field of a session holds the value
+func contains(list interface{}, value string) bool {
+	switch values := list.(type) {
+	case []string:
+		for _, v := range values {
+			if v == value {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, v := range values {
+			if v == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeTestFiles writes the environments and configuration files of a run against the fake server at url
+func writeTestFiles(t *testing.T, fs afero.Fs, dir string, url string, environments ...string) (string, string) {
+	var envs strings.Builder
+	for _, env := range environments {
+		fmt.Fprintf(&envs, "%s:\n  name: %q\n  env-url: %q\n  env-token: %q\n", env, env, url, testToken)
+		if env == "grail" {
+			envs.WriteString("  data-source: grail\n")
+		}
+	}
+	config := fmt.Sprintf(`cfg:
+  name: "cfg"
+  environments: [%s]
+  use_cases: ["incurred_costs", "lost_basket"]
+  properties:
+    application: ["easyTravel"]
+    error_prop: "errormessage"
+    conversion: %q
+    basket_prop: "basketvalue"
+    basket_prop_type: "double"
+    cost_of_error: 10
+`, `"`+strings.Join(environments, `", "`)+`"`, testConversion)
+
+	environmentsFile, configFile := filepath.Join(dir, "environments.yaml"), filepath.Join(dir, "config.yaml")
+	if err := afero.WriteFile(fs, environmentsFile, []byte(envs.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := afero.WriteFile(fs, configFile, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return environmentsFile, configFile
+}
+
+// readRunStats reads the stats of the only report of an environment in the output directory
+func readRunStats(t *testing.T, fs afero.Fs, outputDir string, env string) (report.Stats, string) {
+	paths, err := report.FindStats(fs, filepath.Join(outputDir, env))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 1 {
+		t.Fatalf("expected 1 stats file for environment %s, found %v", env, paths)
+	}
+	stats, err := report.ReadStats(fs, paths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stats, paths[0]
+}
+
+// checkWorkbook checks that the report next to the stats lists the same errors as the stats
+func checkWorkbook(t *testing.T, statsPath string, stats report.Stats) {
+	workbook, err := excelize.OpenFile(strings.TrimSuffix(statsPath, report.StatsExtension) + ".xlsx")
+	if err != nil {
+		t.Fatalf("failed to open report: %s", err)
+	}
+	if env := workbook.GetCellValue(report.SummarySheet, report.SummaryEnvironmentCell); env != stats.Environment.Name {
+		t.Errorf("report is of environment %q, expected %q", env, stats.Environment.Name)
+	}
+
+	listed := make(map[string]bool)
+	for row := report.FirstSummaryRow; ; row++ {
+		name := workbook.GetCellValue(report.SummarySheet, fmt.Sprintf("%s%d", report.SummaryNameColumn, row))
+		if name == "" {
+			break
+		}
+		listed[name] = true
+	}
+	for _, errorStats := range stats.Errors {
+		if !listed[errorStats.Name] {
+			t.Errorf("report doesn't list error %q", errorStats.Name)
+		}
+	}
+	if len(listed) != len(stats.Errors) {
+		t.Errorf("report lists %d errors, expected %d", len(listed), len(stats.Errors))
+	}
+}
+
+func TestAnalyseAgainstFakeServer(t *testing.T) {
+	dataset, err := fakeserver.GenerateDataset(fakeserver.DefaultProfile(), 42, testSessions, testDays, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := expectStats(t, dataset, "easyTravel")
+
+	tests := []struct {
+		name              string
+		requestsPerMinute int
+		sampleLimit       int
+		// exact is whether the stats must match the dataset, which they can't once sessions are sampled
+		exact bool
+	}{
+		{name: "all sessions", exact: true},
+		{name: "rate limited", requestsPerMinute: 4, exact: true},
+		{name: "extrapolated", sampleLimit: testSessions / 8},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clock := &fakeClock{now: time.Now()}
+			requests := &serverStats{}
+			server := httptest.NewServer(countRequests(fakeserver.NewServer(dataset, fakeserver.Options{
+				Tokens:            []string{testToken},
+				RequestsPerMinute: test.requestsPerMinute,
+				SampleLimit:       test.sampleLimit,
+				Timeline:          clock,
+			}), requests))
+			defer server.Close()
+
+			fs, dir := afero.NewOsFs(), t.TempDir()
+			environmentsFile, configFile := writeTestFiles(t, fs, dir, server.URL, "usql")
+			outputDir := filepath.Join(dir, "output")
+
+			err := Analyse(context.Background(), false, outputDir, fs, environmentsFile, configFile, "", Options{
+				Retries:                1,
+				RateLimit:              600,
+				Parallelism:            1,
+				EnvironmentParallelism: 1,
+				RequestTimeout:         10 * time.Second,
+				clock:                  clock,
+			})
+			if err != nil {
+				t.Fatalf("analysis failed: %s", err)
+			}
+
+			stats, statsPath := readRunStats(t, fs, outputDir, "usql")
+			if stats.Partial || stats.Environment.Name != "usql" || stats.Configuration.Id != "cfg" {
+				t.Errorf("unexpected stats of environment %q, configuration %q, partial %t", stats.Environment.Name,
+					stats.Configuration.Id, stats.Partial)
+			}
+			if len(stats.Errors) != len(expected) {
+				t.Errorf("found %d errors, expected %d", len(stats.Errors), len(expected))
+			}
+			for _, errorStats := range stats.Errors {
+				want, ok := expected[errorStats.Name]
+				switch {
+				case !ok:
+					t.Errorf("error %q isn't in the dataset", errorStats.Name)
+				case test.exact && (errorStats.ImpactedUsers != want.impactedUsers || errorStats.UnconvertedUsers != want.unconvertedUsers):
+					t.Errorf("error %q has %d impacted and %d unconverted users, expected %d and %d", errorStats.Name,
+						errorStats.ImpactedUsers, errorStats.UnconvertedUsers, want.impactedUsers, want.unconvertedUsers)
+				case errorStats.ImpactedUsers == 0 || errorStats.ImpactedUsers > want.impactedUsers:
+					t.Errorf("error %q has %d impacted users, expected up to %d", errorStats.Name, errorStats.ImpactedUsers,
+						want.impactedUsers)
+				}
+				if errorStats.LostUsers > errorStats.UnconvertedUsers {
+					t.Errorf("error %q has more lost users (%d) than unconverted ones (%d)", errorStats.Name,
+						errorStats.LostUsers, errorStats.UnconvertedUsers)
+				}
+				if _, ok := errorStats.Values["total_impact"]; !ok {
+					t.Errorf("error %q has no total impact", errorStats.Name)
+				}
+			}
+			checkWorkbook(t, statsPath, stats)
+
+			// sessions are fetched with one query per error, unless their results are extrapolated
+			if test.sampleLimit == 0 && requests.sessionQueries != len(stats.Errors) {
+				t.Errorf("sessions were fetched with %d queries, expected %d", requests.sessionQueries, len(stats.Errors))
+			}
+			if test.sampleLimit > 0 && requests.sessionQueries <= len(stats.Errors) {
+				t.Errorf("sessions were fetched with %d queries, expected extrapolated results to be split", requests.sessionQueries)
+			}
+			if test.requestsPerMinute > 0 && (requests.tooManyRequests == 0 || clock.slept < time.Minute) {
+				t.Errorf("expected requests to be rate limited, got %d responses with HTTP 429 and waited %s",
+					requests.tooManyRequests, clock.slept)
+			}
+		})
+	}
+}
+
+func TestGrailMatchesUSQL(t *testing.T) {
+	dataset, err := fakeserver.GenerateDataset(fakeserver.DefaultProfile(), 7, testSessions, testDays, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(fakeserver.NewServer(dataset, fakeserver.Options{Tokens: []string{testToken}}))
+	defer server.Close()
+
+	fs, dir := afero.NewOsFs(), t.TempDir()
+	environmentsFile, configFile := writeTestFiles(t, fs, dir, server.URL, "usql", "grail")
+	outputDir := filepath.Join(dir, "output")
+
+	err = Analyse(context.Background(), false, outputDir, fs, environmentsFile, configFile, "", Options{
+		Retries:                1,
+		RateLimit:              600,
+		Parallelism:            2,
+		EnvironmentParallelism: 1,
+		RequestTimeout:         10 * time.Second,
+		// Grail queries are polled for their results without waiting
+		clock: &fakeClock{now: time.Now()},
+	})
+	if err != nil {
+		t.Fatalf("analysis failed: %s", err)
+	}
+
+	usql, _ := readRunStats(t, fs, outputDir, "usql")
+	grail, _ := readRunStats(t, fs, outputDir, "grail")
+	if len(usql.Errors) == 0 || len(grail.Errors) != len(usql.Errors) {
+		t.Fatalf("found %d errors in USQL and %d in Grail", len(usql.Errors), len(grail.Errors))
+	}
+	for key, usqlStats := range usql.Errors {
+		grailStats, ok := grail.Errors[key]
+		if !ok {
+			t.Errorf("error %q wasn't found in Grail", key)
+			continue
+		}
+		if grailStats.ImpactedUsers != usqlStats.ImpactedUsers || grailStats.UnconvertedUsers != usqlStats.UnconvertedUsers ||
+			grailStats.LostUsers != usqlStats.LostUsers || grailStats.SharedUsers != usqlStats.SharedUsers {
+			t.Errorf("error %q has %d impacted, %d unconverted, %d lost and %d shared users in Grail, but %d, %d, %d and %d in USQL",
+				key, grailStats.ImpactedUsers, grailStats.UnconvertedUsers, grailStats.LostUsers, grailStats.SharedUsers,
+				usqlStats.ImpactedUsers, usqlStats.UnconvertedUsers, usqlStats.LostUsers, usqlStats.SharedUsers)
+		}
+		if math.Abs(grailStats.LostBaskets-usqlStats.LostBaskets) > 0.01 {
+			t.Errorf("error %q lost baskets worth %.2f in Grail, but %.2f in USQL", key, grailStats.LostBaskets, usqlStats.LostBaskets)
+		}
+		for name, value := range usqlStats.Values {
+			if math.Abs(grailStats.Values[name]-value) > 0.01 {
+				t.Errorf("error %q has %s %.2f in Grail, but %.2f in USQL", key, name, grailStats.Values[name], value)
+			}
+		}
+	}
+}
@@ -0,0 +1,258 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+package analyse
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/config"
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/rest"
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/util"
+	"github.com/spf13/afero"
+)
+
+// checkpointFile is the name of the checkpoint file within the output directory
+const checkpointFile = "derran_checkpoint.gob"
+
+// maxCheckpointAge is the age after which a checkpoint is no longer resumed, as the timeframes of its run would miss
+// the errors and sessions since
+const maxCheckpointAge = 24 * time.Hour
+
+func init() {
+	// concrete types found within analysis results, which gob needs to know about to encode them as interface{}
+	gob.Register([]interface{}{})
+	gob.Register(map[string]int{})
+}
+
+// checkpoint records the progress of an analysis run in the output directory, so that a run which failed or was
+// interrupted can be resumed without repeating the work already done. It holds the errors found in each environment
+// for each configuration, the results of the errors analysed so far, and which environments were fully reported.
+// The checkpoint is saved every time it changes and removed once a run finishes without errors.
+type checkpoint struct {
+	mutex sync.Mutex
+	fs    afero.Fs
+	path  string
+	state checkpointState
+	// saved is true once the checkpoint file holds progress of this run
+	saved bool
+}
+
+type checkpointState struct {
+	// ReferenceTime is the time which the timeframes of the run are computed from
+	ReferenceTime time.Time
+	// Entries holds the progress of each configuration and environment, keyed by checkpointKey
+	Entries map[string]*checkpointEntry
+}
+
+type checkpointEntry struct {
+	// Fingerprint identifies the configuration and timeframe the entry's results were produced with
+	Fingerprint string
+	// ErrorsFound is true once the errors of the environment were found
+	ErrorsFound bool
+	Errors      []rest.EnvironmentError
+	// Results holds the results of the errors analysed so far, keyed by their index in Errors
+	Results map[int]map[string]interface{}
+	// Reported is true once the report of the environment was created
+	Reported bool
+}
+
+// loadCheckpoint returns the checkpoint of the output directory. When resuming, the existing checkpoint is loaded,
+// if there is one, and the run continues from its reference time so that it covers the same timeframe. Otherwise,
+// or if the checkpoint is older than maxCheckpointAge, a new checkpoint is started with the current time as
+// reference time.
+func loadCheckpoint(fs afero.Fs, outputDir string, resume bool, now time.Time) (*checkpoint, error) {
+	c := &checkpoint{
+		fs:   fs,
+		path: filepath.Join(outputDir, checkpointFile),
+		state: checkpointState{
+			ReferenceTime: now,
+			Entries:       make(map[string]*checkpointEntry),
+		},
+	}
+
+	if !resume {
+		return c, nil
+	}
+
+	exists, err := afero.Exists(fs, c.path)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		util.Log.Info("No checkpoint found in %s, starting a new run", outputDir)
+		return c, nil
+	}
+
+	data, err := afero.ReadFile(fs, c.path)
+	if err != nil {
+		return nil, err
+	}
+	var state checkpointState
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&state); err != nil {
+		return nil, fmt.Errorf("checkpoint %s could not be read, remove it or run without --resume: %w", c.path, err)
+	}
+	if age := now.Sub(state.ReferenceTime); age > maxCheckpointAge {
+		util.Log.Warn("The checkpoint in %s is of the run started at %s, more than %s ago, starting a new run", outputDir,
+			state.ReferenceTime.Format(time.RFC3339), maxCheckpointAge)
+		return c, nil
+	}
+	if state.Entries == nil {
+		state.Entries = make(map[string]*checkpointEntry)
+	}
+	c.state = state
+	c.saved = true
+	util.Log.Info("Resuming the run started at %s, which covers the timeframes up to that time",
+		c.state.ReferenceTime.Format(time.RFC3339))
+
+	return c, nil
+}
+
+// timeline returns a TimelineProvider fixed to the reference time of the run
+func (c *checkpoint) timeline() util.TimelineProvider {
+	return util.NewFixedTimelineProvider(c.state.ReferenceTime)
+}
+
+// entry returns the progress of the given configuration and environment. Progress recorded for a different
+// configuration or timeframe is discarded.
+func (c *checkpoint) entry(config config.Config, env string) checkpointEntry {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	key := checkpointKey(config, env)
+	fingerprint := c.fingerprint(config)
+
+	entry, ok := c.state.Entries[key]
+	if !ok || entry.Fingerprint != fingerprint {
+		if ok {
+			util.Log.Info("[%s] Configuration %s or its timeframe changed since the checkpoint, starting over", env, config.GetId())
+		}
+		entry = &checkpointEntry{Fingerprint: fingerprint, Results: make(map[int]map[string]interface{})}
+		c.state.Entries[key] = entry
+	}
+
+	// results are shared read-only, so a shallow copy keeps the entry safe from concurrent updates
+	copied := *entry
+	copied.Results = make(map[int]map[string]interface{}, len(entry.Results))
+	for i, results := range entry.Results {
+		copied.Results[i] = results
+	}
+	return copied
+}
+
+// errorsFound records the errors found in an environment
+func (c *checkpoint) errorsFound(config config.Config, env string, errors []rest.EnvironmentError) error {
+	return c.update(config, env, func(entry *checkpointEntry) {
+		entry.ErrorsFound = true
+		entry.Errors = errors
+	})
+}
+
+// errorAnalysed records the results of an analysed error, given by its index among the errors found
+func (c *checkpoint) errorAnalysed(config config.Config, env string, index int, results map[string]interface{}) error {
+	return c.update(config, env, func(entry *checkpointEntry) {
+		entry.Results[index] = results
+	})
+}
+
+// reported records that the report of an environment was created
+func (c *checkpoint) reported(config config.Config, env string) error {
+	return c.update(config, env, func(entry *checkpointEntry) {
+		entry.Reported = true
+	})
+}
+
+// remove deletes the checkpoint file, once it is no longer needed
+func (c *checkpoint) remove() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if exists, err := afero.Exists(c.fs, c.path); err != nil || !exists {
+		return err
+	}
+	return c.fs.Remove(c.path)
+}
+
+// update applies a change to the progress of a configuration and environment and saves the checkpoint
+func (c *checkpoint) update(config config.Config, env string, change func(entry *checkpointEntry)) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, ok := c.state.Entries[checkpointKey(config, env)]
+	if !ok {
+		return fmt.Errorf("no checkpoint entry for configuration %s and environment %s", config.GetId(), env)
+	}
+	change(entry)
+
+	return c.save()
+}
+
+// save writes the checkpoint to a temporary file first, so that an interruption never leaves a corrupt checkpoint
+func (c *checkpoint) save() error {
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(c.state); err != nil {
+		return fmt.Errorf("failed to encode checkpoint: %w", err)
+	}
+
+	if err := c.fs.MkdirAll(filepath.Dir(c.path), 0777); err != nil {
+		return err
+	}
+	if err := afero.WriteFile(c.fs, c.path+".tmp", buffer.Bytes(), 0644); err != nil {
+		return err
+	}
+	if err := c.fs.Rename(c.path+".tmp", c.path); err != nil {
+		return err
+	}
+
+	c.saved = true
+	return nil
+}
+
+// fingerprint identifies a configuration, as well as the timeframes of the run, so that progress recorded for
+// a configuration that has since been edited, or over a different timeframe, is not reused
+func (c *checkpoint) fingerprint(config config.Config) string {
+	properties := config.GetProperties()
+	keys := make([]string, 0, len(properties))
+	for k := range properties {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s|%s|%v|%v\n", config.GetId(), config.GetName(), config.GetUseCases(), config.GetEnvironments())
+	for _, k := range keys {
+		fmt.Fprintf(hash, "%s=%v\n", k, properties[k])
+	}
+
+	timeline := c.timeline()
+	fmt.Fprintf(hash, "errors=%d-%d\n", timeline.GetDaysBeforeMillis(rest.ErrorsTimeframeDays), timeline.NowMillis())
+	fmt.Fprintf(hash, "sessions=%d-%d\n", timeline.GetDaysBeforeMillis(rest.SessionsTimeframeDays), timeline.NowMillis())
+
+	return fmt.Sprintf("%x", hash.Sum(nil))
+}
+
+func checkpointKey(config config.Config, env string) string {
+	return config.GetId() + "/" + env
+}
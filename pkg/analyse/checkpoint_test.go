@@ -0,0 +1,166 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+package analyse
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/config"
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/rest"
+	"github.com/spf13/afero"
+)
+
+// checkpointTestConfig returns a configuration with the given cost of error, which changes its fingerprint
+func checkpointTestConfig(t *testing.T, costOfError int) config.Config {
+	configs, errs := config.NewConfigurations(map[string]map[string]interface{}{
+		"cfg": {
+			"name":      "cfg",
+			"use_cases": []interface{}{"incurred_costs"},
+			"properties": map[interface{}]interface{}{
+				"error_prop":    "errormessage",
+				"conversion":    "Loading of page /confirmation",
+				"cost_of_error": costOfError,
+			},
+		},
+	})
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	return configs["cfg"]
+}
+
+// saveTestCheckpoint records the progress of a run started at the given time, which found two errors, analysed
+// the first one and reported, in the output directory
+func saveTestCheckpoint(t *testing.T, fs afero.Fs, configuration config.Config, started time.Time) []rest.EnvironmentError {
+	progress, err := loadCheckpoint(fs, "output", false, started)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errors := []rest.EnvironmentError{{Name: "Error A", Source: "errormessage"}, {Name: "Error B", Source: "errormessage"}}
+	progress.entry(configuration, "env")
+	if err := progress.errorsFound(configuration, "env", errors); err != nil {
+		t.Fatal(err)
+	}
+	if err := progress.errorAnalysed(configuration, "env", 0, map[string]interface{}{"impacted_users": 3,
+		"user_breakdown": []interface{}{[]interface{}{"Chrome", 2}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := progress.reported(configuration, "env"); err != nil {
+		t.Fatal(err)
+	}
+	return errors
+}
+
+func TestCheckpointResume(t *testing.T) {
+	started := time.Date(2021, 10, 18, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		resume      bool
+		resumedAt   time.Time
+		costOfError int
+		wantResumed bool
+		wantEntry   bool
+	}{
+		{name: "resumed", resume: true, resumedAt: started.Add(time.Hour), costOfError: 10, wantResumed: true, wantEntry: true},
+		{name: "resumed at the maximum age", resume: true, resumedAt: started.Add(maxCheckpointAge), costOfError: 10,
+			wantResumed: true, wantEntry: true},
+		{name: "not resumed", resume: false, resumedAt: started.Add(time.Hour), costOfError: 10},
+		{name: "older than the maximum age", resume: true, resumedAt: started.Add(maxCheckpointAge + time.Minute),
+			costOfError: 10},
+		{name: "configuration changed", resume: true, resumedAt: started.Add(time.Hour), costOfError: 20, wantResumed: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			errors := saveTestCheckpoint(t, fs, checkpointTestConfig(t, 10), started)
+
+			progress, err := loadCheckpoint(fs, "output", test.resume, test.resumedAt)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			wantReference := test.resumedAt
+			if test.wantResumed {
+				wantReference = started
+			}
+			if reference := progress.timeline().Now(); !reference.Equal(wantReference) {
+				t.Errorf("run covers the timeframes up to %s, expected %s", reference, wantReference)
+			}
+
+			entry := progress.entry(checkpointTestConfig(t, test.costOfError), "env")
+			if !test.wantEntry {
+				if entry.ErrorsFound || entry.Reported || len(entry.Results) > 0 {
+					t.Errorf("progress of the checkpoint was kept: %+v", entry)
+				}
+				return
+			}
+			if !entry.ErrorsFound || !reflect.DeepEqual(entry.Errors, errors) {
+				t.Errorf("found errors %v, expected %v", entry.Errors, errors)
+			}
+			if len(entry.Results) != 1 || entry.Results[0]["impacted_users"] != 3 {
+				t.Errorf("analysed errors are %v, expected the first one", entry.Results)
+			}
+			if !reflect.DeepEqual(entry.Results[0]["user_breakdown"], []interface{}{[]interface{}{"Chrome", 2}}) {
+				t.Errorf("user breakdown is %v", entry.Results[0]["user_breakdown"])
+			}
+			if !entry.Reported {
+				t.Error("the environment isn't reported")
+			}
+		})
+	}
+}
+
+func TestCheckpointRemove(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	started := time.Date(2021, 10, 18, 12, 0, 0, 0, time.UTC)
+	saveTestCheckpoint(t, fs, checkpointTestConfig(t, 10), started)
+
+	progress, err := loadCheckpoint(fs, "output", true, started)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := progress.remove(); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := afero.Exists(fs, progress.path); exists {
+		t.Error("the checkpoint wasn't removed")
+	}
+	if exists, _ := afero.Exists(fs, progress.path+".tmp"); exists {
+		t.Error("the temporary checkpoint was left behind")
+	}
+}
+
+func TestCorruptCheckpoint(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	if err := afero.WriteFile(fs, "output/"+checkpointFile, []byte("not a checkpoint"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := loadCheckpoint(fs, "output", true, time.Now()); err == nil {
+		t.Error("expected an error for a corrupt checkpoint")
+	}
+	if _, err := loadCheckpoint(fs, "output", false, time.Now()); err != nil {
+		t.Errorf("a new run failed because of a corrupt checkpoint: %v", err)
+	}
+}
@@ -0,0 +1,108 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+package analyse
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/config"
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/rest"
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/util"
+)
+
+// analyseCohort takes the users who hit the given error in the cohort week and follows them over the
+// given number of weeks. For each following week their return and conversion rates are compared to
+// those of the users who were active in the cohort week but did not hit the error.
+func analyseCohort(ctx context.Context, client rest.DynatraceClient, config config.Config, envErr rest.EnvironmentError,
+	weeks int, timer util.TimelineProvider, log taskLogger) (results map[string]interface{}, err error) {
+
+	cohortStart := timer.GetDaysBeforeMillis(7 * (weeks + 1))
+	cohortEnd := timer.GetDaysBeforeMillis(7 * weeks)
+
+	cohort, err := client.FetchUserActivity(ctx, config, envErr, cohortStart, cohortEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	impacted := toUserSet(cohort["impacted"])
+	unaffected := toUserSet(cohort["active"])
+	for userId := range impacted {
+		delete(unaffected, userId)
+	}
+
+	log.Info("Following %d impacted and %d unaffected users over %d weeks", len(impacted), len(unaffected), weeks)
+
+	var retention []interface{}
+	for week := 1; week <= weeks; week++ {
+		from := timer.GetDaysBeforeMillis(7 * (weeks + 1 - week))
+		to := timer.GetDaysBeforeMillis(7 * (weeks - week))
+
+		activity, err := client.FetchUserActivity(ctx, config, rest.EnvironmentError{}, from, to)
+		if err != nil {
+			return nil, err
+		}
+
+		active := toUserSet(activity["active"])
+		converted := toUserSet(activity["converted"])
+
+		retention = append(retention, []interface{}{
+			fmt.Sprintf("Week %d", week),
+			retentionRate(impacted, active),
+			retentionRate(impacted, converted),
+			retentionRate(unaffected, active),
+			retentionRate(unaffected, converted),
+		})
+	}
+
+	results = make(map[string]interface{})
+	results["cohort_start"] = time.Unix(0, cohortStart*int64(time.Millisecond)).Format("02 Jan")
+	results["cohort_impacted_users"] = len(impacted)
+	results["cohort_unaffected_users"] = len(unaffected)
+	results["cohort_retention"] = retention
+
+	return results, nil
+}
+
+// toUserSet converts a list of user IDs into a set
+func toUserSet(userIds []string) map[string]bool {
+	set := make(map[string]bool)
+	for _, userId := range userIds {
+		set[userId] = true
+	}
+
+	return set
+}
+
+// retentionRate returns the percentage of users in the cohort that are also found in the given set
+func retentionRate(cohort map[string]bool, found map[string]bool) float64 {
+	if len(cohort) == 0 {
+		return 0
+	}
+
+	count := 0
+	for userId := range cohort {
+		if found[userId] {
+			count++
+		}
+	}
+
+	return float64(count) * 100 / float64(len(cohort))
+}
@@ -0,0 +1,512 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+package analyse
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/environment"
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/rest"
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/util"
+	"github.com/spf13/afero"
+)
+
+const (
+	// discoveryTopValues is the number of most frequent values shown per string property
+	discoveryTopValues = 5
+	// discoveryTopActions is the number of most frequent user actions shown
+	discoveryTopActions = 20
+	// discoveryCandidates is the number of candidates shown per kind of configuration value
+	discoveryCandidates = 5
+)
+
+var (
+	// conversionKeywords hint at user actions which complete a purchase or another goal of the users
+	conversionKeywords = []string{"confirm", "checkout", "thank", "order", "purchase", "payment", "pay", "success",
+		"complete", "booking", "receipt", "submit"}
+	// completionKeywords hint at user actions which follow a completed goal, rather than lead towards it
+	completionKeywords = []string{"confirm", "thank", "success", "complete", "receipt"}
+	// errorKeywords hint at string properties capturing errors, by their key
+	errorKeywords = []string{"error", "err", "exception", "fail", "fault", "message", "msg", "problem", "alert", "warning"}
+	// basketKeywords hint at numeric properties capturing the value of a basket, by their key
+	basketKeywords = []string{"basket", "cart", "revenue", "value", "amount", "total", "price", "order"}
+	// errorValuePattern matches values of properties which read like errors, including HTTP error status codes
+	errorValuePattern = regexp.MustCompile(`(?i)error|fail|exception|invalid|timeout|timed out|unable|denied|unavailable|not found|\b[45]\d\d\b`)
+)
+
+// discoveryCount is how many sampled sessions hold a value
+type discoveryCount struct {
+	value    string
+	sessions int
+}
+
+// discoveryProperty is a session property seen in the sampled sessions
+type discoveryProperty struct {
+	key       string
+	kind      string
+	sessions  int
+	values    []discoveryCount
+	min, max  float64
+	distincts int
+}
+
+// discoveryCandidate is a likely value of a configuration property, with the reasons it was ranked for
+type discoveryCandidate struct {
+	value  string
+	kind   string
+	score  float64
+	reason string
+}
+
+// discovery is what was learned from the sampled sessions of an environment
+type discovery struct {
+	sessions     int
+	applications []discoveryCount
+	properties   []discoveryProperty
+	actions      []discoveryCount
+	conversions  []discoveryCandidate
+	errorProps   []discoveryCandidate
+	basketProps  []discoveryCandidate
+}
+
+// Discover samples the recent sessions of real users in an environment, optionally of a single application,
+// and prints the applications, session properties and user actions seen, ranking the user actions likely to
+// mark a conversion and the properties likely to capture errors or basket values. A starter configuration built
+// from the best candidates is written to the output file for review, which must not exist yet.
+func Discover(ctx context.Context, fs afero.Fs, environmentsFile string, env string, application string, output string,
+	options Options) error {
+
+	if exists, err := afero.Exists(fs, output); err != nil {
+		return err
+	} else if exists {
+		return fmt.Errorf("%s already exists, remove it or choose another output file", output)
+	}
+
+	environments, errs := environment.LoadEnvironmentList(env, environmentsFile, fs)
+	rateLimiters, rateLimitErrs := createRateLimiters(environments, options)
+	if errs = append(errs, rateLimitErrs...); len(errs) > 0 {
+		for _, err := range errs {
+			util.Log.Error("%s", err)
+		}
+		return fmt.Errorf("failed to load environment %s", env)
+	}
+
+	// discovery always queries the environment, rather than exports or recorded fixtures
+	options.Offline, options.Record, options.Replay = "", "", ""
+	progress, err := loadCheckpoint(fs, ".", false, util.NewTimelineProvider().Now())
+	if err != nil {
+		return err
+	}
+	client, err := createClient(nil, env, environments[env], rateLimiters[env], progress, fs, options)
+	if err != nil {
+		return err
+	}
+	sampler, ok := client.(rest.Discovery)
+	if !ok {
+		return fmt.Errorf("environment %s doesn't support discovery", env)
+	}
+
+	var applications []string
+	if application != "" {
+		applications = []string{application}
+	}
+	util.Log.Info("Sampling up to %d sessions of environment %s", rest.DiscoverySampleLimit, env)
+	samples, err := sampler.SampleSessions(ctx, applications, rest.DiscoverySampleLimit)
+	if err != nil {
+		return err
+	}
+	if len(samples) == 0 {
+		return fmt.Errorf("no sessions of real users were found in environment %s in the last %d days", env,
+			rest.SessionsTimeframeDays)
+	}
+
+	result := discover(samples)
+	printDiscovery(os.Stdout, env, result)
+
+	starter := starterConfig(env, application, result, progress.timeline().NowMillis())
+	if err := afero.WriteFile(fs, output, starter, 0644); err != nil {
+		return err
+	}
+	util.Log.Info("A starter configuration was written to %s, review it before running an analysis", output)
+	return nil
+}
+
+// discover counts the applications, session properties and user actions of the sampled sessions, and ranks the
+// candidates for the conversion, error property and basket property of a configuration
+func discover(samples []rest.SessionSample) discovery {
+	applications := make(map[string]int)
+	actions := make(map[string]int)
+	stringValues := make(map[string]map[string]int)
+	numbers := make(map[string]*discoveryProperty)
+
+	for _, sample := range samples {
+		for _, application := range distinct(sample.Applications) {
+			applications[application]++
+		}
+		for _, action := range distinct(sample.Actions) {
+			actions[action]++
+		}
+		for key, value := range sample.StringProperties {
+			if stringValues[key] == nil {
+				stringValues[key] = make(map[string]int)
+			}
+			stringValues[key][value]++
+		}
+		countNumbers(numbers, sample.DoubleProperties, "double")
+		countNumbers(numbers, sample.LongProperties, "long")
+	}
+
+	result := discovery{
+		sessions:     len(samples),
+		applications: sortedCounts(applications),
+		actions:      sortedCounts(actions),
+	}
+	for key, values := range stringValues {
+		property := discoveryProperty{key: key, kind: "string", values: sortedCounts(values), distincts: len(values)}
+		for _, count := range values {
+			property.sessions += count
+		}
+		result.properties = append(result.properties, property)
+	}
+	for _, property := range numbers {
+		result.properties = append(result.properties, *property)
+	}
+	sort.Slice(result.properties, func(i, j int) bool {
+		if result.properties[i].sessions != result.properties[j].sessions {
+			return result.properties[i].sessions > result.properties[j].sessions
+		}
+		return result.properties[i].key < result.properties[j].key
+	})
+
+	result.conversions = rankConversions(result.actions, result.sessions)
+	result.errorProps = rankErrorProperties(result.properties, result.sessions)
+	result.basketProps = rankBasketProperties(result.properties)
+	return result
+}
+
+// countNumbers adds the numeric properties of a session to those counted so far
+func countNumbers(numbers map[string]*discoveryProperty, properties map[string]float64, kind string) {
+	for key, value := range properties {
+		property, ok := numbers[key]
+		if !ok {
+			property = &discoveryProperty{key: key, kind: kind, min: value, max: value}
+			numbers[key] = property
+		}
+		property.sessions++
+		property.min = math.Min(property.min, value)
+		property.max = math.Max(property.max, value)
+	}
+}
+
+// rankConversions ranks user actions which mention conversion keywords, preferring those which a minority of
+// sessions reach. Actions of nearly every session, such as the loading of the home page, are left out.
+func rankConversions(actions []discoveryCount, sessions int) []discoveryCandidate {
+	var candidates []discoveryCandidate
+	for _, action := range actions {
+		share := float64(action.sessions) / float64(sessions)
+		keywords := matchingKeywords(action.value, conversionKeywords)
+		if len(keywords) == 0 || share > 0.9 {
+			continue
+		}
+		score := float64(len(keywords) + len(matchingKeywords(action.value, completionKeywords)))
+		if share >= 0.005 && share <= 0.5 {
+			score += 0.5
+		}
+		candidates = append(candidates, discoveryCandidate{
+			value:  action.value,
+			score:  score,
+			reason: fmt.Sprintf("mentions %s, in %s of sessions", strings.Join(keywords, ", "), percentage(share)),
+		})
+	}
+	return topCandidates(candidates)
+}
+
+// rankErrorProperties ranks string properties by how much their keys and values read like errors, preferring
+// those which a minority of sessions hold
+func rankErrorProperties(properties []discoveryProperty, sessions int) []discoveryCandidate {
+	var candidates []discoveryCandidate
+	for _, property := range properties {
+		if property.kind != "string" {
+			continue
+		}
+		var reasons []string
+		score := 0.0
+		if keywords := matchingKeywords(property.key, errorKeywords); len(keywords) > 0 {
+			score += 2
+			reasons = append(reasons, "key mentions "+strings.Join(keywords, ", "))
+		}
+		errorValues := 0
+		for _, value := range property.values {
+			if errorValuePattern.MatchString(value.value) {
+				errorValues++
+			}
+		}
+		if errorValues > 0 {
+			share := float64(errorValues) / float64(len(property.values))
+			score += share
+			reasons = append(reasons, fmt.Sprintf("%s of top values read like errors", percentage(share)))
+		}
+		if score == 0 {
+			continue
+		}
+		if share := float64(property.sessions) / float64(sessions); share < 0.5 {
+			score += 0.5
+			reasons = append(reasons, fmt.Sprintf("in %s of sessions", percentage(share)))
+		}
+		candidates = append(candidates, discoveryCandidate{value: property.key, score: score, reason: strings.Join(reasons, "; ")})
+	}
+	return topCandidates(candidates)
+}
+
+// rankBasketProperties ranks numeric properties with positive values whose keys mention basket keywords
+func rankBasketProperties(properties []discoveryProperty) []discoveryCandidate {
+	var candidates []discoveryCandidate
+	for _, property := range properties {
+		if property.kind == "string" || property.max <= 0 {
+			continue
+		}
+		keywords := matchingKeywords(property.key, basketKeywords)
+		if len(keywords) == 0 {
+			continue
+		}
+		candidates = append(candidates, discoveryCandidate{
+			value:  property.key,
+			kind:   property.kind,
+			score:  float64(len(keywords)) + float64(property.sessions)/math.MaxInt32,
+			reason: fmt.Sprintf("key mentions %s, values up to %s", strings.Join(keywords, ", "), formatNumber(property.max)),
+		})
+	}
+	return topCandidates(candidates)
+}
+
+// topCandidates returns the best scoring candidates, best first
+func topCandidates(candidates []discoveryCandidate) []discoveryCandidate {
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].score > candidates[j].score })
+	if len(candidates) > discoveryCandidates {
+		candidates = candidates[:discoveryCandidates]
+	}
+	return candidates
+}
+
+// matchingKeywords returns the keywords contained in the text, ignoring case. Keywords contained in another
+// matching keyword, such as pay in payment, are left out.
+func matchingKeywords(text string, keywords []string) []string {
+	lower := strings.ToLower(text)
+	var matches []string
+	for _, keyword := range keywords {
+		if !strings.Contains(lower, keyword) {
+			continue
+		}
+		contained := false
+		for _, other := range keywords {
+			if other != keyword && strings.Contains(other, keyword) && strings.Contains(lower, other) {
+				contained = true
+				break
+			}
+		}
+		if !contained {
+			matches = append(matches, keyword)
+		}
+	}
+	return matches
+}
+
+// sortedCounts returns the counted values, most frequent first
+func sortedCounts(counts map[string]int) []discoveryCount {
+	sorted := make([]discoveryCount, 0, len(counts))
+	for value, sessions := range counts {
+		sorted = append(sorted, discoveryCount{value: value, sessions: sessions})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].sessions != sorted[j].sessions {
+			return sorted[i].sessions > sorted[j].sessions
+		}
+		return sorted[i].value < sorted[j].value
+	})
+	return sorted
+}
+
+// distinct returns the values without duplicates, so that each is counted once per session
+func distinct(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	var unique []string
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			unique = append(unique, value)
+		}
+	}
+	return unique
+}
+
+func percentage(share float64) string {
+	return fmt.Sprintf("%.1f%%", share*100)
+}
+
+func formatNumber(number float64) string {
+	return fmt.Sprintf("%g", math.Round(number*100)/100)
+}
+
+// printDiscovery writes what was discovered as tables, followed by the ranked candidates
+func printDiscovery(w io.Writer, env string, result discovery) {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(table, "Sampled %d sessions of real users in environment %s from the last %d days\n\n", result.sessions, env,
+		rest.SessionsTimeframeDays)
+
+	fmt.Fprintln(table, "APPLICATION\tSESSIONS")
+	for _, application := range result.applications {
+		fmt.Fprintf(table, "%s\t%d\n", application.value, application.sessions)
+	}
+
+	fmt.Fprintln(table, "\nSTRING PROPERTY\tSESSIONS\tDISTINCT VALUES\tTOP VALUES")
+	for _, property := range result.properties {
+		if property.kind != "string" {
+			continue
+		}
+		var top []string
+		for i, value := range property.values {
+			if i == discoveryTopValues {
+				break
+			}
+			top = append(top, fmt.Sprintf("%q (%d)", value.value, value.sessions))
+		}
+		fmt.Fprintf(table, "%s\t%d\t%d\t%s\n", property.key, property.sessions, property.distincts, strings.Join(top, ", "))
+	}
+
+	fmt.Fprintln(table, "\nNUMERIC PROPERTY\tTYPE\tSESSIONS\tMIN\tMAX")
+	for _, property := range result.properties {
+		if property.kind != "string" {
+			fmt.Fprintf(table, "%s\t%s\t%d\t%s\t%s\n", property.key, property.kind, property.sessions, formatNumber(property.min),
+				formatNumber(property.max))
+		}
+	}
+
+	fmt.Fprintln(table, "\nUSER ACTION\tSESSIONS")
+	for i, action := range result.actions {
+		if i == discoveryTopActions {
+			break
+		}
+		fmt.Fprintf(table, "%s\t%d\n", action.value, action.sessions)
+	}
+
+	printCandidates(table, "LIKELY CONVERSION ACTION", result.conversions)
+	printCandidates(table, "LIKELY ERROR PROPERTY", result.errorProps)
+	printCandidates(table, "LIKELY BASKET PROPERTY", result.basketProps)
+
+	if err := table.Flush(); err != nil {
+		util.Log.Warn("Failed to print discovery results: %s", err)
+	}
+}
+
+func printCandidates(w io.Writer, title string, candidates []discoveryCandidate) {
+	fmt.Fprintf(w, "\n%s\tREASON\n", title)
+	if len(candidates) == 0 {
+		fmt.Fprintln(w, "none found\t")
+	}
+	for _, candidate := range candidates {
+		fmt.Fprintf(w, "%s\t%s\n", candidate.value, candidate.reason)
+	}
+}
+
+// starterConfig builds a configuration from the best candidates, with the other candidates listed in comments.
+// Without an error property, JavaScript errors are analysed; without a basket property, the incurred costs use
+// case is chosen with a placeholder cost. Values which couldn't be discovered are left empty, so that the
+// configuration fails to load until they're reviewed.
+func starterConfig(env string, application string, result discovery, now int64) []byte {
+	var b bytes.Buffer
+	date := time.Unix(0, now*int64(time.Millisecond)).UTC().Format("2006-01-02")
+	fmt.Fprintf(&b, "# Starter configuration discovered from %d sessions of environment %s on %s.\n", result.sessions, env, date)
+	fmt.Fprintf(&b, "# Review every value before running an analysis, other candidates are listed in the comments.\n")
+
+	fmt.Fprintf(&b, "discovered-%s:\n", env)
+	if application == "" && len(result.applications) == 1 {
+		application = result.applications[0].value
+	}
+	if application != "" {
+		fmt.Fprintf(&b, "    name: %q\n", "Discovered configuration for "+application)
+	} else {
+		fmt.Fprintf(&b, "    name: %q\n", "Discovered configuration for "+env)
+	}
+
+	fmt.Fprintln(&b, "    use_cases:")
+	if len(result.basketProps) > 0 {
+		fmt.Fprintln(&b, `        - "lost_basket"`)
+	} else {
+		fmt.Fprintln(&b, `        - "incurred_costs"`)
+	}
+
+	fmt.Fprintln(&b, "    properties:")
+	if application != "" {
+		fmt.Fprintf(&b, "        application: %q\n", application)
+	} else {
+		var names []string
+		for _, application := range result.applications {
+			names = append(names, fmt.Sprintf("%q", application.value))
+		}
+		fmt.Fprintf(&b, "        # application: one of %s, or leave out to analyse all applications\n", strings.Join(names, ", "))
+	}
+
+	if len(result.errorProps) > 0 {
+		fmt.Fprintf(&b, "        error_prop: %q%s\n", result.errorProps[0].value, alternatives(result.errorProps))
+	} else {
+		fmt.Fprintln(&b, `        error_source: "javascript"  # no string property reads like an error`)
+	}
+
+	if len(result.conversions) > 0 {
+		fmt.Fprintf(&b, "        conversion: %q%s\n", result.conversions[0].value, alternatives(result.conversions))
+	} else {
+		fmt.Fprintln(&b, `        conversion: ""  # no user action reads like a conversion, see the most frequent user actions`)
+	}
+
+	if len(result.basketProps) > 0 {
+		fmt.Fprintf(&b, "        basket_prop: %q%s\n", result.basketProps[0].value, alternatives(result.basketProps))
+		if result.basketProps[0].kind == "long" {
+			fmt.Fprintln(&b, `        basket_prop_type: "long"`)
+		}
+	} else {
+		fmt.Fprintln(&b, "        cost_of_error: 0  # the average cost incurred when an error occurs")
+	}
+
+	fmt.Fprintln(&b, "    environments:")
+	fmt.Fprintf(&b, "        - %q\n", env)
+	return b.Bytes()
+}
+
+// alternatives returns a comment listing the candidates after the best one, if any
+func alternatives(candidates []discoveryCandidate) string {
+	if len(candidates) < 2 {
+		return ""
+	}
+	var values []string
+	for _, candidate := range candidates[1:] {
+		values = append(values, fmt.Sprintf("%q", candidate.value))
+	}
+	return "  # or " + strings.Join(values, ", ")
+}
@@ -0,0 +1,187 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+package analyse
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/config"
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/environment"
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/rest"
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/util"
+	"github.com/spf13/afero"
+)
+
+// Explain prints what a run would do for each configuration and environment, without analysing anything: the
+// formulas of the configuration's use cases with its values, and the queries it would execute with their
+// timeframes and how their timeframes are sliced. A resumed run is explained with the timeframe of the run it
+// resumes. No request is sent, unless the environments are asked for their query plans, which only the USQL
+// API explains.
+func Explain(ctx context.Context, outputDir string, fs afero.Fs, environmentsFile string, configFile string,
+	specificEnvironment string, queryPlans bool, options Options) error {
+
+	environments, errs := environment.LoadEnvironmentList(specificEnvironment, environmentsFile, fs)
+	configs, configErrs := config.LoadConfigList(configFile, fs)
+	rateLimiters, rateLimitErrs := createRateLimiters(environments, options)
+	if errs = append(append(errs, configErrs...), rateLimitErrs...); len(errs) > 0 {
+		for _, err := range errs {
+			util.Log.Error("%s", err)
+		}
+		return fmt.Errorf("failed to load the environments and configurations")
+	}
+
+	// queries are explained as they would be sent to the environments
+	options.Offline, options.Record, options.Replay = "", "", ""
+	options.withoutCredentials = !queryPlans
+	progress, err := loadCheckpoint(fs, outputDir, options.Resume, util.NewTimelineProvider().Now())
+	if err != nil {
+		return err
+	}
+
+	var configIds []string
+	for id := range configs {
+		configIds = append(configIds, id)
+	}
+	sort.Strings(configIds)
+
+	for _, id := range configIds {
+		configuration := configs[id]
+		printFormulas(os.Stdout, configuration)
+
+		for _, env := range configuration.GetEnvironments() {
+			details, ok := environments[env]
+			if !ok {
+				continue
+			}
+			client, err := createClient(configuration, env, details, rateLimiters[env], progress, fs, options)
+			if err != nil {
+				return err
+			}
+			explainer, ok := client.(rest.Explainer)
+			if !ok {
+				continue
+			}
+
+			fmt.Fprintf(os.Stdout, "\nQueries in environment %s (%s, %s):\n", env, details.GetDataSource(), details.GetEnvironmentUrl())
+			planner, _ := client.(rest.QueryPlanner)
+			if queryPlans && planner == nil {
+				fmt.Fprintf(os.Stdout, "  Query plans are not available for data source %s\n", details.GetDataSource())
+			}
+			for i, query := range explainer.ExplainQueries(configuration) {
+				printQuery(os.Stdout, i+1, query)
+				if queryPlans && planner != nil {
+					printQueryPlan(ctx, os.Stdout, planner, query)
+				}
+			}
+		}
+		fmt.Fprintln(os.Stdout)
+	}
+
+	return nil
+}
+
+// printFormulas writes how the impact of an error is calculated for each use case of the configuration, with the
+// configuration's values or their defaults
+func printFormulas(w io.Writer, configuration config.Config) {
+	fmt.Fprintf(w, "Configuration %s (%s)\n\nFormulas:\n", configuration.GetId(), configuration.GetName())
+
+	conversionMatch, _ := configuration.GetProperty("conversion_match").(string)
+	if conversionMatch == "" {
+		conversionMatch = "exact"
+	}
+	fmt.Fprintf(w, "  converted session = a session with a user action matching %q (%s match)\n",
+		configuration.GetProperty("conversion"), conversionMatch)
+	fmt.Fprintf(w, "  lost_users = users who hit the error in a session which didn't convert, and didn't convert in a later "+
+		"session, unless they hit an error of an earlier error source\n")
+
+	var impacts []string
+	if configuration.HasUseCase(string(config.LostBasket)) {
+		basketType, _ := configuration.GetProperty("basket_prop_type").(string)
+		if basketType == "" {
+			basketType = "double"
+		}
+		multiFactor, margin := 1, 15.0
+		if factor, ok := configuration.GetProperty("multiplication_factor").(int); ok {
+			multiFactor = factor
+		}
+		if value, ok := configuration.GetProperty("margin").(float64); ok {
+			margin = value
+		}
+		fmt.Fprintf(w, "  lost_basket = sum of %s property %q over the sessions of lost users * multiplication_factor %d\n",
+			basketType, configuration.GetProperty("basket_prop"), multiFactor)
+		fmt.Fprintf(w, "  lost_money = lost_basket * margin %g%%\n", margin)
+		impacts = append(impacts, "lost_money")
+	}
+	if configuration.HasUseCase(string(config.AgentHours)) {
+		fmt.Fprintf(w, "  lost_agent_hours = floor(lost_users / 100) * users_calling_in %v * length_of_call %v / 60\n",
+			configuration.GetProperty("users_calling_in"), configuration.GetProperty("length_of_call"))
+		if callCost, ok := configuration.GetProperty("cost_of_call").(float64); ok {
+			fmt.Fprintf(w, "  hours_lost_cost = floor(lost_users / 100) * users_calling_in %v * cost_of_call %g\n",
+				configuration.GetProperty("users_calling_in"), callCost)
+			impacts = append(impacts, "hours_lost_cost")
+		}
+	}
+	if configuration.HasUseCase(string(config.IncurredCosts)) {
+		fmt.Fprintf(w, "  costs_incurred = lost_users * cost_of_error %g\n", configuration.GetProperty("cost_of_error"))
+		impacts = append(impacts, "costs_incurred")
+	}
+	if len(impacts) > 0 {
+		fmt.Fprintf(w, "  total_impact = %s\n", strings.Join(impacts, " + "))
+	}
+	fmt.Fprintln(w, "  Impacts over 14, 21 and 28 days are those of the last 7 days * 2, 3 and 4")
+}
+
+// printQuery writes a query with its step, timeframe and slicing
+func printQuery(w io.Writer, number int, query rest.ExplainedQuery) {
+	fmt.Fprintf(w, "\n  %d. [%s] %s\n", number, query.Step, query.Description)
+	fmt.Fprintf(w, "     Timeframe: %s to %s\n", formatMillis(query.From), formatMillis(query.To))
+	if query.Slicing != "" {
+		fmt.Fprintf(w, "     Slicing: %s\n", query.Slicing)
+	}
+	for _, line := range strings.Split(query.Query, "\n") {
+		fmt.Fprintf(w, "     %s\n", line)
+	}
+}
+
+// printQueryPlan asks the environment for its plan of executing the query, and writes its explanations
+func printQueryPlan(ctx context.Context, w io.Writer, planner rest.QueryPlanner, query rest.ExplainedQuery) {
+	explanations, err := planner.ExplainPlan(ctx, query.Query, query.From, query.To)
+	if err != nil {
+		fmt.Fprintf(w, "     Query plan: failed, %s\n", err)
+		return
+	}
+	if len(explanations) == 0 {
+		fmt.Fprintln(w, "     Query plan: none returned")
+		return
+	}
+	fmt.Fprintln(w, "     Query plan:")
+	for _, explanation := range explanations {
+		fmt.Fprintf(w, "       %s\n", explanation)
+	}
+}
+
+func formatMillis(millis int64) string {
+	return time.Unix(0, millis*int64(time.Millisecond)).UTC().Format("2006-01-02 15:04 MST")
+}
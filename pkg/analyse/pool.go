@@ -0,0 +1,109 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+package analyse
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/rest"
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/util"
+)
+
+// Default limits of the number of tasks which run in parallel
+const (
+	DefaultParallelism            = 4
+	DefaultEnvironmentParallelism = 2
+)
+
+// workerPool bounds the number of analysis tasks which run at the same time, both across the whole run and
+// within each environment. Tasks take a slot of their environment before taking a global slot, so that tasks
+// waiting on a busy environment don't hold back tasks of other environments.
+type workerPool struct {
+	global         chan struct{}
+	perEnvironment map[string]chan struct{}
+}
+
+// newWorkerPool creates a workerPool for the given environments. Limits lower than 1 are raised to 1.
+func newWorkerPool(environments []string, parallelism int, environmentParallelism int) *workerPool {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	if environmentParallelism < 1 {
+		environmentParallelism = 1
+	}
+
+	pool := &workerPool{
+		global:         make(chan struct{}, parallelism),
+		perEnvironment: make(map[string]chan struct{}),
+	}
+	for _, env := range environments {
+		pool.perEnvironment[env] = make(chan struct{}, environmentParallelism)
+	}
+
+	return pool
+}
+
+// run blocks until a slot is free for the given environment and runs the task within it. If the context is
+// done before a slot is free, the task is not run and the context's error is returned.
+func (p *workerPool) run(ctx context.Context, env string, task func() error) error {
+	select {
+	case p.perEnvironment[env] <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-p.perEnvironment[env] }()
+
+	select {
+	case p.global <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-p.global }()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return task()
+}
+
+// taskLogger prefixes log messages with the environment and error being analysed, so that the output of
+// tasks running in parallel can be told apart
+type taskLogger struct {
+	prefix string
+}
+
+func newTaskLogger(env string, envErr rest.EnvironmentError) taskLogger {
+	if envErr.Name == "" {
+		return taskLogger{prefix: fmt.Sprintf("[%s] ", env)}
+	}
+	return taskLogger{prefix: fmt.Sprintf("[%s] %s: ", env, envErr.Name)}
+}
+
+func (t taskLogger) Info(format string, args ...interface{}) {
+	util.Log.Info(t.prefix+format, args...)
+}
+
+func (t taskLogger) Warn(format string, args ...interface{}) {
+	util.Log.Warn(t.prefix+format, args...)
+}
+
+func (t taskLogger) Debug(format string, args ...interface{}) {
+	util.Log.Debug(t.prefix+format, args...)
+}
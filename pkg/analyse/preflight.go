@@ -0,0 +1,151 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+package analyse
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/config"
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/environment"
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/rest"
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/util"
+	"github.com/spf13/afero"
+)
+
+// preflightColumns are the checks shown in the preflight matrix, in order
+var preflightColumns = []string{rest.TokenCheck, rest.ApplicationCheck, rest.ErrorsCheck, rest.ConversionCheck, rest.BasketCheck}
+
+// preflightResult holds the checks of a configuration against one of its environments
+type preflightResult struct {
+	config string
+	env    string
+	checks []rest.PreflightCheck
+}
+
+// preflight checks each environment referenced by the configurations online: that it accepts its token, and
+// that the configurations' applications, error sources, conversion and basket were seen in recent sessions.
+// The outcome is printed as a matrix, and every failed check is returned as an error.
+func preflight(ctx context.Context, configs map[string]config.Config, environments map[string]environment.Environment,
+	rateLimiters map[string]rest.RateLimitStrategy, fs afero.Fs, options Options) (errorList []error) {
+
+	// checks always query the environments, rather than recorded fixtures
+	options.Record, options.Replay = "", ""
+	progress, err := loadCheckpoint(fs, ".", false, util.NewTimelineProvider().Now())
+	if err != nil {
+		return []error{err}
+	}
+
+	var configIds []string
+	for id := range configs {
+		configIds = append(configIds, id)
+	}
+	sort.Strings(configIds)
+
+	var results []preflightResult
+	tokenChecks := make(map[string]rest.PreflightCheck)
+	for _, id := range configIds {
+		configuration := configs[id]
+		for _, env := range configuration.GetEnvironments() {
+			details, ok := environments[env]
+			if !ok || ctx.Err() != nil {
+				continue
+			}
+			util.Log.Info("Checking configuration %s against environment %s", id, env)
+
+			client, err := createClient(configuration, env, details, rateLimiters[env], progress, fs, options)
+			if err != nil {
+				results = append(results, preflightResult{config: id, env: env, checks: []rest.PreflightCheck{
+					{Name: rest.TokenCheck, Detail: err.Error()},
+				}})
+				continue
+			}
+			checker, ok := client.(rest.Preflight)
+			if !ok {
+				continue
+			}
+
+			// tokens are checked once per environment, as they don't depend on the configuration
+			tokenCheck, checked := tokenChecks[env]
+			if !checked {
+				tokenCheck = checker.CheckToken(ctx)
+				tokenChecks[env] = tokenCheck
+			}
+			checks := []rest.PreflightCheck{tokenCheck}
+			if tokenCheck.Passed {
+				checks = append(checks, checker.CheckConfig(ctx, configuration)...)
+			}
+			results = append(results, preflightResult{config: id, env: env, checks: checks})
+		}
+	}
+
+	printPreflightMatrix(os.Stdout, results)
+
+	for _, result := range results {
+		for _, check := range result.checks {
+			util.Log.Debug("[%s/%s] %s: %s", result.config, result.env, check.Name, check.Detail)
+			if !check.Passed {
+				errorList = append(errorList, fmt.Errorf("configuration %s, environment %s: %s check failed, %s", result.config,
+					result.env, check.Name, check.Detail))
+			}
+		}
+	}
+
+	return errorList
+}
+
+// printPreflightMatrix writes a row per configuration and environment, with the outcome of each kind of check.
+// A kind of check fails if any of its checks failed, and is left empty if it wasn't run.
+func printPreflightMatrix(w io.Writer, results []preflightResult) {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	header := []string{"CONFIGURATION", "ENVIRONMENT"}
+	for _, column := range preflightColumns {
+		header = append(header, strings.ToUpper(column))
+	}
+	fmt.Fprintln(table, strings.Join(header, "\t"))
+
+	for _, result := range results {
+		row := []string{result.config, result.env}
+		for _, column := range preflightColumns {
+			outcome := "-"
+			for _, check := range result.checks {
+				if check.Name != column {
+					continue
+				}
+				if !check.Passed {
+					outcome = "FAIL"
+					break
+				}
+				outcome = "pass"
+			}
+			row = append(row, outcome)
+		}
+		fmt.Fprintln(table, strings.Join(row, "\t"))
+	}
+
+	if err := table.Flush(); err != nil {
+		util.Log.Warn("Failed to print preflight results: %s", err)
+	}
+}
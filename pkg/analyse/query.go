@@ -0,0 +1,252 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+package analyse
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/environment"
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/rest"
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/util"
+	"github.com/spf13/afero"
+)
+
+const (
+	// QueryFormatTable prints query results as an aligned table
+	QueryFormatTable = "table"
+	// QueryFormatCSV prints query results as CSV, like the exports of the user sessions query UI
+	QueryFormatCSV = "csv"
+	// QueryFormatJSON prints query results like responses of the USQL table API, which offline runs read
+	QueryFormatJSON = "json"
+
+	// queryCellWidth is the most characters of a value printed in a table
+	queryCellWidth = 60
+)
+
+// queryTimeLayouts are the layouts of the times which query timeframes start and end at, besides milliseconds
+var queryTimeLayouts = []string{time.RFC3339, "2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02"}
+
+// Timeframe is the timeframe of an ad-hoc query: either the last period before now, or the period between two
+// times which are RFC 3339 timestamps, local dates and times or milliseconds since the epoch. A timeframe with a
+// start but no end ends now.
+type Timeframe struct {
+	Last string
+	From string
+	To   string
+}
+
+// Query executes an ad-hoc query against an environment, with its credentials and rate limiting, and prints its
+// results to stdout in the given format. Unless slicing is disabled, the timeframe of queries which don't
+// aggregate sessions is split while their results are extrapolated or reach the most rows a query returns.
+func Query(ctx context.Context, fs afero.Fs, environmentsFile string, env string, query string, timeframe Timeframe,
+	format string, slicing bool, options Options) error {
+
+	if format != QueryFormatTable && format != QueryFormatCSV && format != QueryFormatJSON {
+		return fmt.Errorf("unknown output format %s, must be one of %s, %s or %s", format, QueryFormatTable,
+			QueryFormatCSV, QueryFormatJSON)
+	}
+
+	environments, errs := environment.LoadEnvironmentList(env, environmentsFile, fs)
+	rateLimiters, rateLimitErrs := createRateLimiters(environments, options)
+	if errs = append(errs, rateLimitErrs...); len(errs) > 0 {
+		for _, err := range errs {
+			util.Log.Error("%s", err)
+		}
+		return fmt.Errorf("failed to load environment %s", env)
+	}
+
+	// ad-hoc queries always query the environment, rather than exports or recorded fixtures
+	options.Offline, options.Record, options.Replay = "", "", ""
+	progress, err := loadCheckpoint(fs, ".", false, util.NewTimelineProvider().Now())
+	if err != nil {
+		return err
+	}
+	from, to, err := timeframe.millis(progress.timeline().NowMillis())
+	if err != nil {
+		return err
+	}
+	client, err := createClient(nil, env, environments[env], rateLimiters[env], progress, fs, options)
+	if err != nil {
+		return err
+	}
+	runner, ok := client.(rest.QueryRunner)
+	if !ok {
+		return fmt.Errorf("environment %s doesn't support ad-hoc queries", env)
+	}
+
+	util.Log.Debug("Querying environment %s from %s to %s: %s", env, formatMillis(from), formatMillis(to), query)
+	result, err := runner.RunQuery(ctx, query, from, to, slicing)
+	if err != nil {
+		return err
+	}
+
+	util.Log.Info("%d rows from %s to %s", len(result.Values), formatMillis(from), formatMillis(to))
+	if result.Slices > 1 {
+		util.Log.Info("The timeframe was split in %d slices", result.Slices)
+	}
+	if result.ExtrapolationLevel > 1 {
+		if rest.IsAggregation(query) || !slicing {
+			util.Log.Warn("Results are extrapolated from a sample (level %g), query shorter timeframes for exact "+
+				"results", result.ExtrapolationLevel)
+		} else {
+			util.Log.Warn("Results are extrapolated from a sample (level %g) even in the shortest slices",
+				result.ExtrapolationLevel)
+		}
+	}
+	if result.Truncated {
+		util.Log.Warn("Some queries returned as many rows as they return at most, so rows may be missing")
+	}
+
+	return printQueryResult(os.Stdout, result, format)
+}
+
+// millis returns the start and end of the timeframe in milliseconds
+func (t Timeframe) millis(now int64) (int64, int64, error) {
+	if t.From == "" {
+		if t.To != "" {
+			return 0, 0, fmt.Errorf("a timeframe with an end needs a start")
+		}
+		last, err := parseQueryPeriod(t.Last)
+		if err != nil {
+			return 0, 0, err
+		}
+		return now - last.Milliseconds(), now, nil
+	}
+
+	from, err := parseQueryTime(t.From)
+	if err != nil {
+		return 0, 0, err
+	}
+	to := now
+	if t.To != "" {
+		if to, err = parseQueryTime(t.To); err != nil {
+			return 0, 0, err
+		}
+	}
+	if from >= to {
+		return 0, 0, fmt.Errorf("the timeframe must start before it ends")
+	}
+	return from, to, nil
+}
+
+// parseQueryPeriod parses a duration, which may also be a number of days such as 7d
+func parseQueryPeriod(period string) (time.Duration, error) {
+	var duration time.Duration
+	var err error
+	if strings.HasSuffix(period, "d") {
+		var days float64
+		days, err = strconv.ParseFloat(strings.TrimSuffix(period, "d"), 64)
+		duration = time.Duration(days * float64(24*time.Hour))
+	} else {
+		duration, err = time.ParseDuration(period)
+	}
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("invalid period %s, must be a positive duration such as 30m, 2h or 7d", period)
+	}
+	return duration, nil
+}
+
+// parseQueryTime parses a time as milliseconds since the epoch or in one of queryTimeLayouts, in local time
+// unless it has a time zone
+func parseQueryTime(value string) (int64, error) {
+	if millis, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return millis, nil
+	}
+	for _, layout := range queryTimeLayouts {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t.UnixNano() / int64(time.Millisecond), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid time %s, must be an RFC 3339 timestamp, a date such as 2006-01-02, a date "+
+		"and time such as 2006-01-02 15:04 or milliseconds since the epoch", value)
+}
+
+// printQueryResult prints the results of a query in the given format
+func printQueryResult(out io.Writer, result rest.QueryResult, format string) error {
+	switch format {
+	case QueryFormatJSON:
+		if result.Values == nil {
+			result.Values = [][]interface{}{}
+		}
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(result)
+	case QueryFormatCSV:
+		writer := csv.NewWriter(out)
+		if err := writer.Write(result.ColumnNames); err != nil {
+			return err
+		}
+		for _, row := range result.Values {
+			record := make([]string, 0, len(row))
+			for _, value := range row {
+				record = append(record, formatQueryValue(value))
+			}
+			if err := writer.Write(record); err != nil {
+				return err
+			}
+		}
+		writer.Flush()
+		return writer.Error()
+	default:
+		writer := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(writer, strings.Join(result.ColumnNames, "\t"))
+		for _, row := range result.Values {
+			cells := make([]string, 0, len(row))
+			for _, value := range row {
+				cell := strings.NewReplacer("\t", " ", "\n", " ").Replace(formatQueryValue(value))
+				if runes := []rune(cell); len(runes) > queryCellWidth {
+					cell = string(runes[:queryCellWidth-3]) + "..."
+				}
+				cells = append(cells, cell)
+			}
+			fmt.Fprintln(writer, strings.Join(cells, "\t"))
+		}
+		return writer.Flush()
+	}
+}
+
+// formatQueryValue formats a value of a query result, with lists and maps as JSON like the exports of the user
+// sessions query UI
+func formatQueryValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		formatted, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		return string(formatted)
+	}
+}
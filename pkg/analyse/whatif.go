@@ -0,0 +1,254 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+package analyse
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/config"
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/report"
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/util"
+	"github.com/spf13/afero"
+)
+
+// whatIfProperties are the properties which use case values are computed from, rather than which sessions are
+// analysed, so that they can be overridden without analysing the sessions again. They map to their use case.
+var whatIfProperties = map[string]config.UseCase{
+	"margin":                config.LostBasket,
+	"multiplication_factor": config.LostBasket,
+	"users_calling_in":      config.AgentHours,
+	"length_of_call":        config.AgentHours,
+	"cost_of_call":          config.AgentHours,
+	"cost_of_error":         config.IncurredCosts,
+}
+
+// whatIfResult is the total impact of a report before and after its values were recomputed
+type whatIfResult struct {
+	environment   string
+	configuration string
+	errors        int
+	before, after float64
+}
+
+// WhatIf recomputes the use case values and projections of the reports of a run from the stats written next to
+// them, and writes the reports again to the output directory. Properties are overridden by the configurations of
+// the alternative config file with the same IDs, if given, and then by the given properties. Only the use cases
+// and the properties which values are computed from can be overridden, as any other property would change which
+// sessions are analysed. Nothing is queried, so the run needs neither the environments nor network access.
+func WhatIf(fs afero.Fs, runDir string, outputDir string, configFile string, properties map[string]string) error {
+	runDir, outputDir = filepath.Clean(runDir), filepath.Clean(outputDir)
+	if runDir == outputDir {
+		return fmt.Errorf("the output directory must differ from the directory of the run, so that its reports are kept")
+	}
+
+	overrides := make(map[string]interface{}, len(properties))
+	for property, text := range properties {
+		if _, ok := whatIfProperties[property]; !ok {
+			return fmt.Errorf("property %s can't be overridden, as it changes which sessions are analysed, run a new "+
+				"analysis instead", property)
+		}
+		value, err := config.ParsePropertyValue(property, text)
+		if err != nil {
+			return err
+		}
+		overrides[property] = value
+	}
+
+	var alternatives map[string]config.Config
+	if configFile != "" {
+		var errs []error
+		if alternatives, errs = config.LoadConfigList(configFile, fs); len(errs) > 0 {
+			for _, err := range errs {
+				util.Log.Error("%s", err)
+			}
+			return fmt.Errorf("failed to load the configurations of %s", configFile)
+		}
+	}
+
+	runs, err := latestStats(fs, runDir)
+	if err != nil {
+		return err
+	}
+
+	var results []whatIfResult
+	for _, stats := range runs {
+		analysed, err := stats.Config()
+		if err != nil {
+			return fmt.Errorf("configuration %s of environment %s: %w", stats.Configuration.Id, stats.Environment.Name, err)
+		}
+		configuration, err := whatIfConfig(analysed, alternatives[analysed.GetId()], overrides)
+		if err != nil {
+			return err
+		}
+
+		result := whatIfResult{environment: stats.Environment.Name, configuration: configuration.GetId(), errors: len(stats.Errors)}
+		reportData := make(map[string]map[string]interface{}, len(stats.Errors))
+		for key, errorStats := range stats.Errors {
+			data := errorStats.Data()
+			for k, v := range useCaseValues(configuration, errorStats.LostUsers, errorStats.LostBaskets) {
+				data[k] = v
+			}
+			reportData[key] = data
+			result.before += errorStats.Values["total_impact"]
+			result.after += float64(data["total_impact"].(int))
+		}
+
+		env := stats.Env()
+		if err := report.CreateReport(env, configuration, reportData, outputDir, fs, stats.Partial); err != nil {
+			return fmt.Errorf("environment %s: %w", env.GetName(), err)
+		}
+		// the sessions are the ones of the original run, so its stats keep the time they were analysed at
+		if err := report.CreateStats(env, configuration, reportData, outputDir, fs, stats.Partial, stats.AnalysedAt); err != nil {
+			return fmt.Errorf("environment %s: %w", env.GetName(), err)
+		}
+		results = append(results, result)
+	}
+
+	printWhatIf(os.Stdout, results)
+	util.Log.Info("Recomputed %d reports in %s", len(results), outputDir)
+	return nil
+}
+
+// latestStats reads the stats of the reports of a run. If the run's directory holds the stats of a configuration
+// in an environment from several runs, only the latest ones are kept, as their reports would overwrite each other.
+// Complete stats are kept over partial ones of the same time, which a resumed run may have left.
+func latestStats(fs afero.Fs, runDir string) ([]report.Stats, error) {
+	paths, err := report.FindStats(fs, runDir)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no stats were found in %s, only reports created by derran analyse since stats were "+
+			"introduced can be recomputed", runDir)
+	}
+
+	latest := make(map[string]report.Stats)
+	latestPaths := make(map[string]string)
+	var keys []string
+	for _, path := range paths {
+		stats, err := report.ReadStats(fs, path)
+		if err != nil {
+			return nil, err
+		}
+		key := stats.Environment.Id + "/" + stats.Configuration.Id
+		if previous, ok := latest[key]; !ok {
+			keys = append(keys, key)
+		} else if !report.Supersedes(stats.AnalysedAt, stats.Partial, previous.AnalysedAt, previous.Partial) {
+			util.Log.Info("Skipping %s, which is superseded by %s", path, latestPaths[key])
+			continue
+		} else {
+			util.Log.Info("Skipping %s, which is superseded by %s", latestPaths[key], path)
+		}
+		latest[key], latestPaths[key] = stats, path
+	}
+
+	sort.Strings(keys)
+	runs := make([]report.Stats, 0, len(keys))
+	for _, key := range keys {
+		runs = append(runs, latest[key])
+	}
+	return runs, nil
+}
+
+// whatIfConfig returns the analysed configuration with the use cases and what-if properties of the alternative
+// configuration, if any, and then the overridden properties
+func whatIfConfig(analysed config.Config, alternative config.Config, overrides map[string]interface{}) (config.Config, error) {
+	var useCases []string
+	properties := make(map[string]interface{})
+	if alternative != nil {
+		for _, useCase := range alternative.GetUseCases() {
+			useCases = append(useCases, string(useCase))
+		}
+
+		analysedProperties, alternativeProperties := analysed.GetProperties(), alternative.GetProperties()
+		var ignored []string
+		for property, value := range alternativeProperties {
+			if _, ok := whatIfProperties[property]; ok {
+				properties[property] = value
+			} else if fmt.Sprint(value) != fmt.Sprint(analysedProperties[property]) {
+				ignored = append(ignored, property)
+			}
+		}
+		for property := range analysedProperties {
+			if _, ok := alternativeProperties[property]; !ok {
+				if _, ok := whatIfProperties[property]; !ok {
+					ignored = append(ignored, property)
+				}
+			}
+		}
+		if len(ignored) > 0 {
+			sort.Strings(ignored)
+			util.Log.Warn("Configuration %s: ignoring the changes to %s, which would change which sessions are "+
+				"analysed", analysed.GetId(), strings.Join(ignored, ", "))
+		}
+	}
+	for property, value := range overrides {
+		properties[property] = value
+	}
+
+	// basket values are only read from the sessions when the lost basket use case is analysed
+	for _, useCase := range useCases {
+		if useCase == string(config.LostBasket) && !analysed.HasUseCase(useCase) {
+			return nil, fmt.Errorf("configuration %s: use case %s can't be added, as basket values weren't analysed, "+
+				"run a new analysis instead", analysed.GetId(), useCase)
+		}
+	}
+
+	configuration, err := config.WithOverrides(analysed, useCases, properties)
+	if err != nil {
+		return nil, err
+	}
+	for property := range overrides {
+		if useCase := whatIfProperties[property]; !configuration.HasUseCase(string(useCase)) {
+			util.Log.Warn("Configuration %s: property %s has no effect without use case %s", configuration.GetId(),
+				property, useCase)
+		}
+	}
+	return configuration, nil
+}
+
+// printWhatIf prints the total impact of each report before and after its values were recomputed
+func printWhatIf(out io.Writer, results []whatIfResult) {
+	writer := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "Environment\tConfiguration\tErrors\tTotal impact\tWhat if\tChange")
+	for _, result := range results {
+		fmt.Fprintf(writer, "%s\t%s\t%d\t£%.0f\t£%.0f\t%s\n", result.environment, result.configuration, result.errors,
+			result.before, result.after, formatChange(result.before, result.after))
+	}
+	writer.Flush()
+}
+
+// formatChange formats the change between two values as a signed amount and percentage
+func formatChange(before float64, after float64) string {
+	difference, sign := after-before, "+"
+	if difference < 0 {
+		difference, sign = -difference, "-"
+	}
+	change := fmt.Sprintf("%s£%.0f", sign, difference)
+	if before != 0 {
+		change += fmt.Sprintf(" (%+.1f%%)", (after-before)*100/before)
+	}
+	return change
+}
@@ -22,6 +22,9 @@ package config
 import (
 	"errors"
 	"fmt"
+	"strings"
+
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/util"
 )
 
 type Config interface {
@@ -29,12 +32,20 @@ type Config interface {
 	GetName() string
 	GetUseCases() []UseCase
 	GetProperty(property string) interface{}
+	GetProperties() map[string]interface{}
 	GetEnvironments() []string
 	HasUseCase(string) bool
 }
 
 type UseCase string
 
+// ErrorProperty is a string session property which captures errors, with a label used to group its
+// errors in reports
+type ErrorProperty struct {
+	Name  string
+	Label string
+}
+
 const (
 	LostBasket    UseCase = "lost_basket"
 	AgentHours    UseCase = "agent_hours"
@@ -125,6 +136,36 @@ func newConfig(id string, properties map[string]interface{}) (Config, error) {
 		return nil, err
 	}
 
+	err = checkTrafficFilter(configProps)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkApplications(configProps)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkErrorProperties(configProps)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkAllowedValues(configProps, "error_source", "session_property", "javascript", "request", "custom")
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkAllowedValues(configProps, "conversion_match", "exact", "starts_with", "contains")
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkAllowedValues(configProps, "basket_prop_type", "double", "long")
+	if err != nil {
+		return nil, err
+	}
+
 	return NewConfiguration(id, configName, useCases, configProps, configEnvs), nil
 }
 
@@ -162,6 +203,11 @@ func checkMandatoryProperties(useCases []UseCase, props map[string]interface{})
 	for _, useCase := range useCases {
 		mProps := getMandatoryProperties(useCase)
 		for _, mp := range mProps {
+			// errors reported by the RUM agent don't need a session property
+			if source, ok := props["error_source"]; mp == "error_prop" && ok && source != "session_property" {
+				continue
+			}
+
 			found := false
 			for p := range props {
 				if p == mp {
@@ -178,6 +224,74 @@ func checkMandatoryProperties(useCases []UseCase, props map[string]interface{})
 	return nil
 }
 
+// checkTrafficFilter checks that the properties used for filtering traffic out of the analysis are valid
+func checkTrafficFilter(props map[string]interface{}) error {
+	for _, p := range []string{"include_synthetic", "include_robots"} {
+		if v, ok := props[p]; ok {
+			if _, isBool := v.(bool); !isBool {
+				return fmt.Errorf("property %s must be either true or false", p)
+			}
+		}
+	}
+	for _, p := range []string{"exclude_ip_ranges", "exclude_user_tags"} {
+		if v, ok := props[p]; ok && toStringList(v) == nil {
+			return fmt.Errorf("property %s must be a list of values", p)
+		}
+	}
+	if v, ok := props["exclude_string_props"]; ok && toStringMap(v) == nil {
+		return fmt.Errorf("property exclude_string_props must map session property names to values")
+	}
+	for _, ipRange := range toStringList(props["exclude_ip_ranges"]) {
+		if _, _, err := util.ParseIPRange(ipRange); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkApplications checks that the applications are given either as a single name or as a list of
+// names and entity IDs, and that they are analysed in a supported mode
+func checkApplications(props map[string]interface{}) error {
+	if v, ok := props["application"]; ok {
+		if _, isString := v.(string); !isString && toStringList(v) == nil {
+			return fmt.Errorf("property application must be an application name or a list of names and entity IDs")
+		}
+	}
+
+	if err := checkAllowedValues(props, "application_mode", "combined", "separate"); err != nil {
+		return err
+	}
+
+	return checkAllowedValues(props, "application_type", "web", "mobile", "custom")
+}
+
+// checkErrorProperties checks that error properties are given either as a single property name or as a
+// list of property names and labelled properties
+func checkErrorProperties(props map[string]interface{}) error {
+	if v, ok := props["error_prop"]; ok && toErrorProperties(v) == nil {
+		return fmt.Errorf("property error_prop must be a property name or a list of property names, optionally with a label")
+	}
+
+	return nil
+}
+
+// checkAllowedValues checks that, if present, a property has one of the allowed values
+func checkAllowedValues(props map[string]interface{}, property string, allowed ...string) error {
+	v, ok := props[property]
+	if !ok {
+		return nil
+	}
+
+	for _, a := range allowed {
+		if v == a {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("property %s must be one of: %s", property, strings.Join(allowed, ", "))
+}
+
 // getValidUseCase converts a string into a UseCase
 func getValidUseCase(uc string) (UseCase, error) {
 	switch uc {
@@ -226,6 +340,16 @@ func (c *configImpl) GetName() string {
 	return c.name
 }
 
+// GetProperties returns a copy of a configuration's properties, as read from the YAML file
+func (c *configImpl) GetProperties() map[string]interface{} {
+	properties := make(map[string]interface{}, len(c.properties))
+	for k, v := range c.properties {
+		properties[k] = v
+	}
+
+	return properties
+}
+
 // GetProperty returns, if successful, the value of a configuration's given property
 func (c *configImpl) GetProperty(property string) interface{} {
 	prop, ok := c.properties[property]
@@ -234,14 +358,28 @@ func (c *configImpl) GetProperty(property string) interface{} {
 	}
 
 	switch property {
-	case "error_prop", "application", "conversion", "basket_prop":
+	case "application":
+		// a single application is handled as a list of one
+		switch p := prop.(type) {
+		case string:
+			return []string{p}
+		default:
+			return toStringList(p)
+		}
+	case "error_prop":
+		if errorProps := toErrorProperties(prop); errorProps != nil {
+			return errorProps
+		}
+		return nil
+	case "conversion", "basket_prop", "application_mode", "application_type",
+		"conversion_match", "basket_prop_type", "error_source":
 		switch p := prop.(type) {
 		case string:
 			return p
 		default:
 			return nil
 		}
-	case "multiplication_factor", "users_calling_in", "length_of_call":
+	case "multiplication_factor", "users_calling_in", "length_of_call", "cohort_weeks":
 		switch p := prop.(type) {
 		case float64:
 			return int(p)
@@ -259,6 +397,93 @@ func (c *configImpl) GetProperty(property string) interface{} {
 		default:
 			return nil
 		}
+	case "include_synthetic", "include_robots":
+		switch p := prop.(type) {
+		case bool:
+			return p
+		default:
+			return nil
+		}
+	case "exclude_ip_ranges", "exclude_user_tags":
+		if list := toStringList(prop); list != nil {
+			return list
+		}
+		return nil
+	case "exclude_string_props":
+		if m := toStringMap(prop); m != nil {
+			return m
+		}
+		return nil
+	default:
+		return nil
+	}
+}
+
+// toStringList converts a list unmarshalled from YAML into a list of strings.
+// Returns nil if the value is not a list.
+func toStringList(prop interface{}) []string {
+	switch p := prop.(type) {
+	case []string:
+		return p
+	case []interface{}:
+		list := make([]string, 0, len(p))
+		for _, item := range p {
+			list = append(list, fmt.Sprintf("%v", item))
+		}
+		return list
+	default:
+		return nil
+	}
+}
+
+// toErrorProperties converts error properties unmarshalled from YAML into a list of ErrorProperty.
+// Properties can be given by name only, in which case the name is also the label, or as a map with
+// the name and label keys. Returns nil if the value has any other format.
+func toErrorProperties(prop interface{}) []ErrorProperty {
+	switch p := prop.(type) {
+	case string:
+		return []ErrorProperty{{Name: p, Label: p}}
+	case []interface{}:
+		errorProps := make([]ErrorProperty, 0, len(p))
+		for _, item := range p {
+			switch i := item.(type) {
+			case string:
+				errorProps = append(errorProps, ErrorProperty{Name: i, Label: i})
+			case map[interface{}]interface{}:
+				m := toStringMap(i)
+				if m["name"] == "" {
+					return nil
+				}
+				label := m["label"]
+				if label == "" {
+					label = m["name"]
+				}
+				errorProps = append(errorProps, ErrorProperty{Name: m["name"], Label: label})
+			default:
+				return nil
+			}
+		}
+		if len(errorProps) == 0 {
+			return nil
+		}
+		return errorProps
+	default:
+		return nil
+	}
+}
+
+// toStringMap converts a map unmarshalled from YAML into a map of strings.
+// Returns nil if the value is not a map.
+func toStringMap(prop interface{}) map[string]string {
+	switch p := prop.(type) {
+	case map[string]string:
+		return p
+	case map[interface{}]interface{}:
+		m := make(map[string]string)
+		for k, v := range p {
+			m[fmt.Sprintf("%v", k)] = fmt.Sprintf("%v", v)
+		}
+		return m
 	default:
 		return nil
 	}
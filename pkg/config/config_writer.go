@@ -0,0 +1,258 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// propertyDescriptions describe the mandatory properties, for asking for them and marking them when missing
+var propertyDescriptions = map[string]string{
+	"error_prop":       "the string session property capturing the title of an error",
+	"conversion":       "the name of the user action marking a converted session",
+	"basket_prop":      "the double session property capturing the basket value of a session",
+	"users_calling_in": "the percentage of users likely to call in and report an error",
+	"length_of_call":   "the average length of a support call, in minutes",
+	"cost_of_error":    "the average cost incurred when an error occurs",
+}
+
+// numericProperties and booleanProperties are the properties which don't hold strings
+var (
+	numericProperties = map[string]bool{"multiplication_factor": true, "users_calling_in": true, "length_of_call": true,
+		"cohort_weeks": true, "margin": true, "cost_of_call": true, "cost_of_error": true}
+	booleanProperties = map[string]bool{"include_synthetic": true, "include_robots": true}
+)
+
+// Scaffold is a configuration to be written to a config file, e.g. by derran init. Its properties are given as
+// text and converted to numbers or booleans where required, and its mandatory properties may be missing.
+type Scaffold struct {
+	Id           string
+	Name         string
+	UseCases     []string
+	Properties   map[string]string
+	Environments []string
+}
+
+// MandatoryProperties returns the properties mandatory for any of the given use cases, in the order they are
+// listed for each use case. The error property is only mandatory for errors read from a session property.
+func MandatoryProperties(useCases []string, errorSource string) ([]string, error) {
+	var properties []string
+	seen := make(map[string]bool)
+	for _, uc := range useCases {
+		useCase, err := getValidUseCase(uc)
+		if err != nil {
+			return nil, err
+		}
+		for _, property := range getMandatoryProperties(useCase) {
+			if property == "error_prop" && errorSource != "" && errorSource != "session_property" {
+				continue
+			}
+			if !seen[property] {
+				seen[property] = true
+				properties = append(properties, property)
+			}
+		}
+	}
+
+	return properties, nil
+}
+
+// DescribeProperty returns the description of a mandatory property, or an empty string for other properties
+func DescribeProperty(property string) string {
+	return propertyDescriptions[property]
+}
+
+// MissingProperties returns the mandatory properties of the scaffold's use cases which it doesn't hold
+func (s Scaffold) MissingProperties() ([]string, error) {
+	mandatory, err := MandatoryProperties(s.UseCases, s.Properties["error_source"])
+	if err != nil {
+		return nil, err
+	}
+
+	var missing []string
+	for _, property := range mandatory {
+		if s.Properties[property] == "" {
+			missing = append(missing, property)
+		}
+	}
+	return missing, nil
+}
+
+// MarshalScaffold validates a scaffolded configuration and renders it as the YAML of a config file. Missing
+// mandatory properties are written as comments marked TODO, so that the file fails to load until they are
+// filled in.
+func MarshalScaffold(s Scaffold) ([]byte, error) {
+	missing, err := s.MissingProperties()
+	if err != nil {
+		return nil, err
+	}
+
+	properties := make(map[interface{}]interface{}, len(s.Properties)+len(missing))
+	for property, text := range s.Properties {
+		if text == "" {
+			continue
+		}
+		if properties[property], err = ParsePropertyValue(property, text); err != nil {
+			return nil, err
+		}
+	}
+
+	// a copy of the configuration with placeholders for the missing properties must be valid
+	valid := make(map[interface{}]interface{}, len(properties)+len(missing))
+	for property, value := range properties {
+		valid[property] = value
+	}
+	for _, property := range missing {
+		valid[property] = "placeholder"
+		if numericProperties[property] {
+			valid[property] = float64(0)
+		}
+	}
+	if _, err := newConfig(s.Id, map[string]interface{}{
+		"name":         s.Name,
+		"use_cases":    toInterfaces(s.UseCases),
+		"environments": toInterfaces(s.Environments),
+		"properties":   valid,
+	}); err != nil {
+		return nil, fmt.Errorf("configuration %s is invalid: %w", s.Id, err)
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s:\n", s.Id)
+	fmt.Fprintf(&b, "    name: %q\n", s.Name)
+	fmt.Fprintln(&b, "    use_cases:")
+	for _, useCase := range s.UseCases {
+		fmt.Fprintf(&b, "        - %q\n", useCase)
+	}
+
+	fmt.Fprintln(&b, "    properties:")
+	var names []string
+	for property := range properties {
+		names = append(names, property.(string))
+	}
+	sort.Strings(names)
+	for _, property := range names {
+		fmt.Fprintf(&b, "        %s: %s\n", property, formatPropertyValue(properties[property]))
+	}
+	for _, property := range missing {
+		placeholder := `""`
+		if numericProperties[property] {
+			placeholder = "0"
+		}
+		fmt.Fprintf(&b, "        # %s: %s  # TODO: %s\n", property, placeholder, DescribeProperty(property))
+	}
+
+	fmt.Fprintln(&b, "    environments:")
+	for _, env := range s.Environments {
+		fmt.Fprintf(&b, "        - %q\n", env)
+	}
+
+	return b.Bytes(), nil
+}
+
+// CheckPropertyValue checks that the text of a property can be converted to the type of value it holds
+func CheckPropertyValue(property string, text string) error {
+	if text == "" {
+		return nil
+	}
+	_, err := ParsePropertyValue(property, text)
+	return err
+}
+
+// ParsePropertyValue converts the text of a property to the type of value it holds
+func ParsePropertyValue(property string, text string) (interface{}, error) {
+	switch {
+	case numericProperties[property]:
+		number, err := strconv.ParseFloat(strings.TrimSpace(text), 64)
+		if err != nil {
+			return nil, fmt.Errorf("property %s must be a number, got %s", property, text)
+		}
+		return number, nil
+	case booleanProperties[property]:
+		value, err := strconv.ParseBool(strings.TrimSpace(text))
+		if err != nil {
+			return nil, fmt.Errorf("property %s must be either true or false, got %s", property, text)
+		}
+		return value, nil
+	default:
+		return text, nil
+	}
+}
+
+// ToMap returns the details of a configuration as they are unmarshalled from a config file, so that they can be
+// stored and the configuration created again with NewConfigurations
+func ToMap(c Config) map[string]interface{} {
+	useCases := make([]interface{}, 0, len(c.GetUseCases()))
+	for _, useCase := range c.GetUseCases() {
+		useCases = append(useCases, string(useCase))
+	}
+	properties := make(map[interface{}]interface{})
+	for property, value := range c.GetProperties() {
+		properties[property] = value
+	}
+
+	return map[string]interface{}{
+		"name":         c.GetName(),
+		"use_cases":    useCases,
+		"properties":   properties,
+		"environments": toInterfaces(c.GetEnvironments()),
+	}
+}
+
+// WithOverrides returns a copy of a configuration with the given use cases, unless none are given, and the given
+// properties replaced. The copy is validated like the configurations of a config file.
+func WithOverrides(c Config, useCases []string, overrides map[string]interface{}) (Config, error) {
+	details := ToMap(c)
+	if len(useCases) > 0 {
+		details["use_cases"] = toInterfaces(useCases)
+	}
+	properties := details["properties"].(map[interface{}]interface{})
+	for property, value := range overrides {
+		properties[property] = value
+	}
+
+	overridden, err := newConfig(c.GetId(), details)
+	if err != nil {
+		return nil, fmt.Errorf("configuration %s is invalid: %w", c.GetId(), err)
+	}
+	return overridden, nil
+}
+
+func formatPropertyValue(value interface{}) string {
+	switch v := value.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		return fmt.Sprintf("%q", v)
+	}
+}
+
+func toInterfaces(values []string) []interface{} {
+	list := make([]interface{}, 0, len(values))
+	for _, value := range values {
+		list = append(list, value)
+	}
+	return list
+}
@@ -0,0 +1,243 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+// Package diff compares the results of two runs of the derran command
+package diff
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/util"
+	"github.com/spf13/afero"
+)
+
+const (
+	// FormatTable prints the differences as tables to the terminal
+	FormatTable = "table"
+	// FormatMarkdown writes the differences to a Markdown file
+	FormatMarkdown = "markdown"
+	// FormatExcel writes the differences to an Excel workbook
+	FormatExcel = "xlsx"
+)
+
+const (
+	statusNew       = "new"
+	statusResolved  = "resolved"
+	statusChanged   = "changed"
+	statusUnchanged = "unchanged"
+)
+
+// statusOrder sorts the errors of a report by how much attention their change needs
+var statusOrder = map[string]int{statusNew: 0, statusResolved: 1, statusChanged: 2, statusUnchanged: 3}
+
+// reportDiff holds the differences between the results of a configuration in an environment in two runs
+type reportDiff struct {
+	environment   string
+	configuration string
+	// a and b are the results of the runs, nil if a run didn't report the configuration in the environment
+	a, b   *reportResults
+	errors []errorDiff
+}
+
+// errorDiff holds the differences between the results of an error in two runs
+type errorDiff struct {
+	name   string
+	status string
+	// a and b are the results of the runs, zero if a run didn't report the error
+	a, b errorResults
+}
+
+// count returns the number of errors of the report with the given status
+func (d reportDiff) count(status string) (count int) {
+	for _, errorDiff := range d.errors {
+		if errorDiff.status == status {
+			count++
+		}
+	}
+	return count
+}
+
+// Diff compares the results of two runs, each either a report, the stats of a report or the output directory of a
+// run, and writes errors which are new, resolved or changed in the second run per configuration and environment,
+// including unchanged errors if all is set. Differences are printed as tables to out, or written to a Markdown
+// file or an Excel workbook at the output path.
+func Diff(fs afero.Fs, runA string, runB string, format string, output string, all bool, out io.Writer) error {
+	if format != FormatTable && format != FormatMarkdown && format != FormatExcel {
+		return fmt.Errorf("unknown format %s, must be one of %s, %s or %s", format, FormatTable, FormatMarkdown, FormatExcel)
+	}
+
+	resultsA, err := readRun(fs, runA)
+	if err != nil {
+		return err
+	}
+	resultsB, err := readRun(fs, runB)
+	if err != nil {
+		return err
+	}
+	for _, run := range []map[string]*reportResults{resultsA, resultsB} {
+		for _, results := range run {
+			if results.partial {
+				util.Log.Warn("%s is a partial report, errors which weren't analysed show as new or resolved", results.path)
+			}
+		}
+	}
+
+	diffs := compare(resultsA, resultsB, all)
+	runs := [2]string{describeRun(runA, resultsA), describeRun(runB, resultsB)}
+	switch format {
+	case FormatMarkdown:
+		if err := writeMarkdown(fs, output, runs, diffs); err != nil {
+			return err
+		}
+	case FormatExcel:
+		if err := writeWorkbook(fs, output, runs, diffs); err != nil {
+			return err
+		}
+	default:
+		printTables(out, runs, diffs)
+		return nil
+	}
+
+	util.Log.Info("Differences written to %s", output)
+	return nil
+}
+
+// compare returns the differences between the results of two runs, sorted by environment and configuration
+func compare(runA map[string]*reportResults, runB map[string]*reportResults, all bool) []reportDiff {
+	var keys []string
+	for key := range runA {
+		keys = append(keys, key)
+	}
+	for key := range runB {
+		if _, ok := runA[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	diffs := make([]reportDiff, 0, len(keys))
+	for _, key := range keys {
+		a, b := runA[key], runB[key]
+		diff := reportDiff{a: a, b: b}
+		if a != nil {
+			diff.environment, diff.configuration = a.environment, a.configuration
+		} else {
+			diff.environment, diff.configuration = b.environment, b.configuration
+		}
+		diff.errors = compareErrors(a, b, all)
+		diffs = append(diffs, diff)
+	}
+	return diffs
+}
+
+// compareErrors returns the differences between the errors of two reports, which may be missing from a run. New
+// errors come first, then resolved and changed ones, each sorted by the change of their monetary impact.
+func compareErrors(a *reportResults, b *reportResults, all bool) []errorDiff {
+	errorsA, errorsB := map[string]errorResults{}, map[string]errorResults{}
+	if a != nil {
+		errorsA = a.errors
+	}
+	if b != nil {
+		errorsB = b.errors
+	}
+
+	var diffs []errorDiff
+	for key, resultsA := range errorsA {
+		resultsB, ok := errorsB[key]
+		switch {
+		case !ok:
+			diffs = append(diffs, errorDiff{name: resultsA.name, status: statusResolved, a: resultsA})
+		case resultsA.impactedUsers != resultsB.impactedUsers || resultsA.lostUsers != resultsB.lostUsers ||
+			resultsA.impact != resultsB.impact:
+			diffs = append(diffs, errorDiff{name: resultsB.name, status: statusChanged, a: resultsA, b: resultsB})
+		case all:
+			diffs = append(diffs, errorDiff{name: resultsB.name, status: statusUnchanged, a: resultsA, b: resultsB})
+		}
+	}
+	for key, resultsB := range errorsB {
+		if _, ok := errorsA[key]; !ok {
+			diffs = append(diffs, errorDiff{name: resultsB.name, status: statusNew, b: resultsB})
+		}
+	}
+
+	sort.Slice(diffs, func(i, j int) bool {
+		if diffs[i].status != diffs[j].status {
+			return statusOrder[diffs[i].status] < statusOrder[diffs[j].status]
+		}
+		changeI, changeJ := math.Abs(diffs[i].b.impact-diffs[i].a.impact), math.Abs(diffs[j].b.impact-diffs[j].a.impact)
+		if changeI != changeJ {
+			return changeI > changeJ
+		}
+		return diffs[i].name < diffs[j].name
+	})
+	return diffs
+}
+
+// describeRun describes a run by its path and the dates of its reports
+func describeRun(path string, run map[string]*reportResults) string {
+	var first, last string
+	for _, results := range run {
+		date := results.date.Local().Format("2006-01-02")
+		if first == "" || date < first {
+			first = date
+		}
+		if date > last {
+			last = date
+		}
+	}
+	if first == last {
+		return fmt.Sprintf("%s (%s)", path, first)
+	}
+	return fmt.Sprintf("%s (%s to %s)", path, first, last)
+}
+
+// formatCount formats a number of users, with a dash for a run which didn't report it
+func formatCount(value int, reported bool) string {
+	if !reported {
+		return "-"
+	}
+	return fmt.Sprintf("%d", value)
+}
+
+// formatMoney formats a monetary impact, with a dash for a run which didn't report it
+func formatMoney(value float64, reported bool) string {
+	if !reported {
+		return "-"
+	}
+	return fmt.Sprintf("£%.0f", value)
+}
+
+// formatChange formats the change between two values as a signed difference and, for changes from a value other
+// than zero, a percentage
+func formatChange(before float64, after float64, money bool) string {
+	difference, sign := after-before, "+"
+	if difference < 0 {
+		difference, sign = -difference, "-"
+	}
+	change := fmt.Sprintf("%s%.0f", sign, difference)
+	if money {
+		change = fmt.Sprintf("%s£%.0f", sign, difference)
+	}
+	if before != 0 {
+		change += fmt.Sprintf(", %+.1f%%", (after-before)*100/before)
+	}
+	return change
+}
@@ -0,0 +1,259 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+package diff
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/360EntSecGroup-Skylar/excelize"
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/report"
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/util"
+	"github.com/spf13/afero"
+)
+
+// maxSheetName is the most characters of a sheet name, longer names are truncated
+const maxSheetName = 31
+
+var (
+	// workbookPattern matches the file names of reports, capturing their date, configuration and partial marker
+	workbookPattern = regexp.MustCompile(`^(\d{8})_(.+?)(_partial)?\.xlsx$`)
+	// linkPattern matches the target of the link from the summary to the sheet of an error, capturing its key
+	linkPattern = regexp.MustCompile(`^'(.*)'!A1$`)
+	// invalidSheetCharacters are removed from sheet names
+	invalidSheetCharacters = strings.NewReplacer(":", "", "\\", "", "/", "", "?", "", "*", "", "[", "", "]", "")
+)
+
+// reportResults are the results reported for a configuration in an environment
+type reportResults struct {
+	path          string
+	environment   string
+	configuration string
+	date          time.Time
+	partial       bool
+	// errors are the results of the errors, by their key within the report
+	errors map[string]errorResults
+}
+
+// errorResults are the results reported for an error
+type errorResults struct {
+	name          string
+	impactedUsers int
+	lostUsers     int
+	impact        float64
+}
+
+// totals returns the sums of the results of all errors, which are zero for a report missing from a run
+func (r *reportResults) totals() (total errorResults) {
+	if r == nil {
+		return total
+	}
+	for _, results := range r.errors {
+		total.impactedUsers += results.impactedUsers
+		total.lostUsers += results.lostUsers
+		total.impact += results.impact
+	}
+	return total
+}
+
+// readRun reads the results of a run, keyed by environment and configuration. A run is either a report or stats
+// file, or the output directory of derran analyse or derran whatif. Reports are read from their stats files, and
+// from the reports themselves only when they have none. If the directory holds the results of a configuration in
+// an environment from several runs, only the latest ones are kept, and complete results are kept over partial ones
+// of the same time.
+func readRun(fs afero.Fs, path string) (map[string]*reportResults, error) {
+	info, err := fs.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	if info.IsDir() {
+		err = afero.Walk(fs, path, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() && isResultsFile(path) {
+				paths = append(paths, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(paths)
+	} else if isResultsFile(path) {
+		paths = []string{path}
+	} else {
+		return nil, fmt.Errorf("%s is neither a run directory, nor a report or stats file", path)
+	}
+
+	statsFiles := make(map[string]bool)
+	for _, path := range paths {
+		if strings.HasSuffix(path, report.StatsExtension) {
+			statsFiles[strings.TrimSuffix(path, report.StatsExtension)] = true
+		}
+	}
+
+	run := make(map[string]*reportResults)
+	for _, path := range paths {
+		var results *reportResults
+		if strings.HasSuffix(path, report.StatsExtension) {
+			results, err = readStats(fs, path)
+		} else if !statsFiles[strings.TrimSuffix(path, ".xlsx")] {
+			results, err = readWorkbook(fs, path)
+		} else {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		key := results.environment + "/" + results.configuration
+		if previous, ok := run[key]; ok {
+			if !report.Supersedes(results.date, results.partial, previous.date, previous.partial) {
+				util.Log.Info("Skipping %s, which is superseded by %s", path, previous.path)
+				continue
+			}
+			util.Log.Info("Skipping %s, which is superseded by %s", previous.path, path)
+		}
+		run[key] = results
+	}
+
+	if len(run) == 0 {
+		return nil, fmt.Errorf("no reports were found in %s", path)
+	}
+	return run, nil
+}
+
+// isResultsFile tells whether a file is a report or the stats of a report
+func isResultsFile(path string) bool {
+	return strings.HasSuffix(path, report.StatsExtension) || workbookPattern.MatchString(filepath.Base(path))
+}
+
+// readStats reads the results of a report from its stats file
+func readStats(fs afero.Fs, path string) (*reportResults, error) {
+	stats, err := report.ReadStats(fs, path)
+	if err != nil {
+		return nil, err
+	}
+
+	results := &reportResults{
+		path:          path,
+		environment:   stats.Environment.Name,
+		configuration: stats.Configuration.Id,
+		date:          stats.AnalysedAt,
+		partial:       stats.Partial,
+		errors:        make(map[string]errorResults, len(stats.Errors)),
+	}
+	for key, errorStats := range stats.Errors {
+		results.errors[key] = errorResults{
+			name:          errorStats.Name,
+			impactedUsers: errorStats.ImpactedUsers,
+			lostUsers:     errorStats.LostUsers,
+			impact:        errorStats.Values["total_impact"],
+		}
+	}
+	return results, nil
+}
+
+// readWorkbook reads the results of a report from the report itself. The configuration and date are read from
+// the file name, and the errors from the summary sheet, which links to the sheet of each error.
+func readWorkbook(fs afero.Fs, path string) (*reportResults, error) {
+	file, err := fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	workbook, err := excelize.OpenReader(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read report %s: %w", path, err)
+	}
+
+	match := workbookPattern.FindStringSubmatch(filepath.Base(path))
+	date, err := time.ParseInLocation("20060102", match[1], time.Local)
+	if err != nil {
+		return nil, fmt.Errorf("report %s has an invalid date: %w", path, err)
+	}
+	results := &reportResults{
+		path:          path,
+		environment:   workbook.GetCellValue(report.SummarySheet, report.SummaryEnvironmentCell),
+		configuration: match[2],
+		date:          date,
+		partial:       match[3] != "",
+		errors:        make(map[string]errorResults),
+	}
+	if results.environment == "" {
+		return nil, fmt.Errorf("%s is not a report, its summary has no environment", path)
+	}
+
+	// errors are grouped by their source under a row naming the source, if there are several
+	source := ""
+	for row := report.FirstSummaryRow; ; row++ {
+		name := workbook.GetCellValue(report.SummarySheet, fmt.Sprintf("%s%d", report.SummaryNameColumn, row))
+		if name == "" {
+			break
+		}
+		impactText := workbook.GetCellValue(report.SummarySheet, fmt.Sprintf("%s%d", report.SummaryImpactColumn, row))
+		if impactText == "" {
+			source = name
+			continue
+		}
+
+		key := name
+		if source != "" {
+			key = source + " - " + name
+		}
+		if _, target := workbook.GetCellHyperLink(report.SummarySheet, fmt.Sprintf("%s%d", report.SummaryNameColumn, row)); linkPattern.MatchString(target) {
+			key = linkPattern.FindStringSubmatch(target)[1]
+		}
+		impact, err := strconv.ParseFloat(strings.TrimPrefix(impactText, report.Currency), 64)
+		if err != nil {
+			return nil, fmt.Errorf("report %s has an invalid monetary impact %q for error %s", path, impactText, name)
+		}
+
+		sheet := sheetName(key)
+		impacted, _ := strconv.Atoi(workbook.GetCellValue(sheet, report.ImpactedUsersCell))
+		lost, _ := strconv.Atoi(workbook.GetCellValue(sheet, report.LostUsersCell))
+		results.errors[key] = errorResults{
+			name:          name,
+			impactedUsers: impacted,
+			lostUsers:     lost,
+			impact:        impact,
+		}
+	}
+
+	return results, nil
+}
+
+// sheetName returns the name of the sheet of an error, as sheet names can't hold some characters and are truncated
+func sheetName(key string) string {
+	name := invalidSheetCharacters.Replace(key)
+	if utf8.RuneCountInString(name) > maxSheetName {
+		name = string([]rune(name)[:maxSheetName])
+	}
+	return name
+}
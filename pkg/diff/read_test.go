@@ -0,0 +1,129 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+package diff
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/config"
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/environment"
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/report"
+	"github.com/spf13/afero"
+)
+
+// roundTripError is an error written to a report, with the results readWorkbook is expected to read
+type roundTripError struct {
+	key    string
+	source string
+	errorResults
+}
+
+func TestReadWorkbookOfCreatedReport(t *testing.T) {
+	configs, errs := config.NewConfigurations(map[string]map[string]interface{}{
+		"cfg": {
+			"name":      "cfg",
+			"use_cases": []interface{}{"incurred_costs"},
+			"properties": map[interface{}]interface{}{
+				"error_prop":    "errormessage",
+				"conversion":    "Loading of page /confirmation",
+				"cost_of_error": 10,
+			},
+		},
+	})
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	env := environment.NewEnvironment("test", "Test", "https://abc12345.live.dynatrace.com", "TEST_TOKEN", "", "", "",
+		environment.RateLimit{}, environment.DataSourceUSQL, environment.Auth{})
+
+	tests := []struct {
+		name   string
+		errors []roundTripError
+	}{
+		{
+			name: "single source",
+			errors: []roundTripError{
+				{key: "Checkout failed", errorResults: errorResults{name: "Checkout failed", impactedUsers: 40, lostUsers: 12, impact: 120}},
+				{key: "Payment declined", errorResults: errorResults{name: "Payment declined", impactedUsers: 9, lostUsers: 3, impact: 30}},
+			},
+		},
+		{
+			name: "grouped by source",
+			errors: []roundTripError{
+				{key: "JavaScript - TypeError: undefined is not a function", source: "JavaScript",
+					errorResults: errorResults{name: "TypeError: undefined is not a function", impactedUsers: 25, lostUsers: 5, impact: 50}},
+				{key: "Request - HTTP 500 on /api/cart", source: "Request",
+					errorResults: errorResults{name: "HTTP 500 on /api/cart", impactedUsers: 7, lostUsers: 7, impact: 70}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			outputDir := t.TempDir()
+			fs := afero.NewOsFs()
+
+			reportData := make(map[string]map[string]interface{})
+			for _, e := range test.errors {
+				data := report.ErrorStats{
+					Name:             e.name,
+					Source:           e.source,
+					ImpactedUsers:    e.impactedUsers,
+					UnconvertedUsers: e.impactedUsers,
+					LostUsers:        e.lostUsers,
+					UserBreakdown:    []report.UserCount{{Label: "Desktop Browser", Users: e.lostUsers}},
+					DateBreakdown:    []report.UserCount{{Label: "2021-10-18", Users: e.lostUsers}},
+				}.Data()
+				for _, key := range []string{"costs_incurred", "costs_incurred_14d", "costs_incurred_21d", "costs_incurred_28d",
+					"total_impact"} {
+					data[key] = int(e.impact)
+				}
+				reportData[e.key] = data
+			}
+			if err := report.CreateReport(env, configs["cfg"], reportData, outputDir, fs, false); err != nil {
+				t.Fatal(err)
+			}
+
+			paths, err := afero.Glob(fs, filepath.Join(outputDir, env.GetName(), "*.xlsx"))
+			if err != nil || len(paths) != 1 {
+				t.Fatalf("expected one report, found %v (%v)", paths, err)
+			}
+			results, err := readWorkbook(fs, paths[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if results.environment != env.GetName() || results.configuration != "cfg" || results.partial {
+				t.Errorf("read report of environment %q, configuration %q, partial %t", results.environment,
+					results.configuration, results.partial)
+			}
+			if len(results.errors) != len(test.errors) {
+				t.Errorf("read %d errors, expected %d", len(results.errors), len(test.errors))
+			}
+			for _, e := range test.errors {
+				if got, ok := results.errors[e.key]; !ok {
+					t.Errorf("error %q wasn't read", e.key)
+				} else if got != e.errorResults {
+					t.Errorf("error %q was read as %+v, expected %+v", e.key, got, e.errorResults)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,263 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+package diff
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/360EntSecGroup-Skylar/excelize"
+	"github.com/spf13/afero"
+)
+
+// errorColumns are the columns of the tables listing the differences of errors
+var errorColumns = []string{"Status", "Error", "Impacted users", "Lost users", "Monetary impact"}
+
+// summaryRow is a total of a report in both runs
+type summaryRow struct {
+	label  string
+	a, b   string
+	change string
+}
+
+// title names the configuration and environment of a report, and tells if a run didn't report them
+func (d reportDiff) title() string {
+	title := d.environment + " / " + d.configuration
+	if d.a == nil {
+		title += " (not reported by run A)"
+	} else if d.b == nil {
+		title += " (not reported by run B)"
+	}
+	return title
+}
+
+// statuses counts the errors of the report by status
+func (d reportDiff) statuses() string {
+	return fmt.Sprintf("%d new, %d resolved, %d changed", d.count(statusNew), d.count(statusResolved),
+		d.count(statusChanged))
+}
+
+// summary returns the totals of the report in both runs
+func (d reportDiff) summary() []summaryRow {
+	totalA, totalB := d.a.totals(), d.b.totals()
+	var errorsA, errorsB int
+	if d.a != nil {
+		errorsA = len(d.a.errors)
+	}
+	if d.b != nil {
+		errorsB = len(d.b.errors)
+	}
+
+	return []summaryRow{
+		{"Errors", formatCount(errorsA, d.a != nil), formatCount(errorsB, d.b != nil),
+			formatChange(float64(errorsA), float64(errorsB), false)},
+		{"Impacted users", formatCount(totalA.impactedUsers, d.a != nil), formatCount(totalB.impactedUsers, d.b != nil),
+			formatChange(float64(totalA.impactedUsers), float64(totalB.impactedUsers), false)},
+		{"Lost users", formatCount(totalA.lostUsers, d.a != nil), formatCount(totalB.lostUsers, d.b != nil),
+			formatChange(float64(totalA.lostUsers), float64(totalB.lostUsers), false)},
+		{"Monetary impact", formatMoney(totalA.impact, d.a != nil), formatMoney(totalB.impact, d.b != nil),
+			formatChange(totalA.impact, totalB.impact, true)},
+	}
+}
+
+// cells returns the cells of an error in the tables listing the differences of errors
+func (e errorDiff) cells() []string {
+	reportedA, reportedB := e.status != statusNew, e.status != statusResolved
+	return []string{
+		e.status,
+		e.name,
+		transition(formatCount(e.a.impactedUsers, reportedA), formatCount(e.b.impactedUsers, reportedB),
+			formatChange(float64(e.a.impactedUsers), float64(e.b.impactedUsers), false)),
+		transition(formatCount(e.a.lostUsers, reportedA), formatCount(e.b.lostUsers, reportedB),
+			formatChange(float64(e.a.lostUsers), float64(e.b.lostUsers), false)),
+		transition(formatMoney(e.a.impact, reportedA), formatMoney(e.b.impact, reportedB),
+			formatChange(e.a.impact, e.b.impact, true)),
+	}
+}
+
+// transition formats a value in both runs, with its change if it was reported by both and changed
+func transition(a string, b string, change string) string {
+	switch {
+	case a == b:
+		return a
+	case a == "-" || b == "-":
+		return a + " → " + b
+	default:
+		return a + " → " + b + " (" + change + ")"
+	}
+}
+
+// printTables prints the differences of each report as a summary followed by a table of its errors
+func printTables(out io.Writer, runs [2]string, diffs []reportDiff) {
+	fmt.Fprintf(out, "Run A: %s\nRun B: %s\n", runs[0], runs[1])
+	for _, diff := range diffs {
+		fmt.Fprintf(out, "\n%s\n", diff.title())
+		writer := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		for _, row := range diff.summary() {
+			fmt.Fprintf(writer, "  %s:\t%s\n", row.label, transition(row.a, row.b, row.change))
+		}
+		writer.Flush()
+		fmt.Fprintf(out, "  %s\n", diff.statuses())
+
+		if len(diff.errors) == 0 {
+			continue
+		}
+		fmt.Fprintln(out)
+		writer = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(writer, "  "+strings.Join(errorColumns, "\t"))
+		for _, errorDiff := range diff.errors {
+			fmt.Fprintln(writer, "  "+strings.Join(errorDiff.cells(), "\t"))
+		}
+		writer.Flush()
+	}
+}
+
+// writeMarkdown writes the differences of each report as a section with a summary and a table of its errors
+func writeMarkdown(fs afero.Fs, output string, runs [2]string, diffs []reportDiff) error {
+	var b bytes.Buffer
+	fmt.Fprintln(&b, "# Changes between runs")
+	fmt.Fprintln(&b)
+	fmt.Fprintf(&b, "- **Run A:** %s\n- **Run B:** %s\n", markdownCell(runs[0]), markdownCell(runs[1]))
+
+	for _, diff := range diffs {
+		fmt.Fprintf(&b, "\n## %s\n\n", markdownCell(diff.title()))
+		fmt.Fprintln(&b, "| | Run A | Run B | Change |")
+		fmt.Fprintln(&b, "| --- | ---: | ---: | ---: |")
+		for _, row := range diff.summary() {
+			fmt.Fprintf(&b, "| %s | %s | %s | %s |\n", row.label, row.a, row.b, row.change)
+		}
+		fmt.Fprintf(&b, "\n%s.\n", strings.ToUpper(diff.statuses()[:1])+diff.statuses()[1:])
+
+		if len(diff.errors) == 0 {
+			continue
+		}
+		fmt.Fprintln(&b)
+		fmt.Fprintf(&b, "| %s |\n", strings.Join(errorColumns, " | "))
+		fmt.Fprintln(&b, "| --- | --- | ---: | ---: | ---: |")
+		for _, errorDiff := range diff.errors {
+			cells := errorDiff.cells()
+			for i := range cells {
+				cells[i] = markdownCell(cells[i])
+			}
+			fmt.Fprintf(&b, "| %s |\n", strings.Join(cells, " | "))
+		}
+	}
+
+	return afero.WriteFile(fs, output, b.Bytes(), 0644)
+}
+
+// markdownCell escapes the characters of a text which Markdown tables would interpret
+func markdownCell(text string) string {
+	return strings.NewReplacer("|", "\\|", "\n", " ", "*", "\\*", "_", "\\_").Replace(text)
+}
+
+// writeWorkbook writes the totals of each report to a summary sheet, and the differences of all errors to a sheet
+// of errors, with the values of both runs as numbers so that they can be filtered and sorted
+func writeWorkbook(fs afero.Fs, output string, runs [2]string, diffs []reportDiff) error {
+	workbook := excelize.NewFile()
+	bold, err := workbook.NewStyle(`{"font":{"bold":true}}`)
+	if err != nil {
+		return err
+	}
+
+	summary, errors := "Summary", "Errors"
+	workbook.SetSheetName("Sheet1", summary)
+	workbook.NewSheet(errors)
+
+	workbook.SetCellValue(summary, "A1", "Run A")
+	workbook.SetCellValue(summary, "B1", runs[0])
+	workbook.SetCellValue(summary, "A2", "Run B")
+	workbook.SetCellValue(summary, "B2", runs[1])
+	workbook.SetCellStyle(summary, "A1", "A2", bold)
+
+	summaryColumns := []string{"Environment", "Configuration", "Errors A", "Errors B", "New", "Resolved", "Changed",
+		"Impacted users A", "Impacted users B", "Lost users A", "Lost users B", "Monetary impact A", "Monetary impact B"}
+	setRow(workbook, summary, 4, toInterfaces(summaryColumns))
+	workbook.SetCellStyle(summary, "A4", cellName(len(summaryColumns), 4), bold)
+	for i, diff := range diffs {
+		totalA, totalB := diff.a.totals(), diff.b.totals()
+		row := []interface{}{diff.environment, diff.configuration, nil, nil, diff.count(statusNew),
+			diff.count(statusResolved), diff.count(statusChanged), nil, nil, nil, nil, nil, nil}
+		if diff.a != nil {
+			row[2], row[7], row[9], row[11] = len(diff.a.errors), totalA.impactedUsers, totalA.lostUsers, totalA.impact
+		}
+		if diff.b != nil {
+			row[3], row[8], row[10], row[12] = len(diff.b.errors), totalB.impactedUsers, totalB.lostUsers, totalB.impact
+		}
+		setRow(workbook, summary, 5+i, row)
+	}
+	workbook.SetColWidth(summary, "A", "B", 24)
+	workbook.SetColWidth(summary, "C", "M", 16)
+
+	errorSheetColumns := []string{"Environment", "Configuration", "Error", "Status", "Impacted users A",
+		"Impacted users B", "Lost users A", "Lost users B", "Monetary impact A", "Monetary impact B", "Monetary impact change"}
+	setRow(workbook, errors, 1, toInterfaces(errorSheetColumns))
+	workbook.SetCellStyle(errors, "A1", cellName(len(errorSheetColumns), 1), bold)
+	row := 2
+	for _, diff := range diffs {
+		for _, errorDiff := range diff.errors {
+			values := []interface{}{diff.environment, diff.configuration, errorDiff.name, errorDiff.status,
+				nil, nil, nil, nil, nil, nil, errorDiff.b.impact - errorDiff.a.impact}
+			if errorDiff.status != statusNew {
+				values[4], values[6], values[8] = errorDiff.a.impactedUsers, errorDiff.a.lostUsers, errorDiff.a.impact
+			}
+			if errorDiff.status != statusResolved {
+				values[5], values[7], values[9] = errorDiff.b.impactedUsers, errorDiff.b.lostUsers, errorDiff.b.impact
+			}
+			setRow(workbook, errors, row, values)
+			row++
+		}
+	}
+	workbook.SetColWidth(errors, "A", "B", 20)
+	workbook.SetColWidth(errors, "C", "C", 48)
+	workbook.SetColWidth(errors, "D", "K", 16)
+	workbook.SetActiveSheet(0)
+
+	file, err := fs.Create(output)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return workbook.Write(file)
+}
+
+// setRow sets the cells of a row from its first column, leaving the cells of nil values empty
+func setRow(workbook *excelize.File, sheet string, row int, values []interface{}) {
+	for i, value := range values {
+		if value != nil {
+			workbook.SetCellValue(sheet, cellName(i+1, row), value)
+		}
+	}
+}
+
+// cellName returns the name of the cell at a column and row, both starting at 1
+func cellName(column int, row int) string {
+	return excelize.ToAlphaString(column-1) + fmt.Sprintf("%d", row)
+}
+
+func toInterfaces(values []string) []interface{} {
+	list := make([]interface{}, 0, len(values))
+	for _, value := range values {
+		list = append(list, value)
+	}
+	return list
+}
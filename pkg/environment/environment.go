@@ -22,6 +22,7 @@ package environment
 import (
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/util"
@@ -34,8 +35,21 @@ type Environment interface {
 	GetName() string
 	GetMCCookie() (string, error)
 	GetMCUserAgent() (string, error)
+	GetRateLimitStrategy() string
+	GetRateLimit() int
+	GetDataSource() string
+	GetAuth() Auth
+	GetOAuthClientSecret() (string, error)
 }
 
+// Data sources from which user sessions of an environment are read
+const (
+	// DataSourceUSQL reads sessions with the User Sessions Query Language API
+	DataSourceUSQL = "usql"
+	// DataSourceGrail reads sessions from Grail with DQL queries
+	DataSourceGrail = "grail"
+)
+
 type environmentImpl struct {
 	id             string
 	name           string
@@ -44,6 +58,47 @@ type environmentImpl struct {
 	envToken       string
 	mcCookie       string
 	mcUserAgent    string
+	rateLimit      RateLimit
+	dataSource     string
+	auth           Auth
+}
+
+// Types of authentication of an environment
+const (
+	// AuthApiToken sends an API token in the Authorization header
+	AuthApiToken = "api-token"
+	// AuthMissionControl sends an API token as parameter, along with the cookie of a Mission Control session
+	AuthMissionControl = "mission-control"
+	// AuthPlatformToken sends a platform token as bearer token
+	AuthPlatformToken = "platform-token"
+	// AuthOAuth fetches access tokens with the OAuth2 client credentials flow and sends them as bearer tokens
+	AuthOAuth = "oauth"
+)
+
+// Auth holds the settings of the authentication with an environment
+type Auth struct {
+	// Type is the type of authentication, one of the Auth* constants
+	Type string
+	// SSOUrl is the token endpoint which OAuth access tokens are fetched from, or empty for the default one
+	SSOUrl string
+	// ClientId is the id of the OAuth client
+	ClientId string
+	// ClientSecretName is the name of the environment variable holding the secret of the OAuth client, unless
+	// ClientSecret holds the secret itself
+	ClientSecretName string
+	ClientSecret     string
+	// Scope is the space separated list of scopes requested for OAuth access tokens
+	Scope string
+	// Resource is the account or environment OAuth access tokens are requested for, if required
+	Resource string
+}
+
+// RateLimit holds the settings of the strategy used to stay within the rate limit of an environment
+type RateLimit struct {
+	// Strategy is the name of the rate limiting strategy, or empty for the default one
+	Strategy string
+	// RequestsPerMinute is the request rate allowed by the token-bucket strategy, or 0 for the default one
+	RequestsPerMinute int
 }
 
 // NewEnvironments creates one or more environments from a map of details.
@@ -77,10 +132,19 @@ func newEnvironment(id string, properties map[string]string) (Environment, error
 	environmentUrl, urlErr := util.CheckProperty(properties, "env-url")
 	envTokenName, tokenNameErr := util.CheckProperty(properties, "env-token-name")
 	envToken, tokenErr := util.CheckProperty(properties, "env-token")
+	if tokenNameErr != nil && tokenErr != nil && properties["auth"] == AuthOAuth {
+		// OAuth clients fetch their tokens, so they don't need one in the file
+		tokenNameErr, tokenErr = nil, nil
+	}
 	mcCookie, _ := util.CheckProperty(properties, "mc-cookie")
 	mcUA, _ := util.CheckProperty(properties, "mc-ua")
+	rateLimitStrategy, _ := util.CheckProperty(properties, "rate-limit-strategy")
+	rateLimit, rateLimitErr := checkRateLimit(properties)
+	dataSource, dataSourceErr := checkDataSource(properties)
+	auth, authErr := checkAuth(properties, dataSource, mcUA != "" && mcCookie != "")
 
-	if nameErr != nil || urlErr != nil || (tokenErr != nil && tokenNameErr != nil) {
+	if nameErr != nil || urlErr != nil || (tokenErr != nil && tokenNameErr != nil) || rateLimitErr != nil || dataSourceErr != nil ||
+		authErr != nil {
 		errStr := fmt.Sprintf("failed to parse config for environment %s. issues found:\n", id)
 		if nameErr != nil {
 			errStr += fmt.Sprintf(" \t%s\n", nameErr)
@@ -92,16 +156,102 @@ func newEnvironment(id string, properties map[string]string) (Environment, error
 			errStr += fmt.Sprintf(" \t%s\n", tokenNameErr)
 			errStr += fmt.Sprintf(" \t%s\n", nameErr)
 		}
+		if rateLimitErr != nil {
+			errStr += fmt.Sprintf(" \t%s\n", rateLimitErr)
+		}
+		if dataSourceErr != nil {
+			errStr += fmt.Sprintf(" \t%s\n", dataSourceErr)
+		}
+		if authErr != nil {
+			errStr += fmt.Sprintf(" \t%s\n", authErr)
+		}
 
 		return nil, fmt.Errorf(errStr)
 	}
 
-	return NewEnvironment(id, environmentName, environmentUrl, envTokenName, envToken, mcUA, mcCookie), nil
+	return NewEnvironment(id, environmentName, environmentUrl, envTokenName, envToken, mcUA, mcCookie,
+		RateLimit{Strategy: rateLimitStrategy, RequestsPerMinute: rateLimit}, dataSource, auth), nil
+}
+
+// checkRateLimit parses the optional rate-limit property, which must be a positive number of requests per minute
+func checkRateLimit(properties map[string]string) (int, error) {
+	value, err := util.CheckProperty(properties, "rate-limit")
+	if err != nil {
+		return 0, nil
+	}
+
+	rateLimit, err := strconv.Atoi(value)
+	if err != nil || rateLimit <= 0 {
+		return 0, fmt.Errorf("Property rate-limit must be a positive number of requests per minute, got %s", value)
+	}
+
+	return rateLimit, nil
+}
+
+// checkDataSource parses the optional data-source property, defaulting to USQL
+func checkDataSource(properties map[string]string) (string, error) {
+	value, err := util.CheckProperty(properties, "data-source")
+	if err != nil {
+		return DataSourceUSQL, nil
+	}
+
+	if value != DataSourceUSQL && value != DataSourceGrail {
+		return "", fmt.Errorf("Property data-source must be %s or %s, got %s", DataSourceUSQL, DataSourceGrail, value)
+	}
+
+	return value, nil
+}
+
+// checkAuth parses the optional auth property and the settings of the chosen type of authentication. By default,
+// environments with Mission Control settings authenticate through Mission Control, Grail environments with a
+// platform token and all others with an API token.
+func checkAuth(properties map[string]string, dataSource string, missionControl bool) (Auth, error) {
+	auth := Auth{Type: AuthApiToken}
+	if missionControl {
+		auth.Type = AuthMissionControl
+	} else if dataSource == DataSourceGrail {
+		auth.Type = AuthPlatformToken
+	}
+	if value, err := util.CheckProperty(properties, "auth"); err == nil {
+		auth.Type = value
+	}
+
+	switch auth.Type {
+	case AuthApiToken, AuthPlatformToken:
+	case AuthMissionControl:
+		if !missionControl {
+			return auth, fmt.Errorf("Property auth %s requires the properties mc-ua and mc-cookie", AuthMissionControl)
+		}
+	case AuthOAuth:
+		auth.SSOUrl, _ = util.CheckProperty(properties, "oauth-sso-url")
+		auth.Scope, _ = util.CheckProperty(properties, "oauth-scope")
+		auth.Resource, _ = util.CheckProperty(properties, "oauth-resource")
+		auth.ClientSecretName, _ = util.CheckProperty(properties, "oauth-client-secret-name")
+		auth.ClientSecret, _ = util.CheckProperty(properties, "oauth-client-secret")
+
+		var err error
+		if auth.ClientId, err = util.CheckProperty(properties, "oauth-client-id"); err != nil {
+			return auth, err
+		}
+		if auth.ClientSecretName == "" && auth.ClientSecret == "" {
+			return auth, fmt.Errorf("Property oauth-client-secret-name or oauth-client-secret is required for auth %s", AuthOAuth)
+		}
+	default:
+		return auth, fmt.Errorf("Property auth must be one of %s, %s, %s or %s, got %s", AuthApiToken, AuthMissionControl,
+			AuthPlatformToken, AuthOAuth, auth.Type)
+	}
+
+	if dataSource == DataSourceGrail && (auth.Type == AuthApiToken || auth.Type == AuthMissionControl) {
+		return auth, fmt.Errorf("Property auth must be %s or %s for data-source %s", AuthPlatformToken, AuthOAuth, DataSourceGrail)
+	}
+
+	return auth, nil
 }
 
 // NewEnvironment creates a new Environment based on mandatory details.
 // It should only be used with clean data. Any pre validation and checking should be done in newEnvironment.
-func NewEnvironment(id string, name string, environmentUrl string, envTokenName string, envToken string, mcUA string, mcCookie string) Environment {
+func NewEnvironment(id string, name string, environmentUrl string, envTokenName string, envToken string, mcUA string, mcCookie string,
+	rateLimit RateLimit, dataSource string, auth Auth) Environment {
 	environmentUrl = strings.TrimSuffix(environmentUrl, "/")
 
 	return &environmentImpl{
@@ -112,6 +262,9 @@ func NewEnvironment(id string, name string, environmentUrl string, envTokenName
 		envToken:       envToken,
 		mcUserAgent:    mcUA,
 		mcCookie:       mcCookie,
+		rateLimit:      rateLimit,
+		dataSource:     dataSource,
+		auth:           auth,
 	}
 }
 
@@ -130,6 +283,39 @@ func (s *environmentImpl) GetName() string {
 	return s.name
 }
 
+// GetRateLimitStrategy returns the name of the rate limiting strategy to use with an environment, if specified
+func (s *environmentImpl) GetRateLimitStrategy() string {
+	return s.rateLimit.Strategy
+}
+
+// GetRateLimit returns the number of requests per minute to throttle an environment's requests to, if specified
+func (s *environmentImpl) GetRateLimit() int {
+	return s.rateLimit.RequestsPerMinute
+}
+
+// GetDataSource returns the data source from which an environment's user sessions are read
+func (s *environmentImpl) GetDataSource() string {
+	return s.dataSource
+}
+
+// GetAuth returns the settings of the authentication with an environment
+func (s *environmentImpl) GetAuth() Auth {
+	return s.auth
+}
+
+// GetOAuthClientSecret returns the secret of the OAuth client used to authenticate with an environment
+func (s *environmentImpl) GetOAuthClientSecret() (string, error) {
+	if s.auth.ClientSecret != "" {
+		return s.auth.ClientSecret, nil
+	}
+	value := os.Getenv(s.auth.ClientSecretName)
+	if value == "" {
+		return value, fmt.Errorf("no oauth client secret found for environment %s, environment variable %s not set", s.name,
+			s.auth.ClientSecretName)
+	}
+	return value, nil
+}
+
 // GetMCUserAgent returns an environment's UserAgent string to use with Mission Control
 func (s *environmentImpl) GetMCUserAgent() (string, error) {
 	if s.mcUserAgent != "" {
@@ -0,0 +1,75 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+package environment
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestLoadEnvironmentsWithRateLimit(t *testing.T) {
+	tests := []struct {
+		name      string
+		rateLimit string
+		wantErr   bool
+	}{
+		{"valid", "120", false},
+		{"zero", "0", true},
+		{"negative", "-5", true},
+		{"not a number", "fast", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			yaml := "test:\n" +
+				"  name: \"Test\"\n" +
+				"  env-url: \"https://abc12345.live.dynatrace.com\"\n" +
+				"  env-token-name: \"TEST_TOKEN\"\n" +
+				"  rate-limit: \"" + test.rateLimit + "\"\n"
+			if err := afero.WriteFile(fs, "environments.yaml", []byte(yaml), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			environments, errs := LoadEnvironmentList("", "environments.yaml", fs)
+			if !test.wantErr {
+				if len(errs) > 0 {
+					t.Fatalf("unexpected errors: %v", errs)
+				}
+				if got := environments["test"].GetRateLimit(); got != 120 {
+					t.Errorf("rate limit = %d, expected 120", got)
+				}
+				return
+			}
+
+			var issues string
+			for _, err := range errs {
+				issues += err.Error() + "\n"
+			}
+			if count := strings.Count(issues, "Property rate-limit must be"); count != 1 {
+				t.Errorf("rate limit issue reported %d times, expected once:\n%s", count, issues)
+			}
+			if len(environments) != 0 {
+				t.Errorf("expected no environments, got %d", len(environments))
+			}
+		})
+	}
+}
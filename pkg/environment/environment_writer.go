@@ -0,0 +1,94 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+package environment
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// attributeOrder is the order in which the attributes of an environment are written, followed by any others
+var attributeOrder = []string{"name", "env-url", "env-token-name", "env-token", "mc-ua", "mc-cookie", "data-source", "auth",
+	"oauth-client-id", "oauth-client-secret-name", "oauth-client-secret", "oauth-scope", "oauth-resource", "oauth-sso-url",
+	"rate-limit-strategy", "rate-limit"}
+
+// MarshalEnvironments validates environments given as maps of their attributes by ID, as they would be read
+// from an environments file, and renders them as the YAML of such a file. Empty attributes are left out.
+func MarshalEnvironments(maps map[string]map[string]string) ([]byte, error) {
+	details := make(map[string]map[string]string, len(maps))
+	for id, attributes := range maps {
+		details[id] = make(map[string]string, len(attributes))
+		for attribute, value := range attributes {
+			if value != "" {
+				details[id][attribute] = value
+			}
+		}
+	}
+
+	if _, errs := NewEnvironments(details); len(errs) > 0 {
+		var messages []string
+		for _, err := range errs {
+			messages = append(messages, strings.TrimSpace(err.Error()))
+		}
+		return nil, fmt.Errorf("%s", strings.Join(messages, "\n"))
+	}
+
+	var ids []string
+	for id := range details {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var b bytes.Buffer
+	for i, id := range ids {
+		if i > 0 {
+			fmt.Fprintln(&b)
+		}
+		fmt.Fprintf(&b, "%s:\n", id)
+		for _, attribute := range orderedAttributes(details[id]) {
+			fmt.Fprintf(&b, "    %s: %q\n", attribute, details[id][attribute])
+		}
+	}
+
+	return b.Bytes(), nil
+}
+
+// orderedAttributes returns the attributes of an environment in the order they are written
+func orderedAttributes(attributes map[string]string) []string {
+	var ordered []string
+	known := make(map[string]bool, len(attributeOrder))
+	for _, attribute := range attributeOrder {
+		known[attribute] = true
+		if _, ok := attributes[attribute]; ok {
+			ordered = append(ordered, attribute)
+		}
+	}
+
+	var others []string
+	for attribute := range attributes {
+		if !known[attribute] {
+			others = append(others, attribute)
+		}
+	}
+	sort.Strings(others)
+
+	return append(ordered, others...)
+}
@@ -0,0 +1,205 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+package fakeserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/rest"
+	"github.com/spf13/afero"
+)
+
+// Dataset is an in-memory set of user sessions which USQL and DQL queries are run against. Datasets are read from
+// and written as USQL table JSON, with one row per session and one column per field. Fields of user actions
+// and user errors (e.g. useraction.name) hold a list with one value per action or error of the session.
+type Dataset struct {
+	columns  []string
+	sessions []map[string]interface{}
+}
+
+// NewDataset creates a Dataset from a USQL table, which must have a startTime column
+func NewDataset(table map[string]interface{}) (*Dataset, error) {
+	rawColumns, _ := table["columnNames"].([]interface{})
+	rawValues, _ := table["values"].([]interface{})
+
+	dataset := &Dataset{}
+	startTime := -1
+	for i, rawColumn := range rawColumns {
+		name, ok := rawColumn.(string)
+		if !ok {
+			return nil, fmt.Errorf("column %d has no name", i+1)
+		}
+		if strings.EqualFold(name, "startTime") {
+			startTime = i
+		}
+		dataset.columns = append(dataset.columns, name)
+	}
+	if startTime < 0 {
+		return nil, fmt.Errorf("dataset has no startTime column")
+	}
+
+	for i, rawValue := range rawValues {
+		values, ok := rawValue.([]interface{})
+		if !ok || len(values) != len(dataset.columns) {
+			return nil, fmt.Errorf("session %d doesn't have a value for each of the %d columns", i+1, len(dataset.columns))
+		}
+		if _, ok := toFloat(values[startTime]); !ok {
+			return nil, fmt.Errorf("session %d has no valid startTime", i+1)
+		}
+
+		session := make(map[string]interface{}, len(values))
+		for j, value := range values {
+			session[strings.ToLower(dataset.columns[j])] = value
+		}
+		dataset.sessions = append(dataset.sessions, session)
+	}
+
+	dataset.sort()
+	return dataset, nil
+}
+
+// LoadDataset reads a Dataset from a USQL table JSON file
+func LoadDataset(fs afero.Fs, path string) (*Dataset, error) {
+	data, err := afero.ReadFile(fs, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dataset: %w", err)
+	}
+
+	var table map[string]interface{}
+	if err := json.Unmarshal(data, &table); err != nil {
+		return nil, fmt.Errorf("failed to parse dataset %s: %w", path, err)
+	}
+
+	dataset, err := NewDataset(table)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dataset %s: %w", path, err)
+	}
+	return dataset, nil
+}
+
+// Table returns the sessions of the dataset as a USQL table
+func (d *Dataset) Table() map[string]interface{} {
+	values := make([]interface{}, 0, len(d.sessions))
+	for _, session := range d.sessions {
+		value := make([]interface{}, 0, len(d.columns))
+		for _, column := range d.columns {
+			value = append(value, session[strings.ToLower(column)])
+		}
+		values = append(values, value)
+	}
+
+	return map[string]interface{}{
+		"extrapolationLevel": 1,
+		"columnNames":        d.columns,
+		"values":             values,
+	}
+}
+
+// Sessions returns the number of sessions in the dataset
+func (d *Dataset) Sessions() int {
+	return len(d.sessions)
+}
+
+// Query runs a USQL query over the sessions which started within the timeframe (in milliseconds) and returns
+// the results as a USQL table. If more sessions than the sample limit started within the timeframe, the query
+// only runs over a sample of them and the results are extrapolated, as Dynatrace does for large timeframes.
+// A sample limit of 0 disables extrapolation.
+func (d *Dataset) Query(text string, from int64, to int64, sampleLimit int) (map[string]interface{}, error) {
+	q, err := parseQuery(text)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := d.between(from, to)
+
+	extrapolationLevel := 1
+	if sampleLimit > 0 && len(sessions) > sampleLimit {
+		extrapolationLevel = (len(sessions) + sampleLimit - 1) / sampleLimit
+		sample := make([]map[string]interface{}, 0, sampleLimit)
+		for i := 0; i < len(sessions); i += extrapolationLevel {
+			sample = append(sample, sessions[i])
+		}
+		sessions = sample
+	}
+
+	return map[string]interface{}{
+		"extrapolationLevel": extrapolationLevel,
+		"columnNames":        q.columnNames(),
+		"values":             q.execute(sessions, extrapolationLevel),
+	}, nil
+}
+
+// startTime returns the start time of the session at the given index
+// QueryDQL runs a DQL query over the sessions starting within the timeframe, as records of user.sessions in
+// Grail, and returns at most limit records. Grail doesn't sample sessions, so neither does the dataset.
+func (d *Dataset) QueryDQL(text string, from int64, to int64, limit int) ([]map[string]interface{}, error) {
+	grailFields := make(map[string]string, len(d.columns))
+	for _, column := range d.columns {
+		grailFields[strings.ToLower(rest.GrailField(column))] = strings.ToLower(column)
+	}
+	grailFields["session_properties"] = "properties"
+
+	q, err := parseDQL(text, grailFields)
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 && limit < q.limit {
+		q.limit = limit
+	}
+
+	records := []map[string]interface{}{}
+	for _, values := range q.execute(d.between(from, to), 1) {
+		record := make(map[string]interface{}, len(values))
+		for i, value := range values {
+			// timestamps are ISO 8601 strings in Grail
+			if field := q.columns[i].field; field == "starttime" || field == "endtime" {
+				if millis, ok := toFloat(value); ok {
+					value = time.Unix(0, int64(millis)*int64(time.Millisecond)).UTC().Format(time.RFC3339Nano)
+				}
+			}
+			record[q.columns[i].name] = value
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+// between returns the sessions starting within the timeframe
+func (d *Dataset) between(from int64, to int64) []map[string]interface{} {
+	first := sort.Search(len(d.sessions), func(i int) bool { return d.startTime(i) >= from })
+	last := sort.Search(len(d.sessions), func(i int) bool { return d.startTime(i) >= to })
+	return d.sessions[first:last]
+}
+
+func (d *Dataset) startTime(i int) int64 {
+	startTime, _ := toFloat(d.sessions[i]["starttime"])
+	return int64(startTime)
+}
+
+// sort orders the sessions by their start time
+func (d *Dataset) sort() {
+	sort.SliceStable(d.sessions, func(i, j int) bool {
+		return d.startTime(i) < d.startTime(j)
+	})
+}
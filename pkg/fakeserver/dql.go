@@ -0,0 +1,424 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+package fakeserver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseDQL parses the text of a DQL query over user.sessions records. Only the subset of DQL which derran
+// generates is supported: filter, expand, summarize with count() and optionally by fields, fields, sort and
+// limit commands. Fields of records are mapped to the fields of the dataset by grailFields, and list fields,
+// e.g. errors.name, to the list tables of the dataset.
+func parseDQL(text string, grailFields map[string]string) (*query, error) {
+	tokens, err := tokenize(text, true)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens, grailFields: grailFields}
+	return p.dqlQuery()
+}
+
+func (p *parser) dqlQuery() (*query, error) {
+	q := &query{orderBy: -1, limit: MaxLimit}
+
+	if err := p.expect(p.keyword("fetch"), "fetch"); err != nil {
+		return nil, err
+	}
+	if err := p.expect(p.keyword("user.sessions"), "user.sessions"); err != nil {
+		return nil, err
+	}
+
+	for p.symbol("|") {
+		var err error
+		switch {
+		case p.keyword("filter"):
+			err = p.dqlFilter(q)
+		case p.keyword("expand"):
+			err = p.dqlExpand(q)
+		case p.keyword("summarize"):
+			err = p.dqlSummarize(q)
+		case p.keyword("fields"):
+			err = p.dqlFields(q)
+		case p.keyword("sort"):
+			err = p.dqlSort(q)
+		case p.keyword("limit"):
+			t := p.peek()
+			limit, convErr := strconv.Atoi(t.value)
+			if t.kind != numberToken || convErr != nil || limit <= 0 {
+				return nil, p.unexpected("a positive limit")
+			}
+			p.pos++
+			q.limit = limit
+		default:
+			err = p.unexpected("a command")
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if p.peek().kind != endToken {
+		return nil, p.unexpected("| or end of query")
+	}
+	if q.columns == nil {
+		return nil, fmt.Errorf("queries must select records with a fields or summarize command")
+	}
+
+	return q, nil
+}
+
+func (p *parser) dqlFilter(q *query) error {
+	if q.columns != nil {
+		return fmt.Errorf("filter after fields or summarize is not supported")
+	}
+
+	c, err := p.or()
+	if err != nil {
+		return err
+	}
+	if q.where != nil {
+		c = &andCondition{left: q.where, right: c}
+	}
+	q.where = c
+	return nil
+}
+
+func (p *parser) dqlExpand(q *query) error {
+	if q.columns != nil {
+		return fmt.Errorf("expand after fields or summarize is not supported")
+	}
+
+	t := p.peek()
+	table, ok := p.grailTable(t.value)
+	if t.kind != identifierToken || !ok {
+		return p.unexpected("a list of user actions or errors")
+	}
+	p.pos++
+	q.expand = append(q.expand, table)
+	return nil
+}
+
+// dqlSummarize parses `summarize alias = count(), by: {fields}`. Like a USQL query selecting DISTINCT fields,
+// it counts the sessions of each distinct combination of the fields.
+func (p *parser) dqlSummarize(q *query) error {
+	if q.columns != nil {
+		return fmt.Errorf("only one fields or summarize command is supported")
+	}
+
+	alias := p.peek()
+	if alias.kind != identifierToken {
+		return p.unexpected("an alias")
+	}
+	p.pos++
+	for _, expected := range []string{"=", "count", "(", ")"} {
+		found := p.symbol(expected) || p.keyword(expected)
+		if err := p.expect(found, expected); err != nil {
+			return err
+		}
+	}
+
+	var columns []column
+	if p.symbol(",") {
+		if err := p.expect(p.keyword("by"), "by"); err != nil {
+			return err
+		}
+		if err := p.expect(p.symbol(":"), ":"); err != nil {
+			return err
+		}
+		if err := p.expect(p.symbol("{"), "{"); err != nil {
+			return err
+		}
+		var err error
+		if columns, err = p.dqlColumns(); err != nil {
+			return err
+		}
+		if err := p.expect(p.symbol("}"), "}"); err != nil {
+			return err
+		}
+	}
+
+	q.distinct = true
+	q.columns = append(columns, column{name: alias.value, function: "count"})
+	return nil
+}
+
+func (p *parser) dqlFields(q *query) error {
+	if q.columns != nil {
+		return fmt.Errorf("only one fields or summarize command is supported")
+	}
+	if len(q.expand) > 0 {
+		return fmt.Errorf("expand is only supported before summarize")
+	}
+
+	columns, err := p.dqlColumns()
+	q.columns = columns
+	return err
+}
+
+func (p *parser) dqlSort(q *query) error {
+	t := p.peek()
+	if t.kind != identifierToken {
+		return p.unexpected("a field to sort by")
+	}
+	p.pos++
+
+	for i, c := range q.columns {
+		if strings.EqualFold(c.name, t.value) {
+			q.orderBy = i
+		}
+	}
+	if q.orderBy < 0 {
+		return fmt.Errorf("sort by %s must reference a selected field", t.value)
+	}
+
+	if p.keyword("desc") {
+		q.desc = true
+	} else {
+		p.keyword("asc")
+	}
+	return nil
+}
+
+// dqlColumns parses a list of fields, which are returned under their Grail name
+func (p *parser) dqlColumns() ([]column, error) {
+	var columns []column
+	for {
+		t := p.peek()
+		if t.kind != identifierToken {
+			return nil, p.unexpected("a field")
+		}
+		field, err := p.grailField(t.value)
+		if err != nil {
+			return nil, err
+		}
+		p.pos++
+		columns = append(columns, column{name: t.value, field: field})
+
+		if !p.symbol(",") {
+			return columns, nil
+		}
+	}
+}
+
+// dqlPrimary parses the conditions of DQL filters
+func (p *parser) dqlPrimary() (condition, error) {
+	if p.symbol("(") {
+		inner, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		return inner, p.expect(p.symbol(")"), ")")
+	}
+
+	t := p.peek()
+	if t.kind != identifierToken {
+		return nil, p.unexpected("a condition")
+	}
+	if p.tokens[p.pos+1].kind != symbolToken || p.tokens[p.pos+1].value != "(" || strings.EqualFold(t.value, "toIp") {
+		field, err := p.dqlOperand()
+		if err != nil {
+			return nil, err
+		}
+		return p.dqlComparison(field)
+	}
+	p.pos += 2
+
+	var c condition
+	switch strings.ToLower(t.value) {
+	case "iany":
+		// the condition matches if it matches any element of the lists referenced by [], e.g. the same error
+		// for iAny(errors.type[] == "ERROR_JS" and errors.name[] == "x")
+		outer := p.arrays
+		p.arrays = nil
+		inner, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		c = &anyCondition{tables: p.arrays, inner: inner}
+		p.arrays = outer
+	case "in":
+		field, err := p.dqlOperand()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(p.symbol(","), ","); err != nil {
+			return nil, err
+		}
+		if err := p.expect(p.keyword("array") && p.symbol("("), "array("); err != nil {
+			return nil, err
+		}
+		var values []interface{}
+		for !p.symbol(")") {
+			if len(values) > 0 {
+				if err := p.expect(p.symbol(","), ","); err != nil {
+					return nil, err
+				}
+			}
+			value, err := p.literal()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		c = &inCondition{field: field, values: values}
+	case "isnull", "isnotnull":
+		field, err := p.dqlOperand()
+		if err != nil {
+			return nil, err
+		}
+		c = &nullCondition{field: field}
+		if strings.EqualFold(t.value, "isNotNull") {
+			c = &notCondition{inner: c}
+		}
+	case "startswith", "contains":
+		field, err := p.dqlOperand()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(p.symbol(","), ","); err != nil {
+			return nil, err
+		}
+		value, err := p.literal()
+		if err != nil {
+			return nil, err
+		}
+		if strings.EqualFold(t.value, "startsWith") {
+			c = &startsWithCondition{field: field, prefix: fmt.Sprint(value)}
+		} else {
+			c = &likeCondition{field: field, pattern: "%" + fmt.Sprint(value) + "%"}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported function %s", t.value)
+	}
+
+	return c, p.expect(p.symbol(")"), ")")
+}
+
+// dqlComparison parses the comparison of a field with a value
+func (p *parser) dqlComparison(field string) (condition, error) {
+	operator := p.peek()
+	if operator.kind == symbolToken {
+		switch operator.value {
+		case "==", "!=", "<", "<=", ">", ">=":
+			p.pos++
+			value, err := p.dqlValue()
+			if err != nil {
+				return nil, err
+			}
+			if operator.value == "==" {
+				return &compareCondition{field: field, operator: "=", value: value}, nil
+			}
+			return &compareCondition{field: field, operator: operator.value, value: value}, nil
+		}
+	}
+	return nil, p.unexpected("a comparison")
+}
+
+// dqlOperand parses a field, a list field whose elements are compared one by one, e.g. errors.name[], or
+// toIp of a field. IP addresses are compared as such regardless, so toIp is left out.
+func (p *parser) dqlOperand() (string, error) {
+	if p.keyword("toIp") {
+		if err := p.expect(p.symbol("("), "("); err != nil {
+			return "", err
+		}
+		field, err := p.dqlOperand()
+		if err != nil {
+			return "", err
+		}
+		return field, p.expect(p.symbol(")"), ")")
+	}
+
+	t := p.peek()
+	if t.kind != identifierToken {
+		return "", p.unexpected("a field")
+	}
+	field, err := p.grailField(t.value)
+	if err != nil {
+		return "", err
+	}
+	p.pos++
+
+	if p.symbol("[") {
+		if err := p.expect(p.symbol("]"), "]"); err != nil {
+			return "", err
+		}
+		table := tableOf(field)
+		if !listTables[table] {
+			return "", fmt.Errorf("%s is not a list field", t.value)
+		}
+		if !contains(p.arrays, table) {
+			p.arrays = append(p.arrays, table)
+		}
+	}
+	return field, nil
+}
+
+// dqlValue parses a literal, or toIp of a literal
+func (p *parser) dqlValue() (interface{}, error) {
+	if p.keyword("toIp") {
+		if err := p.expect(p.symbol("("), "("); err != nil {
+			return nil, err
+		}
+		value, err := p.literal()
+		if err != nil {
+			return nil, err
+		}
+		return value, p.expect(p.symbol(")"), ")")
+	}
+	return p.literal()
+}
+
+// grailField returns the dataset field of a field of Grail records
+func (p *parser) grailField(name string) (string, error) {
+	field, ok := p.grailFields[strings.ToLower(name)]
+	if !ok {
+		return "", fmt.Errorf("unknown field %s", name)
+	}
+	return field, nil
+}
+
+// grailTable returns the list table of the dataset matching a list of Grail records, e.g. usererror for errors
+func (p *parser) grailTable(name string) (string, bool) {
+	for grailField, field := range p.grailFields {
+		if strings.HasPrefix(grailField, strings.ToLower(name)+".") && listTables[tableOf(field)] {
+			return tableOf(field), true
+		}
+	}
+	return "", false
+}
+
+// anyCondition matches a session if its inner condition matches any combination of elements of the given
+// list tables
+type anyCondition struct {
+	tables []string
+	inner  condition
+}
+
+func (c *anyCondition) matches(r row) bool {
+	for _, expanded := range expand(r.session, c.tables) {
+		if c.inner.matches(expanded) {
+			return true
+		}
+	}
+	return false
+}
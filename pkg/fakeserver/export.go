@@ -0,0 +1,111 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+package fakeserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/config"
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/rest"
+	"github.com/spf13/afero"
+)
+
+// WriteDataset writes the sessions of the dataset to a USQL table JSON file
+func WriteDataset(fs afero.Fs, dataset *Dataset, path string) error {
+	return writeTable(fs, path, dataset.Table())
+}
+
+// WriteOfflineExports writes the exports which an offline analysis of the configuration reads to the given
+// directory, with the results of the configuration's queries over the sessions of the dataset up to now. Sessions
+// are split over several files the same way online analyses split the timeframe of sessions queries.
+func WriteOfflineExports(fs afero.Fs, dataset *Dataset, configuration config.Config, dir string, now time.Time) error {
+	if err := fs.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create export directory %s: %w", dir, err)
+	}
+
+	to := now.UnixNano() / int64(time.Millisecond)
+	for _, export := range rest.OfflineExports(configuration) {
+		from := to - int64(export.Days)*24*int64(time.Hour/time.Millisecond)
+
+		if export.Name != "sessions" {
+			table, err := dataset.Query(export.Query, from, to, 0)
+			if err != nil {
+				return fmt.Errorf("failed to run query %s: %w", export.Query, err)
+			}
+			if err := writeTable(fs, filepath.Join(dir, export.Name+".json"), table); err != nil {
+				return err
+			}
+			continue
+		}
+
+		tables, err := exportSlices(dataset, export, from, to)
+		if err != nil {
+			return err
+		}
+		for i, table := range tables {
+			name := export.Name + ".json"
+			if i > 0 {
+				name = fmt.Sprintf("%s_%03d.json", export.Name, i)
+			}
+			if err := writeTable(fs, filepath.Join(dir, name), table); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// exportSlices counts the sessions of a sessions export over the timeframe, and runs its query over each of
+// the slices which the timeframe is split into
+func exportSlices(dataset *Dataset, export rest.OfflineExport, from int64, to int64) ([]map[string]interface{}, error) {
+	count, err := dataset.Query(export.CountQuery, from, to, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run query %s: %w", export.CountQuery, err)
+	}
+	extrapolation, _ := toFloat(count["extrapolationLevel"])
+	sessions, _ := toFloat(count["values"].([][]interface{})[0][0])
+	slices := rest.SessionSlices(extrapolation, int(sessions))
+
+	interval := (to - from) / int64(slices)
+	tables := make([]map[string]interface{}, 0, slices)
+	for i := 0; i < slices; i++ {
+		table, err := dataset.Query(export.Query, from+int64(i)*interval, from+int64(i+1)*interval, 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to run query %s: %w", export.Query, err)
+		}
+		tables = append(tables, table)
+	}
+	return tables, nil
+}
+
+// writeTable writes a USQL table to a JSON file
+func writeTable(fs afero.Fs, path string, table map[string]interface{}) error {
+	data, err := json.Marshal(table)
+	if err != nil {
+		return err
+	}
+	if err := afero.WriteFile(fs, path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
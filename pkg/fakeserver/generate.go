@@ -0,0 +1,231 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+package fakeserver
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// user is a user of generated sessions. Users who encountered errors are less likely to return.
+type user struct {
+	internalUserId string
+	userId         interface{}
+	ip             string
+	device         ProfileDevice
+	returnChance   float64
+}
+
+// GenerateDataset generates the given number of sessions, as described by the profile, over the given number
+// of days up to now. The same profile and seed always generate the same sessions.
+//
+// Sessions start at times following the hourly and weekday weights of the profile. Their users take the steps
+// of the funnel, each with its probability, and those completing it convert at the conversion rate. Errors are
+// encountered at their own rates and lower both the conversion rate of the session and the chance of its user
+// to return. The first error of a session is also captured in the error property, and sessions taking the
+// basket action capture a basket value.
+func GenerateDataset(profile Profile, seed int64, sessions int, days int, now time.Time) (*Dataset, error) {
+	if err := profile.validate(); err != nil {
+		return nil, err
+	}
+	if sessions < 0 || days <= 0 {
+		return nil, fmt.Errorf("the number of sessions can't be negative and the number of days must be positive")
+	}
+
+	random := rand.New(rand.NewSource(seed))
+	dataset := &Dataset{columns: []string{
+		"internalUserId", "userId", "userType", "applicationType", "ip", "startTime", "endTime", "duration",
+		"browserType", "osFamily", "useraction.name", "useraction.application", "useraction.internalApplicationId",
+		"usererror.type", "usererror.name",
+	}}
+	if profile.ErrorProperty != "" {
+		dataset.columns = append(dataset.columns, "stringProperties."+profile.ErrorProperty)
+	}
+	if profile.Basket.Property != "" {
+		dataset.columns = append(dataset.columns, profile.Basket.Type+"Properties."+profile.Basket.Property)
+	}
+
+	// users return over time, so sessions are generated in the order they start
+	startTimes := generateStartTimes(random, profile, sessions, days, now)
+	var users []*user
+
+	for _, startTime := range startTimes {
+		var u *user
+		if len(users) > 0 && random.Float64() < profile.ReturnRate {
+			if candidate := users[random.Intn(len(users))]; random.Float64() < candidate.returnChance {
+				u = candidate
+			}
+		}
+		if u == nil {
+			u = newUser(random, profile, len(users))
+			users = append(users, u)
+		}
+
+		dataset.sessions = append(dataset.sessions, generateSession(random, profile, u, startTime))
+	}
+
+	return dataset, nil
+}
+
+// generateStartTimes returns the start times of the given number of sessions, in milliseconds and in order
+func generateStartTimes(random *rand.Rand, profile Profile, sessions int, days int, now time.Time) []int64 {
+	maxWeight := 0.0
+	for _, hourly := range profile.HourlyWeights {
+		for _, weekday := range profile.WeekdayWeights {
+			maxWeight = math.Max(maxWeight, hourly*weekday)
+		}
+	}
+
+	window := time.Duration(days) * 24 * time.Hour
+	start := now.Add(-window)
+	startTimes := make([]int64, 0, sessions)
+
+	// times are drawn uniformly and kept in proportion to the weights of their hour and weekday
+	for len(startTimes) < sessions {
+		t := start.Add(time.Duration(random.Int63n(int64(window))))
+		weight := profile.HourlyWeights[t.Hour()] * profile.WeekdayWeights[t.Weekday()]
+		if random.Float64()*maxWeight < weight {
+			startTimes = append(startTimes, t.UnixNano()/int64(time.Millisecond))
+		}
+	}
+
+	sort.Slice(startTimes, func(i, j int) bool { return startTimes[i] < startTimes[j] })
+	return startTimes
+}
+
+// newUser creates the user with the given number, with a device picked according to the device mix
+func newUser(random *rand.Rand, profile Profile, number int) *user {
+	u := &user{
+		internalUserId: fmt.Sprintf("%d%08d", 1000000+random.Intn(9000000), number),
+		ip:             fmt.Sprintf("%d.%d.%d.%d", 20+random.Intn(180), random.Intn(256), random.Intn(256), 1+random.Intn(254)),
+		returnChance:   1,
+	}
+
+	// a third of the users log in
+	if random.Intn(3) == 0 {
+		u.userId = fmt.Sprintf("user%d@example.com", number)
+	}
+
+	shares := make([]float64, 0, len(profile.Devices))
+	for _, device := range profile.Devices {
+		shares = append(shares, device.Share)
+	}
+	u.device = profile.Devices[pick(random, shares)]
+
+	return u
+}
+
+// generateSession generates a session of the user starting at the given time
+func generateSession(random *rand.Rand, profile Profile, u *user, startTime int64) map[string]interface{} {
+	userTypes := []string{"REAL_USER", "SYNTHETIC", "ROBOT"}
+	userType := userTypes[pick(random, []float64{profile.UserTypes.Real, profile.UserTypes.Synthetic, profile.UserTypes.Robot})]
+
+	session := map[string]interface{}{
+		"internaluserid":  u.internalUserId,
+		"userid":          u.userId,
+		"usertype":        userType,
+		"applicationtype": applicationTypes[profile.Application.Type],
+		"ip":              u.ip,
+		"starttime":       startTime,
+		"browsertype":     u.device.BrowserType,
+		"osfamily":        u.device.OsFamily,
+	}
+
+	// errors are encountered first, as they decide how likely the session is to convert
+	errorTypes, errorNames := []interface{}{}, []interface{}{}
+	conversionRate := profile.Conversion.Rate * u.device.ConversionImpact
+	for _, e := range profile.Errors {
+		if random.Float64() < e.Rate {
+			errorTypes = append(errorTypes, e.Type)
+			errorNames = append(errorNames, e.Name)
+			conversionRate *= e.ConversionImpact
+			u.returnChance *= e.ReturnImpact
+		}
+	}
+	session["usererror.type"] = errorTypes
+	session["usererror.name"] = errorNames
+	if profile.ErrorProperty != "" {
+		session["stringproperties."+profile.ErrorProperty] = nil
+		if len(errorNames) > 0 {
+			session["stringproperties."+profile.ErrorProperty] = errorNames[0]
+		}
+	}
+
+	actions := []interface{}{}
+	for _, step := range profile.Funnel {
+		if random.Float64() >= step.Probability {
+			break
+		}
+		actions = append(actions, step.Action)
+	}
+	if len(actions) == len(profile.Funnel) && random.Float64() < conversionRate {
+		actions = append(actions, profile.Conversion.Action)
+	}
+
+	if profile.Basket.Property != "" {
+		basket := profile.Basket.Type + "properties." + profile.Basket.Property
+		session[basket] = nil
+		for _, action := range actions {
+			if action != profile.Basket.Action {
+				continue
+			}
+			value := profile.Basket.Median * math.Exp(profile.Basket.Spread*random.NormFloat64())
+			if profile.Basket.Type == "long" {
+				session[basket] = int64(math.Round(value))
+			} else {
+				session[basket] = math.Round(value*100) / 100
+			}
+		}
+	}
+
+	applications, applicationIds := []interface{}{}, []interface{}{}
+	for range actions {
+		applications = append(applications, profile.Application.Name)
+		applicationIds = append(applicationIds, profile.Application.Id)
+	}
+	session["useraction.name"] = actions
+	session["useraction.application"] = applications
+	session["useraction.internalapplicationid"] = applicationIds
+
+	duration := int64(len(actions)) * (10000 + random.Int63n(50000))
+	session["endtime"] = startTime + duration
+	session["duration"] = duration
+
+	return session
+}
+
+// pick returns the index of one of the shares, each picked with a probability proportional to its share
+func pick(random *rand.Rand, shares []float64) int {
+	total := 0.0
+	for _, share := range shares {
+		total += share
+	}
+
+	p := random.Float64() * total
+	for i, share := range shares {
+		if p < share {
+			return i
+		}
+		p -= share
+	}
+	return len(shares) - 1
+}
@@ -0,0 +1,253 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+package fakeserver
+
+import (
+	"fmt"
+
+	"github.com/spf13/afero"
+	"gopkg.in/yaml.v2"
+)
+
+// Profile describes the sessions of a generated dataset: the application they belong to, the journey users
+// take through it, how likely they are to convert, the errors they encounter and when they visit
+type Profile struct {
+	Application   ProfileApplication `yaml:"application"`
+	UserTypes     ProfileUserTypes   `yaml:"user_types"`
+	Devices       []ProfileDevice    `yaml:"devices"`
+	Funnel        []ProfileStep      `yaml:"funnel"`
+	Conversion    ProfileConversion  `yaml:"conversion"`
+	Basket        ProfileBasket      `yaml:"basket"`
+	ErrorProperty string             `yaml:"error_property"`
+	Errors        []ProfileError     `yaml:"errors"`
+	// ReturnRate is the share of sessions by users who visited before
+	ReturnRate float64 `yaml:"return_rate"`
+	// HourlyWeights are the relative number of sessions starting in each hour of the day
+	HourlyWeights []float64 `yaml:"hourly_weights"`
+	// WeekdayWeights are the relative number of sessions starting on each day of the week, from Sunday
+	WeekdayWeights []float64 `yaml:"weekday_weights"`
+}
+
+// ProfileApplication is the application of generated sessions, of type web, mobile or custom
+type ProfileApplication struct {
+	Name string `yaml:"name"`
+	Id   string `yaml:"id"`
+	Type string `yaml:"type"`
+}
+
+// ProfileUserTypes are the shares of sessions by real users, synthetic monitors and robots
+type ProfileUserTypes struct {
+	Real      float64 `yaml:"real"`
+	Synthetic float64 `yaml:"synthetic"`
+	Robot     float64 `yaml:"robot"`
+}
+
+// ProfileDevice is a kind of device with its share of sessions. The conversion rate of its sessions is
+// multiplied by its conversion impact.
+type ProfileDevice struct {
+	BrowserType      string  `yaml:"browser_type"`
+	OsFamily         string  `yaml:"os_family"`
+	Share            float64 `yaml:"share"`
+	ConversionImpact float64 `yaml:"conversion_impact"`
+}
+
+// ProfileStep is a user action of the journey, with the probability of a session continuing to it
+type ProfileStep struct {
+	Action      string  `yaml:"action"`
+	Probability float64 `yaml:"probability"`
+}
+
+// ProfileConversion is the action which completes the journey, with the probability of a session which
+// took all steps of the funnel to convert
+type ProfileConversion struct {
+	Action string  `yaml:"action"`
+	Rate   float64 `yaml:"rate"`
+}
+
+// ProfileBasket is the basket value captured in a session property when a session takes the basket action.
+// Values follow a log-normal distribution around the median, the spread being the standard deviation of
+// their logarithm.
+type ProfileBasket struct {
+	Property string  `yaml:"property"`
+	Type     string  `yaml:"type"`
+	Action   string  `yaml:"action"`
+	Median   float64 `yaml:"median"`
+	Spread   float64 `yaml:"spread"`
+}
+
+// ProfileError is an error which sessions encounter at the given rate. The type is the one reported by the RUM
+// agent: Error (JavaScript), Request or Custom. The conversion rate of sessions with the error is multiplied
+// by its conversion impact, and the chance of their users to return by its return impact.
+type ProfileError struct {
+	Name             string  `yaml:"name"`
+	Type             string  `yaml:"type"`
+	Rate             float64 `yaml:"rate"`
+	ConversionImpact float64 `yaml:"conversion_impact"`
+	ReturnImpact     float64 `yaml:"return_impact"`
+}
+
+// DefaultProfile returns the profile of a travel booking website
+func DefaultProfile() Profile {
+	return Profile{
+		Application: ProfileApplication{Name: "easyTravel", Id: "APPLICATION-EA7C4B59F27D43EB", Type: "web"},
+		UserTypes:   ProfileUserTypes{Real: 0.95, Synthetic: 0.03, Robot: 0.02},
+		Devices: []ProfileDevice{
+			{BrowserType: "Desktop Browser", OsFamily: "Windows", Share: 0.42, ConversionImpact: 1},
+			{BrowserType: "Desktop Browser", OsFamily: "macOS", Share: 0.18, ConversionImpact: 1.1},
+			{BrowserType: "Mobile Browser", OsFamily: "Android", Share: 0.22, ConversionImpact: 0.7},
+			{BrowserType: "Mobile Browser", OsFamily: "iOS", Share: 0.18, ConversionImpact: 0.8},
+		},
+		Funnel: []ProfileStep{
+			{Action: "Loading of page /", Probability: 1},
+			{Action: "Loading of page /search", Probability: 0.8},
+			{Action: "Loading of page /product", Probability: 0.7},
+			{Action: "click on \"Add to basket\"", Probability: 0.5},
+			{Action: "Loading of page /checkout", Probability: 0.6},
+		},
+		Conversion: ProfileConversion{Action: "Loading of page /confirmation", Rate: 0.6},
+		Basket: ProfileBasket{
+			Property: "basketvalue",
+			Type:     "double",
+			Action:   "click on \"Add to basket\"",
+			Median:   65,
+			Spread:   0.6,
+		},
+		ErrorProperty: "errormessage",
+		Errors: []ProfileError{
+			{Name: "TypeError: Cannot read properties of undefined (reading 'price')", Type: "Error", Rate: 0.04, ConversionImpact: 0.5, ReturnImpact: 0.8},
+			{Name: "Uncaught ReferenceError: jQuery is not defined", Type: "Error", Rate: 0.02, ConversionImpact: 0.9, ReturnImpact: 1},
+			{Name: "POST /api/checkout 500", Type: "Request", Rate: 0.015, ConversionImpact: 0.2, ReturnImpact: 0.6},
+			{Name: "GET /api/recommendations 503", Type: "Request", Rate: 0.03, ConversionImpact: 0.95, ReturnImpact: 1},
+			{Name: "Payment declined", Type: "Custom", Rate: 0.01, ConversionImpact: 0.3, ReturnImpact: 0.7},
+		},
+		ReturnRate: 0.5,
+		HourlyWeights: []float64{
+			0.2, 0.1, 0.1, 0.1, 0.1, 0.2, 0.4, 0.7, 0.9, 1, 1, 1,
+			1, 0.9, 0.9, 0.9, 0.9, 1, 1, 1, 0.9, 0.8, 0.6, 0.4,
+		},
+		WeekdayWeights: []float64{0.8, 1, 1, 1, 1, 0.9, 0.7},
+	}
+}
+
+// LoadProfile reads a profile from a YAML file. Settings missing from the file keep their default value.
+func LoadProfile(fs afero.Fs, path string) (Profile, error) {
+	profile := DefaultProfile()
+
+	data, err := afero.ReadFile(fs, path)
+	if err != nil {
+		return Profile{}, fmt.Errorf("failed to read profile: %w", err)
+	}
+	if err := yaml.UnmarshalStrict(data, &profile); err != nil {
+		return Profile{}, fmt.Errorf("failed to parse profile %s: %w", path, err)
+	}
+	if err := profile.validate(); err != nil {
+		return Profile{}, fmt.Errorf("invalid profile %s: %w", path, err)
+	}
+
+	return profile, nil
+}
+
+// validate checks that the profile can generate sessions
+func (p Profile) validate() error {
+	if p.Application.Name == "" {
+		return fmt.Errorf("application must have a name")
+	}
+	if _, ok := applicationTypes[p.Application.Type]; !ok {
+		return fmt.Errorf("application type %q must be one of web, mobile or custom", p.Application.Type)
+	}
+	if p.UserTypes.Real+p.UserTypes.Synthetic+p.UserTypes.Robot <= 0 {
+		return fmt.Errorf("user_types must have a positive share")
+	}
+
+	if len(p.Devices) == 0 {
+		return fmt.Errorf("at least one device is required")
+	}
+	for _, device := range p.Devices {
+		if device.Share < 0 || device.ConversionImpact < 0 {
+			return fmt.Errorf("device %s %s must have a positive share and conversion_impact", device.BrowserType, device.OsFamily)
+		}
+	}
+
+	if len(p.Funnel) == 0 {
+		return fmt.Errorf("the funnel must have at least one step")
+	}
+	for _, step := range p.Funnel {
+		if step.Action == "" || !isProbability(step.Probability) {
+			return fmt.Errorf("funnel step %q must have an action and a probability between 0 and 1", step.Action)
+		}
+	}
+	if p.Conversion.Action == "" || !isProbability(p.Conversion.Rate) {
+		return fmt.Errorf("conversion must have an action and a rate between 0 and 1")
+	}
+
+	if p.Basket.Property != "" {
+		if p.Basket.Type != "double" && p.Basket.Type != "long" {
+			return fmt.Errorf("basket type %q must be double or long", p.Basket.Type)
+		}
+		if p.Basket.Median <= 0 || p.Basket.Spread < 0 {
+			return fmt.Errorf("basket must have a positive median and spread")
+		}
+	}
+
+	for _, e := range p.Errors {
+		if e.Name == "" {
+			return fmt.Errorf("errors must have a name")
+		}
+		if e.Type != "Error" && e.Type != "Request" && e.Type != "Custom" {
+			return fmt.Errorf("error %q has type %q, which must be one of Error, Request or Custom", e.Name, e.Type)
+		}
+		if !isProbability(e.Rate) || e.ConversionImpact < 0 || !isProbability(e.ReturnImpact) {
+			return fmt.Errorf("error %q must have a rate and return_impact between 0 and 1, and a positive conversion_impact", e.Name)
+		}
+	}
+
+	if !isProbability(p.ReturnRate) {
+		return fmt.Errorf("return_rate must be between 0 and 1")
+	}
+	if len(p.HourlyWeights) != 24 || !hasPositiveWeight(p.HourlyWeights) {
+		return fmt.Errorf("hourly_weights must have 24 weights, not all 0")
+	}
+	if len(p.WeekdayWeights) != 7 || !hasPositiveWeight(p.WeekdayWeights) {
+		return fmt.Errorf("weekday_weights must have 7 weights, not all 0")
+	}
+
+	return nil
+}
+
+// applicationTypes maps the application types of profiles to the application types of sessions
+var applicationTypes = map[string]string{
+	"web":    "WEB_APPLICATION",
+	"mobile": "MOBILE_APPLICATION",
+	"custom": "CUSTOM_APPLICATION",
+}
+
+func isProbability(value float64) bool {
+	return value >= 0 && value <= 1
+}
+
+func hasPositiveWeight(weights []float64) bool {
+	positive := false
+	for _, weight := range weights {
+		if weight < 0 {
+			return false
+		}
+		positive = positive || weight > 0
+	}
+	return positive
+}
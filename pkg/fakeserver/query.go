@@ -0,0 +1,574 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+package fakeserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"sort"
+	"strings"
+)
+
+// listTables are the tables whose fields hold one value per user action or user error of a session
+var listTables = map[string]bool{
+	"useraction": true,
+	"usererror":  true,
+}
+
+// mapFields are the fields holding all session properties with the given prefixes, as a map by key. The
+// properties field holds the properties of all types, as session_properties of Grail records.
+var mapFields = map[string][]string{
+	"stringproperties": {"stringproperties."},
+	"doubleproperties": {"doubleproperties."},
+	"longproperties":   {"longproperties."},
+	"properties":       {"stringproperties.", "doubleproperties.", "longproperties."},
+}
+
+// row is a session, in which the fields of list tables are either lists of all values, or bound to the
+// value of a single element, e.g. one user error of the session
+type row struct {
+	session map[string]interface{}
+	bound   map[string]int
+}
+
+// value returns the value of a field in the row, nil if the session has no such field
+func (r row) value(field string) interface{} {
+	if prefixes, ok := mapFields[field]; ok {
+		return r.properties(prefixes)
+	}
+
+	table := tableOf(field)
+	if !listTables[table] {
+		return r.session[field]
+	}
+
+	list, _ := r.session[field].([]interface{})
+	index, bound := r.bound[table]
+	if !bound {
+		return list
+	}
+	if index < 0 || index >= len(list) {
+		return nil
+	}
+	return list[index]
+}
+
+// properties returns the non-null session properties with any of the given prefixes, by key
+func (r row) properties(prefixes []string) map[string]interface{} {
+	properties := make(map[string]interface{})
+	for field, value := range r.session {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(field, prefix) && value != nil {
+				properties[field[len(prefix):]] = value
+			}
+		}
+	}
+	return properties
+}
+
+// values returns the non-null values of a field in the row, as a list
+func (r row) values(field string) []interface{} {
+	switch v := r.value(field).(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		var values []interface{}
+		for _, element := range v {
+			if element != nil {
+				values = append(values, element)
+			}
+		}
+		return values
+	default:
+		return []interface{}{v}
+	}
+}
+
+// tableOf returns the table of a field, e.g. useraction for useraction.name
+func tableOf(field string) string {
+	if i := strings.IndexByte(field, '.'); i >= 0 {
+		return field[:i]
+	}
+	return ""
+}
+
+// Conditions on fields holding several values match if any of the values matches
+
+type andCondition struct {
+	left, right condition
+}
+
+func (c *andCondition) matches(r row) bool {
+	return c.left.matches(r) && c.right.matches(r)
+}
+
+type orCondition struct {
+	left, right condition
+}
+
+func (c *orCondition) matches(r row) bool {
+	return c.left.matches(r) || c.right.matches(r)
+}
+
+type notCondition struct {
+	inner condition
+}
+
+func (c *notCondition) matches(r row) bool {
+	return !c.inner.matches(r)
+}
+
+type nullCondition struct {
+	field string
+}
+
+func (c *nullCondition) matches(r row) bool {
+	return len(r.values(c.field)) == 0
+}
+
+type compareCondition struct {
+	field    string
+	operator string
+	value    interface{}
+}
+
+func (c *compareCondition) matches(r row) bool {
+	for _, value := range r.values(c.field) {
+		result, comparable := compare(value, c.value)
+		if !comparable {
+			if c.operator == "!=" || c.operator == "<>" {
+				return true
+			}
+			continue
+		}
+
+		switch c.operator {
+		case "=":
+			if result == 0 {
+				return true
+			}
+		case "!=", "<>":
+			if result != 0 {
+				return true
+			}
+		case "<":
+			if result < 0 {
+				return true
+			}
+		case "<=":
+			if result <= 0 {
+				return true
+			}
+		case ">":
+			if result > 0 {
+				return true
+			}
+		case ">=":
+			if result >= 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type inCondition struct {
+	field  string
+	values []interface{}
+}
+
+func (c *inCondition) matches(r row) bool {
+	for _, value := range r.values(c.field) {
+		for _, candidate := range c.values {
+			if result, comparable := compare(value, candidate); comparable && result == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type betweenCondition struct {
+	field     string
+	low, high interface{}
+}
+
+func (c *betweenCondition) matches(r row) bool {
+	for _, value := range r.values(c.field) {
+		low, lowComparable := compare(value, c.low)
+		high, highComparable := compare(value, c.high)
+		if lowComparable && highComparable && low >= 0 && high <= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+type startsWithCondition struct {
+	field  string
+	prefix string
+}
+
+func (c *startsWithCondition) matches(r row) bool {
+	for _, value := range r.values(c.field) {
+		if s, ok := value.(string); ok && strings.HasPrefix(s, c.prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+type likeCondition struct {
+	field   string
+	pattern string
+}
+
+func (c *likeCondition) matches(r row) bool {
+	for _, value := range r.values(c.field) {
+		if s, ok := value.(string); ok && like(s, c.pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// like matches a string against a pattern in which % stands for any number of characters
+func like(s string, pattern string) bool {
+	parts := strings.Split(pattern, "%")
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+
+	last := len(parts) - 1
+	for _, part := range parts[1:last] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+
+	if last == 0 {
+		return s == ""
+	}
+	return strings.HasSuffix(s, parts[last])
+}
+
+// compare compares two values, as numbers if both are numbers, as IP addresses if both are IP addresses
+// and as strings otherwise. Values of different types are not comparable.
+func compare(a interface{}, b interface{}) (result int, comparable bool) {
+	if x, ok := toFloat(a); ok {
+		y, ok := toFloat(b)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		default:
+			return 0, true
+		}
+	}
+
+	switch x := a.(type) {
+	case string:
+		y, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		if ipX, ipY := net.ParseIP(x), net.ParseIP(y); ipX != nil && ipY != nil {
+			return bytes.Compare(ipX.To16(), ipY.To16()), true
+		}
+		return strings.Compare(x, y), true
+	case bool:
+		y, ok := b.(bool)
+		if !ok || x != y {
+			return 1, ok
+		}
+		return 0, true
+	default:
+		return 0, false
+	}
+}
+
+// toFloat converts numeric values to float64
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	default:
+		return 0, false
+	}
+}
+
+// group collects the rows with the same values in the DISTINCT columns, and the sessions they belong to
+type group struct {
+	key      []interface{}
+	rows     []row
+	sessions []map[string]interface{}
+	seen     map[int]bool
+}
+
+// execute runs the query against the given sessions, which are a sample of the sessions in the timeframe
+// of the query if the results are extrapolated. Counts and sums are multiplied by the extrapolation level.
+func (q *query) execute(sessions []map[string]interface{}, extrapolationLevel int) [][]interface{} {
+	var keyColumns []column
+	aggregated := false
+	for _, c := range q.columns {
+		if c.function == "" {
+			keyColumns = append(keyColumns, c)
+		} else {
+			aggregated = true
+		}
+	}
+
+	if !q.distinct && !aggregated {
+		var values [][]interface{}
+		for _, session := range sessions {
+			r := row{session: session}
+			if q.where != nil && !q.where.matches(r) {
+				continue
+			}
+			var value []interface{}
+			for _, c := range q.columns {
+				value = append(value, r.value(c.field))
+			}
+			values = append(values, value)
+		}
+		return q.order(values, false)
+	}
+
+	// rows are expanded into one row per element of the list tables selected by the DISTINCT columns, so
+	// that e.g. DISTINCT usererror.name groups the errors rather than the lists of errors of sessions. DQL
+	// queries may expand further tables.
+	tables := append([]string{}, q.expand...)
+	for _, c := range keyColumns {
+		if table := tableOf(c.field); listTables[table] && !contains(tables, table) {
+			tables = append(tables, table)
+		}
+	}
+	sort.Strings(tables)
+
+	groups := make(map[string]*group)
+	var ordered []*group
+	for i, session := range sessions {
+		for _, r := range expand(session, tables) {
+			if q.where != nil && !q.where.matches(r) {
+				continue
+			}
+
+			var key []interface{}
+			for _, c := range keyColumns {
+				key = append(key, r.value(c.field))
+			}
+			encoded, _ := json.Marshal(key)
+
+			g, found := groups[string(encoded)]
+			if !found {
+				g = &group{key: key, seen: make(map[int]bool)}
+				groups[string(encoded)] = g
+				ordered = append(ordered, g)
+			}
+			g.rows = append(g.rows, r)
+			if !g.seen[i] {
+				g.seen[i] = true
+				g.sessions = append(g.sessions, session)
+			}
+		}
+	}
+
+	// aggregating all sessions results in a single row, even if no session matches
+	if len(keyColumns) == 0 && len(ordered) == 0 {
+		ordered = append(ordered, &group{})
+	}
+
+	var values [][]interface{}
+	for _, g := range ordered {
+		var value []interface{}
+		key := 0
+		for _, c := range q.columns {
+			if c.function == "" {
+				value = append(value, g.key[key])
+				key++
+			} else {
+				value = append(value, g.aggregate(c, extrapolationLevel))
+			}
+		}
+		values = append(values, value)
+	}
+
+	return q.order(values, aggregated)
+}
+
+// expand returns the rows of a session with each combination of elements of the given list tables bound
+func expand(session map[string]interface{}, tables []string) []row {
+	rows := []row{{session: session, bound: map[string]int{}}}
+
+	for _, table := range tables {
+		size := 0
+		for field, value := range session {
+			if list, ok := value.([]interface{}); ok && tableOf(field) == table && len(list) > size {
+				size = len(list)
+			}
+		}
+
+		var expanded []row
+		for _, r := range rows {
+			if size == 0 {
+				expanded = append(expanded, bind(r, table, -1))
+			}
+			for index := 0; index < size; index++ {
+				expanded = append(expanded, bind(r, table, index))
+			}
+		}
+		rows = expanded
+	}
+
+	return rows
+}
+
+// bind returns a copy of the row with the given list table bound to one of its elements
+func bind(r row, table string, index int) row {
+	bound := make(map[string]int, len(r.bound)+1)
+	for t, i := range r.bound {
+		bound[t] = i
+	}
+	bound[table] = index
+
+	return row{session: r.session, bound: bound}
+}
+
+// aggregate computes the value of an aggregated column over the group. Fields of list tables are aggregated
+// over all rows of the group, other fields once per session.
+func (g *group) aggregate(c column, extrapolationLevel int) interface{} {
+	if c.field == "" {
+		return len(g.sessions) * extrapolationLevel
+	}
+
+	var values []interface{}
+	if listTables[tableOf(c.field)] {
+		for _, r := range g.rows {
+			values = append(values, r.values(c.field)...)
+		}
+	} else {
+		for _, session := range g.sessions {
+			values = append(values, row{session: session}.values(c.field)...)
+		}
+	}
+
+	if c.function == "count" {
+		return len(values) * extrapolationLevel
+	}
+
+	var numbers []float64
+	for _, value := range values {
+		if number, ok := toFloat(value); ok {
+			numbers = append(numbers, number)
+		}
+	}
+
+	if c.function == "sum" {
+		sum := 0.0
+		for _, number := range numbers {
+			sum += number
+		}
+		return sum * float64(extrapolationLevel)
+	}
+	if len(numbers) == 0 {
+		return nil
+	}
+
+	result := numbers[0]
+	for _, number := range numbers[1:] {
+		switch c.function {
+		case "avg":
+			result += number
+		case "min":
+			if number < result {
+				result = number
+			}
+		case "max":
+			if number > result {
+				result = number
+			}
+		}
+	}
+	if c.function == "avg" {
+		result /= float64(len(numbers))
+	}
+	return result
+}
+
+// order sorts the result rows by the ORDER BY column, or aggregated results by their first aggregated column
+// in descending order if the query has no ORDER BY, and applies the limit
+func (q *query) order(values [][]interface{}, aggregated bool) [][]interface{} {
+	orderBy, desc := q.orderBy, q.desc
+	if orderBy < 0 && aggregated {
+		for i, c := range q.columns {
+			if c.function != "" {
+				orderBy, desc = i, true
+				break
+			}
+		}
+	}
+
+	if orderBy >= 0 {
+		sort.SliceStable(values, func(i, j int) bool {
+			result, _ := compare(values[i][orderBy], values[j][orderBy])
+			if desc {
+				return result > 0
+			}
+			return result < 0
+		})
+	}
+
+	if len(values) > q.limit {
+		values = values[:q.limit]
+	}
+	if values == nil {
+		values = [][]interface{}{}
+	}
+	return values
+}
+
+func contains(list []string, value string) bool {
+	for _, element := range list {
+		if element == value {
+			return true
+		}
+	}
+	return false
+}
+
+// columnNames returns the names of the selected columns, as they are returned by the USQL API
+func (q *query) columnNames() []string {
+	names := make([]string, 0, len(q.columns))
+	for _, c := range q.columns {
+		names = append(names, c.name)
+	}
+	return names
+}
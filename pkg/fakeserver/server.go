@@ -0,0 +1,414 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+package fakeserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/util"
+)
+
+// TableAPI is the path of the USQL table API served by the fake server
+const TableAPI = "/api/v1/userSessionQueryLanguage/table"
+
+// GrailQueryAPI is the path of the Grail query API served by the fake server, whose execute, poll and cancel
+// endpoints are at GrailQueryAPI:execute etc.
+const GrailQueryAPI = "/platform/storage/query/v1/query"
+
+// TokenLookupAPI is the path of the API token lookup API served by the fake server
+const TokenLookupAPI = "/api/v2/apiTokens/lookup"
+
+// DefaultTokenScopes are the scopes of tokens served by the token lookup API unless specified otherwise
+var DefaultTokenScopes = []string{"DTAQLAccess"}
+
+// defaultResultRecords is the number of records returned by DQL queries which don't specify a maximum
+const defaultResultRecords = 1000
+
+// defaultTimeframe is the timeframe of queries which don't specify one, as in Dynatrace
+const defaultTimeframe = 2 * time.Hour
+
+// Options configures the behaviour of a fake server
+type Options struct {
+	// Tokens are the API tokens accepted by the server. If empty, any token is accepted.
+	Tokens []string
+	// RequestsPerMinute is the number of requests served per minute before responding with HTTP 429, or 0
+	// for no rate limit
+	RequestsPerMinute int
+	// SampleLimit is the number of sessions a query runs over before its results are extrapolated, or 0 to
+	// never extrapolate results
+	SampleLimit int
+	// TokenScopes are the scopes of tokens returned by the token lookup API, DefaultTokenScopes if nil
+	TokenScopes []string
+	// Timeline is the clock of the rate limit and of the default timeframe of queries, the current time if nil
+	Timeline util.TimelineProvider
+}
+
+type server struct {
+	mutex       sync.Mutex
+	dataset     *Dataset
+	options     Options
+	timeline    util.TimelineProvider
+	windowStart time.Time
+	requests    int
+	queries     map[string][]map[string]interface{}
+}
+
+// NewServer creates an http.Handler which serves the USQL table API, the Grail query API and the token lookup
+// API of a Dynatrace environment over the sessions of the dataset. Like Dynatrace, it checks the API token of
+// requests, extrapolates the results of queries over many sessions and responds with HTTP 429 and X-RateLimit
+// headers once the rate limit is exceeded.
+func NewServer(dataset *Dataset, options Options) http.Handler {
+	timeline := options.Timeline
+	if timeline == nil {
+		timeline = util.NewTimelineProvider()
+	}
+	return &server{
+		dataset:  dataset,
+		options:  options,
+		timeline: timeline,
+		queries:  make(map[string][]map[string]interface{}),
+	}
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	handler, method := s.table, http.MethodGet
+	switch r.URL.Path {
+	case TableAPI:
+	case GrailQueryAPI + ":execute":
+		handler, method = s.execute, http.MethodPost
+	case GrailQueryAPI + ":poll":
+		handler = s.poll
+	case GrailQueryAPI + ":cancel":
+		handler, method = s.cancel, http.MethodPost
+	case TokenLookupAPI:
+		handler, method = s.lookupToken, http.MethodPost
+	default:
+		writeError(w, http.StatusNotFound, "Resource "+r.URL.Path+" not found")
+		return
+	}
+	if r.Method != method {
+		writeError(w, http.StatusMethodNotAllowed, "Method "+r.Method+" not allowed")
+		return
+	}
+
+	if status, message := s.authenticate(r); status != http.StatusOK {
+		writeError(w, status, message)
+		return
+	}
+
+	if !s.withinRateLimit(w) {
+		util.Log.Info("Rate limit of %d requests/min exceeded, responding with HTTP 429", s.options.RequestsPerMinute)
+		writeError(w, http.StatusTooManyRequests, "Too Many Requests")
+		return
+	}
+
+	handler(w, r)
+}
+
+// table serves the USQL table API
+func (s *server) table(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	text := params.Get("query")
+	if text == "" {
+		writeError(w, http.StatusBadRequest, "Query must not be empty")
+		return
+	}
+
+	now := s.timeline.NowMillis()
+	from, err := timestampParam(params.Get("startTimestamp"), now-defaultTimeframe.Milliseconds())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid startTimestamp: "+err.Error())
+		return
+	}
+	to, err := timestampParam(params.Get("endTimestamp"), now)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid endTimestamp: "+err.Error())
+		return
+	}
+	if from >= to {
+		writeError(w, http.StatusBadRequest, "startTimestamp must be before endTimestamp")
+		return
+	}
+
+	table, err := s.dataset.Query(text, from, to, s.options.SampleLimit)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid query: "+err.Error())
+		return
+	}
+	util.Log.Debug("Served %d rows (extrapolation level %v) for query: %s", len(table["values"].([][]interface{})),
+		table["extrapolationLevel"], text)
+
+	if params.Get("explain") == "true" {
+		table["explanations"] = s.explain(table, from, to)
+	}
+
+	writeJSON(w, http.StatusOK, table)
+}
+
+// explain describes how the fake server executed a query, in place of the query plan of Dynatrace
+func (s *server) explain(table map[string]interface{}, from int64, to int64) []string {
+	explanations := []string{fmt.Sprintf("Scanned %d sessions starting between %s and %s", len(s.dataset.between(from, to)),
+		time.Unix(0, from*int64(time.Millisecond)).UTC().Format(time.RFC3339), time.Unix(0, to*int64(time.Millisecond)).UTC().Format(time.RFC3339))}
+	if level := table["extrapolationLevel"].(int); level > 1 {
+		explanations = append(explanations, fmt.Sprintf("Sampled every %d. session, results are extrapolated", level))
+	}
+	return append(explanations, fmt.Sprintf("Returned %d rows", len(table["values"].([][]interface{}))))
+}
+
+// execute serves the execute endpoint of the Grail query API. The query is run right away, but like a long
+// running query in Grail, its state is RUNNING and the records are only returned when it is polled.
+func (s *server) execute(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Query                 string `json:"query"`
+		DefaultTimeframeStart string `json:"defaultTimeframeStart"`
+		DefaultTimeframeEnd   string `json:"defaultTimeframeEnd"`
+		MaxResultRecords      int    `json:"maxResultRecords"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request body: "+err.Error())
+		return
+	}
+	if request.Query == "" {
+		writeError(w, http.StatusBadRequest, "Query must not be empty")
+		return
+	}
+
+	now := s.timeline.Now()
+	from, err := timeframeParam(request.DefaultTimeframeStart, now.Add(-defaultTimeframe))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid defaultTimeframeStart: "+err.Error())
+		return
+	}
+	to, err := timeframeParam(request.DefaultTimeframeEnd, now)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid defaultTimeframeEnd: "+err.Error())
+		return
+	}
+	if from >= to {
+		writeError(w, http.StatusBadRequest, "defaultTimeframeStart must be before defaultTimeframeEnd")
+		return
+	}
+
+	limit := request.MaxResultRecords
+	if limit <= 0 {
+		limit = defaultResultRecords
+	}
+	records, err := s.dataset.QueryDQL(request.Query, from, to, limit)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid query: "+err.Error())
+		return
+	}
+	util.Log.Debug("Served %d records for query: %s", len(records), request.Query)
+
+	token := uuid.NewString()
+	s.mutex.Lock()
+	s.queries[token] = records
+	s.mutex.Unlock()
+
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{"state": "RUNNING", "requestToken": token, "progress": 0})
+}
+
+// poll serves the poll endpoint of the Grail query API, returning the records of a query once
+func (s *server) poll(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("request-token")
+
+	s.mutex.Lock()
+	records, found := s.queries[token]
+	delete(s.queries, token)
+	s.mutex.Unlock()
+
+	if !found {
+		writeError(w, http.StatusGone, "Query "+token+" not found, it may have been cancelled or its results expired")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"state":    "SUCCEEDED",
+		"progress": 100,
+		"result":   map[string]interface{}{"records": records},
+	})
+}
+
+// cancel serves the cancel endpoint of the Grail query API
+func (s *server) cancel(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("request-token")
+
+	s.mutex.Lock()
+	_, found := s.queries[token]
+	delete(s.queries, token)
+	s.mutex.Unlock()
+
+	if !found {
+		writeError(w, http.StatusGone, "Query "+token+" not found")
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// lookupToken serves the token lookup API. All accepted tokens have the scopes of the server's options.
+func (s *server) lookupToken(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Token == "" {
+		writeError(w, http.StatusBadRequest, "Request body must hold the token to look up")
+		return
+	}
+	if !s.accepts(request.Token) {
+		writeError(w, http.StatusNotFound, "Token not found")
+		return
+	}
+
+	scopes := s.options.TokenScopes
+	if scopes == nil {
+		scopes = DefaultTokenScopes
+	}
+	id := request.Token
+	if parts := strings.Split(request.Token, "."); len(parts) == 3 {
+		// like Dynatrace, the secret part of the token is not returned
+		id = parts[0] + "." + parts[1]
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"id":           id,
+		"name":         "fake-server",
+		"enabled":      true,
+		"owner":        "fake-server",
+		"creationDate": s.timeline.Now().UTC().Format(time.RFC3339),
+		"scopes":       scopes,
+	})
+}
+
+// authenticate checks the API token of a request, which is passed in the Authorization header or, for
+// Managed Cluster requests, in the Api-Token parameter. Requests of the Grail query API pass a platform
+// token as bearer token instead.
+func (s *server) authenticate(r *http.Request) (status int, message string) {
+	token := r.URL.Query().Get("Api-Token")
+	authorization := r.Header.Get("Authorization")
+	if strings.HasPrefix(r.URL.Path, GrailQueryAPI) {
+		token = strings.TrimPrefix(authorization, "Bearer ")
+		if token == authorization {
+			token = ""
+		}
+	} else if strings.HasPrefix(authorization, "Api-Token ") {
+		token = strings.TrimPrefix(authorization, "Api-Token ")
+	}
+
+	if token == "" {
+		return http.StatusUnauthorized, "Missing authorization parameter."
+	}
+	if !s.accepts(token) {
+		return http.StatusUnauthorized, "Token Authentication failed"
+	}
+	return http.StatusOK, ""
+}
+
+// accepts checks whether the server accepts a token
+func (s *server) accepts(token string) bool {
+	if len(s.options.Tokens) == 0 {
+		return true
+	}
+	for _, accepted := range s.options.Tokens {
+		if token == accepted {
+			return true
+		}
+	}
+	return false
+}
+
+// withinRateLimit counts the request against the rate limit of the current one minute window and sets the
+// X-RateLimit headers of the response. It returns false if the rate limit is exceeded.
+func (s *server) withinRateLimit(w http.ResponseWriter) bool {
+	if s.options.RequestsPerMinute <= 0 {
+		return true
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.timeline.Now()
+	if now.Sub(s.windowStart) >= time.Minute {
+		s.windowStart = now
+		s.requests = 0
+	}
+	reset := s.windowStart.Add(time.Minute)
+
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(s.options.RequestsPerMinute))
+	w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset.UnixNano()/int64(time.Microsecond), 10))
+
+	if s.requests >= s.options.RequestsPerMinute {
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("Retry-After", strconv.Itoa(int(reset.Sub(now).Seconds())+1))
+		return false
+	}
+
+	s.requests++
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(s.options.RequestsPerMinute-s.requests))
+	return true
+}
+
+// timestampParam parses a timestamp parameter in milliseconds, or returns the default if it is empty
+func timestampParam(value string, defaultValue int64) (int64, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+// timeframeParam parses an ISO 8601 timestamp into milliseconds, or returns the default if it is empty
+func timeframeParam(value string, defaultValue time.Time) (int64, error) {
+	timestamp := defaultValue
+	if value != "" {
+		var err error
+		if timestamp, err = time.Parse(time.RFC3339Nano, value); err != nil {
+			return 0, err
+		}
+	}
+	return timestamp.UnixNano() / int64(time.Millisecond), nil
+}
+
+// writeJSON writes a JSON response
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		util.Log.Warn("Failed to write response: %s", err)
+	}
+}
+
+// writeError writes an error response in the format of the Dynatrace API
+func writeError(w http.ResponseWriter, status int, message string) {
+	var apiError struct {
+		Error struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	apiError.Error.Code = status
+	apiError.Error.Message = message
+
+	writeJSON(w, status, apiError)
+}
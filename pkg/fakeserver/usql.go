@@ -0,0 +1,476 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+package fakeserver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DefaultLimit and MaxLimit are the number of rows returned by a query without a LIMIT, and the most rows
+// a query can return
+const (
+	DefaultLimit = 50
+	MaxLimit     = 5000
+)
+
+// query is a parsed USQL query. Only the subset of USQL which derran generates is supported: selecting
+// fields, DISTINCT fields and the count, sum, avg, min and max functions from the usersession table,
+// with a WHERE condition, an ORDER BY and a LIMIT.
+type query struct {
+	distinct bool
+	expand   []string
+	columns  []column
+	where    condition
+	orderBy  int
+	desc     bool
+	limit    int
+}
+
+// column is a selected field, or a function of a field
+type column struct {
+	name     string
+	field    string
+	function string
+}
+
+// condition is a WHERE condition, evaluated against a row of the dataset
+type condition interface {
+	matches(r row) bool
+}
+
+type token struct {
+	kind  tokenKind
+	value string
+}
+
+type tokenKind int
+
+const (
+	identifierToken tokenKind = iota
+	stringToken
+	numberToken
+	symbolToken
+	endToken
+)
+
+// tokenize splits a query into identifiers (including keywords), quoted strings, numbers and symbols. Double
+// quoted strings of DQL queries may contain escaped characters, while USQL strings are taken as they are.
+func tokenize(text string, escapes bool) ([]token, error) {
+	var tokens []token
+
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"' && escapes:
+			end := i + 1
+			for ; end < len(text) && text[end] != '"'; end++ {
+				if text[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(text) {
+				return nil, fmt.Errorf("unterminated string starting at position %d", i)
+			}
+			value, err := strconv.Unquote(text[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string starting at position %d", i)
+			}
+			tokens = append(tokens, token{kind: stringToken, value: value})
+			i = end + 1
+		case c == '"' || c == '\'':
+			end := strings.IndexByte(text[i+1:], c)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string starting at position %d", i)
+			}
+			tokens = append(tokens, token{kind: stringToken, value: text[i+1 : i+1+end]})
+			i += end + 2
+		case c >= '0' && c <= '9' || c == '-' && i+1 < len(text) && text[i+1] >= '0' && text[i+1] <= '9':
+			start := i
+			for i++; i < len(text) && (text[i] >= '0' && text[i] <= '9' || text[i] == '.'); i++ {
+			}
+			tokens = append(tokens, token{kind: numberToken, value: text[start:i]})
+		case isIdentifierChar(c):
+			start := i
+			for ; i < len(text) && isIdentifierChar(text[i]); i++ {
+			}
+			tokens = append(tokens, token{kind: identifierToken, value: text[start:i]})
+		case c == '!' || c == '<' || c == '>' || c == '=' && i+1 < len(text) && text[i+1] == '=':
+			if i+1 < len(text) && (text[i+1] == '=' || c == '<' && text[i+1] == '>') {
+				tokens = append(tokens, token{kind: symbolToken, value: text[i : i+2]})
+				i += 2
+			} else if c == '!' {
+				return nil, fmt.Errorf("unexpected character %q at position %d", c, i)
+			} else {
+				tokens = append(tokens, token{kind: symbolToken, value: string(c)})
+				i++
+			}
+		case strings.IndexByte("(),=*|{}[]:", c) >= 0:
+			tokens = append(tokens, token{kind: symbolToken, value: string(c)})
+			i++
+		default:
+			return nil, fmt.Errorf("unexpected character %q at position %d", c, i)
+		}
+	}
+
+	return append(tokens, token{kind: endToken}), nil
+}
+
+func isIdentifierChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '.'
+}
+
+// parser is a recursive descent parser of USQL and DQL queries
+type parser struct {
+	tokens []token
+	pos    int
+	// grailFields maps the fields of Grail records to the fields of the dataset when parsing DQL, see dql.go
+	grailFields map[string]string
+	// arrays are the list tables whose elements are referenced by the condition being parsed, e.g. errors[]
+	arrays []string
+}
+
+// parseQuery parses the text of a USQL query
+func parseQuery(text string) (*query, error) {
+	tokens, err := tokenize(text, false)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	return p.query()
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+// keyword consumes the next token if it is the given keyword
+func (p *parser) keyword(keyword string) bool {
+	if t := p.peek(); t.kind == identifierToken && strings.EqualFold(t.value, keyword) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// symbol consumes the next token if it is the given symbol
+func (p *parser) symbol(symbol string) bool {
+	if t := p.peek(); t.kind == symbolToken && t.value == symbol {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(found bool, expected string) error {
+	if found {
+		return nil
+	}
+	return p.unexpected(expected)
+}
+
+func (p *parser) unexpected(expected string) error {
+	t := p.peek()
+	if t.kind == endToken {
+		return fmt.Errorf("expected %s but the query ended", expected)
+	}
+	return fmt.Errorf("expected %s but found %q", expected, t.value)
+}
+
+func (p *parser) query() (*query, error) {
+	q := &query{orderBy: -1, limit: DefaultLimit}
+
+	if err := p.expect(p.keyword("SELECT"), "SELECT"); err != nil {
+		return nil, err
+	}
+	q.distinct = p.keyword("DISTINCT")
+
+	for {
+		c, err := p.column()
+		if err != nil {
+			return nil, err
+		}
+		q.columns = append(q.columns, c)
+		if !p.symbol(",") {
+			break
+		}
+	}
+
+	if err := p.expect(p.keyword("FROM"), "FROM"); err != nil {
+		return nil, err
+	}
+	if err := p.expect(p.keyword("usersession"), "table usersession"); err != nil {
+		return nil, err
+	}
+
+	if p.keyword("WHERE") {
+		where, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		q.where = where
+	}
+
+	if p.keyword("ORDER") {
+		if err := p.expect(p.keyword("BY"), "BY"); err != nil {
+			return nil, err
+		}
+		c, err := p.column()
+		if err != nil {
+			return nil, err
+		}
+		for i, selected := range q.columns {
+			if strings.EqualFold(selected.name, c.name) {
+				q.orderBy = i
+			}
+		}
+		if q.orderBy < 0 {
+			return nil, fmt.Errorf("ORDER BY %s must reference a selected column", c.name)
+		}
+		if p.keyword("DESC") {
+			q.desc = true
+		} else {
+			p.keyword("ASC")
+		}
+	}
+
+	if p.keyword("LIMIT") {
+		t := p.peek()
+		limit, err := strconv.Atoi(t.value)
+		if t.kind != numberToken || err != nil || limit <= 0 {
+			return nil, p.unexpected("a positive LIMIT")
+		}
+		p.pos++
+		if limit > MaxLimit {
+			return nil, fmt.Errorf("LIMIT %d exceeds the maximum of %d", limit, MaxLimit)
+		}
+		q.limit = limit
+	}
+
+	if p.peek().kind != endToken {
+		return nil, p.unexpected("end of query")
+	}
+
+	return q, nil
+}
+
+func (p *parser) column() (column, error) {
+	t := p.peek()
+	if t.kind != identifierToken {
+		return column{}, p.unexpected("a column")
+	}
+	p.pos++
+
+	if !p.symbol("(") {
+		return column{name: t.value, field: strings.ToLower(t.value)}, nil
+	}
+
+	function := strings.ToLower(t.value)
+	switch function {
+	case "count", "sum", "avg", "min", "max":
+	default:
+		return column{}, fmt.Errorf("unsupported function %s", t.value)
+	}
+
+	var field string
+	if p.symbol("*") {
+		if function != "count" {
+			return column{}, fmt.Errorf("%s(*) is not supported", function)
+		}
+	} else if argument := p.peek(); argument.kind == identifierToken {
+		field = strings.ToLower(argument.value)
+		p.pos++
+	} else {
+		return column{}, p.unexpected("a field in " + function + "()")
+	}
+	if err := p.expect(p.symbol(")"), ")"); err != nil {
+		return column{}, err
+	}
+
+	name := function + "(*)"
+	if field != "" {
+		name = function + "(" + field + ")"
+	}
+	return column{name: name, field: field, function: function}, nil
+}
+
+func (p *parser) or() (condition, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("OR") {
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = &orCondition{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) and() (condition, error) {
+	left, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("AND") {
+		right, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		left = &andCondition{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) not() (condition, error) {
+	if p.keyword("NOT") {
+		inner, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return &notCondition{inner: inner}, nil
+	}
+	return p.primary()
+}
+
+func (p *parser) primary() (condition, error) {
+	if p.grailFields != nil {
+		return p.dqlPrimary()
+	}
+	if p.symbol("(") {
+		inner, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		return inner, p.expect(p.symbol(")"), ")")
+	}
+
+	t := p.peek()
+	if t.kind != identifierToken {
+		return nil, p.unexpected("a field")
+	}
+	p.pos++
+	field := strings.ToLower(t.value)
+
+	switch {
+	case p.keyword("IS"):
+		negate := p.keyword("NOT")
+		var c condition
+		if p.keyword("NULL") {
+			c = &nullCondition{field: field}
+		} else {
+			value, err := p.literal()
+			if err != nil {
+				return nil, err
+			}
+			c = &compareCondition{field: field, operator: "=", value: value}
+		}
+		if negate {
+			c = &notCondition{inner: c}
+		}
+		return c, nil
+	case p.keyword("IN"):
+		if err := p.expect(p.symbol("("), "("); err != nil {
+			return nil, err
+		}
+		var values []interface{}
+		for {
+			value, err := p.literal()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+			if !p.symbol(",") {
+				break
+			}
+		}
+		return &inCondition{field: field, values: values}, p.expect(p.symbol(")"), ")")
+	case p.keyword("BETWEEN"):
+		low, err := p.literal()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(p.keyword("AND"), "AND"); err != nil {
+			return nil, err
+		}
+		high, err := p.literal()
+		if err != nil {
+			return nil, err
+		}
+		return &betweenCondition{field: field, low: low, high: high}, nil
+	case p.keyword("STARTSWITH"):
+		value, err := p.literal()
+		if err != nil {
+			return nil, err
+		}
+		return &startsWithCondition{field: field, prefix: fmt.Sprint(value)}, nil
+	case p.keyword("LIKE"):
+		value, err := p.literal()
+		if err != nil {
+			return nil, err
+		}
+		return &likeCondition{field: field, pattern: fmt.Sprint(value)}, nil
+	}
+
+	if operator := p.peek(); operator.kind == symbolToken {
+		switch operator.value {
+		case "=", "!=", "<>", "<", "<=", ">", ">=":
+			p.pos++
+			value, err := p.literal()
+			if err != nil {
+				return nil, err
+			}
+			return &compareCondition{field: field, operator: operator.value, value: value}, nil
+		}
+	}
+	return nil, p.unexpected("a condition on " + t.value)
+}
+
+// literal parses a quoted string or a number
+func (p *parser) literal() (interface{}, error) {
+	t := p.peek()
+	switch t.kind {
+	case stringToken:
+		p.pos++
+		return t.value, nil
+	case numberToken:
+		p.pos++
+		number, err := strconv.ParseFloat(t.value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", t.value)
+		}
+		return number, nil
+	case identifierToken:
+		switch strings.ToLower(t.value) {
+		case "true":
+			p.pos++
+			return true, nil
+		case "false":
+			p.pos++
+			return false, nil
+		}
+	}
+	return nil, p.unexpected("a value")
+}
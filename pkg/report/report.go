@@ -23,6 +23,9 @@ import (
 	"fmt"
 	_ "image/png"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/360EntSecGroup-Skylar/excelize"
@@ -32,6 +35,26 @@ import (
 	"github.com/spf13/afero"
 )
 
+// The cells of a report holding the results which derran diff reads from reports without stats
+const (
+	// SummarySheet is the sheet listing the errors of a report by monetary impact
+	SummarySheet = "Summary"
+	// SummaryEnvironmentCell holds the name of the environment on the summary sheet
+	SummaryEnvironmentCell = "D6"
+	// FirstSummaryRow is the row of the summary sheet which the list of errors starts at
+	FirstSummaryRow = 12
+	// SummaryNameColumn holds the name of each error, or of the error source the errors below it are read from
+	SummaryNameColumn = "B"
+	// SummaryImpactColumn holds the monetary impact of each error, and is empty in the rows of error sources
+	SummaryImpactColumn = "E"
+	// ImpactedUsersCell, UnconvertedUsersCell and LostUsersCell hold the users of an error on its sheet
+	ImpactedUsersCell    = "C6"
+	UnconvertedUsersCell = "G6"
+	LostUsersCell        = "K6"
+	// Currency prefixes the monetary values of a report
+	Currency = "£"
+)
+
 type useCaseData struct {
 	mainValueMeaning       string
 	mainValueDescription   string
@@ -43,11 +66,36 @@ type useCaseData struct {
 
 //go:embed img
 var imgs embed.FS
-var allUseCases = make(map[string]useCaseData)
 
-func CreateReport(env environment.Environment, config config.Config, reportData map[string]map[string]interface{}, outputDir string, fs afero.Fs) error {
+// allUseCases defines the flat text that accompanies use case data in the report
+var allUseCases = map[string]useCaseData{
+	"lost_basket": {
+		mainValueMeaning:       "Revenue at risk",
+		mainValueDescription:   "Total basket value potentially at risk from the lost users.",
+		secondValueMeaning:     "Potential lost profit",
+		secondValueDescription: "The total profit potentially lost based on a {MARGIN}% margin.",
+		mainIcon:               "cart_purple.png",
+		secondIcon:             "money_purple.png",
+	},
+	"agent_hours": {
+		mainValueMeaning:       "Agent hours lost",
+		mainValueDescription:   "Estimated number of hours spent by agents on calls as a result of the error.",
+		secondValueMeaning:     "Potential cost of calls",
+		secondValueDescription: "The estimated cost of agents handling calls associated with the error.",
+		mainIcon:               "time_blue.png",
+		secondIcon:             "money_blue.png",
+	},
+	"incurred_costs": {
+		mainValueMeaning:     "Potential costs incurred",
+		mainValueDescription: "The estimated revenue impact from users hitting the error in your application.",
+		mainIcon:             "money_green.png",
+	},
+}
+
+func CreateReport(env environment.Environment, config config.Config, reportData map[string]map[string]interface{}, outputDir string, fs afero.Fs,
+	partial bool) error {
 	reportDir := outputDir + string(os.PathSeparator) + env.GetName()
-	reportPath := reportDir + string(os.PathSeparator) + util.GetTodayDigitString() + "_" + config.GetId() + ".xlsx"
+	reportPath := reportBasePath(env, config, outputDir, partial) + ".xlsx"
 
 	if exists, err := afero.DirExists(fs, outputDir); !exists && err == nil {
 		if err := fs.MkdirAll(outputDir, 0777); err != nil {
@@ -66,9 +114,9 @@ func CreateReport(env environment.Environment, config config.Config, reportData
 
 	report := excelize.NewFile()
 
-	report.SetSheetName("Sheet1", "Summary")
-	populateSummarySheet("Summary", report, reportData, env, config)
-	report.SetSheetViewOptions("Summary", 0, excelize.ShowGridLines(false))
+	report.SetSheetName("Sheet1", SummarySheet)
+	populateSummarySheet(SummarySheet, report, reportData, env, config, partial)
+	report.SetSheetViewOptions(SummarySheet, 0, excelize.ShowGridLines(false))
 
 	for envErr, details := range reportData {
 		idx := report.NewSheet(envErr)
@@ -80,10 +128,14 @@ func CreateReport(env environment.Environment, config config.Config, reportData
 		populateBaseData(envErr, report)
 
 		// values that are always present
-		report.SetCellValue(envErr, "D2", envErr)
-		report.SetCellValue(envErr, "C6", details["impacted_users"].(int))
-		report.SetCellValue(envErr, "G6", details["unconverted_users"].(int))
-		report.SetCellValue(envErr, "K6", details["lost_users"].(int))
+		if name, ok := details["error_name"].(string); ok {
+			report.SetCellValue(envErr, "D2", name)
+		} else {
+			report.SetCellValue(envErr, "D2", envErr)
+		}
+		report.SetCellValue(envErr, ImpactedUsersCell, details["impacted_users"].(int))
+		report.SetCellValue(envErr, UnconvertedUsersCell, details["unconverted_users"].(int))
+		report.SetCellValue(envErr, LostUsersCell, details["lost_users"].(int))
 
 		// charts
 		addUserBreakdownChart(envErr, report, details["user_breakdown"], "B12")
@@ -91,7 +143,17 @@ func CreateReport(env environment.Environment, config config.Config, reportData
 
 		// values that are populated based on use case configuration
 		populateUseCaseCurrentData(envErr, report, config, details)
-		populateUseCaseFutureData(envErr, report, config, details)
+		nextRow := populateUseCaseFutureData(envErr, report, config, details)
+
+		// application dimension, when more than one application is impacted
+		if breakdown, ok := details["application_breakdown"].([]interface{}); ok && len(breakdown) > 1 {
+			nextRow = populateApplicationData(envErr, report, breakdown, nextRow+1)
+		}
+
+		// optional cohort analysis
+		if _, ok := details["cohort_retention"]; ok {
+			populateCohortData(envErr, report, details, nextRow+1)
+		}
 	}
 
 	report.SetActiveSheet(0)
@@ -103,6 +165,42 @@ func CreateReport(env environment.Environment, config config.Config, reportData
 	return nil
 }
 
+// reportBasePath returns the path of the files reporting a configuration in an environment, without extension
+func reportBasePath(env environment.Environment, config config.Config, outputDir string, partial bool) string {
+	path := outputDir + string(os.PathSeparator) + env.GetName() + string(os.PathSeparator) + util.GetTodayDigitString() +
+		"_" + config.GetId()
+	if partial {
+		path += "_partial"
+	}
+	return path
+}
+
+// RemovePartialReports removes the partial reports of a configuration in an environment, and their stats, which an
+// interrupted run left in the output directory, once the complete report is written. It returns the removed files.
+func RemovePartialReports(env environment.Environment, config config.Config, outputDir string, fs afero.Fs) ([]string, error) {
+	reportDir := filepath.Join(outputDir, env.GetName())
+	infos, err := afero.ReadDir(fs, reportDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// partial reports are dated by the day they were created, which may be before the complete report's
+	partialPattern := regexp.MustCompile(`^\d{8}_` + regexp.QuoteMeta(config.GetId()) + `_partial(\.xlsx|` +
+		regexp.QuoteMeta(StatsExtension) + `)$`)
+	var removed []string
+	for _, info := range infos {
+		if info.IsDir() || !partialPattern.MatchString(info.Name()) {
+			continue
+		}
+		path := filepath.Join(reportDir, info.Name())
+		if err := fs.Remove(path); err != nil {
+			return removed, err
+		}
+		removed = append(removed, path)
+	}
+	return removed, nil
+}
+
 func setColumnWidths(sheet string, report *excelize.File) {
 	// Separator columns
 	report.SetColWidth(sheet, "A", "A", 2.43)
@@ -200,29 +298,6 @@ func populateUseCaseCurrentData(sheet string, report *excelize.File, config conf
 	styleValueExplain := getExcelStyle("valueExplain", report)
 	styleDefault := getExcelStyle("default", report)
 
-	// Define flat text that accompanies use case data in the report
-	allUseCases["lost_basket"] = useCaseData{
-		mainValueMeaning:       "Revenue at risk",
-		mainValueDescription:   "Total basket value potentially at risk from the lost users.",
-		secondValueMeaning:     "Potential lost profit",
-		secondValueDescription: "The total profit potentially lost based on a {MARGIN}% margin.",
-		mainIcon:               "cart_purple.png",
-		secondIcon:             "money_purple.png",
-	}
-	allUseCases["agent_hours"] = useCaseData{
-		mainValueMeaning:       "Agent hours lost",
-		mainValueDescription:   "Estimated number of hours spent by agents on calls as a result of the error.",
-		secondValueMeaning:     "Potential cost of calls",
-		secondValueDescription: "The estimated cost of agents handling calls associated with the error.",
-		mainIcon:               "time_blue.png",
-		secondIcon:             "money_blue.png",
-	}
-	allUseCases["incurred_costs"] = useCaseData{
-		mainValueMeaning:     "Potential costs incurred",
-		mainValueDescription: "The estimated revenue impact from users hitting the error in your application.",
-		mainIcon:             "money_green.png",
-	}
-
 	report.SetCellValue(sheet, "B24", "Based on the "+fmt.Sprintf("%d", details["lost_users"].(int))+" lost users...")
 	report.SetCellStyle(sheet, "B24", "B24", styleSubtitle)
 
@@ -290,14 +365,15 @@ func populateUseCaseCurrentData(sheet string, report *excelize.File, config conf
 		} else if useCase == "agent_hours" {
 			report.SetCellStyle(sheet, "C"+fmt.Sprintf("%d", idx), "C"+fmt.Sprintf("%d", idx), styleCurrentValue)
 			mainValue = details["lost_agent_hours"].(float64)
-			if val, ok := details["hours_lost_cost"]; ok {
-				secondValue = fmt.Sprintf("£%.0f", val.(float64))
+			// the cost of lost hours is only known if the cost of a call is configured
+			if cost, ok := details["hours_lost_cost"].(float64); ok {
+				secondValue = fmt.Sprintf("£%.0f", cost)
 			}
 		} else if useCase == "incurred_costs" {
 			mainValue = fmt.Sprintf("£%d", details["costs_incurred"].(int))
 		}
 		report.SetCellValue(sheet, "C"+fmt.Sprintf("%d", idx), mainValue)
-		if allUseCases[string(useCase)].secondValueMeaning != "" && secondValue != "" {
+		if allUseCases[string(useCase)].secondValueMeaning != "" && secondValue != nil {
 			report.SetCellValue(sheet, "G"+fmt.Sprintf("%d", idx), secondValue)
 		}
 
@@ -309,7 +385,7 @@ func populateUseCaseCurrentData(sheet string, report *excelize.File, config conf
 	}
 }
 
-func populateUseCaseFutureData(sheet string, report *excelize.File, config config.Config, details map[string]interface{}) {
+func populateUseCaseFutureData(sheet string, report *excelize.File, config config.Config, details map[string]interface{}) (nextRow int) {
 	styleSubtitle := getExcelStyle("subtitle", report)
 	styleSubtitle2 := getExcelStyle("subtitle2", report)
 	styleCurrentValue := getExcelStyle("currentValue", report)
@@ -360,21 +436,28 @@ func populateUseCaseFutureData(sheet string, report *excelize.File, config confi
 			report.SetCellValue(sheet, "J"+fmt.Sprintf("%d", idx+1), fmt.Sprintf("£%d", details["lost_money_28d"].(int)))
 			idx += 3
 		} else if useCase == "agent_hours" {
-			// Additional cells for this use case
+			report.SetCellValue(sheet, "B"+fmt.Sprintf("%d", idx), "Due to call centre load...")
+			report.SetCellValue(sheet, "B"+fmt.Sprintf("%d", idx+1), fmt.Sprintf("%.0f", details["lost_agent_hours_14d"].(float64))+" Hours")
+			report.SetCellValue(sheet, "F"+fmt.Sprintf("%d", idx+1), fmt.Sprintf("%.0f", details["lost_agent_hours_21d"].(float64))+" Hours")
+			report.SetCellValue(sheet, "J"+fmt.Sprintf("%d", idx+1), fmt.Sprintf("%.0f", details["lost_agent_hours_28d"].(float64))+" Hours")
+
+			// Additional cells for the cost of lost hours, which is only known if the cost of a call is configured
+			cost14d, ok14d := details["hours_lost_cost_14d"].(float64)
+			cost21d, ok21d := details["hours_lost_cost_21d"].(float64)
+			cost28d, ok28d := details["hours_lost_cost_28d"].(float64)
+			if !ok14d || !ok21d || !ok28d {
+				idx += 3
+				continue
+			}
 			report.MergeCell(sheet, "B"+fmt.Sprintf("%d", idx+2), "C"+fmt.Sprintf("%d", idx+2))
 			report.MergeCell(sheet, "F"+fmt.Sprintf("%d", idx+2), "G"+fmt.Sprintf("%d", idx+2))
 			report.MergeCell(sheet, "J"+fmt.Sprintf("%d", idx+2), "K"+fmt.Sprintf("%d", idx+2))
 			report.SetCellStyle(sheet, "B"+fmt.Sprintf("%d", idx+2), "B"+fmt.Sprintf("%d", idx+2), styleFutureValueMoney)
 			report.SetCellStyle(sheet, "F"+fmt.Sprintf("%d", idx+2), "F"+fmt.Sprintf("%d", idx+2), styleFutureValueMoney)
 			report.SetCellStyle(sheet, "J"+fmt.Sprintf("%d", idx+2), "J"+fmt.Sprintf("%d", idx+2), styleFutureValueMoney)
-
-			report.SetCellValue(sheet, "B"+fmt.Sprintf("%d", idx), "Due to call centre load...")
-			report.SetCellValue(sheet, "B"+fmt.Sprintf("%d", idx+1), fmt.Sprintf("%.0f", details["lost_agent_hours_14d"].(float64))+" Hours")
-			report.SetCellValue(sheet, "F"+fmt.Sprintf("%d", idx+1), fmt.Sprintf("%.0f", details["lost_agent_hours_21d"].(float64))+" Hours")
-			report.SetCellValue(sheet, "J"+fmt.Sprintf("%d", idx+1), fmt.Sprintf("%.0f", details["lost_agent_hours_28d"].(float64))+" Hours")
-			report.SetCellValue(sheet, "B"+fmt.Sprintf("%d", idx+2), fmt.Sprintf("£%.0f", details["hours_lost_cost_14d"].(float64)))
-			report.SetCellValue(sheet, "F"+fmt.Sprintf("%d", idx+2), fmt.Sprintf("£%.0f", details["hours_lost_cost_21d"].(float64)))
-			report.SetCellValue(sheet, "J"+fmt.Sprintf("%d", idx+2), fmt.Sprintf("£%.0f", details["hours_lost_cost_28d"].(float64)))
+			report.SetCellValue(sheet, "B"+fmt.Sprintf("%d", idx+2), fmt.Sprintf("£%.0f", cost14d))
+			report.SetCellValue(sheet, "F"+fmt.Sprintf("%d", idx+2), fmt.Sprintf("£%.0f", cost21d))
+			report.SetCellValue(sheet, "J"+fmt.Sprintf("%d", idx+2), fmt.Sprintf("£%.0f", cost28d))
 			idx += 4
 		} else if useCase == "incurred_costs" {
 			report.SetCellValue(sheet, "B"+fmt.Sprintf("%d", idx), "Due to incurred costs...")
@@ -384,15 +467,106 @@ func populateUseCaseFutureData(sheet string, report *excelize.File, config confi
 			idx += 3
 		}
 	}
+
+	return idx
+}
+
+func populateApplicationData(sheet string, report *excelize.File, breakdown []interface{}, idx int) (nextRow int) {
+	styleSubtitle := getExcelStyle("subtitle", report)
+	styleValueExplain := getExcelStyle("valueExplain", report)
+	styleDefault := getExcelStyle("default", report)
+
+	totalLost := 0
+	for _, r := range breakdown {
+		totalLost += r.([]interface{})[2].(int)
+	}
+
+	// Flat text and styles
+	report.SetCellStyle(sheet, "B"+fmt.Sprintf("%d", idx), "B"+fmt.Sprintf("%d", idx), styleSubtitle)
+	report.SetCellValue(sheet, "B"+fmt.Sprintf("%d", idx), "Impact per application...")
+	idx += 2
+
+	// Table header
+	report.SetRowHeight(sheet, idx, 33.75)
+	report.MergeCell(sheet, "B"+fmt.Sprintf("%d", idx), "C"+fmt.Sprintf("%d", idx))
+	report.SetCellStyle(sheet, "B"+fmt.Sprintf("%d", idx), "H"+fmt.Sprintf("%d", idx), styleValueExplain)
+	report.SetCellValue(sheet, "B"+fmt.Sprintf("%d", idx), "Application")
+	report.SetCellValue(sheet, "D"+fmt.Sprintf("%d", idx), "Impacted users")
+	report.SetCellValue(sheet, "G"+fmt.Sprintf("%d", idx), "Lost users")
+	report.SetCellValue(sheet, "H"+fmt.Sprintf("%d", idx), "Share of lost users")
+	idx++
+
+	// Table rows
+	for _, r := range breakdown {
+		row := r.([]interface{})
+		share := 0.0
+		if totalLost > 0 {
+			share = float64(row[2].(int)) * 100 / float64(totalLost)
+		}
+		report.MergeCell(sheet, "B"+fmt.Sprintf("%d", idx), "C"+fmt.Sprintf("%d", idx))
+		report.SetCellStyle(sheet, "B"+fmt.Sprintf("%d", idx), "H"+fmt.Sprintf("%d", idx), styleDefault)
+		report.SetCellValue(sheet, "B"+fmt.Sprintf("%d", idx), row[0].(string))
+		report.SetCellValue(sheet, "D"+fmt.Sprintf("%d", idx), row[1].(int))
+		report.SetCellValue(sheet, "G"+fmt.Sprintf("%d", idx), row[2].(int))
+		report.SetCellValue(sheet, "H"+fmt.Sprintf("%d", idx), fmt.Sprintf("%.1f%%", share))
+		idx++
+	}
+
+	return idx
+}
+
+func populateCohortData(sheet string, report *excelize.File, details map[string]interface{}, idx int) {
+	styleSubtitle := getExcelStyle("subtitle", report)
+	styleValueExplain := getExcelStyle("valueExplain", report)
+	styleDefault := getExcelStyle("default", report)
+
+	// Flat text and styles
+	report.SetCellStyle(sheet, "B"+fmt.Sprintf("%d", idx), "B"+fmt.Sprintf("%d", idx), styleSubtitle)
+	report.SetCellValue(sheet, "B"+fmt.Sprintf("%d", idx), "Retention of users over the following weeks...")
+	idx++
+	report.MergeCell(sheet, "B"+fmt.Sprintf("%d", idx), "H"+fmt.Sprintf("%d", idx))
+	report.SetCellStyle(sheet, "B"+fmt.Sprintf("%d", idx), "B"+fmt.Sprintf("%d", idx), styleDefault)
+	report.SetCellValue(sheet, "B"+fmt.Sprintf("%d", idx), fmt.Sprintf(
+		"Cohort of %d impacted and %d unaffected users from the week starting %s.",
+		details["cohort_impacted_users"].(int), details["cohort_unaffected_users"].(int), details["cohort_start"].(string)))
+	idx += 2
+
+	// Table header
+	report.SetRowHeight(sheet, idx, 33.75)
+	report.SetCellStyle(sheet, "B"+fmt.Sprintf("%d", idx), "H"+fmt.Sprintf("%d", idx), styleValueExplain)
+	report.SetCellValue(sheet, "B"+fmt.Sprintf("%d", idx), "Week")
+	report.SetCellValue(sheet, "C"+fmt.Sprintf("%d", idx), "Impacted users returned")
+	report.SetCellValue(sheet, "D"+fmt.Sprintf("%d", idx), "Impacted users converted")
+	report.SetCellValue(sheet, "G"+fmt.Sprintf("%d", idx), "Unaffected users returned")
+	report.SetCellValue(sheet, "H"+fmt.Sprintf("%d", idx), "Unaffected users converted")
+	idx++
+
+	// Table rows
+	for _, r := range details["cohort_retention"].([]interface{}) {
+		row := r.([]interface{})
+		report.SetCellStyle(sheet, "B"+fmt.Sprintf("%d", idx), "H"+fmt.Sprintf("%d", idx), styleDefault)
+		report.SetCellValue(sheet, "B"+fmt.Sprintf("%d", idx), row[0].(string))
+		report.SetCellValue(sheet, "C"+fmt.Sprintf("%d", idx), fmt.Sprintf("%.1f%%", row[1].(float64)))
+		report.SetCellValue(sheet, "D"+fmt.Sprintf("%d", idx), fmt.Sprintf("%.1f%%", row[2].(float64)))
+		report.SetCellValue(sheet, "G"+fmt.Sprintf("%d", idx), fmt.Sprintf("%.1f%%", row[3].(float64)))
+		report.SetCellValue(sheet, "H"+fmt.Sprintf("%d", idx), fmt.Sprintf("%.1f%%", row[4].(float64)))
+		idx++
+	}
 }
 
 func addUserBreakdownChart(sheet string, report *excelize.File, data interface{}, posX string) {
-	chartData := data.([3]interface{})
+	chartData := data.([]interface{})
 	labels := []string{}
 	values := []string{}
 
+	// breakdowns of mobile and custom applications are per platform, not per browser channel
+	title := "Lost user breakdown per channel"
+	if len(chartData) > 0 && chartData[0].([]interface{})[0] == "iOS" {
+		title = "Lost user breakdown per platform"
+	}
+
 	for _, i := range chartData {
-		item := i.([2]interface{})
+		item := i.([]interface{})
 		labels = append(labels, item[0].(string))
 		values = append(values, fmt.Sprintf("%d", item[1].(int)))
 	}
@@ -413,7 +587,7 @@ func addUserBreakdownChart(sheet string, report *excelize.File, data interface{}
 			"position": "right"
 		},
 		"title": {
-			"name": "Lost user breakdown per channel"
+			"name": "`+title+`"
 		},
 		"plotarea": {
 			"show_bubble_size": true,
@@ -488,12 +662,12 @@ func addDailyBreakdownChart(sheet string, report *excelize.File, data interface{
 	}
 }
 
-func populateSummarySheet(sheet string, report *excelize.File, reportData map[string]map[string]interface{}, env environment.Environment, config config.Config) {
+func populateSummarySheet(sheet string, report *excelize.File, reportData map[string]map[string]interface{}, env environment.Environment, config config.Config,
+	partial bool) {
 	styleSubtitle := getExcelStyle("subtitle", report)
 	styleLogoBump := getExcelStyle("logoBump", report)
 	styleSubtitle2 := getExcelStyle("subtitle2", report)
 	styleSummaryDetail := getExcelStyle("summaryDetail", report)
-	styleSummaryMoney := getExcelStyle("summaryMoney", report)
 	styleLink := getExcelStyle("link", report)
 
 	// Layout
@@ -530,7 +704,7 @@ func populateSummarySheet(sheet string, report *excelize.File, reportData map[st
 	// Flat text
 	//report.SetCellValue(sheet, "E3", "error analyser")
 	report.SetCellValue(sheet, "B6", "Environment name")
-	report.SetCellValue(sheet, "D6", env.GetName())
+	report.SetCellValue(sheet, SummaryEnvironmentCell, env.GetName())
 	report.SetCellValue(sheet, "B7", "Environment URL")
 	report.SetCellValue(sheet, "D7", env.GetEnvironmentUrl())
 	report.SetCellValue(sheet, "B8", "Configuration")
@@ -538,24 +712,86 @@ func populateSummarySheet(sheet string, report *excelize.File, reportData map[st
 	report.SetCellValue(sheet, "B11", "Error name")
 	report.SetCellValue(sheet, "E11", "Monetary impact")
 
+	// Reports of interrupted runs only hold the errors analysed until the interruption
+	if partial {
+		report.SetCellValue(sheet, "B9", "Partial report")
+		report.SetCellStyle(sheet, "D9", "D9", styleSummaryDetail)
+		report.SetCellValue(sheet, "D9", "The analysis was interrupted, not all errors were analysed")
+	}
+
+	// The application dimension is only shown when errors impact more than one application
+	showApplications := false
+	for _, details := range reportData {
+		if breakdown, ok := details["application_breakdown"].([]interface{}); ok && len(breakdown) > 1 {
+			showApplications = true
+		}
+	}
+	if showApplications {
+		report.MergeCell(sheet, "H11", "J11")
+		report.SetCellStyle(sheet, "H11", "H11", styleSubtitle2)
+		report.SetCellValue(sheet, "H11", "Most impacted application")
+	}
+
 	// Errors analysed by monetary impact
-	errors := make(map[string]int)
+	// Errors are grouped by the error source they were read from, if there are several
+	errors := make(map[string]map[string]int)
 	for envErr, details := range reportData {
-		errors[envErr] = details["total_impact"].(int)
+		source, _ := details["error_source"].(string)
+		if errors[source] == nil {
+			errors[source] = make(map[string]int)
+		}
+		errors[source][envErr] = details["total_impact"].(int)
 	}
-	report.SetCellValue(sheet, "B10", fmt.Sprintf("%d", len(errors))+" errors analysed...")
-	i := 12
-	for _, k := range util.SortMapDesc(errors) {
-		idx := fmt.Sprintf("%d", i)
-		report.MergeCell(sheet, "B"+idx, "D"+idx)
-		report.MergeCell(sheet, "E"+idx, "G"+idx)
-		report.SetCellStyle(sheet, "B"+idx, "B"+idx, styleLink)
-		report.SetCellStyle(sheet, "E"+idx, "E"+idx, styleSummaryMoney)
-
-		report.SetCellValue(sheet, "B"+idx, k.Key)
-		report.SetCellHyperLink(sheet, "B"+idx, "'"+k.Key+"'!A1", "Location")
-		report.SetCellValue(sheet, "E"+idx, fmt.Sprintf("£%d", k.Value))
-
-		i++
+	sources := make([]string, 0, len(errors))
+	for source := range errors {
+		sources = append(sources, source)
 	}
+	sort.Strings(sources)
+
+	report.SetCellValue(sheet, "B10", fmt.Sprintf("%d", len(reportData))+" errors analysed...")
+	i := FirstSummaryRow
+	for _, source := range sources {
+		if len(sources) > 1 {
+			idx := fmt.Sprintf("%d", i)
+			report.MergeCell(sheet, SummaryNameColumn+idx, "D"+idx)
+			report.SetCellStyle(sheet, SummaryNameColumn+idx, SummaryNameColumn+idx, styleSummaryDetail)
+			report.SetCellValue(sheet, SummaryNameColumn+idx, source)
+			i++
+		}
+
+		for _, k := range util.SortMapDesc(errors[source]) {
+			i = populateSummaryRow(sheet, report, reportData, k, i, showApplications)
+		}
+	}
+}
+
+// populateSummaryRow adds the row of an error to the summary and returns the index of the next row
+func populateSummaryRow(sheet string, report *excelize.File, reportData map[string]map[string]interface{},
+	k util.Pair, i int, showApplications bool) int {
+	styleSummaryMoney := getExcelStyle("summaryMoney", report)
+	styleLink := getExcelStyle("link", report)
+
+	idx := fmt.Sprintf("%d", i)
+	report.MergeCell(sheet, SummaryNameColumn+idx, "D"+idx)
+	report.MergeCell(sheet, SummaryImpactColumn+idx, "G"+idx)
+	report.SetCellStyle(sheet, SummaryNameColumn+idx, SummaryNameColumn+idx, styleLink)
+	report.SetCellStyle(sheet, SummaryImpactColumn+idx, SummaryImpactColumn+idx, styleSummaryMoney)
+
+	if name, ok := reportData[k.Key]["error_name"].(string); ok {
+		report.SetCellValue(sheet, SummaryNameColumn+idx, name)
+	} else {
+		report.SetCellValue(sheet, SummaryNameColumn+idx, k.Key)
+	}
+	report.SetCellHyperLink(sheet, SummaryNameColumn+idx, "'"+k.Key+"'!A1", "Location")
+	report.SetCellValue(sheet, SummaryImpactColumn+idx, fmt.Sprintf(Currency+"%d", k.Value))
+
+	if showApplications {
+		if breakdown, ok := reportData[k.Key]["application_breakdown"].([]interface{}); ok && len(breakdown) > 0 {
+			report.MergeCell(sheet, "H"+idx, "J"+idx)
+			report.SetCellStyle(sheet, "H"+idx, "H"+idx, styleSummaryMoney)
+			report.SetCellValue(sheet, "H"+idx, breakdown[0].([]interface{})[0].(string))
+		}
+	}
+
+	return i + 1
 }
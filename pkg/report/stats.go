@@ -0,0 +1,408 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/config"
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/environment"
+	"github.com/spf13/afero"
+)
+
+const (
+	// StatsExtension is the extension of the stats files written next to reports
+	StatsExtension = ".stats.json"
+	// statsVersion is the version of the format of stats files
+	statsVersion = 1
+)
+
+// valueKeys are the keys of the use case values and their projections within the data of an error
+var valueKeys = []string{"lost_basket", "lost_money", "lost_money_14d", "lost_money_21d", "lost_money_28d",
+	"lost_agent_hours", "lost_agent_hours_14d", "lost_agent_hours_21d", "lost_agent_hours_28d",
+	"hours_lost_cost", "hours_lost_cost_14d", "hours_lost_cost_21d", "hours_lost_cost_28d",
+	"costs_incurred", "costs_incurred_14d", "costs_incurred_21d", "costs_incurred_28d", "total_impact"}
+
+// Stats are the statistics of the sessions analysed for a configuration in an environment, with the use case
+// values computed from them. They are written next to the report of the environment, so that the values can be
+// recomputed with other properties, and runs compared, without querying the environment again.
+type Stats struct {
+	Version       int                   `json:"version"`
+	AnalysedAt    time.Time             `json:"analysedAt"`
+	Partial       bool                  `json:"partial"`
+	Environment   StatsEnvironment      `json:"environment"`
+	Configuration StatsConfiguration    `json:"configuration"`
+	Errors        map[string]ErrorStats `json:"errors"`
+}
+
+// StatsEnvironment is the environment which sessions were analysed in
+type StatsEnvironment struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	Url  string `json:"url"`
+}
+
+// StatsConfiguration is the configuration which sessions were analysed with, as read from its config file
+type StatsConfiguration struct {
+	Id           string                 `json:"id"`
+	Name         string                 `json:"name"`
+	UseCases     []string               `json:"useCases"`
+	Properties   map[string]interface{} `json:"properties"`
+	Environments []string               `json:"environments"`
+}
+
+// ErrorStats are the statistics of the sessions which got an error
+type ErrorStats struct {
+	Name             string `json:"name"`
+	Source           string `json:"source,omitempty"`
+	ImpactedUsers    int    `json:"impactedUsers"`
+	UnconvertedUsers int    `json:"unconvertedUsers"`
+	LostUsers        int    `json:"lostUsers"`
+	SharedUsers      int    `json:"sharedUsers"`
+	// LostBaskets is the value of the baskets of lost users, before the multiplication factor
+	LostBaskets          float64            `json:"lostBaskets"`
+	UserBreakdown        []UserCount        `json:"userBreakdown"`
+	DateBreakdown        []UserCount        `json:"dateBreakdown"`
+	ApplicationBreakdown []ApplicationCount `json:"applicationBreakdown,omitempty"`
+	Cohort               *CohortStats       `json:"cohort,omitempty"`
+	// Values are the values of the use cases and their projections, by their keys within the data of the error
+	Values map[string]float64 `json:"values"`
+}
+
+// UserCount is the number of lost users within a breakdown
+type UserCount struct {
+	Label string `json:"label"`
+	Users int    `json:"users"`
+}
+
+// ApplicationCount is the number of impacted and lost users of an application
+type ApplicationCount struct {
+	Application   string `json:"application"`
+	ImpactedUsers int    `json:"impactedUsers"`
+	LostUsers     int    `json:"lostUsers"`
+}
+
+// CohortStats are the results of the cohort analysis of the users who got an error
+type CohortStats struct {
+	Start           string          `json:"start"`
+	ImpactedUsers   int             `json:"impactedUsers"`
+	UnaffectedUsers int             `json:"unaffectedUsers"`
+	Retention       []RetentionWeek `json:"retention"`
+}
+
+// RetentionWeek holds the percentages of impacted and unaffected users who were active and converted in a week
+type RetentionWeek struct {
+	Week                string  `json:"week"`
+	ImpactedActive      float64 `json:"impactedActive"`
+	ImpactedConverted   float64 `json:"impactedConverted"`
+	UnaffectedActive    float64 `json:"unaffectedActive"`
+	UnaffectedConverted float64 `json:"unaffectedConverted"`
+}
+
+// CreateStats writes the stats of the errors reported for a configuration in an environment next to its report
+func CreateStats(env environment.Environment, configuration config.Config, reportData map[string]map[string]interface{},
+	outputDir string, fs afero.Fs, partial bool, analysedAt time.Time) error {
+
+	details := config.ToMap(configuration)
+	stats := Stats{
+		Version:    statsVersion,
+		AnalysedAt: analysedAt.UTC(),
+		Partial:    partial,
+		Environment: StatsEnvironment{
+			Id:   env.GetId(),
+			Name: env.GetName(),
+			Url:  env.GetEnvironmentUrl(),
+		},
+		Configuration: StatsConfiguration{
+			Id:           configuration.GetId(),
+			Name:         configuration.GetName(),
+			Properties:   jsonValue(details["properties"]).(map[string]interface{}),
+			Environments: configuration.GetEnvironments(),
+		},
+		Errors: make(map[string]ErrorStats, len(reportData)),
+	}
+	for _, useCase := range configuration.GetUseCases() {
+		stats.Configuration.UseCases = append(stats.Configuration.UseCases, string(useCase))
+	}
+	for key, data := range reportData {
+		stats.Errors[key] = NewErrorStats(data)
+	}
+
+	body, err := json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := reportBasePath(env, configuration, outputDir, partial) + StatsExtension
+	if err := fs.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+	return afero.WriteFile(fs, path, body, 0644)
+}
+
+// ReadStats reads a stats file written next to a report
+func ReadStats(fs afero.Fs, path string) (Stats, error) {
+	var stats Stats
+	body, err := afero.ReadFile(fs, path)
+	if err != nil {
+		return stats, err
+	}
+	if err := json.Unmarshal(body, &stats); err != nil {
+		return stats, fmt.Errorf("%s is not a stats file: %w", path, err)
+	}
+	if stats.Version < 1 || stats.Version > statsVersion {
+		return stats, fmt.Errorf("%s has unsupported version %d, it was written by another version of derran", path,
+			stats.Version)
+	}
+	return stats, nil
+}
+
+// Supersedes tells whether the results of a configuration in an environment, analysed at a time and partial or not,
+// replace other results of the same configuration and environment. Later results replace earlier ones and, as a
+// resumed run keeps the time of the run it resumes, complete results replace partial ones analysed at the same time.
+func Supersedes(analysedAt time.Time, partial bool, otherAnalysedAt time.Time, otherPartial bool) bool {
+	if !analysedAt.Equal(otherAnalysedAt) {
+		return analysedAt.After(otherAnalysedAt)
+	}
+	return !partial || otherPartial
+}
+
+// FindStats returns the paths of the stats files within a directory and its subdirectories, sorted by path
+func FindStats(fs afero.Fs, dir string) ([]string, error) {
+	var paths []string
+	err := afero.Walk(fs, dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && strings.HasSuffix(info.Name(), StatsExtension) {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	sort.Strings(paths)
+	return paths, err
+}
+
+// Config creates the configuration which the sessions were analysed with
+func (s Stats) Config() (config.Config, error) {
+	useCases := make([]interface{}, 0, len(s.Configuration.UseCases))
+	for _, useCase := range s.Configuration.UseCases {
+		useCases = append(useCases, useCase)
+	}
+	environments := make([]interface{}, 0, len(s.Configuration.Environments))
+	for _, env := range s.Configuration.Environments {
+		environments = append(environments, env)
+	}
+	configs, errs := config.NewConfigurations(map[string]map[string]interface{}{
+		s.Configuration.Id: {
+			"name":         s.Configuration.Name,
+			"use_cases":    useCases,
+			"properties":   yamlValue(s.Configuration.Properties),
+			"environments": environments,
+		},
+	})
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+	return configs[s.Configuration.Id], nil
+}
+
+// Env creates the environment which the sessions were analysed in, without any credentials
+func (s Stats) Env() environment.Environment {
+	return environment.NewEnvironment(s.Environment.Id, s.Environment.Name, s.Environment.Url, "", "", "", "",
+		environment.RateLimit{}, "", environment.Auth{})
+}
+
+// NewErrorStats extracts the stats of an error from its data within a report
+func NewErrorStats(data map[string]interface{}) ErrorStats {
+	stats := ErrorStats{
+		Name:             toString(data["error_name"]),
+		Source:           toString(data["error_source"]),
+		ImpactedUsers:    toInt(data["impacted_users"]),
+		UnconvertedUsers: toInt(data["unconverted_users"]),
+		LostUsers:        toInt(data["lost_users"]),
+		SharedUsers:      toInt(data["shared_users"]),
+		LostBaskets:      toFloat(data["lost_baskets"]),
+		UserBreakdown:    toUserCounts(data["user_breakdown"]),
+		DateBreakdown:    toUserCounts(data["date_breakdown"]),
+		Values:           make(map[string]float64),
+	}
+
+	breakdown, _ := data["application_breakdown"].([]interface{})
+	for _, r := range breakdown {
+		row := r.([]interface{})
+		stats.ApplicationBreakdown = append(stats.ApplicationBreakdown, ApplicationCount{
+			Application:   toString(row[0]),
+			ImpactedUsers: toInt(row[1]),
+			LostUsers:     toInt(row[2]),
+		})
+	}
+
+	if retention, ok := data["cohort_retention"].([]interface{}); ok {
+		stats.Cohort = &CohortStats{
+			Start:           toString(data["cohort_start"]),
+			ImpactedUsers:   toInt(data["cohort_impacted_users"]),
+			UnaffectedUsers: toInt(data["cohort_unaffected_users"]),
+		}
+		for _, r := range retention {
+			row := r.([]interface{})
+			stats.Cohort.Retention = append(stats.Cohort.Retention, RetentionWeek{
+				Week:                toString(row[0]),
+				ImpactedActive:      toFloat(row[1]),
+				ImpactedConverted:   toFloat(row[2]),
+				UnaffectedActive:    toFloat(row[3]),
+				UnaffectedConverted: toFloat(row[4]),
+			})
+		}
+	}
+
+	for _, key := range valueKeys {
+		if _, ok := data[key]; ok {
+			stats.Values[key] = toFloat(data[key])
+		}
+	}
+
+	return stats
+}
+
+// Data returns the data of the error within a report, without the values of the use cases
+func (e ErrorStats) Data() map[string]interface{} {
+	data := map[string]interface{}{
+		"error_name":        e.Name,
+		"error_source":      e.Source,
+		"impacted_users":    e.ImpactedUsers,
+		"unconverted_users": e.UnconvertedUsers,
+		"lost_users":        e.LostUsers,
+		"shared_users":      e.SharedUsers,
+		"lost_baskets":      e.LostBaskets,
+		"user_breakdown":    fromUserCounts(e.UserBreakdown),
+		"date_breakdown":    fromUserCounts(e.DateBreakdown),
+	}
+
+	var breakdown []interface{}
+	for _, count := range e.ApplicationBreakdown {
+		breakdown = append(breakdown, []interface{}{count.Application, count.ImpactedUsers, count.LostUsers})
+	}
+	data["application_breakdown"] = breakdown
+
+	if e.Cohort != nil {
+		var retention []interface{}
+		for _, week := range e.Cohort.Retention {
+			retention = append(retention, []interface{}{week.Week, week.ImpactedActive, week.ImpactedConverted,
+				week.UnaffectedActive, week.UnaffectedConverted})
+		}
+		data["cohort_start"] = e.Cohort.Start
+		data["cohort_impacted_users"] = e.Cohort.ImpactedUsers
+		data["cohort_unaffected_users"] = e.Cohort.UnaffectedUsers
+		data["cohort_retention"] = retention
+	}
+
+	return data
+}
+
+func toUserCounts(value interface{}) []UserCount {
+	rows, _ := value.([]interface{})
+	counts := make([]UserCount, 0, len(rows))
+	for _, r := range rows {
+		row := r.([]interface{})
+		counts = append(counts, UserCount{Label: toString(row[0]), Users: toInt(row[1])})
+	}
+	return counts
+}
+
+func fromUserCounts(counts []UserCount) []interface{} {
+	var rows []interface{}
+	for _, count := range counts {
+		rows = append(rows, []interface{}{count.Label, count.Users})
+	}
+	return rows
+}
+
+func toString(value interface{}) string {
+	s, _ := value.(string)
+	return s
+}
+
+func toInt(value interface{}) int {
+	switch v := value.(type) {
+	case int:
+		return v
+	case float64:
+		return int(v)
+	default:
+		return 0
+	}
+}
+
+func toFloat(value interface{}) float64 {
+	switch v := value.(type) {
+	case int:
+		return float64(v)
+	case float64:
+		return v
+	default:
+		return 0
+	}
+}
+
+// jsonValue converts a value unmarshalled from YAML, whose maps are keyed by interface{}, so that it can be
+// marshalled to JSON
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			m[fmt.Sprintf("%v", key)] = jsonValue(item)
+		}
+		return m
+	case []interface{}:
+		list := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			list = append(list, jsonValue(item))
+		}
+		return list
+	default:
+		return v
+	}
+}
+
+// yamlValue converts a value unmarshalled from JSON back to the types it has when unmarshalled from YAML
+func yamlValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		m := make(map[interface{}]interface{}, len(v))
+		for key, item := range v {
+			m[key] = yamlValue(item)
+		}
+		return m
+	case []interface{}:
+		list := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			list = append(list, yamlValue(item))
+		}
+		return list
+	default:
+		return v
+	}
+}
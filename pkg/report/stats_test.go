@@ -0,0 +1,55 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+package report
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSupersedes(t *testing.T) {
+	earlier := time.Date(2021, 10, 18, 12, 0, 0, 0, time.UTC)
+	later := earlier.Add(time.Hour)
+
+	tests := []struct {
+		name         string
+		analysedAt   time.Time
+		partial      bool
+		otherAt      time.Time
+		otherPartial bool
+		want         bool
+	}{
+		{"later complete over earlier complete", later, false, earlier, false, true},
+		{"earlier complete under later complete", earlier, false, later, false, false},
+		{"later partial over earlier complete", later, true, earlier, false, true},
+		{"earlier complete under later partial", earlier, false, later, true, false},
+		{"complete over partial of the same time", earlier, false, earlier, true, true},
+		{"partial under complete of the same time", earlier, true, earlier, false, false},
+		{"complete over complete of the same time", earlier, false, earlier, false, true},
+		{"partial over partial of the same time", earlier, true, earlier, true, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := Supersedes(test.analysedAt, test.partial, test.otherAt, test.otherPartial); got != test.want {
+				t.Errorf("Supersedes() = %t, expected %t", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+package rest
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// usqlRowLimit is the most rows a USQL query returns
+	usqlRowLimit = 5000
+	// minQuerySlice is the shortest timeframe an ad-hoc query is split into
+	minQuerySlice = time.Minute
+)
+
+// aggregationPattern matches queries which aggregate sessions, whose results can't be concatenated across slices
+var aggregationPattern = regexp.MustCompile(`(?i)\b(count|sum|avg|min|max|median|percentile|top|countDistinct|summarize)\s*\(|\bgroup\s+by\b|\bdistinct\b|\bsummarize\b|\bmakeTimeseries\b`)
+
+// QueryResult is the result of an ad-hoc query, shaped like a response of the USQL table API
+type QueryResult struct {
+	ColumnNames        []string        `json:"columnNames"`
+	Values             [][]interface{} `json:"values"`
+	ExtrapolationLevel float64         `json:"extrapolationLevel"`
+	// Slices is the number of timeframes the query was executed over
+	Slices int `json:"-"`
+	// Truncated tells whether some slice still returned as many rows as the query returns at most
+	Truncated bool `json:"-"`
+}
+
+// QueryRunner executes ad-hoc queries in the query language of an environment
+type QueryRunner interface {
+	// RunQuery executes a query over the given timeframe. With slicing, queries which don't aggregate sessions are
+	// executed again over both halves of the timeframe while their results are extrapolated or reach the most rows
+	// a query returns, and the rows of all slices are concatenated.
+	RunQuery(ctx context.Context, query string, from int64, to int64, slicing bool) (QueryResult, error)
+}
+
+// IsAggregation tells whether a query aggregates sessions, so that it isn't sliced
+func IsAggregation(query string) bool {
+	return aggregationPattern.MatchString(query)
+}
+
+func (d *dynatraceClientImpl) RunQuery(ctx context.Context, query string, from int64, to int64, slicing bool) (QueryResult, error) {
+	return runSliced(ctx, from, to, slicing && !IsAggregation(query), usqlRowLimit,
+		func(ctx context.Context, from int64, to int64) (QueryResult, error) {
+			table, err := d.queryTable(ctx, query, from, to)
+			if err != nil {
+				return QueryResult{}, err
+			}
+			return toQueryResult(table), nil
+		})
+}
+
+func (g *grailClient) RunQuery(ctx context.Context, query string, from int64, to int64, slicing bool) (QueryResult, error) {
+	return runSliced(ctx, from, to, slicing && !IsAggregation(query), grailRecordLimit,
+		func(ctx context.Context, from int64, to int64) (QueryResult, error) {
+			records, err := g.execute(ctx, query, from, to)
+			if err != nil {
+				return QueryResult{}, err
+			}
+			return recordsToQueryResult(records), nil
+		})
+}
+
+// runSliced executes a query over a timeframe and, with slicing, over both halves of the timeframe while its
+// results are extrapolated or reach the row limit, down to slices of minQuerySlice
+func runSliced(ctx context.Context, from int64, to int64, slicing bool, rowLimit int,
+	execute func(ctx context.Context, from int64, to int64) (QueryResult, error)) (QueryResult, error) {
+
+	result, err := execute(ctx, from, to)
+	if err != nil {
+		return QueryResult{}, err
+	}
+	result.Slices = 1
+	complete := result.ExtrapolationLevel <= 1 && len(result.Values) < rowLimit
+	if complete || !slicing || to-from <= minQuerySlice.Milliseconds() {
+		result.Truncated = len(result.Values) >= rowLimit
+		return result, nil
+	}
+
+	middle := from + (to-from)/2
+	first, err := runSliced(ctx, from, middle, slicing, rowLimit, execute)
+	if err != nil {
+		return QueryResult{}, err
+	}
+	second, err := runSliced(ctx, middle, to, slicing, rowLimit, execute)
+	if err != nil {
+		return QueryResult{}, err
+	}
+
+	columnNames := first.ColumnNames
+	if len(columnNames) == 0 {
+		columnNames = second.ColumnNames
+	}
+	return QueryResult{
+		ColumnNames:        columnNames,
+		Values:             append(first.Values, second.Values...),
+		ExtrapolationLevel: maxFloat(first.ExtrapolationLevel, second.ExtrapolationLevel),
+		Slices:             first.Slices + second.Slices,
+		Truncated:          first.Truncated || second.Truncated,
+	}, nil
+}
+
+// toQueryResult converts an unmarshalled response of the USQL table API
+func toQueryResult(table map[string]interface{}) QueryResult {
+	result := QueryResult{ExtrapolationLevel: 1}
+	if level, ok := table["extrapolationLevel"].(float64); ok {
+		result.ExtrapolationLevel = level
+	}
+	columnNames, _ := table["columnNames"].([]interface{})
+	for _, name := range columnNames {
+		result.ColumnNames = append(result.ColumnNames, toString(name))
+	}
+	values, _ := table["values"].([]interface{})
+	for _, value := range values {
+		row, _ := value.([]interface{})
+		result.Values = append(result.Values, row)
+	}
+	return result
+}
+
+// recordsToQueryResult converts the records of a DQL query to a table, with a column per field sorted by name as
+// records don't keep the order of their fields
+func recordsToQueryResult(records []map[string]interface{}) QueryResult {
+	seen := map[string]bool{}
+	var fields []string
+	for _, record := range records {
+		for field := range record {
+			if !seen[field] {
+				seen[field] = true
+				fields = append(fields, field)
+			}
+		}
+	}
+	sort.Strings(fields)
+
+	result := QueryResult{ColumnNames: fields, ExtrapolationLevel: 1}
+	for _, record := range records {
+		row := make([]interface{}, 0, len(fields))
+		for _, field := range fields {
+			row = append(row, record[field])
+		}
+		result.Values = append(result.Values, row)
+	}
+	return result
+}
+
+// toString formats a column name, which is a string unless the response is malformed
+func toString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return ""
+	}
+}
+
+func maxFloat(a float64, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
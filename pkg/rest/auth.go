@@ -0,0 +1,293 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/util"
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/version"
+)
+
+// DefaultSSOUrl is the token endpoint of the Dynatrace SSO, which OAuth2 clients fetch access tokens from
+const DefaultSSOUrl = "https://sso.dynatrace.com/sso/oauth2/token"
+
+// oauthRefreshMargin is the time before an access token expires at which it is refreshed, so that it doesn't
+// expire while a request is on its way
+const oauthRefreshMargin = time.Minute
+
+// oauthDefaultLifetime is the lifetime of access tokens which the SSO returns without telling when they expire
+const oauthDefaultLifetime = 5 * time.Minute
+
+// Authenticator adds the credentials of an environment to the requests sent to it. Authenticators are called
+// before every attempt of a request, and may be shared by several clients.
+type Authenticator interface {
+	// Authenticate adds credentials to the request
+	Authenticate(ctx context.Context, req *http.Request) error
+}
+
+// expiringAuthenticator is implemented by Authenticators whose credentials expire. Clients set the clock which
+// the credentials expire on, and drop the credentials a request was rejected with, so that the request is sent
+// once more with fresh ones.
+type expiringAuthenticator interface {
+	// useClock sets the clock which the expiry of credentials is checked on
+	useClock(clock util.TimelineProvider)
+	// invalidate drops the credentials the request was authenticated with, unless they were refreshed already
+	invalidate(req *http.Request)
+}
+
+// userAgent identifies derran to Dynatrace
+func userAgent() string {
+	return "Dynatrace Error Analyser/" + version.ErrorAnalyser + " " + (runtime.GOOS + " " + runtime.GOARCH)
+}
+
+type apiTokenAuthenticator struct {
+	token string
+}
+
+// NewApiTokenAuthenticator creates an Authenticator sending an API token in the Authorization header
+func NewApiTokenAuthenticator(token string) (Authenticator, error) {
+	if token == "" {
+		return nil, errors.New("no token")
+	}
+
+	if !isNewDynatraceTokenFormat(token) {
+		util.Log.Warn("You used an old token format. Please consider switching to the new 1.205+ token format.")
+		util.Log.Warn("More information: https://www.dynatrace.com/support/help/dynatrace-api/basics/dynatrace-api-authentication/#-dynatrace-version-1205--token-format")
+	}
+
+	return &apiTokenAuthenticator{token: token}, nil
+}
+
+func (a *apiTokenAuthenticator) Authenticate(_ context.Context, req *http.Request) error {
+	req.Header.Set("Authorization", "Api-Token "+a.token)
+	req.Header.Set("User-Agent", userAgent())
+	return nil
+}
+
+type missionControlAuthenticator struct {
+	token     string
+	userAgent string
+	cookie    string
+}
+
+// NewMissionControlAuthenticator creates an Authenticator for environments which are only reachable through
+// Mission Control. The API token is passed as query parameter, along with the user agent and cookie of
+// a Mission Control session.
+func NewMissionControlAuthenticator(token, mcUA, mcCookie string) (Authenticator, error) {
+	if token == "" {
+		return nil, errors.New("no token")
+	}
+	if mcUA == "" || mcCookie == "" {
+		return nil, errors.New("mission control requires both a user agent and a cookie")
+	}
+
+	return &missionControlAuthenticator{token: token, userAgent: mcUA, cookie: mcCookie}, nil
+}
+
+func (a *missionControlAuthenticator) Authenticate(_ context.Context, req *http.Request) error {
+	params := req.URL.Query()
+	params.Set("Api-Token", a.token)
+	req.URL.RawQuery = params.Encode()
+
+	req.Header.Set("User-Agent", a.userAgent)
+	req.Header.Set("Cookie", a.cookie)
+	return nil
+}
+
+type platformTokenAuthenticator struct {
+	token string
+}
+
+// NewPlatformTokenAuthenticator creates an Authenticator sending a platform token as bearer token
+func NewPlatformTokenAuthenticator(token string) (Authenticator, error) {
+	if token == "" {
+		return nil, errors.New("no token")
+	}
+
+	return &platformTokenAuthenticator{token: token}, nil
+}
+
+func (a *platformTokenAuthenticator) Authenticate(_ context.Context, req *http.Request) error {
+	req.Header.Set("Authorization", "Bearer "+a.token)
+	req.Header.Set("User-Agent", userAgent())
+	return nil
+}
+
+// OAuthClient holds the credentials of an OAuth2 client
+type OAuthClient struct {
+	// SSOUrl is the token endpoint, DefaultSSOUrl if empty
+	SSOUrl string
+	// ClientId and ClientSecret identify the client
+	ClientId     string
+	ClientSecret string
+	// Scope is the space separated list of scopes requested for access tokens
+	Scope string
+	// Resource is the account or environment access tokens are requested for, e.g. urn:dtaccount:<uuid>,
+	// if required by the SSO
+	Resource string
+}
+
+type oauthAuthenticator struct {
+	mutex       sync.Mutex
+	client      *http.Client
+	clock       util.TimelineProvider
+	credentials OAuthClient
+	accessToken string
+	expiry      time.Time
+}
+
+// NewOAuthAuthenticator creates an Authenticator which fetches access tokens with the OAuth2 client credentials
+// flow and sends them as bearer tokens. Access tokens are cached until shortly before they expire, or until a
+// request is rejected with them, and then fetched again.
+func NewOAuthAuthenticator(credentials OAuthClient) (Authenticator, error) {
+	if credentials.ClientId == "" || credentials.ClientSecret == "" {
+		return nil, errors.New("oauth requires a client id and a client secret")
+	}
+	if credentials.SSOUrl == "" {
+		credentials.SSOUrl = DefaultSSOUrl
+	}
+	if err := checkEnvironmentUrl(credentials.SSOUrl); err != nil {
+		return nil, errors.New("sso url " + credentials.SSOUrl + " was not valid")
+	}
+
+	return &oauthAuthenticator{
+		client:      &http.Client{Timeout: 30 * time.Second},
+		clock:       util.NewTimelineProvider(),
+		credentials: credentials,
+	}, nil
+}
+
+func (a *oauthAuthenticator) Authenticate(ctx context.Context, req *http.Request) error {
+	token, err := a.token(ctx)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("User-Agent", userAgent())
+	return nil
+}
+
+// token returns the cached access token, fetching a new one if it is missing or about to expire. Requests
+// waiting for a token share the one fetched.
+func (a *oauthAuthenticator) token(ctx context.Context) (string, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.accessToken != "" && a.clock.Now().Add(oauthRefreshMargin).Before(a.expiry) {
+		return a.accessToken, nil
+	}
+
+	util.Log.Debug("Fetching OAuth access token from %s", a.credentials.SSOUrl)
+	token, expiresIn, err := a.fetch(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	a.accessToken = token
+	a.expiry = a.clock.Now().Add(expiresIn)
+	return token, nil
+}
+
+func (a *oauthAuthenticator) useClock(clock util.TimelineProvider) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.clock = clock
+}
+
+func (a *oauthAuthenticator) invalidate(req *http.Request) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	// requests rejected with a token which was refreshed meanwhile are sent with the new one
+	if a.accessToken != "" && req.Header.Get("Authorization") == "Bearer "+a.accessToken {
+		a.accessToken = ""
+	}
+}
+
+// fetch requests an access token from the SSO with the client credentials grant
+func (a *oauthAuthenticator) fetch(ctx context.Context) (token string, expiresIn time.Duration, err error) {
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", a.credentials.ClientId)
+	form.Set("client_secret", a.credentials.ClientSecret)
+	if a.credentials.Scope != "" {
+		form.Set("scope", a.credentials.Scope)
+	}
+	if a.credentials.Resource != "" {
+		form.Set("resource", a.credentials.Resource)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.credentials.SSOUrl, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", userAgent())
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", 0, ctx.Err()
+		}
+		return "", 0, &NetworkError{Err: err}
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", 0, &NetworkError{Err: err}
+	}
+
+	var result struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int64  `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	parseErr := json.Unmarshal(body, &result)
+
+	switch {
+	case resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnauthorized:
+		// the SSO responds with the errors of RFC 6749, e.g. invalid_client for wrong credentials
+		message := errorMessage(body)
+		if result.Error != "" {
+			message = strings.TrimSpace(result.Error + ": " + result.ErrorDescription)
+		}
+		return "", 0, &AuthenticationError{Message: "failed to fetch oauth access token, " + message}
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return "", 0, checkResponse(Response{StatusCode: resp.StatusCode, Body: body, Headers: resp.Header})
+	case parseErr != nil || result.AccessToken == "":
+		return "", 0, &AuthenticationError{Message: "the sso responded without an oauth access token"}
+	}
+
+	if result.ExpiresIn <= 0 {
+		return result.AccessToken, oauthDefaultLifetime, nil
+	}
+	return result.AccessToken, time.Duration(result.ExpiresIn) * time.Second, nil
+}
@@ -0,0 +1,210 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+package rest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ssoServer is a fake SSO which issues numbered access tokens with the given lifetime, or none if it is 0
+type ssoServer struct {
+	*httptest.Server
+	expiresIn int
+
+	mutex   sync.Mutex
+	fetched int
+	forms   []map[string]string
+}
+
+func newSSOServer(t *testing.T, expiresIn int) *ssoServer {
+	sso := &ssoServer{expiresIn: expiresIn}
+	sso.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Error(err)
+		}
+		if r.PostForm.Get("client_secret") != "secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"invalid_client","error_description":"wrong client secret"}`)
+			return
+		}
+
+		sso.mutex.Lock()
+		sso.fetched++
+		token := fmt.Sprintf("token-%d", sso.fetched)
+		sso.forms = append(sso.forms, map[string]string{
+			"grant_type": r.PostForm.Get("grant_type"),
+			"client_id":  r.PostForm.Get("client_id"),
+			"scope":      r.PostForm.Get("scope"),
+		})
+		sso.mutex.Unlock()
+
+		if sso.expiresIn > 0 {
+			fmt.Fprintf(w, `{"access_token":%q,"expires_in":%d}`, token, sso.expiresIn)
+		} else {
+			fmt.Fprintf(w, `{"access_token":%q}`, token)
+		}
+	}))
+	t.Cleanup(sso.Close)
+	return sso
+}
+
+func (s *ssoServer) fetches() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.fetched
+}
+
+// newTestOAuthAuthenticator creates an OAuth authenticator fetching tokens from the SSO, on the given clock
+func newTestOAuthAuthenticator(t *testing.T, sso *ssoServer, secret string, clock *fakeTimeline) *oauthAuthenticator {
+	auth, err := NewOAuthAuthenticator(OAuthClient{SSOUrl: sso.URL, ClientId: "client", ClientSecret: secret, Scope: "storage:buckets:read"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	oauth := auth.(*oauthAuthenticator)
+	oauth.useClock(clock)
+	return oauth
+}
+
+// bearer authenticates a request and returns its bearer token
+func bearer(t *testing.T, auth Authenticator) string {
+	req, err := http.NewRequest(http.MethodGet, "http://127.0.0.1/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := auth.Authenticate(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	return req.Header.Get("Authorization")
+}
+
+func TestOAuthFetchesToken(t *testing.T) {
+	sso := newSSOServer(t, 300)
+	auth := newTestOAuthAuthenticator(t, sso, "secret", newFakeTimeline())
+
+	if token := bearer(t, auth); token != "Bearer token-1" {
+		t.Errorf("request authenticated with %q, expected Bearer token-1", token)
+	}
+	expected := map[string]string{"grant_type": "client_credentials", "client_id": "client", "scope": "storage:buckets:read"}
+	if len(sso.forms) != 1 || fmt.Sprint(sso.forms[0]) != fmt.Sprint(expected) {
+		t.Errorf("sso was sent %v, expected %v", sso.forms, expected)
+	}
+}
+
+func TestOAuthRejectedCredentials(t *testing.T) {
+	sso := newSSOServer(t, 300)
+	auth := newTestOAuthAuthenticator(t, sso, "wrong", newFakeTimeline())
+
+	req, err := http.NewRequest(http.MethodGet, "http://127.0.0.1/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = auth.Authenticate(context.Background(), req)
+	var authErr *AuthenticationError
+	if !errors.As(err, &authErr) {
+		t.Fatalf("expected an AuthenticationError, got %v", err)
+	}
+}
+
+func TestOAuthCachesAndRefreshesTokens(t *testing.T) {
+	tests := []struct {
+		name      string
+		expiresIn int
+		lifetime  time.Duration
+	}{
+		{name: "lifetime of the sso", expiresIn: 600, lifetime: 10 * time.Minute},
+		{name: "default lifetime", expiresIn: 0, lifetime: oauthDefaultLifetime},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sso := newSSOServer(t, test.expiresIn)
+			clock := newFakeTimeline()
+			auth := newTestOAuthAuthenticator(t, sso, "secret", clock)
+
+			bearer(t, auth)
+			clock.advance(test.lifetime - oauthRefreshMargin - time.Second)
+			if token := bearer(t, auth); token != "Bearer token-1" || sso.fetches() != 1 {
+				t.Errorf("request authenticated with %q after %d fetches, expected the cached token-1", token, sso.fetches())
+			}
+
+			clock.advance(2 * time.Second)
+			if token := bearer(t, auth); token != "Bearer token-2" || sso.fetches() != 2 {
+				t.Errorf("request authenticated with %q after %d fetches, expected the refreshed token-2", token, sso.fetches())
+			}
+		})
+	}
+}
+
+func TestOAuthRefetchesRejectedToken(t *testing.T) {
+	tests := []struct {
+		name        string
+		rejected    map[string]bool
+		wantErr     bool
+		wantFetches int
+	}{
+		{name: "accepted", rejected: map[string]bool{}, wantFetches: 1},
+		{name: "revoked token", rejected: map[string]bool{"Bearer token-1": true}, wantFetches: 2},
+		{name: "all tokens rejected", rejected: map[string]bool{"Bearer token-1": true, "Bearer token-2": true}, wantErr: true,
+			wantFetches: 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sso := newSSOServer(t, 300)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if test.rejected[r.Header.Get("Authorization")] {
+					w.WriteHeader(http.StatusUnauthorized)
+					fmt.Fprint(w, `{"error":{"code":401,"message":"Token is expired"}}`)
+					return
+				}
+				fmt.Fprint(w, `{"columnNames":["count(*)"],"values":[[1]],"extrapolationLevel":1}`)
+			}))
+			defer server.Close()
+
+			clock := newFakeTimeline()
+			auth := newTestOAuthAuthenticator(t, sso, "secret", newFakeTimeline())
+			client, err := NewDynatraceClient(server.URL, auth, WithClock(clock))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if auth.clock != clock {
+				t.Error("the authenticator doesn't check the expiry of tokens on the clock of the client")
+			}
+
+			_, err = client.(*dynatraceClientImpl).queryTable(context.Background(), "SELECT count(*) FROM usersession", 0, 1)
+			var authErr *AuthenticationError
+			if test.wantErr && !errors.As(err, &authErr) {
+				t.Errorf("expected an AuthenticationError, got %v", err)
+			}
+			if !test.wantErr && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if sso.fetches() != test.wantFetches {
+				t.Errorf("fetched %d tokens, expected %d", sso.fetches(), test.wantFetches)
+			}
+		})
+	}
+}
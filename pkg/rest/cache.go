@@ -0,0 +1,155 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+package rest
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/util"
+	"github.com/spf13/afero"
+)
+
+// DefaultCacheTTL is how long cached query responses are reused unless specified otherwise
+const DefaultCacheTTL = 24 * time.Hour
+
+// QueryCache stores the responses of USQL queries on disk, so that re-running an analysis doesn't repeat
+// every query against the environment. Responses are keyed by the environment URL, the query and the
+// timeframe relative to the current time (e.g. the last 7 days), and are reused until they expire. Tokens
+// are neither part of the keys nor of the cached files. A cache may be shared by several clients.
+type QueryCache interface {
+	// Stats returns the number of cache hits and misses so far
+	Stats() (hits int, misses int)
+
+	get(environmentUrl string, query string, from int64, to int64, now int64) (body []byte, ok bool)
+	put(environmentUrl string, query string, from int64, to int64, now int64, body []byte) error
+}
+
+type queryCacheImpl struct {
+	mutex   sync.Mutex
+	fs      afero.Fs
+	dir     string
+	ttl     time.Duration
+	refresh bool
+	hits    int
+	misses  int
+}
+
+// cacheEntry is the content of a cached file
+type cacheEntry struct {
+	Environment string          `json:"environment"`
+	Query       string          `json:"query"`
+	From        int64           `json:"from"`
+	To          int64           `json:"to"`
+	Created     time.Time       `json:"created"`
+	Response    json.RawMessage `json:"response"`
+}
+
+// NewQueryCache creates a QueryCache storing responses in the given directory for the given TTL. When refreshing,
+// cached responses are not reused, but replaced by the new responses.
+func NewQueryCache(fs afero.Fs, dir string, ttl time.Duration, refresh bool) (QueryCache, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("no cache directory provided")
+	}
+	if ttl <= 0 {
+		return nil, fmt.Errorf("cache TTL must be positive, got %s", ttl)
+	}
+	if err := fs.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory %s: %w", dir, err)
+	}
+
+	return &queryCacheImpl{
+		fs:      fs,
+		dir:     dir,
+		ttl:     ttl,
+		refresh: refresh,
+	}, nil
+}
+
+func (c *queryCacheImpl) Stats() (hits int, misses int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.hits, c.misses
+}
+
+func (c *queryCacheImpl) get(environmentUrl string, query string, from int64, to int64, now int64) (body []byte, ok bool) {
+	path := c.path(environmentUrl, query, from, to, now)
+
+	if !c.refresh {
+		if data, err := afero.ReadFile(c.fs, path); err == nil {
+			var entry cacheEntry
+			if err := json.Unmarshal(data, &entry); err == nil {
+				age := time.Since(entry.Created)
+				if age < c.ttl {
+					c.count(true)
+					util.Log.Debug("Cache hit (%s old) for query: %s", age.Round(time.Second), query)
+					return entry.Response, true
+				}
+			}
+		}
+	}
+
+	c.count(false)
+	util.Log.Debug("Cache miss for query: %s", query)
+	return nil, false
+}
+
+func (c *queryCacheImpl) put(environmentUrl string, query string, from int64, to int64, now int64, body []byte) error {
+	data, err := json.Marshal(cacheEntry{
+		Environment: environmentUrl,
+		Query:       query,
+		From:        from,
+		To:          to,
+		Created:     time.Now(),
+		Response:    body,
+	})
+	if err != nil {
+		return err
+	}
+
+	// written to a temporary file first, so that parallel readers never see a partially written entry
+	path := c.path(environmentUrl, query, from, to, now)
+	if err := afero.WriteFile(c.fs, path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return c.fs.Rename(path+".tmp", path)
+}
+
+func (c *queryCacheImpl) count(hit bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if hit {
+		c.hits++
+	} else {
+		c.misses++
+	}
+}
+
+// path returns the file of a query's cached response. The timeframe is made relative to the current time, so
+// that runs shortly after one another share their cached responses.
+func (c *queryCacheImpl) path(environmentUrl string, query string, from int64, to int64, now int64) string {
+	key := fmt.Sprintf("%s\n%s\n%d\n%d", environmentUrl, query, now-from, now-to)
+	return filepath.Join(c.dir, fmt.Sprintf("%x.json", sha256.Sum256([]byte(key))))
+}
@@ -19,255 +19,471 @@
 package rest
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"math"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/config"
 	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/util"
 )
 
+// DynatraceClient retrieves the data for error analysis from a Dynatrace environment. All requests are
+// cancelled once the given context is done.
 type DynatraceClient interface {
-	// Retrieves a list of error names as captured by the string property referenced in config.yaml
-	FetchErrors(config config.Config) (environmentErrors []string, err error)
+	// Retrieves a list of errors as captured by the error sources referenced in config.yaml
+	FetchErrors(ctx context.Context, config config.Config) (environmentErrors []EnvironmentError, err error)
 
 	// Retrieves user session data for sessions that encountered given error
-	FetchSessionsByError(config config.Config, envErr string) (sessions []interface{}, err error)
+	FetchSessionsByError(ctx context.Context, config config.Config, envErr EnvironmentError) (sessions []interface{}, err error)
+
+	// Retrieves the IDs of users active within the given timeframe, mapped as "active", "converted" and,
+	// if an error is given, "impacted"
+	FetchUserActivity(ctx context.Context, config config.Config, envErr EnvironmentError, from int64, to int64) (activity map[string][]string, err error)
+}
+
+// EnvironmentError is an error found in a Dynatrace environment
+type EnvironmentError struct {
+	// Name is the title of the error
+	Name string
+	// Source is the error property, or the type of error source, that the error was read from
+	Source string
+	// Label groups the errors of the same source in reports
+	Label string
+	// Order is the position of the error's source among the sources referenced in config.yaml. Lost
+	// sessions which hit errors from several sources are attributed to the source listed first.
+	Order int
 }
 
 type dynatraceClientImpl struct {
+	clientSettings
 	environmentUrl string
-	token          string
-	mcUserAgent    string
-	mcCookie       string
-	client         *http.Client
+	auth           Authenticator
+}
+
+// clientSettings are the settings shared by the clients of all data sources
+type clientSettings struct {
+	client      *http.Client
+	retry       retryPolicy
+	rateLimiter RateLimitStrategy
+	timeline    util.TimelineProvider
+	// clock paces and retries requests and polls for the results of queries, unlike the timeline it always runs with
+	// the current time
+	clock util.TimelineProvider
+	cache QueryCache
+}
+
+// newClientSettings creates the default settings, changed by the given options
+func newClientSettings(options []ClientOption) clientSettings {
+	settings := clientSettings{
+		client:      &http.Client{Timeout: DefaultRequestTimeout},
+		retry:       newRetryPolicy(DefaultRetries),
+		rateLimiter: createRateLimitStrategy(SleepRateLimitStrategy, 0),
+		timeline:    util.NewTimelineProvider(),
+		clock:       util.NewTimelineProvider(),
+	}
+	for _, option := range options {
+		option(&settings)
+	}
+	settings.retry.timelineProvider = settings.clock
+
+	return settings
+}
+
+// ClientOption configures optional behaviour of a DynatraceClient
+type ClientOption func(s *clientSettings)
+
+// WithRetries sets the number of times a request failing with a transient error is retried
+func WithRetries(retries int) ClientOption {
+	return func(s *clientSettings) {
+		s.retry = newRetryPolicy(retries)
+	}
+}
+
+// WithRequestTimeout sets the time limit for a single request, after which it fails with a NetworkError
+func WithRequestTimeout(timeout time.Duration) ClientOption {
+	return func(s *clientSettings) {
+		s.client.Timeout = timeout
+	}
+}
+
+// WithTimelineProvider sets the TimelineProvider which the timeframes of queries are computed from. A provider
+// with a fixed current time makes all queries of a run cover the same timeframe.
+func WithTimelineProvider(timeline util.TimelineProvider) ClientOption {
+	return func(s *clientSettings) {
+		s.timeline = timeline
+	}
+}
+
+// WithClock sets the TimelineProvider which requests wait on for the rate limit and before being retried, and which
+// running queries are polled on. Unlike the TimelineProvider of queries, whose current time may be fixed for a
+// run, its current time has to advance.
+func WithClock(clock util.TimelineProvider) ClientOption {
+	return func(s *clientSettings) {
+		s.clock = clock
+	}
+}
+
+// WithQueryCache sets the cache which query responses are read from and stored in
+func WithQueryCache(cache QueryCache) ClientOption {
+	return func(s *clientSettings) {
+		s.cache = cache
+	}
+}
+
+// WithRateLimitStrategy sets the strategy used to stay within the rate limit of the environment
+func WithRateLimitStrategy(strategy RateLimitStrategy) ClientOption {
+	return func(s *clientSettings) {
+		s.rateLimiter = strategy
+	}
+}
+
+// WithFixtures records the requests of the client and their responses, or replays them instead of sending the requests
+func WithFixtures(fixtures Fixtures) ClientOption {
+	return func(s *clientSettings) {
+		s.client.Transport = fixtures.transport(s.client.Transport)
+	}
 }
 
 const (
 	userSessionsTableAPI string = "/api/v1/userSessionQueryLanguage/table"
 )
 
-// NewDynatraceClient creates a new DynatraceClient
-func NewDynatraceClient(environmentUrl, token, mcUA, mcCookie string) (DynatraceClient, error) {
+// Timeframes, in days up to the current time, which errors are discovered in and sessions are analysed over
+const (
+	ErrorsTimeframeDays   = 1
+	SessionsTimeframeDays = 7
+)
+
+// DefaultRequestTimeout is the time limit for a single request unless specified otherwise
+const DefaultRequestTimeout = 2 * time.Minute
+
+// NewDynatraceClient creates a new DynatraceClient querying the USQL API, authenticating requests with
+// the given Authenticator
+func NewDynatraceClient(environmentUrl string, auth Authenticator, options ...ClientOption) (DynatraceClient, error) {
 
 	if environmentUrl == "" {
 		return nil, errors.New("no environment url")
 	}
 
-	if token == "" {
-		return nil, errors.New("no token")
-	}
-
-	parsedUrl, err := url.ParseRequestURI(environmentUrl)
-	if err != nil {
-		return nil, errors.New("environment url " + environmentUrl + " was not valid")
+	if auth == nil {
+		return nil, errors.New("no authenticator")
 	}
 
-	if parsedUrl.Scheme != "https" {
-		return nil, errors.New("environment url " + environmentUrl + " was not valid")
+	if err := checkEnvironmentUrl(environmentUrl); err != nil {
+		return nil, err
 	}
 
-	if !isNewDynatraceTokenFormat(token) {
-		util.Log.Warn("You used an old token format. Please consider switching to the new 1.205+ token format.")
-		util.Log.Warn("More information: https://www.dynatrace.com/support/help/dynatrace-api/basics/dynatrace-api-authentication/#-dynatrace-version-1205--token-format")
+	settings := newClientSettings(options)
+	if expiring, ok := auth.(expiringAuthenticator); ok {
+		expiring.useClock(settings.clock)
 	}
 
 	return &dynatraceClientImpl{
+		clientSettings: settings,
 		environmentUrl: environmentUrl,
-		token:          token,
-		mcUserAgent:    mcUA,
-		mcCookie:       mcCookie,
-		client:         &http.Client{},
+		auth:           auth,
 	}, nil
 }
 
-func isNewDynatraceTokenFormat(token string) bool {
-	return strings.HasPrefix(token, "dt0c01.") && strings.Count(token, ".") == 2
-}
+// checkEnvironmentUrl checks that the environment URL is valid. Plain HTTP is only accepted for local
+// environments, such as the fake server.
+func checkEnvironmentUrl(environmentUrl string) error {
+	parsedUrl, err := url.ParseRequestURI(environmentUrl)
+	if err != nil {
+		return errors.New("environment url " + environmentUrl + " was not valid")
+	}
 
-func (d *dynatraceClientImpl) FetchErrors(config config.Config) (environmentErrors []string, err error) {
-	application := fmt.Sprintf("%s", config.GetProperty("application"))
-	errorProp := fmt.Sprintf("%s", config.GetProperty("error_prop"))
+	if parsedUrl.Scheme != "https" && !(parsedUrl.Scheme == "http" && isLoopback(parsedUrl.Hostname())) {
+		return errors.New("environment url " + environmentUrl + " was not valid")
+	}
 
-	if application != "" {
-		application = "useraction.application IS \"" + application + "\" AND "
+	return nil
+}
+
+// isLoopback checks whether the host is the local machine
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
 	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
 
-	timer := util.NewTimelineProvider()
-	now := timer.NowMillis()
-	dayAgo := timer.GetDaysBeforeMillis(1)
+func isNewDynatraceTokenFormat(token string) bool {
+	return strings.HasPrefix(token, "dt0c01.") && strings.Count(token, ".") == 2
+}
 
-	query := "SELECT DISTINCT stringProperties." + errorProp + ", count(*) FROM usersession WHERE " + application + "stringProperties." + errorProp + " IS NOT NULL"
-	params := url.Values{}
-	params.Add("query", query)
-	params.Add("startTimestamp", fmt.Sprintf("%d", dayAgo))
-	params.Add("endTimestamp", fmt.Sprintf("%d", now))
-	params.Add("addDeepLinkFields", "false")
-	params.Add("explain", "false")
-	fullUrl := d.environmentUrl + userSessionsTableAPI + "?" + params.Encode()
-	fmt.Println(fullUrl)
+func (d *dynatraceClientImpl) FetchErrors(ctx context.Context, config config.Config) (environmentErrors []EnvironmentError, err error) {
+	now := d.timeline.NowMillis()
+	dayAgo := d.timeline.GetDaysBeforeMillis(ErrorsTimeframeDays)
 
-	response, err := get(d.client, fullUrl, d.token, d.mcUserAgent, d.mcCookie)
+	for order, source := range createErrorSources(config) {
+		query := discoveryQuery(config, source)
+		util.Log.Debug("\t\tDiscovering errors with query: %s", query)
 
-	if err != nil {
-		return nil, err
-	}
+		m, err := d.queryTable(ctx, query, dayAgo, now)
+		if err != nil {
+			return nil, err
+		}
 
-	var m map[string]interface{}
-	if err := json.Unmarshal(response.Body, &m); err != nil {
-		return nil, err
+		environmentErrors = append(environmentErrors, errorsFromTable(m, source, order)...)
 	}
 
-	values := m["values"].([]interface{})
+	return environmentErrors, nil
+}
 
-	for i := range values {
-		value := values[i].([]interface{})
-		// TODO: Remove this
-		// Added limit of 10 for testing purposes
-		if i == 10 {
-			break
-		}
-		errorName := value[0].(string)
-		errorCount := value[1].(float64)
+// errorsFromTable reads the errors out of the results of an error source's discovery query
+func errorsFromTable(table map[string]interface{}, source errorSource, order int) (environmentErrors []EnvironmentError) {
+	values, _ := table["values"].([]interface{})
 
-		if errorCount < 4000 {
-			environmentErrors = append(environmentErrors, errorName)
+	for _, row := range values {
+		value, _ := row.([]interface{})
+		if len(value) < 2 {
+			continue
+		}
+		errorName, _ := value[0].(string)
+		errorCount, _ := value[1].(float64)
+
+		if errorName != "" && errorCount < 4000 {
+			environmentErrors = append(environmentErrors, EnvironmentError{
+				Name:   errorName,
+				Source: source.key(),
+				Label:  source.label(),
+				Order:  order,
+			})
 		}
 	}
 
-	return environmentErrors, nil
+	return environmentErrors
 }
 
-func (d *dynatraceClientImpl) FetchSessionsByError(config config.Config,
-	envErr string) (sessions []interface{}, err error) {
-
-	application := config.GetProperty("application").(string)
-	errorProp := config.GetProperty("error_prop").(string)
-	conversion := config.GetProperty("conversion").(string)
+func (d *dynatraceClientImpl) FetchSessionsByError(ctx context.Context, config config.Config,
+	envErr EnvironmentError) (sessions []interface{}, err error) {
 
-	if application != "" {
-		application = "useraction.application IS \"" + application + "\" AND "
+	sources := createErrorSources(config)
+	source, err := findErrorSource(sources, envErr)
+	if err != nil {
+		return nil, err
 	}
 
-	timer := util.NewTimelineProvider()
-	now := timer.NowMillis()
-	sevenDaysAgo := timer.GetDaysBeforeMillis(7)
+	now := d.timeline.NowMillis()
+	sevenDaysAgo := d.timeline.GetDaysBeforeMillis(SessionsTimeframeDays)
 
-	query := "SELECT count(*) FROM usersession WHERE " + application + "useraction.name IS \"" + conversion + "\" OR stringProperties." + errorProp + " IS \"" + envErr + "\" LIMIT 5000"
-	params := url.Values{}
-	params.Add("query", query)
-	params.Add("startTimestamp", fmt.Sprintf("%d", sevenDaysAgo))
-	params.Add("endTimestamp", fmt.Sprintf("%d", now))
-	params.Add("addDeepLinkFields", "false")
-	params.Add("explain", "false")
-	fullUrl := d.environmentUrl + userSessionsTableAPI + "?" + params.Encode()
+	for _, applications := range applicationGroups(config) {
+		if len(applications) == 1 {
+			util.Log.Debug("\t\tFetching sessions of application %s", applications[0])
+		}
 
-	response, err := get(d.client, fullUrl, d.token, d.mcUserAgent, d.mcCookie)
+		query, countQuery := sessionsQueries(config, sources, source, applications, envErr.Name)
+		groupSessions, err := d.fetchSessions(ctx, query, countQuery, sevenDaysAgo, now)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkSessionWidth(query, groupSessions, util.SessionWidth(config.HasUseCase("lost_basket"), len(sources))); err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, groupSessions...)
+	}
+
+	return sessions, nil
+}
 
+// fetchSessions executes the given sessions query over the timeframe. The count query is run first and,
+// if the results would be extrapolated or exceed the query limit, the timeframe is split into smaller
+// slices which are queried one by one.
+func (d *dynatraceClientImpl) fetchSessions(ctx context.Context, query string, countQuery string, from int64,
+	to int64) (sessions []interface{}, err error) {
+
+	m, err := d.queryTable(ctx, countQuery, from, to)
 	if err != nil {
 		return nil, err
 	}
 
-	var m map[string]interface{}
-	if err := json.Unmarshal(response.Body, &m); err != nil {
+	extrapolation, _ := m["extrapolationLevel"].(float64)
+	count, err := countFromTable(countQuery, m)
+	if err != nil {
 		return nil, err
 	}
 
-	extrapolation := m["extrapolationLevel"].(float64)
-	values := m["values"].([]interface{})
-	count := int(values[0].([]interface{})[0].(float64))
-
 	util.Log.Debug(fmt.Sprintf("Extrapolation level: %.0f and %d sessions returned.", extrapolation, count))
 
-	if extrapolation > 1 || count > 4999 {
-		var numberOfQueriesEx int
-		var numberOfQueriesLen int
-		var numberOfQueries int
-
-		if extrapolation > 1 {
-			numberOfQueriesEx = int(extrapolation) / 2
-		}
-		if count > 4999 {
-			numberOfQueriesLen = int(math.Round(float64(count / 5000)))
-		}
-		numberOfQueries = int(math.Max(float64(numberOfQueriesEx), float64(numberOfQueriesLen)))
+	if numberOfQueries := SessionSlices(extrapolation, count); numberOfQueries > 1 {
 		util.Log.Info("Will split results in %d queries", numberOfQueries)
 
-		interval := (now - sevenDaysAgo) / int64(numberOfQueries)
+		interval := (to - from) / int64(numberOfQueries)
 
 		for i := 0; i < numberOfQueries; i++ {
-			startTime := sevenDaysAgo + int64(i)*interval
-			endTime := sevenDaysAgo + int64(i+1)*interval
-			var query string
-
-			if config.HasUseCase("lost_basket") {
-				basketProp := fmt.Sprintf("%s", config.GetProperty("basket_prop"))
-				query += "SELECT internalUserId, stringProperties." + errorProp + ", startTime, endTime, useraction.name, doubleProperties." + basketProp
-				query += ", browserType FROM usersession WHERE " + application + "useraction.name IS \"" + conversion + "\" OR stringProperties."
-				query += errorProp + " IS \"" + envErr + "\" LIMIT 5000"
-			} else {
-				query += "SELECT internalUserId, stringProperties." + errorProp + ", startTime, endTime, useraction.name, browserType FROM usersession WHERE "
-				query += application + "useraction.name IS \"" + conversion + "\" OR stringProperties." + errorProp + " IS \"" + envErr + "\" LIMIT 5000"
-			}
+			startTime := from + int64(i)*interval
+			endTime := from + int64(i+1)*interval
 
-			params := url.Values{}
-			params.Add("query", query)
-			params.Add("startTimestamp", fmt.Sprintf("%d", startTime))
-			params.Add("endTimestamp", fmt.Sprintf("%d", endTime))
-			params.Add("addDeepLinkFields", "false")
-			params.Add("explain", "false")
-			fullUrl = d.environmentUrl + userSessionsTableAPI + "?" + params.Encode()
-
-			response, err := get(d.client, fullUrl, d.token, d.mcUserAgent, d.mcCookie)
+			m, err := d.queryTable(ctx, query, startTime, endTime)
 			if err != nil {
 				return nil, err
 			}
-
-			var m map[string]interface{}
-			if err := json.Unmarshal(response.Body, &m); err != nil {
-				return nil, err
-			}
-			values := m["values"].([]interface{})
+			values, _ := m["values"].([]interface{})
 			sessions = append(sessions, values...)
 		}
 	} else {
-		var query string
-
-		if config.HasUseCase("lost_basket") {
-			basketProp := fmt.Sprintf("%s", config.GetProperty("basket_prop"))
-			query += "SELECT internalUserId, stringProperties." + errorProp + ", startTime, endTime, useraction.name, doubleProperties." + basketProp
-			query += ", browserType FROM usersession WHERE " + application + "useraction.name IS \"" + conversion + "\" OR stringProperties." + errorProp
-			query += " IS \"" + envErr + "\" LIMIT 5000"
-		} else {
-			query += "SELECT internalUserId, stringProperties." + errorProp + ", startTime, endTime, useraction.name, browserType FROM usersession WHERE "
-			query += application + "useraction.name IS \"" + conversion + "\" OR stringProperties." + errorProp + " IS \"" + envErr + "\" LIMIT 5000"
+		m, err := d.queryTable(ctx, query, from, to)
+		if err != nil {
+			return nil, err
 		}
+		values, _ := m["values"].([]interface{})
+		sessions = append(sessions, values...)
+	}
 
-		params := url.Values{}
-		params.Add("query", query)
-		params.Add("startTimestamp", fmt.Sprintf("%d", sevenDaysAgo))
-		params.Add("endTimestamp", fmt.Sprintf("%d", now))
-		params.Add("addDeepLinkFields", "false")
-		params.Add("explain", "false")
-		fullUrl = d.environmentUrl + userSessionsTableAPI + "?" + params.Encode()
+	return sessions, nil
+}
+
+// countFromTable returns the number in the first column of the first row of the results of a count query, or a
+// QueryError if the results hold none
+func countFromTable(query string, table map[string]interface{}) (int, error) {
+	values, _ := table["values"].([]interface{})
+	if len(values) == 0 {
+		return 0, &QueryError{Query: query, Message: "the count query returned no rows"}
+	}
+	row, _ := values[0].([]interface{})
+	if len(row) == 0 {
+		return 0, &QueryError{Query: query, Message: "the count query returned an empty row"}
+	}
+	count, ok := row[0].(float64)
+	if !ok {
+		return 0, &QueryError{Query: query, Message: fmt.Sprintf("the count query returned %v rather than a number", row[0])}
+	}
+	return int(count), nil
+}
+
+// checkSessionWidth makes sure that all sessions returned by a query are rows of at least the given number of
+// columns, so that they can be unpacked
+func checkSessionWidth(query string, sessions []interface{}, width int) error {
+	for _, session := range sessions {
+		if row, ok := session.([]interface{}); !ok || len(row) < width {
+			return &QueryError{Query: query, Message: fmt.Sprintf("the query returned a session of %d columns rather than %d",
+				len(row), width)}
+		}
+	}
+	return nil
+}
+
+// SessionSlices returns the number of equal slices the timeframe of a sessions query is split into, given the
+// extrapolation level and the number of sessions returned by its count query, so that the results of each slice
+// are neither extrapolated nor exceed the row limit of USQL
+func SessionSlices(extrapolation float64, count int) int {
+	var slicesEx, slicesLen int
+	if extrapolation > 1 {
+		slicesEx = int(extrapolation) / 2
+	}
+	if count >= usqlRowLimit {
+		slicesLen = count/usqlRowLimit + 1
+	}
+	return int(math.Max(1, math.Max(float64(slicesEx), float64(slicesLen))))
+}
 
-		response, err := get(d.client, fullUrl, d.token, d.mcUserAgent, d.mcCookie)
+func (d *dynatraceClientImpl) FetchUserActivity(ctx context.Context, config config.Config, envErr EnvironmentError, from int64,
+	to int64) (activity map[string][]string, err error) {
 
+	var errorCondition string
+	if envErr.Name != "" {
+		source, err := findErrorSource(createErrorSources(config), envErr)
 		if err != nil {
 			return nil, err
 		}
+		errorCondition = source.errorCondition(envErr.Name)
+	}
+	queries := userActivityQueries(config, errorCondition)
 
-		var m map[string]interface{}
-		if err := json.Unmarshal(response.Body, &m); err != nil {
+	activity = make(map[string][]string)
+	for key, query := range queries {
+		query := query
+		result, err := runSliced(ctx, from, to, true, usqlRowLimit, func(ctx context.Context, from int64, to int64) (QueryResult, error) {
+			table, err := d.queryTable(ctx, query, from, to)
+			if err != nil {
+				return QueryResult{}, err
+			}
+			return toQueryResult(table), nil
+		})
+		if err != nil {
 			return nil, err
 		}
-		values = m["values"].([]interface{})
-		sessions = append(sessions, values...)
+		activity[key] = distinctUsers(result, key)
 	}
 
-	return sessions, nil
+	return activity, nil
+}
+
+// distinctUsers returns the distinct user IDs in the first column of the sliced results of a user activity query,
+// as users active in several slices are returned by each of them. If a slice still reached the row limit, some
+// users are missing, which is logged as a warning.
+func distinctUsers(result QueryResult, activity string) []string {
+	if result.Truncated {
+		util.Log.Warn("Some slices of the query for %s users returned the maximum number of rows, the %s users are incomplete",
+			activity, activity)
+	}
+	if result.Slices > 1 {
+		util.Log.Debug("\t\tQueried %s users in %d slices", activity, result.Slices)
+	}
+
+	seen := make(map[string]bool)
+	users := []string{}
+	for _, row := range result.Values {
+		if len(row) == 0 {
+			continue
+		}
+		if userId, ok := row[0].(string); ok && !seen[userId] {
+			seen[userId] = true
+			users = append(users, userId)
+		}
+	}
+	return users
+}
+
+// queryTable executes a USQL query over the given timeframe and returns the unmarshalled table response
+func (d *dynatraceClientImpl) queryTable(ctx context.Context, query string, from int64, to int64) (table map[string]interface{}, err error) {
+	now := d.timeline.NowMillis()
+	if d.cache != nil {
+		if body, ok := d.cache.get(d.environmentUrl, query, from, to, now); ok {
+			if err := json.Unmarshal(body, &table); err == nil {
+				return table, nil
+			}
+		}
+	}
+
+	response, err := get(ctx, d.clientSettings, d.tableUrl(query, from, to, false), d.auth)
+	if queryErr, ok := err.(*QueryError); ok {
+		queryErr.Query = query
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(response.Body, &table); err != nil {
+		return nil, err
+	}
+
+	if d.cache != nil {
+		if err := d.cache.put(d.environmentUrl, query, from, to, now, response.Body); err != nil {
+			util.Log.Warn("Failed to cache response: %s", err)
+		}
+	}
+
+	return table, nil
+}
+
+// tableUrl returns the URL executing a USQL query over the given timeframe, optionally explaining the query plan
+func (d *dynatraceClientImpl) tableUrl(query string, from int64, to int64, explain bool) string {
+	params := url.Values{}
+	params.Add("query", query)
+	params.Add("startTimestamp", fmt.Sprintf("%d", from))
+	params.Add("endTimestamp", fmt.Sprintf("%d", to))
+	params.Add("addDeepLinkFields", "false")
+	params.Add("explain", fmt.Sprintf("%t", explain))
+	return d.environmentUrl + userSessionsTableAPI + "?" + params.Encode()
 }
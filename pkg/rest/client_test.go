@@ -0,0 +1,135 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+package rest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newTestClient returns a client of a server answering every request with the given body
+func newTestClient(t *testing.T, body string) *dynatraceClientImpl {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(server.Close)
+
+	auth, err := NewApiTokenAuthenticator("dt0c01.fake.token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewDynatraceClient(server.URL, auth, WithRetries(0), WithClock(newFakeTimeline()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client.(*dynatraceClientImpl)
+}
+
+func TestErrorsFromTableReadsAllErrors(t *testing.T) {
+	var values []interface{}
+	for i := 0; i < 25; i++ {
+		values = append(values, []interface{}{fmt.Sprintf("Error %d", i), float64(100 - i)})
+	}
+	// errors without a name, occurring too often or in rows of another shape are left out
+	values = append(values, []interface{}{"", 10.0}, []interface{}{"Frequent error", 5000.0}, []interface{}{"Short row"}, "not a row")
+
+	source := &sessionPropertyErrorSource{errorProp: "errormessage"}
+	environmentErrors := errorsFromTable(map[string]interface{}{"values": values}, source, 1)
+	if len(environmentErrors) != 25 {
+		t.Fatalf("read %d errors, expected 25", len(environmentErrors))
+	}
+	for i, envErr := range environmentErrors {
+		if envErr.Name != fmt.Sprintf("Error %d", i) || envErr.Source != "errormessage" || envErr.Order != 1 {
+			t.Errorf("error %d is %+v", i, envErr)
+		}
+	}
+}
+
+func TestFetchSessionsRejectsMalformedCounts(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"no values", `{"columnNames":["count(*)"],"extrapolationLevel":1}`},
+		{"no rows", `{"columnNames":["count(*)"],"values":[],"extrapolationLevel":1}`},
+		{"empty row", `{"columnNames":["count(*)"],"values":[[]],"extrapolationLevel":1}`},
+		{"row not a list", `{"columnNames":["count(*)"],"values":[42],"extrapolationLevel":1}`},
+		{"count not a number", `{"columnNames":["count(*)"],"values":[["many"]],"extrapolationLevel":1}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := newTestClient(t, test.body)
+
+			_, err := client.fetchSessions(context.Background(), "SELECT internalUserId FROM usersession",
+				"SELECT count(*) FROM usersession", 0, 1)
+			var queryErr *QueryError
+			if !errors.As(err, &queryErr) {
+				t.Fatalf("expected a QueryError, got %v", err)
+			}
+			if queryErr.Query != "SELECT count(*) FROM usersession" {
+				t.Errorf("QueryError names query %q, expected the count query", queryErr.Query)
+			}
+		})
+	}
+}
+
+func TestFetchSessionsWithoutExtrapolationLevel(t *testing.T) {
+	client := newTestClient(t, `{"columnNames":["count(*)"],"values":[[3]]}`)
+
+	sessions, err := client.fetchSessions(context.Background(), "SELECT internalUserId FROM usersession",
+		"SELECT count(*) FROM usersession", 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 {
+		t.Errorf("got %d rows, expected 1", len(sessions))
+	}
+}
+
+func TestCheckSessionWidth(t *testing.T) {
+	tests := []struct {
+		name     string
+		sessions []interface{}
+		wantErr  bool
+	}{
+		{"no sessions", nil, false},
+		{"exact width", []interface{}{[]interface{}{"user", 1.0, 2.0}}, false},
+		{"wider", []interface{}{[]interface{}{"user", 1.0, 2.0, "extra"}}, false},
+		{"narrower", []interface{}{[]interface{}{"user", 1.0, 2.0}, []interface{}{"user", 1.0}}, true},
+		{"not a row", []interface{}{"user"}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkSessionWidth("SELECT", test.sessions, 3)
+			var queryErr *QueryError
+			if test.wantErr && !errors.As(err, &queryErr) {
+				t.Errorf("expected a QueryError, got %v", err)
+			}
+			if !test.wantErr && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
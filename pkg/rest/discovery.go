@@ -0,0 +1,133 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+package rest
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// DiscoverySampleLimit is the most sessions sampled for discovery
+const DiscoverySampleLimit = 5000
+
+// SessionSample is a session sampled for suggesting the values of configurations
+type SessionSample struct {
+	// Applications are the applications of the session's user actions
+	Applications []string
+	// Actions are the names of the session's user actions
+	Actions []string
+	// StringProperties are the string session properties, by key
+	StringProperties map[string]string
+	// DoubleProperties and LongProperties are the numeric session properties, by key. Grail doesn't tell
+	// doubles and longs apart, so all its numeric properties are doubles.
+	DoubleProperties map[string]float64
+	LongProperties   map[string]float64
+}
+
+// Discovery samples the sessions of an environment
+type Discovery interface {
+	// SampleSessions returns up to limit sessions of real users from the last days which are analysed, of the
+	// given applications or of all applications if none are given
+	SampleSessions(ctx context.Context, applications []string, limit int) ([]SessionSample, error)
+}
+
+func (d *dynatraceClientImpl) SampleSessions(ctx context.Context, applications []string, limit int) ([]SessionSample, error) {
+	query := "SELECT useraction.application, useraction.name, stringProperties, doubleProperties, longProperties FROM usersession" +
+		whereClause(applicationCondition(applications), "userType IS \"REAL_USER\"") + fmt.Sprintf(" LIMIT %d", limit)
+
+	table, err := d.queryTable(ctx, query, d.timeline.GetDaysBeforeMillis(SessionsTimeframeDays), d.timeline.NowMillis())
+	if err != nil {
+		return nil, err
+	}
+
+	var samples []SessionSample
+	for _, value := range table["values"].([]interface{}) {
+		row := value.([]interface{})
+		samples = append(samples, SessionSample{
+			Applications:     toStrings(row[0]),
+			Actions:          toStrings(row[1]),
+			StringProperties: toStringMap(row[2]),
+			DoubleProperties: toNumberMap(row[3]),
+			LongProperties:   toNumberMap(row[4]),
+		})
+	}
+
+	return samples, nil
+}
+
+func (g *grailClient) SampleSessions(ctx context.Context, applications []string, limit int) ([]SessionSample, error) {
+	fields := []string{GrailField("useraction.application"), GrailField("useraction.name"), "session_properties"}
+	query := dqlQuery(grailSessions, dqlFilter(dqlApplicationCondition(applications), GrailField("userType")+" == \"REAL_USER\""),
+		"fields "+strings.Join(fields, ", "), fmt.Sprintf("limit %d", limit))
+
+	table, err := g.query(ctx, query, fields, nil, g.timeline.GetDaysBeforeMillis(SessionsTimeframeDays), g.timeline.NowMillis())
+	if err != nil {
+		return nil, err
+	}
+
+	var samples []SessionSample
+	for _, value := range table["values"].([]interface{}) {
+		row := value.([]interface{})
+		samples = append(samples, SessionSample{
+			Applications:     toStrings(row[0]),
+			Actions:          toStrings(row[1]),
+			StringProperties: toStringMap(row[2]),
+			DoubleProperties: toNumberMap(row[2]),
+		})
+	}
+
+	return samples, nil
+}
+
+// toStrings converts a list of values to the strings among them
+func toStrings(value interface{}) []string {
+	list, _ := value.([]interface{})
+	values := make([]string, 0, len(list))
+	for _, element := range list {
+		if s, ok := element.(string); ok {
+			values = append(values, s)
+		}
+	}
+	return values
+}
+
+// toStringMap converts a map of properties to those with string values
+func toStringMap(value interface{}) map[string]string {
+	properties, _ := value.(map[string]interface{})
+	values := make(map[string]string)
+	for key, property := range properties {
+		if s, ok := property.(string); ok {
+			values[key] = s
+		}
+	}
+	return values
+}
+
+// toNumberMap converts a map of properties to those with numeric values
+func toNumberMap(value interface{}) map[string]float64 {
+	properties, _ := value.(map[string]interface{})
+	numbers := make(map[string]float64)
+	for key, property := range properties {
+		if number, ok := property.(float64); ok {
+			numbers[key] = number
+		}
+	}
+	return numbers
+}
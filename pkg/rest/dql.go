@@ -0,0 +1,288 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+package rest
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/config"
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/util"
+)
+
+// grailSessions is the DQL command reading user sessions from Grail
+const grailSessions = "fetch user.sessions"
+
+// grailFields maps the fields of USQL queries to the fields of user.sessions records in Grail. Fields of user
+// actions and user errors hold one value per action or error of the session, as in USQL.
+var grailFields = map[string]string{
+	"internaluserid":                   "user.internal_id",
+	"userid":                           "user.tag",
+	"usertype":                         "user.type",
+	"applicationtype":                  "application.type",
+	"ip":                               "client.ip",
+	"starttime":                        "start_time",
+	"endtime":                          "end_time",
+	"duration":                         "duration",
+	"browsertype":                      "browser.type",
+	"osfamily":                         "os.family",
+	"useraction.name":                  "user_actions.name",
+	"useraction.application":           "user_actions.application",
+	"useraction.internalapplicationid": "user_actions.application_id",
+	"usererror.type":                   "errors.type",
+	"usererror.name":                   "errors.name",
+}
+
+// grailPropertyPrefixes maps the prefixes of session properties in USQL to their prefix in Grail, where
+// properties of all types share the same prefix
+var grailPropertyPrefixes = map[string]string{
+	"stringproperties.": "session_properties.",
+	"doubleproperties.": "session_properties.",
+	"longproperties.":   "session_properties.",
+}
+
+// GrailField returns the field of user.sessions records in Grail matching the given USQL field. Unknown fields
+// keep their name.
+func GrailField(field string) string {
+	lower := strings.ToLower(field)
+	if grailField, ok := grailFields[lower]; ok {
+		return grailField
+	}
+	for prefix, grailPrefix := range grailPropertyPrefixes {
+		if strings.HasPrefix(lower, prefix) {
+			return grailPrefix + field[len(prefix):]
+		}
+	}
+	return field
+}
+
+// dqlQuery joins the given commands into a DQL query, skipping empty ones
+func dqlQuery(commands ...string) string {
+	var parts []string
+	for _, command := range commands {
+		if command != "" {
+			parts = append(parts, command)
+		}
+	}
+
+	return strings.Join(parts, "\n| ")
+}
+
+// dqlFilter returns a filter command matching records which meet all of the given conditions, each wrapped
+// in parentheses. Empty conditions are skipped and if no conditions are left an empty string is returned.
+func dqlFilter(conditions ...string) string {
+	var parts []string
+	for _, condition := range conditions {
+		if condition != "" {
+			parts = append(parts, "("+condition+")")
+		}
+	}
+
+	if len(parts) == 0 {
+		return ""
+	}
+	return "filter " + strings.Join(parts, " and ")
+}
+
+// dqlString quotes a string for use in a DQL query
+func dqlString(value string) string {
+	return strconv.Quote(value)
+}
+
+// dqlArray returns a DQL array of the given strings
+func dqlArray(values []string) string {
+	quoted := make([]string, 0, len(values))
+	for _, value := range values {
+		quoted = append(quoted, dqlString(value))
+	}
+
+	return "array(" + strings.Join(quoted, ", ") + ")"
+}
+
+// dqlSessionsFilter returns the filter restricting a query to the sessions of the configuration's applications
+// and traffic, which also meet the given conditions
+func dqlSessionsFilter(config config.Config, applications []string, conditions ...string) string {
+	return dqlFilter(append([]string{
+		dqlApplicationCondition(applications),
+		dqlApplicationTypeCondition(config),
+		dqlTrafficCondition(config),
+	}, conditions...)...)
+}
+
+// dqlApplicationCondition is the DQL equivalent of applicationCondition
+func dqlApplicationCondition(applications []string) string {
+	var names, ids []string
+
+	for _, application := range applications {
+		if applicationEntityId.MatchString(application) {
+			ids = append(ids, application)
+		} else {
+			names = append(names, application)
+		}
+	}
+
+	var conditions []string
+	if len(names) > 0 {
+		conditions = append(conditions, "iAny(in("+GrailField("useraction.application")+"[], "+dqlArray(names)+"))")
+	}
+	if len(ids) > 0 {
+		conditions = append(conditions, "iAny(in("+GrailField("useraction.internalApplicationId")+"[], "+dqlArray(ids)+"))")
+	}
+
+	return strings.Join(conditions, " or ")
+}
+
+// dqlApplicationTypeCondition is the DQL equivalent of applicationTypeCondition
+func dqlApplicationTypeCondition(config config.Config) string {
+	switch config.GetProperty("application_type") {
+	case "web":
+		return GrailField("applicationType") + " == \"WEB_APPLICATION\""
+	case "mobile":
+		return GrailField("applicationType") + " == \"MOBILE_APPLICATION\""
+	case "custom":
+		return GrailField("applicationType") + " == \"CUSTOM_APPLICATION\""
+	default:
+		return ""
+	}
+}
+
+// dqlDiscoveryQuery is the DQL equivalent of discoveryQuery
+func dqlDiscoveryQuery(config config.Config, source errorSource) string {
+	var expand string
+	if source.dqlExpand() != "" {
+		expand = "expand " + source.dqlExpand()
+	}
+
+	return dqlQuery(grailSessions, dqlSessionsFilter(config, allApplications(config)), expand,
+		dqlFilter(source.dqlDiscoveryCondition()), "summarize count = count(), by: {"+source.dqlErrorField()+"}",
+		"sort count desc", "limit 50")
+}
+
+// dqlSessionsQueries is the DQL equivalent of sessionsQueries, fetching the given fields of the sessions
+func dqlSessionsQueries(config config.Config, source errorSource, fields []string, applications []string,
+	errorName string) (query string, countQuery string) {
+
+	filter := dqlSessionsFilter(config, applications, dqlConversionCondition(config)+" or "+source.dqlErrorCondition(errorName))
+	return dqlQuery(grailSessions, filter, "fields "+strings.Join(fields, ", "), fmt.Sprintf("limit %d", grailRecordLimit)),
+		dqlQuery(grailSessions, filter, "summarize count = count()")
+}
+
+// dqlUserActivityQueries is the DQL equivalent of userActivityQueries
+func dqlUserActivityQueries(config config.Config, errorCondition string) map[string]string {
+	applications := allApplications(config)
+	filters := map[string]string{
+		"active":    dqlSessionsFilter(config, applications),
+		"converted": dqlSessionsFilter(config, applications, dqlConversionCondition(config)),
+	}
+	if errorCondition != "" {
+		filters["impacted"] = dqlSessionsFilter(config, applications, errorCondition)
+	}
+
+	queries := make(map[string]string, len(filters))
+	for key, filter := range filters {
+		queries[key] = dqlQuery(grailSessions, filter, "summarize count = count(), by: {"+GrailField("internalUserId")+"}",
+			fmt.Sprintf("limit %d", grailRecordLimit))
+	}
+	return queries
+}
+
+// dqlConversionCondition is the DQL equivalent of conversionCondition
+func dqlConversionCondition(config config.Config) string {
+	conversion := config.GetProperty("conversion").(string)
+	action := GrailField("useraction.name") + "[]"
+
+	switch config.GetProperty("conversion_match") {
+	case "starts_with":
+		return "iAny(startsWith(" + action + ", " + dqlString(conversion) + "))"
+	case "contains":
+		return "iAny(contains(" + action + ", " + dqlString(conversion) + "))"
+	default:
+		return "iAny(" + action + " == " + dqlString(conversion) + ")"
+	}
+}
+
+// dqlTrafficCondition is the DQL equivalent of trafficCondition. Fields which are not set don't match the
+// excluded values, as in USQL.
+func dqlTrafficCondition(config config.Config) string {
+	userTypes := []string{"REAL_USER"}
+	if includeSynthetic, _ := config.GetProperty("include_synthetic").(bool); includeSynthetic {
+		userTypes = append(userTypes, "SYNTHETIC")
+	}
+	if includeRobots, _ := config.GetProperty("include_robots").(bool); includeRobots {
+		userTypes = append(userTypes, "ROBOT")
+	}
+	conditions := []string{"in(" + GrailField("userType") + ", " + dqlArray(userTypes) + ")"}
+
+	ip := GrailField("ip")
+	if ipRanges, ok := config.GetProperty("exclude_ip_ranges").([]string); ok {
+		for _, ipRange := range ipRanges {
+			first, last, err := util.ParseIPRange(ipRange)
+			if err != nil {
+				continue
+			}
+			if first.Equal(last) {
+				conditions = append(conditions, "isNull("+ip+") or "+ip+" != "+dqlString(first.String()))
+			} else {
+				conditions = append(conditions, "isNull("+ip+") or not (toIp("+ip+") >= toIp("+dqlString(first.String())+
+					") and toIp("+ip+") <= toIp("+dqlString(last.String())+"))")
+			}
+		}
+	}
+
+	if userTags, ok := config.GetProperty("exclude_user_tags").([]string); ok && len(userTags) > 0 {
+		userTag := GrailField("userId")
+		conditions = append(conditions, "isNull("+userTag+") or not in("+userTag+", "+dqlArray(userTags)+")")
+	}
+
+	if stringProps, ok := config.GetProperty("exclude_string_props").(map[string]string); ok {
+		// sorted for the query to be the same between runs
+		keys := make([]string, 0, len(stringProps))
+		for key := range stringProps {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			property := GrailField("stringProperties." + key)
+			conditions = append(conditions, "isNull("+property+") or "+property+" != "+dqlString(stringProps[key]))
+		}
+	}
+
+	for i := range conditions {
+		conditions[i] = "(" + conditions[i] + ")"
+	}
+	return strings.Join(conditions, " and ")
+}
+
+// dqlSessionFields returns the Grail fields matching the columns of the USQL sessions query, in the same order,
+// along with the fields holding numbers
+func dqlSessionFields(config config.Config, sources []errorSource) (fields []string, numbers map[string]bool) {
+	numbers = map[string]bool{GrailField("duration"): true}
+	for _, column := range columnList(sessionColumns(config, sources)) {
+		lower := strings.ToLower(column)
+		if strings.HasPrefix(lower, "doubleproperties.") || strings.HasPrefix(lower, "longproperties.") {
+			numbers[GrailField(column)] = true
+		}
+		fields = append(fields, GrailField(column))
+	}
+
+	return fields, numbers
+}
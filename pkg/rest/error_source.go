@@ -0,0 +1,197 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+package rest
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/config"
+)
+
+// errorSource hides the details of where errors are read from behind this interface, so that
+// discovering errors and fetching the sessions impacted by them works the same for all sources
+type errorSource interface {
+	// key returns the error property, or the type of error source, which identifies this source
+	key() string
+
+	// label returns the label which groups the errors of this source in reports
+	label() string
+
+	// discoveryColumns returns the columns which select the error names and their number of occurrences
+	discoveryColumns() string
+
+	// discoveryCondition returns the condition matching sessions which have any error from this source
+	discoveryCondition() string
+
+	// errorColumn returns the column which selects the error (or errors) of a session
+	errorColumn() string
+
+	// errorCondition returns the condition matching sessions which have the given error
+	errorCondition(envErr string) string
+
+	// dqlExpand returns the field which is expanded into one record per error before discovering errors
+	// with DQL, or an empty string if sessions have a single error
+	dqlExpand() string
+
+	// dqlDiscoveryCondition is the DQL equivalent of discoveryCondition, for expanded records
+	dqlDiscoveryCondition() string
+
+	// dqlErrorField returns the field which holds the error of expanded records, and the error (or errors)
+	// of sessions
+	dqlErrorField() string
+
+	// dqlErrorCondition is the DQL equivalent of errorCondition
+	dqlErrorCondition(envErr string) string
+}
+
+// Values of usererror.type for the errors reported by the RUM agent
+const (
+	javascriptErrorType string = "Error"
+	requestErrorType    string = "Request"
+	customErrorType     string = "Custom"
+)
+
+// createErrorSources creates the errorSources referenced by the error_source property of the config.
+// If not specified, errors are read from the string session properties referenced by error_prop, with
+// one source for each property, in the order they are listed.
+func createErrorSources(configuration config.Config) []errorSource {
+	switch configuration.GetProperty("error_source") {
+	case "javascript":
+		return []errorSource{&userErrorSource{source: "javascript", errorType: javascriptErrorType, errorLabel: "JavaScript errors"}}
+	case "request":
+		return []errorSource{&userErrorSource{source: "request", errorType: requestErrorType, errorLabel: "Request errors"}}
+	case "custom":
+		return []errorSource{&userErrorSource{source: "custom", errorType: customErrorType, errorLabel: "Custom errors"}}
+	default:
+		var sources []errorSource
+		for _, errorProp := range configuration.GetProperty("error_prop").([]config.ErrorProperty) {
+			sources = append(sources, &sessionPropertyErrorSource{errorProp: errorProp.Name, errorLabel: errorProp.Label})
+		}
+		return sources
+	}
+}
+
+// findErrorSource returns the source, out of the given ones, which the error was read from
+func findErrorSource(sources []errorSource, envErr EnvironmentError) (errorSource, error) {
+	for _, source := range sources {
+		if source.key() == envErr.Source {
+			return source, nil
+		}
+	}
+
+	return nil, fmt.Errorf("error source %s of error %s is not referenced by the configuration", envErr.Source, envErr.Name)
+}
+
+// sessionPropertyErrorSource reads errors from a string session property, which holds the title of the
+// error a session encountered. This requires the application to be instrumented to capture the property.
+type sessionPropertyErrorSource struct {
+	errorProp  string
+	errorLabel string
+}
+
+func (s *sessionPropertyErrorSource) key() string {
+	return s.errorProp
+}
+
+func (s *sessionPropertyErrorSource) label() string {
+	return s.errorLabel
+}
+
+func (s *sessionPropertyErrorSource) discoveryColumns() string {
+	return "DISTINCT stringProperties." + s.errorProp + ", count(*)"
+}
+
+func (s *sessionPropertyErrorSource) discoveryCondition() string {
+	return "stringProperties." + s.errorProp + " IS NOT NULL"
+}
+
+func (s *sessionPropertyErrorSource) errorColumn() string {
+	return "stringProperties." + s.errorProp
+}
+
+func (s *sessionPropertyErrorSource) errorCondition(envErr string) string {
+	return "stringProperties." + s.errorProp + " IS \"" + envErr + "\""
+}
+
+func (s *sessionPropertyErrorSource) dqlExpand() string {
+	return ""
+}
+
+func (s *sessionPropertyErrorSource) dqlDiscoveryCondition() string {
+	return "isNotNull(" + s.dqlErrorField() + ")"
+}
+
+func (s *sessionPropertyErrorSource) dqlErrorField() string {
+	return GrailField("stringProperties." + s.errorProp)
+}
+
+func (s *sessionPropertyErrorSource) dqlErrorCondition(envErr string) string {
+	return s.dqlErrorField() + " == " + dqlString(envErr)
+}
+
+// userErrorSource reads errors from the user errors captured by the RUM agent out of the box, i.e.
+// JavaScript errors, HTTP request errors or custom errors, depending on the error type. A session may
+// hold any number of user errors, so the error column selects a list of error names.
+type userErrorSource struct {
+	source     string
+	errorType  string
+	errorLabel string
+}
+
+func (s *userErrorSource) key() string {
+	return s.source
+}
+
+func (s *userErrorSource) label() string {
+	return s.errorLabel
+}
+
+func (s *userErrorSource) discoveryColumns() string {
+	return "DISTINCT usererror.name, count(*)"
+}
+
+func (s *userErrorSource) discoveryCondition() string {
+	return "usererror.type IS \"" + s.errorType + "\" AND usererror.name IS NOT NULL"
+}
+
+func (s *userErrorSource) errorColumn() string {
+	return "usererror.name"
+}
+
+func (s *userErrorSource) errorCondition(envErr string) string {
+	return "usererror.type IS \"" + s.errorType + "\" AND usererror.name IS \"" + envErr + "\""
+}
+
+func (s *userErrorSource) dqlExpand() string {
+	return strings.SplitN(GrailField("usererror.name"), ".", 2)[0]
+}
+
+func (s *userErrorSource) dqlDiscoveryCondition() string {
+	return GrailField("usererror.type") + " == " + dqlString(s.errorType) + " and isNotNull(" + s.dqlErrorField() + ")"
+}
+
+func (s *userErrorSource) dqlErrorField() string {
+	return GrailField("usererror.name")
+}
+
+func (s *userErrorSource) dqlErrorCondition(envErr string) string {
+	return "iAny(" + GrailField("usererror.type") + "[] == " + dqlString(s.errorType) + " and " +
+		s.dqlErrorField() + "[] == " + dqlString(envErr) + ")"
+}
@@ -0,0 +1,147 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// AuthenticationError is returned when the environment rejects the token (HTTP 401)
+type AuthenticationError struct {
+	Message string
+}
+
+func (e *AuthenticationError) Error() string {
+	return "authentication failed, check that the token is valid and has not expired: " + e.Message
+}
+
+// PermissionError is returned when the token is valid but lacks the required scope (HTTP 403)
+type PermissionError struct {
+	Message string
+}
+
+func (e *PermissionError) Error() string {
+	return "permission denied, check that the token has the 'User sessions' scope: " + e.Message
+}
+
+// QueryError is returned when the environment rejects a query as invalid (HTTP 400)
+type QueryError struct {
+	Query   string
+	Message string
+}
+
+func (e *QueryError) Error() string {
+	if e.Query == "" {
+		return "bad query: " + e.Message
+	}
+	return fmt.Sprintf("bad query %q: %s", e.Query, e.Message)
+}
+
+// RateLimitError is returned when the rate limit is still exceeded after the rate limiting strategy gave up (HTTP 429)
+type RateLimitError struct {
+	Message string
+}
+
+func (e *RateLimitError) Error() string {
+	return "rate limit exceeded: " + e.Message
+}
+
+// ServerError is returned when the environment fails to process a request (HTTP 5xx), or
+// responds with any other unexpected status
+type ServerError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("server error (HTTP %d): %s", e.StatusCode, e.Message)
+}
+
+// NetworkError is returned when the environment could not be reached
+type NetworkError struct {
+	Err error
+}
+
+func (e *NetworkError) Error() string {
+	return "network error: " + e.Err.Error()
+}
+
+func (e *NetworkError) Unwrap() error {
+	return e.Err
+}
+
+// isTransient checks whether a request failing with the given error is worth retrying
+func isTransient(err error) bool {
+	switch e := err.(type) {
+	case *NetworkError, *RateLimitError:
+		return true
+	case *ServerError:
+		return e.StatusCode >= 500
+	default:
+		return false
+	}
+}
+
+// checkResponse converts unsuccessful responses into the matching error type
+func checkResponse(response Response) error {
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return nil
+	}
+
+	message := errorMessage(response.Body)
+
+	switch {
+	case response.StatusCode == http.StatusBadRequest:
+		return &QueryError{Message: message}
+	case response.StatusCode == http.StatusUnauthorized:
+		return &AuthenticationError{Message: message}
+	case response.StatusCode == http.StatusForbidden:
+		return &PermissionError{Message: message}
+	case response.StatusCode == http.StatusTooManyRequests:
+		return &RateLimitError{Message: message}
+	default:
+		return &ServerError{StatusCode: response.StatusCode, Message: message}
+	}
+}
+
+// errorMessage extracts the message from a Dynatrace API error response, falling back to the raw body
+func errorMessage(body []byte) string {
+	var apiError struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+
+	if err := json.Unmarshal(body, &apiError); err == nil && apiError.Error.Message != "" {
+		return apiError.Error.Message
+	}
+
+	message := strings.TrimSpace(string(body))
+	if len(message) > 200 {
+		message = message[:200] + "..."
+	}
+	if message == "" {
+		message = "no details provided"
+	}
+
+	return message
+}
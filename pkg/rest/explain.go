@@ -0,0 +1,252 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/config"
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/util"
+)
+
+// Steps of a run which execute queries
+const (
+	ErrorsStep   = "discover errors"
+	SessionsStep = "fetch sessions"
+	CohortStep   = "follow users"
+)
+
+// ExplainedError stands for the errors in explained queries, as errors are only known once discovered
+const ExplainedError = "<error>"
+
+// ExplainedQuery is a query which a run would execute
+type ExplainedQuery struct {
+	// Step is the step of the run executing the query, one of the *Step constants
+	Step string
+	// Description tells what the query retrieves
+	Description string
+	// Query is the USQL or DQL query
+	Query string
+	// From and To are the timeframe of the query, in milliseconds
+	From int64
+	To   int64
+	// Slicing tells how the timeframe is split into slices, if it may be
+	Slicing string
+}
+
+// Explainer tells which queries a client would execute for a configuration
+type Explainer interface {
+	// ExplainQueries returns the queries a run would execute for the configuration, in order, without sending
+	// any request. Queries for an error are given for the ExplainedError.
+	ExplainQueries(config config.Config) []ExplainedQuery
+}
+
+// QueryPlanner asks an environment how it executes queries
+type QueryPlanner interface {
+	// ExplainPlan executes a query with explain=true and returns the explanations of the environment's query plan
+	ExplainPlan(ctx context.Context, query string, from int64, to int64) ([]string, error)
+}
+
+// queryLanguage builds the queries of a run in the query language of a data source
+type queryLanguage interface {
+	discoveryQuery(config config.Config, source errorSource) string
+	sessionsQueries(config config.Config, sources []errorSource, source errorSource, applications []string, errorName string) (string, string)
+	userActivityQueries(config config.Config, errorCondition string) map[string]string
+	errorCondition(source errorSource, errorName string) string
+	// slicing tells how the timeframe of sessions queries is split into slices
+	slicing() string
+	// activitySlicing tells how the timeframe of user activity queries is split into slices
+	activitySlicing() string
+}
+
+type usqlLanguage struct{}
+
+func (usqlLanguage) discoveryQuery(config config.Config, source errorSource) string {
+	return discoveryQuery(config, source)
+}
+
+func (usqlLanguage) sessionsQueries(config config.Config, sources []errorSource, source errorSource, applications []string,
+	errorName string) (string, string) {
+	return sessionsQueries(config, sources, source, applications, errorName)
+}
+
+func (usqlLanguage) userActivityQueries(config config.Config, errorCondition string) map[string]string {
+	return userActivityQueries(config, errorCondition)
+}
+
+func (usqlLanguage) errorCondition(source errorSource, errorName string) string {
+	return source.errorCondition(errorName)
+}
+
+func (usqlLanguage) slicing() string {
+	return fmt.Sprintf("the sessions are counted first, and if the count is extrapolated (level L) or reaches %d, the "+
+		"timeframe is split into max(L / 2, count / %d + 1) equal slices queried one by one", usqlRowLimit, usqlRowLimit)
+}
+
+func (usqlLanguage) activitySlicing() string {
+	return activitySlicing(usqlRowLimit)
+}
+
+type dqlLanguage struct{}
+
+func (dqlLanguage) discoveryQuery(config config.Config, source errorSource) string {
+	return dqlDiscoveryQuery(config, source)
+}
+
+func (dqlLanguage) sessionsQueries(config config.Config, sources []errorSource, source errorSource, applications []string,
+	errorName string) (string, string) {
+	fields, _ := dqlSessionFields(config, sources)
+	return dqlSessionsQueries(config, source, fields, applications, errorName)
+}
+
+func (dqlLanguage) userActivityQueries(config config.Config, errorCondition string) map[string]string {
+	return dqlUserActivityQueries(config, errorCondition)
+}
+
+func (dqlLanguage) errorCondition(source errorSource, errorName string) string {
+	return source.dqlErrorCondition(errorName)
+}
+
+func (dqlLanguage) slicing() string {
+	return fmt.Sprintf("the sessions are counted first, and if the count reaches %d, the timeframe is split into "+
+		"count / %d + 1 equal slices queried one by one", grailRecordLimit, grailRecordLimit)
+}
+
+func (dqlLanguage) activitySlicing() string {
+	return activitySlicing(grailRecordLimit)
+}
+
+// activitySlicing describes the slicing of user activity queries, which is the same in all query languages
+func activitySlicing(limit int) string {
+	return fmt.Sprintf("if the users reach %d or are extrapolated, the timeframe is split in halves, down to slices of %s, "+
+		"and the distinct users of all slices are merged", limit, minQuerySlice)
+}
+
+func (d *dynatraceClientImpl) ExplainQueries(config config.Config) []ExplainedQuery {
+	return explainQueries(config, d.timeline, usqlLanguage{})
+}
+
+func (g *grailClient) ExplainQueries(config config.Config) []ExplainedQuery {
+	return explainQueries(config, g.timeline, dqlLanguage{})
+}
+
+// explainQueries lists the queries of a run in the given query language, in the order they are executed: the
+// discovery of errors from each error source, then for each error the sessions of each group of applications and,
+// with the cohort analysis, the activity of users in the cohort week and each of the following weeks
+func explainQueries(config config.Config, timeline util.TimelineProvider, language queryLanguage) []ExplainedQuery {
+	now := timeline.NowMillis()
+	sources := createErrorSources(config)
+
+	var queries []ExplainedQuery
+	for _, source := range sources {
+		queries = append(queries, ExplainedQuery{
+			Step:        ErrorsStep,
+			Description: "errors of " + source.label() + ", with their number of occurrences",
+			Query:       language.discoveryQuery(config, source),
+			From:        timeline.GetDaysBeforeMillis(ErrorsTimeframeDays),
+			To:          now,
+		})
+	}
+
+	for _, source := range sources {
+		for _, applications := range applicationGroups(config) {
+			description := "sessions which hit an error of " + source.label() + " or converted"
+			if len(applications) > 0 {
+				description += ", of " + strings.Join(applications, ", ")
+			}
+
+			query, countQuery := language.sessionsQueries(config, sources, source, applications, ExplainedError)
+			from := timeline.GetDaysBeforeMillis(SessionsTimeframeDays)
+			queries = append(queries,
+				ExplainedQuery{Step: SessionsStep, Description: "number of " + description, Query: countQuery, From: from, To: now},
+				ExplainedQuery{Step: SessionsStep, Description: description, Query: query, From: from, To: now,
+					Slicing: language.slicing()},
+			)
+		}
+	}
+
+	weeks, _ := config.GetProperty("cohort_weeks").(int)
+	if weeks > 0 && len(sources) > 0 {
+		from, to := timeline.GetDaysBeforeMillis(7*(weeks+1)), timeline.GetDaysBeforeMillis(7*weeks)
+		errorCondition := language.errorCondition(sources[0], ExplainedError)
+		queries = append(queries, activityQueries(language.userActivityQueries(config, errorCondition), "in the cohort week",
+			from, to, language.activitySlicing())...)
+
+		for week := 1; week <= weeks; week++ {
+			from, to := timeline.GetDaysBeforeMillis(7*(weeks+1-week)), timeline.GetDaysBeforeMillis(7*(weeks-week))
+			queries = append(queries, activityQueries(language.userActivityQueries(config, ""), fmt.Sprintf("in week %d", week),
+				from, to, language.activitySlicing())...)
+		}
+	}
+
+	return queries
+}
+
+// activityQueries explains the queries of user activity within a week, ordered by the activity they retrieve
+func activityQueries(queries map[string]string, week string, from int64, to int64, slicing string) []ExplainedQuery {
+	var keys []string
+	for key := range queries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var explained []ExplainedQuery
+	for _, key := range keys {
+		explained = append(explained, ExplainedQuery{
+			Step:        CohortStep,
+			Description: key + " users " + week,
+			Query:       queries[key],
+			From:        from,
+			To:          to,
+			Slicing:     slicing,
+		})
+	}
+	return explained
+}
+
+func (d *dynatraceClientImpl) ExplainPlan(ctx context.Context, query string, from int64, to int64) ([]string, error) {
+	response, err := get(ctx, d.clientSettings, d.tableUrl(query, from, to, true), d.auth)
+	if queryErr, ok := err.(*QueryError); ok {
+		queryErr.Query = query
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var table struct {
+		Explanations []interface{} `json:"explanations"`
+	}
+	if err := json.Unmarshal(response.Body, &table); err != nil {
+		return nil, err
+	}
+
+	var explanations []string
+	for _, explanation := range table.Explanations {
+		if s, ok := explanation.(string); ok {
+			explanations = append(explanations, s)
+		} else if b, err := json.Marshal(explanation); err == nil {
+			explanations = append(explanations, string(b))
+		}
+	}
+	return explanations, nil
+}
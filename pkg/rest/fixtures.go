@@ -0,0 +1,419 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/util"
+	"github.com/spf13/afero"
+)
+
+// Modes of Fixtures
+const (
+	RecordFixtures = "record"
+	ReplayFixtures = "replay"
+)
+
+// Ways recorded requests are matched when replaying fixtures
+const (
+	// IgnoreTimestamps matches requests regardless of their timeframe. Requests which only differ by
+	// their timeframe are served the recorded responses in the order they were recorded.
+	IgnoreTimestamps = "ignore"
+	// RelativeTimestamps matches requests by their timeframe relative to the start of the run, so that
+	// e.g. a query over the last 7 days only matches a query recorded over the last 7 days.
+	RelativeTimestamps = "relative"
+)
+
+// volatileParams are the query parameters which change from one run to the next. The request tokens of
+// running Grail queries are not, as replayed queries are polled with the recorded token.
+var volatileParams = []string{"startTimestamp", "endTimestamp"}
+
+// volatileBodyFields are the fields of JSON request bodies which change from one run to the next
+var volatileBodyFields = []string{"defaultTimeframeStart", "defaultTimeframeEnd"}
+
+// redacted replaces secrets in recorded fixtures
+const redacted = "REDACTED"
+
+// Fixtures records the requests made by clients and their responses to a directory, or replays them from it
+// instead of sending the requests. Tokens and cookies are redacted from recorded fixtures. When replaying, any
+// request which does not match a recorded one fails with an UnmatchedRequestError. Fixtures may be shared
+// by several clients.
+type Fixtures interface {
+	// Stats returns the number of requests recorded or replayed so far, and the number of unmatched requests
+	Stats() (requests int, unmatched int)
+
+	transport(next http.RoundTripper) http.RoundTripper
+}
+
+// UnmatchedRequestError is returned when replaying fixtures and no recorded request matches the one made
+type UnmatchedRequestError struct {
+	Method string
+	URL    string
+}
+
+func (e *UnmatchedRequestError) Error() string {
+	return fmt.Sprintf("no recorded fixture matches request %s %s", e.Method, e.URL)
+}
+
+type fixturesImpl struct {
+	mutex         sync.Mutex
+	fs            afero.Fs
+	dir           string
+	mode          string
+	match         string
+	referenceTime int64
+	requests      int
+	unmatched     int
+	recorded      map[string][]fixture
+	served        map[string]int
+}
+
+// fixture is the content of a recorded file
+type fixture struct {
+	ReferenceTime int64           `json:"referenceTime"`
+	Request       fixtureRequest  `json:"request"`
+	Response      fixtureResponse `json:"response"`
+}
+
+type fixtureRequest struct {
+	Method  string      `json:"method"`
+	URL     string      `json:"url"`
+	Headers http.Header `json:"headers"`
+	Body    string      `json:"body,omitempty"`
+}
+
+type fixtureResponse struct {
+	StatusCode int         `json:"statusCode"`
+	Headers    http.Header `json:"headers"`
+	Body       string      `json:"body"`
+}
+
+// NewFixtures creates Fixtures recording to, or replaying from, the given directory. The reference time (in
+// milliseconds) is the current time of the run, which timeframes are made relative to when matching requests
+// by RelativeTimestamps.
+func NewFixtures(fs afero.Fs, dir string, mode string, match string, referenceTime int64) (Fixtures, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("no fixtures directory provided")
+	}
+	if match != IgnoreTimestamps && match != RelativeTimestamps {
+		return nil, fmt.Errorf("unknown fixture matching %q, must be one of %s or %s", match, IgnoreTimestamps, RelativeTimestamps)
+	}
+
+	f := &fixturesImpl{
+		fs:            fs,
+		dir:           dir,
+		mode:          mode,
+		match:         match,
+		referenceTime: referenceTime,
+		recorded:      make(map[string][]fixture),
+		served:        make(map[string]int),
+	}
+
+	switch mode {
+	case RecordFixtures:
+		if err := fs.MkdirAll(dir, 0700); err != nil {
+			return nil, fmt.Errorf("failed to create fixtures directory %s: %w", dir, err)
+		}
+		files, err := f.files()
+		if err != nil {
+			return nil, err
+		}
+		// fixtures of earlier recordings are kept, new ones are numbered after them
+		f.requests = len(files)
+		return f, nil
+	case ReplayFixtures:
+		return f, f.load()
+	default:
+		return nil, fmt.Errorf("unknown fixtures mode %q, must be one of %s or %s", mode, RecordFixtures, ReplayFixtures)
+	}
+}
+
+func (f *fixturesImpl) Stats() (requests int, unmatched int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.requests, f.unmatched
+}
+
+func (f *fixturesImpl) transport(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &fixturesTransport{fixtures: f, next: next}
+}
+
+// files returns the names of the recorded files, in the order they were recorded
+func (f *fixturesImpl) files() ([]string, error) {
+	infos, err := afero.ReadDir(f.fs, f.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fixtures directory %s: %w", f.dir, err)
+	}
+
+	var files []string
+	for _, info := range infos {
+		if !info.IsDir() && strings.HasPrefix(info.Name(), "request_") && strings.HasSuffix(info.Name(), ".json") {
+			files = append(files, info.Name())
+		}
+	}
+
+	return files, nil
+}
+
+// load reads all recorded fixtures and groups them by the key of their request
+func (f *fixturesImpl) load() error {
+	files, err := f.files()
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no fixtures found in %s", f.dir)
+	}
+
+	for _, file := range files {
+		path := filepath.Join(f.dir, file)
+		data, err := afero.ReadFile(f.fs, path)
+		if err != nil {
+			return fmt.Errorf("failed to read fixture %s: %w", path, err)
+		}
+
+		var recorded fixture
+		if err := json.Unmarshal(data, &recorded); err != nil {
+			return fmt.Errorf("failed to parse fixture %s: %w", path, err)
+		}
+
+		requestUrl, err := url.Parse(recorded.Request.URL)
+		if err != nil {
+			return fmt.Errorf("invalid request url in fixture %s: %w", path, err)
+		}
+
+		key := fixtureKey(recorded.Request.Method, requestUrl, []byte(recorded.Request.Body), f.match, recorded.ReferenceTime)
+		f.recorded[key] = append(f.recorded[key], recorded)
+	}
+
+	util.Log.Info("Replaying %d recorded requests from %s", len(files), f.dir)
+	return nil
+}
+
+// replay returns the recorded response to the given request. Requests recorded several times are served the
+// recorded responses in turn, and the last one once all have been served.
+func (f *fixturesImpl) replay(request *http.Request) (*http.Response, error) {
+	requestBody, err := readRequestBody(request)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	key := fixtureKey(request.Method, request.URL, requestBody, f.match, f.referenceTime)
+	recorded, found := f.recorded[key]
+	if !found {
+		f.unmatched++
+		return nil, &UnmatchedRequestError{Method: request.Method, URL: redactUrl(request.URL).String()}
+	}
+
+	index := f.served[key]
+	if index >= len(recorded) {
+		index = len(recorded) - 1
+	}
+	f.served[key]++
+	f.requests++
+
+	response := recorded[index].Response
+	util.Log.Debug("Replaying fixture for %s", key)
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", response.StatusCode, http.StatusText(response.StatusCode)),
+		StatusCode:    response.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        response.Headers.Clone(),
+		Body:          ioutil.NopCloser(strings.NewReader(response.Body)),
+		ContentLength: int64(len(response.Body)),
+		Request:       request,
+	}, nil
+}
+
+// record stores the given request and its response, without tokens and cookies
+func (f *fixturesImpl) record(request *http.Request, requestBody []byte, response *http.Response, body []byte) error {
+	requestHeaders := request.Header.Clone()
+	for _, header := range []string{"Authorization", "Cookie"} {
+		if requestHeaders.Get(header) != "" {
+			requestHeaders.Set(header, redacted)
+		}
+	}
+	responseHeaders := response.Header.Clone()
+	responseHeaders.Del("Set-Cookie")
+
+	data, err := json.MarshalIndent(fixture{
+		ReferenceTime: f.referenceTime,
+		Request: fixtureRequest{
+			Method:  request.Method,
+			URL:     redactUrl(request.URL).String(),
+			Headers: requestHeaders,
+			Body:    string(requestBody),
+		},
+		Response: fixtureResponse{
+			StatusCode: response.StatusCode,
+			Headers:    responseHeaders,
+			Body:       string(body),
+		},
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f.mutex.Lock()
+	f.requests++
+	path := filepath.Join(f.dir, fmt.Sprintf("request_%05d.json", f.requests))
+	f.mutex.Unlock()
+
+	return afero.WriteFile(f.fs, path, data, 0600)
+}
+
+// fixtureKey identifies a request when matching it against recorded ones. Tokens are not part of the key, and
+// timeframes are either left out or made relative to the reference time.
+func fixtureKey(method string, requestUrl *url.URL, body []byte, match string, referenceTime int64) string {
+	params := redactUrl(requestUrl).Query()
+	params.Del("Api-Token")
+
+	for _, param := range volatileParams {
+		value := params.Get(param)
+		if value == "" {
+			continue
+		}
+
+		timestamp, err := strconv.ParseInt(value, 10, 64)
+		if match == RelativeTimestamps && err == nil {
+			params.Set(param, fmt.Sprintf("now-%d", referenceTime-timestamp))
+		} else {
+			params.Del(param)
+		}
+	}
+
+	key := method + " " + requestUrl.Scheme + "://" + requestUrl.Host + requestUrl.Path + "?" + params.Encode()
+	if len(body) > 0 {
+		key += " " + fixtureBodyKey(body, match, referenceTime)
+	}
+	return key
+}
+
+// fixtureBodyKey identifies the body of a request, with its timeframe left out or made relative to the
+// reference time like the one of query parameters. Bodies which are not JSON objects are used as they are.
+func fixtureBodyKey(body []byte, match string, referenceTime int64) string {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return string(body)
+	}
+
+	for _, field := range volatileBodyFields {
+		value, ok := fields[field].(string)
+		if !ok {
+			continue
+		}
+
+		timestamp, err := time.Parse(time.RFC3339Nano, value)
+		if match == RelativeTimestamps && err == nil {
+			fields[field] = fmt.Sprintf("now-%d", referenceTime-timestamp.UnixNano()/int64(time.Millisecond))
+		} else {
+			delete(fields, field)
+		}
+	}
+
+	// maps are encoded with sorted keys, so the key doesn't depend on the order of fields
+	key, err := json.Marshal(fields)
+	if err != nil {
+		return string(body)
+	}
+	return string(key)
+}
+
+// readRequestBody returns a copy of the body of a request, leaving the request's body to be sent
+func readRequestBody(request *http.Request) ([]byte, error) {
+	if request.Body == nil || request.GetBody == nil {
+		return nil, nil
+	}
+
+	body, err := request.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	return ioutil.ReadAll(body)
+}
+
+// redactUrl returns a copy of the url without the token which Managed Cluster requests pass as parameter
+func redactUrl(requestUrl *url.URL) *url.URL {
+	redactedUrl := *requestUrl
+	params := redactedUrl.Query()
+	if params.Get("Api-Token") != "" {
+		params.Set("Api-Token", redacted)
+		redactedUrl.RawQuery = params.Encode()
+	}
+
+	return &redactedUrl
+}
+
+// fixturesTransport sends requests through the next transport and records them, or replays them
+type fixturesTransport struct {
+	fixtures *fixturesImpl
+	next     http.RoundTripper
+}
+
+func (t *fixturesTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if t.fixtures.mode == ReplayFixtures {
+		return t.fixtures.replay(request)
+	}
+
+	requestBody, err := readRequestBody(request)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := t.next.RoundTrip(request)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	response.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	if err := t.fixtures.record(request, requestBody, response, body); err != nil {
+		util.Log.Warn("Failed to record fixture: %s", err)
+	}
+
+	return response, nil
+}
@@ -0,0 +1,193 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+package rest
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+const fixturesDir = "fixtures"
+
+// fixturesReferenceTime is the time of the recorded run, in milliseconds
+const fixturesReferenceTime int64 = 1634560000000
+
+// recordFixture records a request to a server answering every request with the same body, and returns the
+// content of the recorded fixture and the url of the server, which is no longer running
+func recordFixture(t *testing.T, fs afero.Fs, requestUrl string, headers map[string]string) (recorded string, serverUrl string) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Set-Cookie", "session=secret-session")
+		fmt.Fprint(w, `{"values":[]}`)
+	}))
+	defer server.Close()
+
+	fixtures, err := NewFixtures(fs, fixturesDir, RecordFixtures, IgnoreTimestamps, fixturesReferenceTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: fixtures.transport(nil)}
+
+	request, err := http.NewRequest(http.MethodGet, server.URL+requestUrl, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for header, value := range headers {
+		request.Header.Set(header, value)
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if string(body) != `{"values":[]}` {
+		t.Fatalf("recording changed the response body to %s", body)
+	}
+
+	data, err := afero.ReadFile(fs, filepath.Join(fixturesDir, "request_00001.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data), server.URL
+}
+
+func TestRecordRedactsSecrets(t *testing.T) {
+	tests := []struct {
+		name       string
+		requestUrl string
+		headers    map[string]string
+		secrets    []string
+	}{
+		{
+			name:       "api token header",
+			requestUrl: userSessionsTableAPI + "?query=SELECT",
+			headers:    map[string]string{"Authorization": "Api-Token dt0c01.secret.token"},
+			secrets:    []string{"dt0c01.secret.token"},
+		},
+		{
+			name:       "bearer token and cookie",
+			requestUrl: userSessionsTableAPI + "?query=SELECT",
+			headers:    map[string]string{"Authorization": "Bearer secret-bearer", "Cookie": "JSESSIONID=secret-cookie"},
+			secrets:    []string{"secret-bearer", "secret-cookie"},
+		},
+		{
+			name:       "api token parameter",
+			requestUrl: userSessionsTableAPI + "?query=SELECT&Api-Token=secret-param-token",
+			secrets:    []string{"secret-param-token"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorded, _ := recordFixture(t, afero.NewMemMapFs(), test.requestUrl, test.headers)
+
+			for _, secret := range append(test.secrets, "secret-session") {
+				if strings.Contains(recorded, secret) {
+					t.Errorf("recorded fixture contains secret %q:\n%s", secret, recorded)
+				}
+			}
+			if !strings.Contains(recorded, redacted) {
+				t.Errorf("recorded fixture doesn't mark the redacted secrets:\n%s", recorded)
+			}
+		})
+	}
+}
+
+func TestReplayMatchesTimestamps(t *testing.T) {
+	const day int64 = 24 * 60 * 60 * 1000
+	recordedUrl := fmt.Sprintf("%s?query=SELECT&startTimestamp=%d&endTimestamp=%d", userSessionsTableAPI,
+		fixturesReferenceTime-7*day, fixturesReferenceTime)
+
+	tests := []struct {
+		name          string
+		match         string
+		referenceTime int64
+		from, to      int64
+		matched       bool
+	}{
+		{"ignore, same timeframe", IgnoreTimestamps, fixturesReferenceTime, fixturesReferenceTime - 7*day, fixturesReferenceTime, true},
+		{"ignore, later timeframe", IgnoreTimestamps, fixturesReferenceTime + day, fixturesReferenceTime - 6*day, fixturesReferenceTime + day, true},
+		{"ignore, other timeframe length", IgnoreTimestamps, fixturesReferenceTime, fixturesReferenceTime - day, fixturesReferenceTime, true},
+		{"relative, same timeframe", RelativeTimestamps, fixturesReferenceTime, fixturesReferenceTime - 7*day, fixturesReferenceTime, true},
+		{"relative, later run", RelativeTimestamps, fixturesReferenceTime + day, fixturesReferenceTime - 6*day, fixturesReferenceTime + day, true},
+		{"relative, other timeframe length", RelativeTimestamps, fixturesReferenceTime, fixturesReferenceTime - day, fixturesReferenceTime, false},
+		{"relative, same timeframe in later run", RelativeTimestamps, fixturesReferenceTime + day, fixturesReferenceTime - 7*day, fixturesReferenceTime, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			_, serverUrl := recordFixture(t, fs, recordedUrl, map[string]string{"Authorization": "Api-Token dt0c01.secret.token"})
+
+			fixtures, err := NewFixtures(fs, fixturesDir, ReplayFixtures, test.match, test.referenceTime)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client := &http.Client{Transport: fixtures.transport(nil)}
+
+			// replayed requests are never sent, so the server doesn't need to be running
+			requestUrl := fmt.Sprintf("%s%s?query=SELECT&startTimestamp=%d&endTimestamp=%d", serverUrl,
+				userSessionsTableAPI, test.from, test.to)
+			response, err := client.Get(requestUrl)
+			if !test.matched {
+				var unmatched *UnmatchedRequestError
+				if !errors.As(err, &unmatched) {
+					t.Fatalf("expected an UnmatchedRequestError, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("request wasn't matched: %s", err)
+			}
+			body, _ := ioutil.ReadAll(response.Body)
+			response.Body.Close()
+			if string(body) != `{"values":[]}` {
+				t.Errorf("replayed body %s, expected the recorded one", body)
+			}
+		})
+	}
+}
+
+func TestReplayFailsOnUnmatchedRequest(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	_, serverUrl := recordFixture(t, fs, userSessionsTableAPI+"?query=SELECT", nil)
+
+	fixtures, err := NewFixtures(fs, fixturesDir, ReplayFixtures, IgnoreTimestamps, fixturesReferenceTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: fixtures.transport(nil)}
+
+	_, err = client.Get(serverUrl + userSessionsTableAPI + "?query=SELECT+DISTINCT")
+	var unmatched *UnmatchedRequestError
+	if !errors.As(err, &unmatched) {
+		t.Fatalf("expected an UnmatchedRequestError, got %v", err)
+	}
+	if requests, unmatchedRequests := fixtures.Stats(); requests != 0 || unmatchedRequests != 1 {
+		t.Errorf("got %d replayed and %d unmatched requests, expected 0 and 1", requests, unmatchedRequests)
+	}
+}
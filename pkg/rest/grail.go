@@ -0,0 +1,371 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/config"
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/util"
+)
+
+// Paths of the Grail query API
+const (
+	grailExecuteAPI string = "/platform/storage/query/v1/query:execute"
+	grailPollAPI    string = "/platform/storage/query/v1/query:poll"
+	grailCancelAPI  string = "/platform/storage/query/v1/query:cancel"
+)
+
+const (
+	// grailRecordLimit is the most records a query returns, queries for more sessions are split
+	grailRecordLimit = 5000
+	// grailPollInterval is the time between polls for the results of a running query
+	grailPollInterval = 500 * time.Millisecond
+	// grailQueryTimeout is the time after which a running query is cancelled
+	grailQueryTimeout = 10 * time.Minute
+)
+
+// grailClient is a DynatraceClient which reads user sessions from Grail with DQL queries, rather than from the
+// USQL API. Records are mapped into the same tables as the results of USQL queries, so that sessions are
+// analysed the same regardless of their data source.
+type grailClient struct {
+	clientSettings
+	environmentUrl string
+	auth           Authenticator
+}
+
+// grailQueryRequest is the body of a request executing a DQL query
+type grailQueryRequest struct {
+	Query                      string `json:"query"`
+	DefaultTimeframeStart      string `json:"defaultTimeframeStart"`
+	DefaultTimeframeEnd        string `json:"defaultTimeframeEnd"`
+	RequestTimeoutMilliseconds int64  `json:"requestTimeoutMilliseconds"`
+	MaxResultRecords           int    `json:"maxResultRecords"`
+}
+
+// grailQueryResponse is the state of a DQL query, with its result once it succeeded
+type grailQueryResponse struct {
+	State        string `json:"state"`
+	RequestToken string `json:"requestToken"`
+	Result       *struct {
+		Records []map[string]interface{} `json:"records"`
+	} `json:"result"`
+}
+
+// NewGrailClient creates a DynatraceClient querying Grail, authenticating requests with the given Authenticator,
+// which must send a platform token or an OAuth access token
+func NewGrailClient(environmentUrl string, auth Authenticator, options ...ClientOption) (DynatraceClient, error) {
+	if environmentUrl == "" {
+		return nil, errors.New("no environment url")
+	}
+
+	if auth == nil {
+		return nil, errors.New("no authenticator")
+	}
+
+	if err := checkEnvironmentUrl(environmentUrl); err != nil {
+		return nil, err
+	}
+
+	settings := newClientSettings(options)
+	if expiring, ok := auth.(expiringAuthenticator); ok {
+		expiring.useClock(settings.clock)
+	}
+
+	return &grailClient{
+		clientSettings: settings,
+		environmentUrl: environmentUrl,
+		auth:           auth,
+	}, nil
+}
+
+func (g *grailClient) FetchErrors(ctx context.Context, config config.Config) (environmentErrors []EnvironmentError, err error) {
+	now := g.timeline.NowMillis()
+	dayAgo := g.timeline.GetDaysBeforeMillis(ErrorsTimeframeDays)
+
+	for order, source := range createErrorSources(config) {
+		query := dqlDiscoveryQuery(config, source)
+		util.Log.Debug("\t\tDiscovering errors with query: %s", query)
+
+		table, err := g.query(ctx, query, []string{source.dqlErrorField(), "count"}, nil, dayAgo, now)
+		if err != nil {
+			return nil, err
+		}
+
+		environmentErrors = append(environmentErrors, errorsFromTable(table, source, order)...)
+	}
+
+	return environmentErrors, nil
+}
+
+func (g *grailClient) FetchSessionsByError(ctx context.Context, config config.Config,
+	envErr EnvironmentError) (sessions []interface{}, err error) {
+
+	sources := createErrorSources(config)
+	source, err := findErrorSource(sources, envErr)
+	if err != nil {
+		return nil, err
+	}
+
+	now := g.timeline.NowMillis()
+	sevenDaysAgo := g.timeline.GetDaysBeforeMillis(SessionsTimeframeDays)
+	fields, numbers := dqlSessionFields(config, sources)
+
+	for _, applications := range applicationGroups(config) {
+		if len(applications) == 1 {
+			util.Log.Debug("\t\tFetching sessions of application %s", applications[0])
+		}
+
+		query, countQuery := dqlSessionsQueries(config, source, fields, applications, envErr.Name)
+		table, err := g.query(ctx, countQuery, []string{"count"}, nil, sevenDaysAgo, now)
+		if err != nil {
+			return nil, err
+		}
+		count, err := countFromTable(countQuery, table)
+		if err != nil {
+			return nil, err
+		}
+
+		// the timeframe is split into slices which are expected to stay within the record limit
+		slices := 1
+		if count >= grailRecordLimit {
+			slices = count/grailRecordLimit + 1
+			util.Log.Info("Will split results in %d queries", slices)
+		}
+		interval := (now - sevenDaysAgo) / int64(slices)
+
+		for i := 0; i < slices; i++ {
+			table, err := g.query(ctx, query, fields, numbers, sevenDaysAgo+int64(i)*interval, sevenDaysAgo+int64(i+1)*interval)
+			if err != nil {
+				return nil, err
+			}
+			values, _ := table["values"].([]interface{})
+			sessions = append(sessions, values...)
+		}
+	}
+
+	return sessions, nil
+}
+
+func (g *grailClient) FetchUserActivity(ctx context.Context, config config.Config, envErr EnvironmentError, from int64,
+	to int64) (activity map[string][]string, err error) {
+
+	var errorCondition string
+	if envErr.Name != "" {
+		source, err := findErrorSource(createErrorSources(config), envErr)
+		if err != nil {
+			return nil, err
+		}
+		errorCondition = source.dqlErrorCondition(envErr.Name)
+	}
+
+	userId := GrailField("internalUserId")
+	activity = make(map[string][]string)
+	for key, query := range dqlUserActivityQueries(config, errorCondition) {
+		query := query
+		result, err := runSliced(ctx, from, to, true, grailRecordLimit, func(ctx context.Context, from int64, to int64) (QueryResult, error) {
+			table, err := g.query(ctx, query, []string{userId, "count"}, nil, from, to)
+			if err != nil {
+				return QueryResult{}, err
+			}
+			return toQueryResult(table), nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		activity[key] = distinctUsers(result, key)
+	}
+
+	return activity, nil
+}
+
+// query executes a DQL query over the given timeframe and returns its records as a table of the given fields,
+// in the same format as the results of USQL queries
+func (g *grailClient) query(ctx context.Context, query string, fields []string, numbers map[string]bool, from int64,
+	to int64) (table map[string]interface{}, err error) {
+	now := g.timeline.NowMillis()
+	if g.cache != nil {
+		if body, ok := g.cache.get(g.environmentUrl, query, from, to, now); ok {
+			if err := json.Unmarshal(body, &table); err == nil {
+				return table, nil
+			}
+		}
+	}
+
+	records, err := g.execute(ctx, query, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	table = grailTable(records, fields, numbers)
+	if g.cache != nil {
+		body, err := json.Marshal(table)
+		if err == nil {
+			err = g.cache.put(g.environmentUrl, query, from, to, now, body)
+		}
+		if err != nil {
+			util.Log.Warn("Failed to cache response: %s", err)
+		}
+	}
+
+	return table, nil
+}
+
+// execute starts a DQL query and polls for its results until it succeeds, fails or the context is done. Queries
+// which are still running when the context is done, or after the query timeout, are cancelled.
+func (g *grailClient) execute(ctx context.Context, query string, from int64, to int64) ([]map[string]interface{}, error) {
+	body, err := json.Marshal(grailQueryRequest{
+		Query:                      query,
+		DefaultTimeframeStart:      millisToTimestamp(from),
+		DefaultTimeframeEnd:        millisToTimestamp(to),
+		RequestTimeoutMilliseconds: (10 * time.Second).Milliseconds(),
+		MaxResultRecords:           grailRecordLimit,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := newRequest(http.MethodPost, g.environmentUrl+grailExecuteAPI, body)
+	if err != nil {
+		return nil, err
+	}
+	response, err := g.send(ctx, req, query)
+	if err != nil {
+		return nil, err
+	}
+
+	started := g.clock.Now()
+	for response.State != "SUCCEEDED" {
+		if response.State != "RUNNING" && response.State != "NOT_STARTED" {
+			return nil, &QueryError{Query: query, Message: "query ended in state " + response.State}
+		}
+		if g.clock.Now().Sub(started) > grailQueryTimeout {
+			g.cancel(response.RequestToken)
+			return nil, &QueryError{Query: query, Message: fmt.Sprintf("query did not complete within %s", grailQueryTimeout)}
+		}
+		if err := g.clock.SleepContext(ctx, grailPollInterval); err != nil {
+			g.cancel(response.RequestToken)
+			return nil, err
+		}
+
+		params := url.Values{}
+		params.Add("request-token", response.RequestToken)
+		params.Add("request-timeout-milliseconds", strconv.FormatInt((5*time.Second).Milliseconds(), 10))
+		req, err := newRequest(http.MethodGet, g.environmentUrl+grailPollAPI+"?"+params.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		token := response.RequestToken
+		if response, err = g.send(ctx, req, query); err != nil {
+			if ctx.Err() != nil {
+				g.cancel(token)
+			}
+			return nil, err
+		}
+	}
+
+	if response.Result == nil {
+		return nil, &QueryError{Query: query, Message: "query succeeded without a result"}
+	}
+	return response.Result.Records, nil
+}
+
+// send sends a request of the query API and reads the state of the query from the response
+func (g *grailClient) send(ctx context.Context, req *http.Request, query string) (grailQueryResponse, error) {
+	response, err := send(ctx, g.clientSettings, req, g.auth)
+	if queryErr, ok := err.(*QueryError); ok {
+		queryErr.Query = query
+	}
+	if err != nil {
+		return grailQueryResponse{}, err
+	}
+
+	var state grailQueryResponse
+	if err := json.Unmarshal(response.Body, &state); err != nil {
+		return grailQueryResponse{}, err
+	}
+	return state, nil
+}
+
+// cancel stops a running query, so that it doesn't use up resources of the environment. Failures are
+// only logged, as the query also stops on its own once it times out.
+func (g *grailClient) cancel(requestToken string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	params := url.Values{}
+	params.Add("request-token", requestToken)
+	req, err := newRequest(http.MethodPost, g.environmentUrl+grailCancelAPI+"?"+params.Encode(), nil)
+	if err == nil {
+		settings := g.clientSettings
+		settings.retry.retries = 0
+		_, err = send(ctx, settings, req, g.auth)
+	}
+	if err != nil {
+		util.Log.Debug("Failed to cancel query: %s", err)
+	}
+}
+
+// grailTable converts DQL records into a table of the given fields, in the same format as the results of USQL
+// queries. Timestamps are converted to milliseconds, and counts and the given numeric fields which Grail returns
+// as strings (such as long values) to numbers.
+func grailTable(records []map[string]interface{}, fields []string, numbers map[string]bool) map[string]interface{} {
+	timestamps := map[string]bool{GrailField("startTime"): true, GrailField("endTime"): true}
+
+	values := make([]interface{}, 0, len(records))
+	for _, record := range records {
+		row := make([]interface{}, 0, len(fields))
+		for _, field := range fields {
+			value := record[field]
+			if s, ok := value.(string); ok {
+				if t, err := time.Parse(time.RFC3339Nano, s); err == nil && timestamps[field] {
+					value = float64(t.UnixNano() / int64(time.Millisecond))
+				} else if number, err := strconv.ParseFloat(s, 64); err == nil && (field == "count" || numbers[field]) {
+					value = number
+				}
+			}
+			row = append(row, value)
+		}
+		values = append(values, row)
+	}
+
+	columnNames := make([]interface{}, 0, len(fields))
+	for _, field := range fields {
+		columnNames = append(columnNames, field)
+	}
+
+	return map[string]interface{}{
+		"extrapolationLevel": float64(1),
+		"columnNames":        columnNames,
+		"values":             values,
+	}
+}
+
+// millisToTimestamp formats a time in milliseconds as an ISO 8601 timestamp
+func millisToTimestamp(millis int64) string {
+	return time.Unix(0, millis*int64(time.Millisecond)).UTC().Format(time.RFC3339Nano)
+}
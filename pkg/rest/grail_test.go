@@ -0,0 +1,284 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+package rest_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/config"
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/fakeserver"
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/rest"
+)
+
+const grailTestToken = "dt0c01.test.token"
+
+// grailProxy wraps the fake server so that queries are still running for a number of polls, or forever if it is
+// negative, and records the polls and the status of cancellations
+type grailProxy struct {
+	handler      http.Handler
+	runningPolls int
+
+	mutex     sync.Mutex
+	polls     int
+	cancelled []int
+}
+
+func (p *grailProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case fakeserver.GrailQueryAPI + ":poll":
+		p.mutex.Lock()
+		p.polls++
+		running := p.runningPolls < 0 || p.polls <= p.runningPolls
+		p.mutex.Unlock()
+
+		if running {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{"state": "RUNNING", "requestToken": r.URL.Query().Get("request-token")})
+			return
+		}
+	case fakeserver.GrailQueryAPI + ":cancel":
+		recorder := httptest.NewRecorder()
+		p.handler.ServeHTTP(recorder, r)
+		p.mutex.Lock()
+		p.cancelled = append(p.cancelled, recorder.Code)
+		p.mutex.Unlock()
+		w.WriteHeader(recorder.Code)
+		return
+	}
+	p.handler.ServeHTTP(w, r)
+}
+
+// newGrailTest starts a fake server over a generated dataset behind a grailProxy, and creates a Grail client
+// querying it with the given options
+func newGrailTest(t *testing.T, sessions int, runningPolls int, options ...rest.ClientOption) (*fakeserver.Dataset,
+	*grailProxy, rest.QueryRunner) {
+
+	dataset, err := fakeserver.GenerateDataset(fakeserver.DefaultProfile(), 42, sessions, 1, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := &grailProxy{
+		handler:      fakeserver.NewServer(dataset, fakeserver.Options{Tokens: []string{grailTestToken}}),
+		runningPolls: runningPolls,
+	}
+	server := httptest.NewServer(proxy)
+	t.Cleanup(server.Close)
+
+	auth, err := rest.NewPlatformTokenAuthenticator(grailTestToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := rest.NewGrailClient(server.URL, auth, append([]rest.ClientOption{rest.WithRetries(0)}, options...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dataset, proxy, client.(rest.QueryRunner)
+}
+
+// lastDay returns the timeframe of the last day in milliseconds, which holds all sessions of the test datasets
+func lastDay() (int64, int64) {
+	now := time.Now()
+	return now.AddDate(0, 0, -1).UnixNano() / int64(time.Millisecond), now.UnixNano() / int64(time.Millisecond)
+}
+
+func TestGrailPollsUntilSucceeded(t *testing.T) {
+	query := "fetch user.sessions | summarize count = count(), by: {" + rest.GrailField("browserType") + "}"
+
+	tests := []struct {
+		name         string
+		runningPolls int
+	}{
+		{name: "succeeded at first poll", runningPolls: 0},
+		{name: "running for several polls", runningPolls: 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clock := rest.NewFakeTimeline()
+			dataset, proxy, client := newGrailTest(t, 500, test.runningPolls, rest.WithClock(clock))
+			from, to := lastDay()
+
+			started := clock.Now()
+			result, err := client.RunQuery(context.Background(), query, from, to, false)
+			if err != nil {
+				t.Fatalf("query failed: %s", err)
+			}
+
+			expected, err := dataset.QueryDQL(query, from, to, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(result.Values) != len(expected) || len(expected) == 0 {
+				t.Errorf("got %d records, expected %d", len(result.Values), len(expected))
+			}
+			if proxy.polls != test.runningPolls+1 {
+				t.Errorf("polled %d times, expected %d", proxy.polls, test.runningPolls+1)
+			}
+			if waited := clock.Now().Sub(started); waited != time.Duration(test.runningPolls+1)*rest.GrailPollInterval {
+				t.Errorf("waited %s between polls, expected %s", waited, time.Duration(test.runningPolls+1)*rest.GrailPollInterval)
+			}
+			if len(proxy.cancelled) != 0 {
+				t.Errorf("the query was cancelled")
+			}
+		})
+	}
+}
+
+func TestGrailCancelsRunningQueries(t *testing.T) {
+	query := "fetch user.sessions | summarize count = count()"
+
+	tests := []struct {
+		name string
+		// fakeClock runs the client on a fake timeline instead of the current time, so that polls take no time
+		fakeClock bool
+		timeout   time.Duration
+		check     func(t *testing.T, err error)
+	}{
+		{
+			name:    "context timeout",
+			timeout: 50 * time.Millisecond,
+			check: func(t *testing.T, err error) {
+				if !errors.Is(err, context.DeadlineExceeded) {
+					t.Errorf("expected the deadline to be exceeded, got %v", err)
+				}
+			},
+		},
+		{
+			name:      "query timeout",
+			fakeClock: true,
+			check: func(t *testing.T, err error) {
+				var queryErr *rest.QueryError
+				if !errors.As(err, &queryErr) {
+					t.Errorf("expected a query error, got %v", err)
+				}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var options []rest.ClientOption
+			if test.fakeClock {
+				options = append(options, rest.WithClock(rest.NewFakeTimeline()))
+			}
+			_, proxy, client := newGrailTest(t, 100, -1, options...)
+			from, to := lastDay()
+
+			ctx := context.Background()
+			if test.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, test.timeout)
+				defer cancel()
+			}
+
+			_, err := client.RunQuery(ctx, query, from, to, false)
+			test.check(t, err)
+			// the server still holds the results of the query until it is cancelled
+			if len(proxy.cancelled) != 1 || proxy.cancelled[0] != http.StatusAccepted {
+				t.Errorf("expected the query to be cancelled once, cancellations responded with %v", proxy.cancelled)
+			}
+		})
+	}
+}
+
+func TestGrailRecordLimit(t *testing.T) {
+	query := "fetch user.sessions | fields " + rest.GrailField("internalUserId") + ", " + rest.GrailField("startTime")
+
+	tests := []struct {
+		name          string
+		slicing       bool
+		wantTruncated bool
+	}{
+		{name: "truncated", slicing: false, wantTruncated: true},
+		{name: "sliced", slicing: true, wantTruncated: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dataset, _, client := newGrailTest(t, 3*rest.GrailRecordLimit, 0, rest.WithClock(rest.NewFakeTimeline()))
+			from, to := lastDay()
+
+			result, err := client.RunQuery(context.Background(), query, from, to, test.slicing)
+			if err != nil {
+				t.Fatalf("query failed: %s", err)
+			}
+
+			expected := rest.GrailRecordLimit
+			if test.slicing {
+				expected = dataset.Sessions()
+			}
+			if len(result.Values) != expected {
+				t.Errorf("got %d records, expected %d", len(result.Values), expected)
+			}
+			if result.Truncated != test.wantTruncated {
+				t.Errorf("truncated is %t, expected %t", result.Truncated, test.wantTruncated)
+			}
+			if test.slicing && result.Slices < 4 {
+				t.Errorf("queried %d slices, expected at least 4 for %d sessions", result.Slices, dataset.Sessions())
+			}
+		})
+	}
+}
+
+func TestGrailRejectsMalformedCounts(t *testing.T) {
+	configs, errs := config.NewConfigurations(map[string]map[string]interface{}{
+		"cfg": {
+			"name":      "cfg",
+			"use_cases": []interface{}{"incurred_costs"},
+			"properties": map[interface{}]interface{}{
+				"error_prop":    "errormessage",
+				"conversion":    "Loading of page /confirmation",
+				"cost_of_error": 10,
+			},
+		},
+	})
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+
+	// the count query of the sessions returns no records, rather than a record with a count
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"state": "SUCCEEDED", "result": map[string]interface{}{"records": []interface{}{}}})
+	}))
+	defer server.Close()
+
+	auth, err := rest.NewPlatformTokenAuthenticator(grailTestToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := rest.NewGrailClient(server.URL, auth, rest.WithRetries(0), rest.WithClock(rest.NewFakeTimeline()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.FetchSessionsByError(context.Background(), configs["cfg"],
+		rest.EnvironmentError{Name: "Error", Source: "errormessage"})
+	var queryErr *rest.QueryError
+	if !errors.As(err, &queryErr) {
+		t.Errorf("expected a QueryError, got %v", err)
+	}
+}
@@ -0,0 +1,408 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+package rest
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/config"
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/util"
+	"github.com/spf13/afero"
+)
+
+// OfflineExport is a USQL query whose results an offline analysis reads from an export
+type OfflineExport struct {
+	// Name is the name of the export file, without extension
+	Name string
+	// Query is the USQL query whose results are exported
+	Query string
+	// CountQuery counts the sessions of a sessions query, which are exported over SessionSlices slices of the
+	// timeframe, one file per slice. It is empty for exports which aren't sliced.
+	CountQuery string
+	// Days is the timeframe of the query, in days up to the current time
+	Days int
+}
+
+// OfflineExports returns the exports which an offline analysis of the configuration reads: the results of
+// the error discovery query of each error source, followed by the results of the sessions query
+func OfflineExports(config config.Config) (exports []OfflineExport) {
+	sources := createErrorSources(config)
+
+	for _, source := range sources {
+		name := "errors_" + source.key()
+		if len(sources) == 1 {
+			name = "errors"
+		}
+		exports = append(exports, OfflineExport{Name: name, Query: discoveryQuery(config, source), Days: ErrorsTimeframeDays})
+	}
+
+	query, countQuery := offlineSessionsQueries(config, sources)
+	return append(exports, OfflineExport{Name: "sessions", Query: query, CountQuery: countQuery, Days: SessionsTimeframeDays})
+}
+
+// offlineSessionsQueries returns the query selecting the sessions of all errors of the configuration at once,
+// as well as the sessions which converted, and the query counting them. Like the sessions queries of online
+// analyses, the query returns at most the row limit of USQL, so its timeframe is split into slices.
+func offlineSessionsQueries(config config.Config, sources []errorSource) (query string, countQuery string) {
+	var errorConditions []string
+	for _, source := range sources {
+		errorConditions = append(errorConditions, "("+source.discoveryCondition()+")")
+	}
+
+	where := whereClause(applicationCondition(allApplications(config)), applicationTypeCondition(config), trafficCondition(config),
+		conversionCondition(config)+" OR "+strings.Join(errorConditions, " OR "))
+	return sessionColumns(config, sources) + " FROM usersession" + where + " LIMIT " + strconv.Itoa(usqlRowLimit),
+		"SELECT count(*) FROM usersession" + where
+}
+
+// offlineClient is a DynatraceClient which reads the results of USQL queries from files exported from an
+// environment, rather than querying the environment. Exports may be the JSON response of the USQL table API
+// or CSV files whose list columns hold JSON arrays. The directory of a configuration and environment holds:
+//   - errors.json (or .csv) with the results of the error discovery query, or errors_<source>.json for each
+//     error source if the configuration references several
+//   - sessions.json (or .csv) with the results of the sessions query. If its count query returns 5000 sessions
+//     or more, or extrapolated results, the timeframe is split into SessionSlices slices, exported to several
+//     files named sessions_<anything>.json
+//
+// The queries to export are listed in the error returned for missing files.
+type offlineClient struct {
+	fs  afero.Fs
+	dir string
+}
+
+// NewOfflineClient creates a DynatraceClient reading USQL exports from the given directory
+func NewOfflineClient(fs afero.Fs, dir string) (DynatraceClient, error) {
+	if exists, err := afero.DirExists(fs, dir); err != nil || !exists {
+		return nil, fmt.Errorf("offline export directory %s not found", dir)
+	}
+
+	return &offlineClient{fs: fs, dir: dir}, nil
+}
+
+func (o *offlineClient) FetchErrors(ctx context.Context, config config.Config) (environmentErrors []EnvironmentError, err error) {
+	sources := createErrorSources(config)
+
+	for order, source := range sources {
+		names := []string{"errors_" + source.key()}
+		if len(sources) == 1 {
+			names = append(names, "errors")
+		}
+
+		query := discoveryQuery(config, source)
+
+		files, err := o.exports(names...)
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("no export of errors found in %s, save the results of this query over the last %d day(s) as %s.json or %s.csv: %s",
+				o.dir, ErrorsTimeframeDays, names[len(names)-1], names[len(names)-1], query)
+		}
+
+		table, err := o.readTables(files, columnList(query))
+		if err != nil {
+			return nil, err
+		}
+		environmentErrors = append(environmentErrors, errorsFromTable(table, source, order)...)
+	}
+
+	return environmentErrors, nil
+}
+
+func (o *offlineClient) FetchSessionsByError(ctx context.Context, config config.Config,
+	envErr EnvironmentError) (sessions []interface{}, err error) {
+
+	sources := createErrorSources(config)
+	if _, err := findErrorSource(sources, envErr); err != nil {
+		return nil, err
+	}
+
+	query, countQuery := offlineSessionsQueries(config, sources)
+
+	files, err := o.exports("sessions", "sessions_*")
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no export of sessions found in %s, save the results of this query over the last %d days as sessions.json or sessions.csv: %s "+
+			"(if %s returns %d sessions or more, split the timeframe and save each part as sessions_<part>.json)",
+			o.dir, SessionsTimeframeDays, query, countQuery, usqlRowLimit)
+	}
+
+	table, err := o.readTables(files, columnList(query))
+	if err != nil {
+		return nil, err
+	}
+
+	// the export holds the sessions of all errors, those which neither hit this error nor converted are left out,
+	// the same as the error's own query would
+	conversion := config.GetProperty("conversion").(string)
+	conversionMatch, _ := config.GetProperty("conversion_match").(string)
+	isLostBasket := config.HasUseCase("lost_basket")
+
+	for _, row := range table["values"].([]interface{}) {
+		sDetails := util.UnpackSession(isLostBasket, row.([]interface{}))
+
+		if hasError(sDetails["errors"].([][]string), envErr) || hasConversion(sDetails["actions"].([]string), conversion, conversionMatch) {
+			sessions = append(sessions, row)
+		}
+	}
+
+	return sessions, nil
+}
+
+func (o *offlineClient) FetchUserActivity(ctx context.Context, config config.Config, envErr EnvironmentError, from int64,
+	to int64) (activity map[string][]string, err error) {
+	return nil, errors.New("the cohort analysis needs to query the environment over several weeks and is not supported offline, remove cohort_weeks from the configuration")
+}
+
+// exports returns the export files with the given names (which may contain wildcards), in .json or .csv format
+func (o *offlineClient) exports(names ...string) ([]string, error) {
+	var files []string
+	for _, name := range names {
+		for _, extension := range []string{".json", ".csv"} {
+			matches, err := afero.Glob(o.fs, filepath.Join(o.dir, name+extension))
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, matches...)
+		}
+	}
+	sort.Strings(files)
+
+	return files, nil
+}
+
+// readTables reads the given export files and combines them into a single table, in the format of the USQL
+// table API's response. Columns are arranged in the given order.
+func (o *offlineClient) readTables(files []string, columns []string) (table map[string]interface{}, err error) {
+	var values []interface{}
+
+	for _, file := range files {
+		data, err := afero.ReadFile(o.fs, file)
+		if err != nil {
+			return nil, err
+		}
+
+		var exported map[string]interface{}
+		if strings.EqualFold(filepath.Ext(file), ".csv") {
+			exported, err = parseCSVTable(data)
+		} else {
+			err = json.Unmarshal(data, &exported)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read export %s: %w", file, err)
+		}
+
+		if extrapolation, ok := exported["extrapolationLevel"].(float64); ok && extrapolation > 1 {
+			util.Log.Warn("Export %s holds extrapolated results (level %.0f), export shorter timeframes for accurate results", file, extrapolation)
+		}
+		if rows, ok := exported["values"].([]interface{}); ok && len(rows) == usqlRowLimit {
+			util.Log.Warn("Export %s holds %d rows, the most a query returns, export shorter timeframes for complete results", file, usqlRowLimit)
+		}
+
+		rows, err := arrangeColumns(exported, columns)
+		if err != nil {
+			return nil, fmt.Errorf("export %s does not match its query: %w", file, err)
+		}
+		util.Log.Debug("Read %d rows from export %s", len(rows), file)
+		values = append(values, rows...)
+	}
+
+	return map[string]interface{}{
+		"columnNames":        toInterfaces(columns),
+		"values":             values,
+		"extrapolationLevel": float64(1),
+	}, nil
+}
+
+// arrangeColumns returns the rows of an exported table with their columns in the given order. Columns are
+// matched by name, or by position if the export has no matching column names but the same number of columns.
+func arrangeColumns(exported map[string]interface{}, columns []string) ([]interface{}, error) {
+	rows, ok := exported["values"].([]interface{})
+	if !ok {
+		return nil, errors.New("no values found")
+	}
+
+	positions := make(map[string]int)
+	if names, ok := exported["columnNames"].([]interface{}); ok {
+		for i, name := range names {
+			if name, ok := name.(string); ok {
+				positions[strings.ToLower(name)] = i
+			}
+		}
+	}
+
+	indexes := make([]int, len(columns))
+	var missing []string
+	for i, column := range columns {
+		position, ok := positions[strings.ToLower(column)]
+		if !ok {
+			missing = append(missing, column)
+		}
+		indexes[i] = position
+	}
+	if len(missing) > 0 {
+		if len(positions) != len(columns) {
+			return nil, fmt.Errorf("columns %s not found", strings.Join(missing, ", "))
+		}
+		for i := range indexes {
+			indexes[i] = i
+		}
+	}
+
+	arranged := make([]interface{}, 0, len(rows))
+	for _, row := range rows {
+		cells, ok := row.([]interface{})
+		if !ok || len(cells) < len(columns) {
+			return nil, fmt.Errorf("row %v has fewer than %d columns", row, len(columns))
+		}
+
+		arrangedRow := make([]interface{}, len(columns))
+		for i, index := range indexes {
+			arrangedRow[i] = cells[index]
+		}
+		arranged = append(arranged, arrangedRow)
+	}
+
+	return arranged, nil
+}
+
+// parseCSVTable reads a table exported as CSV, such as by derran query. The first row holds the column names.
+// Cell values are converted to the types found in the API's responses: numbers for timestamps, counts and
+// numeric properties, lists for user action and user error columns, and strings otherwise.
+func parseCSVTable(data []byte) (map[string]interface{}, error) {
+	reader := csv.NewReader(strings.NewReader(strings.TrimPrefix(string(data), "\ufeff")))
+	reader.FieldsPerRecord = -1
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, errors.New("no column names found")
+	}
+
+	columns := records[0]
+	values := make([]interface{}, 0, len(records)-1)
+	for line, record := range records[1:] {
+		row := make([]interface{}, len(columns))
+		for i := range columns {
+			if i < len(record) {
+				if row[i], err = parseCSVCell(columns[i], record[i]); err != nil {
+					return nil, fmt.Errorf("row %d, column %s: %w", line+1, columns[i], err)
+				}
+			}
+		}
+		values = append(values, row)
+	}
+
+	return map[string]interface{}{
+		"columnNames": toInterfaces(columns),
+		"values":      values,
+	}, nil
+}
+
+func parseCSVCell(column string, cell string) (interface{}, error) {
+	cell = strings.TrimSpace(cell)
+	column = strings.ToLower(column)
+
+	switch {
+	case cell == "" || cell == "null":
+		return nil, nil
+	case strings.HasPrefix(column, "useraction.") || strings.HasPrefix(column, "usererror."):
+		return parseCSVList(cell)
+	case column == "starttime" || column == "endtime":
+		if number, err := strconv.ParseFloat(cell, 64); err == nil {
+			return number, nil
+		}
+		for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02 15:04"} {
+			if t, err := time.Parse(layout, cell); err == nil {
+				return float64(t.UnixNano() / int64(time.Millisecond)), nil
+			}
+		}
+		return cell, nil
+	case strings.HasPrefix(column, "count(") || strings.HasPrefix(column, "doubleproperties.") || strings.HasPrefix(column, "longproperties."):
+		if number, err := strconv.ParseFloat(cell, 64); err == nil {
+			return number, nil
+		}
+		return cell, nil
+	default:
+		return cell, nil
+	}
+}
+
+// parseCSVList reads a list cell, which holds a JSON array as written by derran query. Lists in other formats
+// can't be read, as the names of actions and errors may contain the characters separating their items.
+func parseCSVList(cell string) ([]interface{}, error) {
+	var list []interface{}
+	if err := json.Unmarshal([]byte(cell), &list); err != nil {
+		return nil, fmt.Errorf("list %s is not a JSON array, export lists as JSON arrays such as [\"first\",\"second\"]", cell)
+	}
+	return list, nil
+}
+
+// columnList returns the names of the columns selected by a query
+func columnList(query string) []string {
+	selected := strings.TrimPrefix(query, "SELECT ")
+	if end := strings.Index(selected, " FROM "); end >= 0 {
+		selected = selected[:end]
+	}
+	selected = strings.TrimPrefix(selected, "DISTINCT ")
+
+	return strings.Split(selected, ", ")
+}
+
+func hasError(sessionErrors [][]string, envErr EnvironmentError) bool {
+	if envErr.Order >= len(sessionErrors) {
+		return false
+	}
+	for _, sessionError := range sessionErrors[envErr.Order] {
+		if sessionError == envErr.Name {
+			return true
+		}
+	}
+	return false
+}
+
+func hasConversion(actions []string, conversion string, conversionMatch string) bool {
+	for _, action := range actions {
+		if util.MatchesConversion(action, conversion, conversionMatch) {
+			return true
+		}
+	}
+	return false
+}
+
+func toInterfaces(values []string) []interface{} {
+	converted := make([]interface{}, len(values))
+	for i, value := range values {
+		converted[i] = value
+	}
+	return converted
+}
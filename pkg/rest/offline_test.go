@@ -0,0 +1,69 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+package rest
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCSVTableLists(t *testing.T) {
+	tests := []struct {
+		name    string
+		csv     string
+		want    []interface{}
+		wantErr bool
+	}{
+		{
+			name: "names with commas",
+			csv:  "internalUserId,useraction.name\nuser1,\"[\"\"Loading of page /search?from=London, UK\"\", \"\"click on \\\"\"Book, now\\\"\"\"\"]\"\n",
+			want: []interface{}{"user1", []interface{}{"Loading of page /search?from=London, UK", "click on \"Book, now\""}},
+		},
+		{
+			name: "empty list",
+			csv:  "internalUserId,usererror.name\nuser1,[]\n",
+			want: []interface{}{"user1", []interface{}{}},
+		},
+		{
+			name:    "list which is not JSON",
+			csv:     "internalUserId,useraction.name\nuser1,\"[Loading of page /search, click on Book]\"\n",
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			table, err := parseCSVTable([]byte(test.csv))
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", table)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			values := table["values"].([]interface{})
+			if len(values) != 1 || !reflect.DeepEqual(values[0], test.want) {
+				t.Errorf("got rows %v, expected %v", values, test.want)
+			}
+		})
+	}
+}
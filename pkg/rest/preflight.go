@@ -0,0 +1,285 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/config"
+)
+
+// tokenLookupAPI is the path of the API returning the metadata of an API token
+const tokenLookupAPI string = "/api/v2/apiTokens/lookup"
+
+// Scopes which tokens need for derran to read user sessions
+const (
+	usqlScope  = "DTAQLAccess"
+	grailScope = "storage:user.sessions:read"
+)
+
+// Names of preflight checks
+const (
+	TokenCheck       = "token"
+	ApplicationCheck = "application"
+	ErrorsCheck      = "errors"
+	ConversionCheck  = "conversion"
+	BasketCheck      = "basket"
+)
+
+// PreflightCheck is the outcome of a check of an environment before analysing it
+type PreflightCheck struct {
+	// Name is what was checked, one of the *Check constants. A configuration may be subject to several checks
+	// of the same name, e.g. one per application.
+	Name   string
+	Passed bool
+	// Detail explains the outcome of the check
+	Detail string
+}
+
+// Preflight checks that an environment can be analysed, without running the analysis. Checks which fail to
+// run, e.g. because the environment can't be reached, are reported as failed rather than returned as errors.
+type Preflight interface {
+	// CheckToken verifies that the environment accepts the token and that it has the scopes to read user sessions
+	CheckToken(ctx context.Context) PreflightCheck
+
+	// CheckConfig confirms that the applications, error sources, conversion action and basket property referenced
+	// by the configuration were seen in the sessions of the timeframe which is analysed
+	CheckConfig(ctx context.Context, config config.Config) []PreflightCheck
+}
+
+// preflightCondition is a condition which some sessions of the configuration's applications are expected to meet
+type preflightCondition struct {
+	name        string
+	description string
+	usql        string
+	dqlExpand   string
+	dql         string
+}
+
+// sessionCounter counts the recent sessions of the given applications which meet the condition
+type sessionCounter func(ctx context.Context, applications []string, condition preflightCondition) (int, error)
+
+// checkConfig runs the checks of a configuration, counting sessions with the given function
+func checkConfig(ctx context.Context, config config.Config, count sessionCounter) (checks []PreflightCheck) {
+	applications := allApplications(config)
+
+	var applicationConditions []preflightCondition
+	for _, application := range applications {
+		applicationConditions = append(applicationConditions, preflightCondition{name: ApplicationCheck, description: application})
+	}
+	if len(applications) == 0 {
+		applicationConditions = append(applicationConditions, preflightCondition{name: ApplicationCheck, description: "all applications"})
+	}
+
+	for _, condition := range applicationConditions {
+		scope := applications
+		if len(applications) > 0 {
+			scope = []string{condition.description}
+		}
+		checks = append(checks, runPreflightCheck(ctx, count, scope, condition))
+	}
+
+	for _, condition := range preflightConditions(config) {
+		checks = append(checks, runPreflightCheck(ctx, count, applications, condition))
+	}
+
+	return checks
+}
+
+// preflightConditions returns the conditions on the error sources, conversion and basket of a configuration
+func preflightConditions(config config.Config) []preflightCondition {
+	var conditions []preflightCondition
+
+	for _, source := range createErrorSources(config) {
+		description := "user errors of type " + source.key()
+		if _, ok := source.(*sessionPropertyErrorSource); ok {
+			description = "error property " + source.key()
+		}
+		conditions = append(conditions, preflightCondition{
+			name:        ErrorsCheck,
+			description: description,
+			usql:        source.discoveryCondition(),
+			dqlExpand:   source.dqlExpand(),
+			dql:         source.dqlDiscoveryCondition(),
+		})
+	}
+
+	conditions = append(conditions, preflightCondition{
+		name:        ConversionCheck,
+		description: "conversion action " + config.GetProperty("conversion").(string),
+		usql:        conversionCondition(config),
+		dql:         dqlConversionCondition(config),
+	})
+
+	if config.HasUseCase("lost_basket") {
+		basket := "doubleProperties." + config.GetProperty("basket_prop").(string)
+		if config.GetProperty("basket_prop_type") == "long" {
+			basket = "longProperties." + config.GetProperty("basket_prop").(string)
+		}
+		conditions = append(conditions, preflightCondition{
+			name:        BasketCheck,
+			description: "basket property " + basket,
+			usql:        basket + " IS NOT NULL",
+			dql:         "isNotNull(" + GrailField(basket) + ")",
+		})
+	}
+
+	return conditions
+}
+
+func runPreflightCheck(ctx context.Context, count sessionCounter, applications []string, condition preflightCondition) PreflightCheck {
+	sessions, err := count(ctx, applications, condition)
+	switch {
+	case err != nil:
+		return PreflightCheck{Name: condition.name, Detail: fmt.Sprintf("%s: %s", condition.description, err)}
+	case sessions == 0:
+		return PreflightCheck{Name: condition.name, Detail: fmt.Sprintf("%s: no sessions in the last %d days", condition.description,
+			SessionsTimeframeDays)}
+	default:
+		return PreflightCheck{Name: condition.name, Passed: true, Detail: fmt.Sprintf("%s: %d sessions in the last %d days",
+			condition.description, sessions, SessionsTimeframeDays)}
+	}
+}
+
+// countOf reads the count of a table with a single row and column
+func countOf(table map[string]interface{}) int {
+	values, _ := table["values"].([]interface{})
+	if len(values) == 0 {
+		return 0
+	}
+	row, _ := values[0].([]interface{})
+	if len(row) == 0 {
+		return 0
+	}
+	count, _ := row[0].(float64)
+	return int(count)
+}
+
+// apiTokenHolder is implemented by Authenticators which send an API token, whose metadata can be looked up
+type apiTokenHolder interface {
+	apiToken() string
+}
+
+func (a *apiTokenAuthenticator) apiToken() string {
+	return a.token
+}
+
+func (a *missionControlAuthenticator) apiToken() string {
+	return a.token
+}
+
+func (d *dynatraceClientImpl) CheckToken(ctx context.Context) PreflightCheck {
+	holder, ok := d.auth.(apiTokenHolder)
+	if !ok {
+		// tokens other than API tokens can't be looked up, but a query shows whether they are accepted
+		_, err := d.queryTable(ctx, "SELECT count(*) FROM usersession", d.timeline.GetDaysBeforeMillis(1), d.timeline.NowMillis())
+		return tokenCheckFromQuery(err, usqlScope)
+	}
+
+	body, err := json.Marshal(map[string]string{"token": holder.apiToken()})
+	if err != nil {
+		return PreflightCheck{Name: TokenCheck, Detail: err.Error()}
+	}
+	req, err := newRequest(http.MethodPost, d.environmentUrl+tokenLookupAPI, body)
+	if err != nil {
+		return PreflightCheck{Name: TokenCheck, Detail: err.Error()}
+	}
+	response, err := send(ctx, d.clientSettings, req, d.auth)
+	if err != nil {
+		return PreflightCheck{Name: TokenCheck, Detail: err.Error()}
+	}
+
+	var token struct {
+		Name           string   `json:"name"`
+		Enabled        bool     `json:"enabled"`
+		ExpirationDate string   `json:"expirationDate"`
+		Scopes         []string `json:"scopes"`
+	}
+	if err := json.Unmarshal(response.Body, &token); err != nil {
+		return PreflightCheck{Name: TokenCheck, Detail: "invalid token lookup response: " + err.Error()}
+	}
+
+	name := "token"
+	if token.Name != "" {
+		name = "token " + token.Name
+	}
+	if !token.Enabled {
+		return PreflightCheck{Name: TokenCheck, Detail: name + " is disabled"}
+	}
+	if expiry, err := time.Parse(time.RFC3339, token.ExpirationDate); err == nil && expiry.Before(d.timeline.Now()) {
+		return PreflightCheck{Name: TokenCheck, Detail: fmt.Sprintf("%s expired on %s", name, expiry.Format("2006-01-02"))}
+	}
+	for _, scope := range token.Scopes {
+		if scope == usqlScope {
+			return PreflightCheck{Name: TokenCheck, Passed: true, Detail: fmt.Sprintf("%s has scope %s", name, usqlScope)}
+		}
+	}
+	return PreflightCheck{Name: TokenCheck, Detail: fmt.Sprintf("%s lacks scope %s, granted: %s", name, usqlScope,
+		strings.Join(token.Scopes, ", "))}
+}
+
+func (d *dynatraceClientImpl) CheckConfig(ctx context.Context, config config.Config) []PreflightCheck {
+	from, to := d.timeline.GetDaysBeforeMillis(SessionsTimeframeDays), d.timeline.NowMillis()
+
+	return checkConfig(ctx, config, func(ctx context.Context, applications []string, condition preflightCondition) (int, error) {
+		query := "SELECT count(*) FROM usersession" + whereClause(applicationCondition(applications),
+			applicationTypeCondition(config), trafficCondition(config), condition.usql)
+		table, err := d.queryTable(ctx, query, from, to)
+		return countOf(table), err
+	})
+}
+
+func (g *grailClient) CheckToken(ctx context.Context) PreflightCheck {
+	// platform tokens and OAuth access tokens can't be looked up, but a query shows whether they are accepted
+	_, err := g.query(ctx, dqlQuery(grailSessions, "summarize count = count()"), []string{"count"}, nil,
+		g.timeline.GetDaysBeforeMillis(1), g.timeline.NowMillis())
+	return tokenCheckFromQuery(err, grailScope)
+}
+
+func (g *grailClient) CheckConfig(ctx context.Context, config config.Config) []PreflightCheck {
+	from, to := g.timeline.GetDaysBeforeMillis(SessionsTimeframeDays), g.timeline.NowMillis()
+
+	return checkConfig(ctx, config, func(ctx context.Context, applications []string, condition preflightCondition) (int, error) {
+		var expand string
+		if condition.dqlExpand != "" {
+			expand = "expand " + condition.dqlExpand
+		}
+		query := dqlQuery(grailSessions, dqlSessionsFilter(config, applications), expand, dqlFilter(condition.dql),
+			"summarize count = count()")
+		table, err := g.query(ctx, query, []string{"count"}, nil, from, to)
+		return countOf(table), err
+	})
+}
+
+// tokenCheckFromQuery turns the outcome of a query into the outcome of a token check
+func tokenCheckFromQuery(err error, scope string) PreflightCheck {
+	switch err.(type) {
+	case nil:
+		return PreflightCheck{Name: TokenCheck, Passed: true, Detail: "token accepted for queries requiring scope " + scope}
+	case *PermissionError:
+		return PreflightCheck{Name: TokenCheck, Detail: fmt.Sprintf("token lacks scope %s: %s", scope, err)}
+	default:
+		return PreflightCheck{Name: TokenCheck, Detail: err.Error()}
+	}
+}
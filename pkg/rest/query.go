@@ -0,0 +1,249 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+package rest
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/config"
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/util"
+)
+
+// applicationEntityId matches the entity ID of web, mobile and custom applications
+var applicationEntityId = regexp.MustCompile(`^(MOBILE_|CUSTOM_)?APPLICATION-[0-9A-F]+$`)
+
+// applicationGroups returns the groups of applications that are queried separately. In combined mode (the
+// default) all applications referenced in the config are queried together, while in separate mode each
+// application is queried on its own. A config without applications results in a single, empty group.
+func applicationGroups(config config.Config) [][]string {
+	applications := allApplications(config)
+
+	if mode, _ := config.GetProperty("application_mode").(string); mode != "separate" || len(applications) == 0 {
+		return [][]string{applications}
+	}
+
+	groups := make([][]string, 0, len(applications))
+	for _, application := range applications {
+		groups = append(groups, []string{application})
+	}
+
+	return groups
+}
+
+// allApplications returns all applications referenced in the config, regardless of the application mode
+func allApplications(config config.Config) []string {
+	applications, _ := config.GetProperty("application").([]string)
+	return applications
+}
+
+// applicationCondition returns the USQL condition which restricts a query to the given applications.
+// Applications can be referenced either by display name or by entity ID. If no applications are given,
+// an empty string is returned.
+func applicationCondition(applications []string) string {
+	var names, ids []string
+
+	for _, application := range applications {
+		if applicationEntityId.MatchString(application) {
+			ids = append(ids, "\""+application+"\"")
+		} else {
+			names = append(names, "\""+application+"\"")
+		}
+	}
+
+	var conditions []string
+	if len(names) > 0 {
+		conditions = append(conditions, "useraction.application IN ("+strings.Join(names, ", ")+")")
+	}
+	if len(ids) > 0 {
+		conditions = append(conditions, "useraction.internalApplicationId IN ("+strings.Join(ids, ", ")+")")
+	}
+
+	return strings.Join(conditions, " OR ")
+}
+
+// applicationTypeCondition returns the USQL condition which restricts a query to the type of application
+// referenced in the config. If no type is given, sessions of all application types are included.
+func applicationTypeCondition(config config.Config) string {
+	switch config.GetProperty("application_type") {
+	case "web":
+		return "applicationType IS \"WEB_APPLICATION\""
+	case "mobile":
+		return "applicationType IS \"MOBILE_APPLICATION\""
+	case "custom":
+		return "applicationType IS \"CUSTOM_APPLICATION\""
+	default:
+		return ""
+	}
+}
+
+// conversionCondition returns the USQL condition which matches sessions containing the conversion action.
+// Mobile and custom applications have no pages, so their conversions are often actions or events whose
+// names carry extra details; these can be matched on the start of the name or on a part of it.
+func conversionCondition(config config.Config) string {
+	conversion := config.GetProperty("conversion").(string)
+
+	switch config.GetProperty("conversion_match") {
+	case "starts_with":
+		return "useraction.name STARTSWITH \"" + conversion + "\""
+	case "contains":
+		return "useraction.name LIKE \"%" + conversion + "%\""
+	default:
+		return "useraction.name IS \"" + conversion + "\""
+	}
+}
+
+// trafficCondition returns the USQL condition which filters out the traffic that should not be part of
+// the analysis. Only real users are included, unless the config allows synthetic or robot traffic, and
+// sessions matching any of the configured IP ranges, user tags or string properties are excluded.
+func trafficCondition(config config.Config) string {
+	userTypes := []string{"\"REAL_USER\""}
+	if includeSynthetic, _ := config.GetProperty("include_synthetic").(bool); includeSynthetic {
+		userTypes = append(userTypes, "\"SYNTHETIC\"")
+	}
+	if includeRobots, _ := config.GetProperty("include_robots").(bool); includeRobots {
+		userTypes = append(userTypes, "\"ROBOT\"")
+	}
+	conditions := []string{"userType IN (" + strings.Join(userTypes, ", ") + ")"}
+
+	if ipRanges, ok := config.GetProperty("exclude_ip_ranges").([]string); ok {
+		for _, ipRange := range ipRanges {
+			first, last, err := util.ParseIPRange(ipRange)
+			if err != nil {
+				continue
+			}
+			if first.Equal(last) {
+				conditions = append(conditions, "NOT ip IS \""+first.String()+"\"")
+			} else {
+				conditions = append(conditions, "NOT ip BETWEEN \""+first.String()+"\" AND \""+last.String()+"\"")
+			}
+		}
+	}
+
+	if userTags, ok := config.GetProperty("exclude_user_tags").([]string); ok && len(userTags) > 0 {
+		quoted := make([]string, 0, len(userTags))
+		for _, tag := range userTags {
+			quoted = append(quoted, "\""+tag+"\"")
+		}
+		conditions = append(conditions, "NOT userId IN ("+strings.Join(quoted, ", ")+")")
+	}
+
+	if stringProps, ok := config.GetProperty("exclude_string_props").(map[string]string); ok {
+		// sorted for the query to be the same between runs
+		keys := make([]string, 0, len(stringProps))
+		for key := range stringProps {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			conditions = append(conditions, "NOT stringProperties."+key+" IS \""+stringProps[key]+"\"")
+		}
+	}
+
+	return strings.Join(conditions, " AND ")
+}
+
+// sessionColumns returns the SELECT part of the query used to fetch the user sessions that are analysed.
+// The order of the columns is the one expected by util.UnpackSession, with the errors of each source
+// selected last, in the order of the sources.
+func sessionColumns(config config.Config, sources []errorSource) string {
+	columns := "SELECT internalUserId, startTime, endTime, useraction.name"
+
+	if config.HasUseCase("lost_basket") {
+		if config.GetProperty("basket_prop_type") == "long" {
+			columns += ", longProperties." + config.GetProperty("basket_prop").(string)
+		} else {
+			columns += ", doubleProperties." + config.GetProperty("basket_prop").(string)
+		}
+	}
+
+	// browser type is only known for web sessions, the OS family tells apart mobile platforms
+	columns += ", browserType, osFamily, useraction.application"
+
+	for _, source := range sources {
+		columns += ", " + source.errorColumn()
+	}
+
+	return columns
+}
+
+// discoveryQuery returns the query which discovers the errors of an error source, with their number of occurrences
+func discoveryQuery(config config.Config, source errorSource) string {
+	return "SELECT " + source.discoveryColumns() + " FROM usersession" +
+		whereClause(applicationCondition(allApplications(config)), applicationTypeCondition(config), trafficCondition(config),
+			source.discoveryCondition())
+}
+
+// sessionsQueries returns the query fetching the sessions of the given applications which hit an error or
+// converted, and the query counting them
+func sessionsQueries(config config.Config, sources []errorSource, source errorSource, applications []string,
+	errorName string) (query string, countQuery string) {
+
+	where := whereClause(
+		applicationCondition(applications),
+		applicationTypeCondition(config),
+		trafficCondition(config),
+		conversionCondition(config)+" OR "+source.errorCondition(errorName),
+	)
+
+	return sessionColumns(config, sources) + " FROM usersession" + where + " LIMIT " + strconv.Itoa(usqlRowLimit),
+		"SELECT count(*) FROM usersession" + where
+}
+
+// userActivityQueries returns the queries of the users who were active, converted and, given the condition of
+// an error, were impacted by the error, mapped as "active", "converted" and "impacted". Queries returning as
+// many users as the row limit are executed again over slices of their timeframe.
+func userActivityQueries(config config.Config, errorCondition string) map[string]string {
+	application := applicationCondition(allApplications(config))
+	applicationType := applicationTypeCondition(config)
+	traffic := trafficCondition(config)
+
+	limit := " LIMIT " + strconv.Itoa(usqlRowLimit)
+	queries := map[string]string{
+		"active":    "SELECT DISTINCT internalUserId FROM usersession" + whereClause(application, applicationType, traffic) + limit,
+		"converted": "SELECT DISTINCT internalUserId FROM usersession" + whereClause(application, applicationType, traffic, conversionCondition(config)) + limit,
+	}
+	if errorCondition != "" {
+		queries["impacted"] = "SELECT DISTINCT internalUserId FROM usersession" + whereClause(application, applicationType, traffic, errorCondition) + limit
+	}
+
+	return queries
+}
+
+// whereClause joins the given conditions into a USQL WHERE clause. Each condition is wrapped in
+// parentheses so that conditions containing OR keep their meaning. Empty conditions are skipped and
+// if no conditions are left an empty string is returned.
+func whereClause(conditions ...string) string {
+	var parts []string
+
+	for _, condition := range conditions {
+		if condition != "" {
+			parts = append(parts, "("+condition+")")
+		}
+	}
+
+	if len(parts) == 0 {
+		return ""
+	}
+
+	return " WHERE " + strings.Join(parts, " AND ")
+}
@@ -17,25 +17,68 @@
 package rest
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"net/http"
 	"time"
 
 	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/util"
 )
 
-// rateLimitStrategy ensures that the concrete implementation of the rate limiting strategy can be hidden
-// behind this interface
-type rateLimitStrategy interface {
-	executeRequest(timelineProvider util.TimelineProvider, callback func() (Response, error)) (Response, error)
+// RateLimitStrategy ensures that the concrete implementation of the rate limiting strategy can be hidden
+// behind this interface. A strategy may keep track of the requests sent to an environment, so the same
+// instance should be shared by all clients of that environment.
+type RateLimitStrategy interface {
+	executeRequest(ctx context.Context, timelineProvider util.TimelineProvider, callback func() (Response, error)) (Response, error)
 }
 
-// createRateLimitStrategy creates a rateLimitStrategy. In the future this can be extended to instantiate
-// different rate limiting strategies based on e.g. environment variables. The current implementation
-// always returns the strategy simpleSleepRateLimitStrategy, which suspends the current goroutine until
-// the time in the rate limiting header 'X-RateLimit-Reset' is up.
-func createRateLimitStrategy() rateLimitStrategy {
-	return &simpleSleepRateLimitStrategy{}
+// Names of the rate limiting strategies which can be selected per environment
+const (
+	SleepRateLimitStrategy       string = "sleep"
+	TokenBucketRateLimitStrategy string = "token-bucket"
+	AdaptiveRateLimitStrategy    string = "adaptive"
+)
+
+// DefaultRequestsPerMinute is the request rate the token bucket strategy allows if none is specified
+const DefaultRequestsPerMinute = 50
+
+// NewRateLimitStrategy creates the RateLimitStrategy with the given name. The requests per minute are
+// only used by the token bucket strategy, with DefaultRequestsPerMinute applying if 0 is given.
+func NewRateLimitStrategy(name string, requestsPerMinute int) (RateLimitStrategy, error) {
+	if requestsPerMinute < 0 {
+		return nil, fmt.Errorf("rate limit must be a positive number of requests per minute, got %d", requestsPerMinute)
+	}
+
+	switch name {
+	case SleepRateLimitStrategy, TokenBucketRateLimitStrategy, AdaptiveRateLimitStrategy, "":
+		return createRateLimitStrategy(name, requestsPerMinute), nil
+	default:
+		return nil, fmt.Errorf("unknown rate limit strategy %s, must be one of %s, %s or %s", name,
+			SleepRateLimitStrategy, TokenBucketRateLimitStrategy, AdaptiveRateLimitStrategy)
+	}
+}
+
+// createRateLimitStrategy creates a rateLimitStrategy based on its name:
+//   - sleep (default): simpleSleepRateLimitStrategy, which suspends the current goroutine until the time in
+//     the rate limiting header 'X-RateLimit-Reset' is up, once the rate limit was exceeded.
+//   - token-bucket: tokenBucketRateLimitStrategy, which proactively throttles requests to the given number
+//     of requests per minute.
+//   - adaptive: adaptiveRateLimitStrategy, which paces requests based on the rate limiting headers of
+//     previous responses.
+func createRateLimitStrategy(name string, requestsPerMinute int) RateLimitStrategy {
+	if requestsPerMinute == 0 {
+		requestsPerMinute = DefaultRequestsPerMinute
+	}
+
+	switch name {
+	case TokenBucketRateLimitStrategy:
+		return newTokenBucketRateLimitStrategy(requestsPerMinute)
+	case AdaptiveRateLimitStrategy:
+		return &adaptiveRateLimitStrategy{fallback: &simpleSleepRateLimitStrategy{}}
+	default:
+		return &simpleSleepRateLimitStrategy{}
+	}
 }
 
 // simpleSleepRateLimitStrategy, is a rate limiting strategy which suspends the current goroutine until
@@ -44,7 +87,7 @@ func createRateLimitStrategy() rateLimitStrategy {
 // polling iterations before giving up.
 type simpleSleepRateLimitStrategy struct{}
 
-func (s *simpleSleepRateLimitStrategy) executeRequest(timelineProvider util.TimelineProvider, callback func() (Response, error)) (Response, error) {
+func (s *simpleSleepRateLimitStrategy) executeRequest(ctx context.Context, timelineProvider util.TimelineProvider, callback func() (Response, error)) (Response, error) {
 
 	response, err := callback()
 	if err != nil {
@@ -61,7 +104,7 @@ func (s *simpleSleepRateLimitStrategy) executeRequest(timelineProvider util.Time
 			return response, err
 		}
 
-		util.Log.Info("Rate limit of %d requests/min reached: Applying rate limit strategy (simpleSleepRateLimitStrategy, iteration: %d)", limit, currentIteration+1)
+		util.Log.Info("Rate limit of %s requests/min reached: Applying rate limit strategy (simpleSleepRateLimitStrategy, iteration: %d)", limit, currentIteration+1)
 		util.Log.Info("simpleSleepRateLimitStrategy: Attempting to sleep until %s", humanReadableTimestamp)
 
 		// Attention: this uses client time:
@@ -78,7 +121,9 @@ func (s *simpleSleepRateLimitStrategy) executeRequest(timelineProvider util.Time
 		sleepDuration = s.applyMinMaxDefaults(sleepDuration)
 
 		util.Log.Debug("simpleSleepRateLimitStrategy: Sleeping for %f seconds...", sleepDuration.Seconds())
-		timelineProvider.Sleep(sleepDuration)
+		if err := timelineProvider.SleepContext(ctx, sleepDuration); err != nil {
+			return Response{}, err
+		}
 		util.Log.Debug("simpleSleepRateLimitStrategy: Slept for %f seconds", sleepDuration.Seconds())
 
 		// Checking again:
@@ -95,18 +140,18 @@ func (s *simpleSleepRateLimitStrategy) executeRequest(timelineProvider util.Time
 
 func (s *simpleSleepRateLimitStrategy) extractRateLimitHeaders(response Response) (limit string, humanReadableResetTimestamp string, resetTimeInMicroseconds int64, err error) {
 
-	limitAsArray := response.Headers["X-RateLimit-Limit"]
-	resetAsArray := response.Headers["X-RateLimit-Reset"]
+	headers := http.Header(response.Headers)
+	limit = headers.Get("X-RateLimit-Limit")
+	reset := headers.Get("X-RateLimit-Reset")
 
-	if limitAsArray == nil || limitAsArray[0] == "" {
+	if limit == "" {
 		return "", "", 0, errors.New("rate limit header 'X-RateLimit-Limit' not found")
 	}
-	if resetAsArray == nil || resetAsArray[0] == "" {
+	if reset == "" {
 		return "", "", 0, errors.New("rate limit header 'X-RateLimit-Reset' not found")
 	}
 
-	limit = limitAsArray[0]
-	humanReadableResetTimestamp, resetTimeInMicroseconds, err = util.StringTimestampToHumanReadableFormat(resetAsArray[0])
+	humanReadableResetTimestamp, resetTimeInMicroseconds, err = util.StringTimestampToHumanReadableFormat(reset)
 	if err != nil {
 		return "", "", 0, err
 	}
@@ -0,0 +1,129 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+package rest
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/util"
+)
+
+// adaptiveRateLimitStrategy is a rate limiting strategy which learns the rate limit of the environment from
+// the 'X-RateLimit-*' headers of its responses. While plenty of requests remain in the current window, requests
+// are sent right away. Once fewer than a fifth of them remain, the remaining ones are spread out evenly until
+// the window resets, and once none remain, requests wait for the reset. Should the rate limit be exceeded
+// anyway, it falls back to simpleSleepRateLimitStrategy.
+type adaptiveRateLimitStrategy struct {
+	mutex     sync.Mutex
+	known     bool
+	limit     int
+	remaining int
+	reset     time.Time
+	fallback  RateLimitStrategy
+}
+
+// adaptiveMaxWait caps the time a request waits for the rate limit window to reset
+const adaptiveMaxWait = 1 * time.Minute
+
+func (a *adaptiveRateLimitStrategy) executeRequest(ctx context.Context, timelineProvider util.TimelineProvider, callback func() (Response, error)) (Response, error) {
+	return a.fallback.executeRequest(ctx, timelineProvider, func() (Response, error) {
+		if wait := a.pace(timelineProvider.Now()); wait > 0 {
+			if err := timelineProvider.SleepContext(ctx, wait); err != nil {
+				return Response{}, err
+			}
+		}
+
+		response, err := callback()
+		if err == nil {
+			a.learn(response)
+		}
+
+		return response, err
+	})
+}
+
+// pace returns how long to wait before sending the next request, based on what is known of the current rate
+// limit window, and counts the request against the remaining ones
+func (a *adaptiveRateLimitStrategy) pace(now time.Time) time.Duration {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if !a.known || !now.Before(a.reset) {
+		return 0
+	}
+
+	window := a.reset.Sub(now)
+	a.remaining--
+
+	var wait time.Duration
+	switch {
+	case a.remaining < 0:
+		wait = window
+	case a.remaining < a.limit/5:
+		wait = window / time.Duration(a.remaining+1)
+	}
+
+	if wait > adaptiveMaxWait {
+		wait = adaptiveMaxWait
+	}
+	if wait > 0 {
+		util.Log.Debug("adaptiveRateLimitStrategy: %d of %d requests remaining, delaying request for %f seconds...",
+			a.remaining, a.limit, wait.Seconds())
+	}
+	return wait
+}
+
+// learn updates the known rate limit window from the headers of a response, if present
+func (a *adaptiveRateLimitStrategy) learn(response Response) {
+	limit, limitErr := headerInt(response, "X-RateLimit-Limit")
+	reset, resetErr := headerInt(response, "X-RateLimit-Reset")
+	if limitErr != nil || resetErr != nil {
+		return
+	}
+
+	remaining, err := headerInt(response, "X-RateLimit-Remaining")
+	if err != nil {
+		if response.StatusCode != http.StatusTooManyRequests {
+			return
+		}
+		remaining = 0
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.known = true
+	a.limit = int(limit)
+	a.remaining = int(remaining)
+	a.reset = util.ConvertMicrosecondsToUnixTime(reset)
+}
+
+// headerInt parses the first value of the given header as an integer
+func headerInt(response Response, header string) (int64, error) {
+	value := http.Header(response.Headers).Get(header)
+	if value == "" {
+		return 0, strconv.ErrSyntax
+	}
+
+	return strconv.ParseInt(value, 10, 64)
+}
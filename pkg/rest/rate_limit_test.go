@@ -0,0 +1,290 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+package rest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTimeline is a TimelineProvider whose current time only advances when sleeping, and which records the time slept
+type fakeTimeline struct {
+	mutex sync.Mutex
+	now   time.Time
+	slept time.Duration
+}
+
+func newFakeTimeline() *fakeTimeline {
+	return &fakeTimeline{now: time.Date(2021, 10, 18, 12, 0, 0, 0, time.UTC)}
+}
+
+func (f *fakeTimeline) Now() time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.now
+}
+
+func (f *fakeTimeline) NowMillis() int64 {
+	return f.Now().UnixNano() / int64(time.Millisecond)
+}
+
+func (f *fakeTimeline) GetDaysBeforeMillis(days int) int64 {
+	return f.Now().AddDate(0, 0, -days).UnixNano() / int64(time.Millisecond)
+}
+
+func (f *fakeTimeline) Sleep(duration time.Duration) {
+	f.advance(duration)
+	f.mutex.Lock()
+	f.slept += duration
+	f.mutex.Unlock()
+}
+
+func (f *fakeTimeline) SleepContext(ctx context.Context, duration time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	f.Sleep(duration)
+	return nil
+}
+
+func (f *fakeTimeline) advance(duration time.Duration) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.now = f.now.Add(duration)
+}
+
+// takeSlept returns the time slept since it was last called
+func (f *fakeTimeline) takeSlept() time.Duration {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	slept := f.slept
+	f.slept = 0
+	return slept
+}
+
+// rateLimitHeaders returns the rate limit headers of a response, with a window resetting after the given duration
+func rateLimitHeaders(timeline *fakeTimeline, limit int, remaining int, resetIn time.Duration) map[string][]string {
+	headers := http.Header{}
+	headers.Set("X-RateLimit-Limit", strconv.Itoa(limit))
+	if remaining >= 0 {
+		headers.Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	}
+	headers.Set("X-RateLimit-Reset", strconv.FormatInt(timeline.Now().Add(resetIn).UnixNano()/int64(time.Microsecond), 10))
+	return headers
+}
+
+func okResponse() (Response, error) {
+	return Response{StatusCode: http.StatusOK}, nil
+}
+
+func TestTokenBucketRefillAndBurst(t *testing.T) {
+	type step struct {
+		// advance is the time passing before the request
+		advance time.Duration
+		// wait is the time the request is expected to be throttled for
+		wait time.Duration
+	}
+	burst := func(requests int) []step {
+		return make([]step, requests)
+	}
+
+	tests := []struct {
+		name              string
+		requestsPerMinute int
+		steps             []step
+	}{
+		{
+			name:              "burst up to the capacity",
+			requestsPerMinute: 60,
+			steps:             append(burst(6), step{wait: time.Second}, step{wait: time.Second}),
+		},
+		{
+			name:              "refill after a pause",
+			requestsPerMinute: 60,
+			steps:             append(burst(6), step{advance: 3 * time.Second}, step{}, step{}, step{wait: time.Second}),
+		},
+		{
+			name:              "refill up to the capacity",
+			requestsPerMinute: 60,
+			steps:             append(append(burst(6), step{advance: time.Minute}), append(burst(5), step{wait: time.Second})...),
+		},
+		{
+			name:              "capacity of at least one token",
+			requestsPerMinute: 6,
+			steps:             []step{{}, {wait: 10 * time.Second}, {advance: 5 * time.Second, wait: 5 * time.Second}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			timeline := newFakeTimeline()
+			strategy := newTokenBucketRateLimitStrategy(test.requestsPerMinute)
+
+			for i, step := range test.steps {
+				timeline.advance(step.advance)
+				if _, err := strategy.executeRequest(context.Background(), timeline, okResponse); err != nil {
+					t.Fatalf("request %d failed: %s", i+1, err)
+				}
+				if slept := timeline.takeSlept(); slept.Round(time.Millisecond) != step.wait {
+					t.Errorf("request %d waited %s, expected %s", i+1, slept, step.wait)
+				}
+			}
+		})
+	}
+}
+
+func TestAdaptiveBackOffAndRecovery(t *testing.T) {
+	// response is a response of the environment, with headers of a window resetting after resetIn. A remaining
+	// number of requests below 0 leaves out the header.
+	type response struct {
+		status    int
+		limit     int
+		remaining int
+		resetIn   time.Duration
+	}
+
+	tests := []struct {
+		name      string
+		responses []response
+		// waits are the times each request is expected to wait for, the requests being answered by the responses
+		// in turn
+		waits []time.Duration
+	}{
+		{
+			name: "plenty remaining",
+			responses: []response{
+				{http.StatusOK, 10, 9, time.Minute},
+				{http.StatusOK, 10, 8, time.Minute},
+				{http.StatusOK, 10, 7, time.Minute},
+			},
+			waits: []time.Duration{0, 0, 0},
+		},
+		{
+			name: "spread out when few remain",
+			responses: []response{
+				{http.StatusOK, 10, 2, time.Minute},
+				{http.StatusOK, 10, 1, 30 * time.Second},
+			},
+			waits: []time.Duration{0, 30 * time.Second},
+		},
+		{
+			name: "wait for the reset when none remain",
+			responses: []response{
+				{http.StatusOK, 10, 0, 20 * time.Second},
+				{http.StatusOK, 10, 9, time.Minute},
+			},
+			waits: []time.Duration{0, 20 * time.Second},
+		},
+		{
+			name: "wait capped",
+			responses: []response{
+				{http.StatusOK, 10, 0, 5 * time.Minute},
+				{http.StatusOK, 10, 9, time.Minute},
+			},
+			waits: []time.Duration{0, adaptiveMaxWait},
+		},
+		{
+			name: "back off after 429 and recover",
+			responses: []response{
+				{http.StatusTooManyRequests, 10, -1, 30 * time.Second},
+				{http.StatusOK, 10, 9, time.Minute},
+				{http.StatusOK, 10, 8, time.Minute},
+			},
+			// the fallback sleeps until the reset and sends the request again, which isn't paced as the
+			// window has reset, after which requests are sent right away again
+			waits: []time.Duration{30 * time.Second, 0},
+		},
+		{
+			name: "back off after 429 with remaining requests",
+			responses: []response{
+				{http.StatusOK, 10, 5, time.Minute},
+				{http.StatusTooManyRequests, 10, -1, 10 * time.Second},
+				{http.StatusOK, 10, 1, 20 * time.Second},
+				{http.StatusOK, 10, 0, 10 * time.Second},
+			},
+			waits: []time.Duration{0, 10 * time.Second, 20 * time.Second},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			timeline := newFakeTimeline()
+			strategy := createRateLimitStrategy(AdaptiveRateLimitStrategy, 0)
+
+			responses := test.responses
+			callback := func() (Response, error) {
+				if len(responses) == 0 {
+					return Response{}, fmt.Errorf("unexpected request")
+				}
+				r := responses[0]
+				responses = responses[1:]
+				return Response{StatusCode: r.status, Headers: rateLimitHeaders(timeline, r.limit, r.remaining, r.resetIn)}, nil
+			}
+
+			for i, wait := range test.waits {
+				response, err := strategy.executeRequest(context.Background(), timeline, callback)
+				if err != nil {
+					t.Fatalf("request %d failed: %s", i+1, err)
+				}
+				if response.StatusCode != http.StatusOK {
+					t.Errorf("request %d ended with status %d", i+1, response.StatusCode)
+				}
+				if slept := timeline.takeSlept(); slept.Round(time.Millisecond) != wait {
+					t.Errorf("request %d waited %s, expected %s", i+1, slept, wait)
+				}
+			}
+		})
+	}
+}
+
+func TestClientWaitsOnItsClock(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"columnNames":["internalUserId"],"values":[],"extrapolationLevel":1}`)
+	}))
+	defer server.Close()
+
+	clock := newFakeTimeline()
+	strategy, err := NewRateLimitStrategy(TokenBucketRateLimitStrategy, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := NewApiTokenAuthenticator("dt0c01.fake.token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewDynatraceClient(server.URL, auth, WithRateLimitStrategy(strategy), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 8; i++ {
+		if _, err := client.(*dynatraceClientImpl).queryTable(context.Background(), "SELECT internalUserId FROM usersession", 0, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if slept := clock.takeSlept(); slept.Round(time.Millisecond) != 2*time.Second {
+		t.Errorf("client waited %s for the rate limit, expected 2s", slept)
+	}
+}
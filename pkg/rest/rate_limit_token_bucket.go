@@ -0,0 +1,90 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+package rest
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/util"
+)
+
+// tokenBucketRateLimitStrategy is a rate limiting strategy which proactively throttles requests on the client
+// side, so that the rate limit of the environment is never exceeded. Tokens are added to the bucket at the
+// given number of requests per minute and every request (including repeated ones) takes a token, waiting for
+// one to become available if the bucket is empty. The bucket holds a tenth of a minute's worth of tokens, which
+// allows short bursts while keeping the rate over any one minute close to the configured one.
+// Should the rate limit be exceeded anyway, e.g. by other tools sharing the environment's quota, it falls
+// back to simpleSleepRateLimitStrategy.
+type tokenBucketRateLimitStrategy struct {
+	mutex      sync.Mutex
+	capacity   float64
+	tokens     float64
+	refillRate float64
+	lastRefill time.Time
+	fallback   RateLimitStrategy
+}
+
+func newTokenBucketRateLimitStrategy(requestsPerMinute int) *tokenBucketRateLimitStrategy {
+	capacity := math.Max(1, float64(requestsPerMinute)/10)
+
+	return &tokenBucketRateLimitStrategy{
+		capacity:   capacity,
+		tokens:     capacity,
+		refillRate: float64(requestsPerMinute) / 60,
+		fallback:   &simpleSleepRateLimitStrategy{},
+	}
+}
+
+func (t *tokenBucketRateLimitStrategy) executeRequest(ctx context.Context, timelineProvider util.TimelineProvider, callback func() (Response, error)) (Response, error) {
+	return t.fallback.executeRequest(ctx, timelineProvider, func() (Response, error) {
+		if wait := t.take(timelineProvider.Now()); wait > 0 {
+			util.Log.Debug("tokenBucketRateLimitStrategy: Throttling request for %f seconds...", wait.Seconds())
+			if err := timelineProvider.SleepContext(ctx, wait); err != nil {
+				return Response{}, err
+			}
+		}
+
+		return callback()
+	})
+}
+
+// take refills the bucket for the time passed since the last request and takes a token out of it. If no token
+// is available, the token is reserved in advance and the time to wait until it becomes available is returned.
+func (t *tokenBucketRateLimitStrategy) take(now time.Time) time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.lastRefill.IsZero() {
+		t.lastRefill = now
+	}
+	if elapsed := now.Sub(t.lastRefill); elapsed > 0 {
+		t.tokens = math.Min(t.capacity, t.tokens+elapsed.Seconds()*t.refillRate)
+		t.lastRefill = now
+	}
+
+	t.tokens--
+	if t.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-t.tokens / t.refillRate * float64(time.Second))
+}
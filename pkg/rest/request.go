@@ -17,15 +17,15 @@
 package rest
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"io"
 	"io/ioutil"
 	"net/http"
-	"runtime"
-	"strings"
 
 	"github.com/google/uuid"
 	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/util"
-	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/version"
 )
 
 type Response struct {
@@ -34,47 +34,69 @@ type Response struct {
 	Headers    map[string][]string
 }
 
-func get(client *http.Client, url, apiToken, mcUA, mcCookie string) (Response, error) {
-	req, err := request(http.MethodGet, url, apiToken, mcUA, mcCookie)
+func get(ctx context.Context, settings clientSettings, url string, auth Authenticator) (Response, error) {
+	req, err := newRequest(http.MethodGet, url, nil)
 
 	if err != nil {
 		return Response{}, err
 	}
 
-	return executeRequest(client, req), nil
+	return send(ctx, settings, req, auth)
 }
 
-func request(method, url, apiToken, mcUA, mcCookie string) (*http.Request, error) {
-	return requestWithBody(method, url, nil, apiToken, mcUA, mcCookie)
-}
+// send authenticates and executes the request, retrying it as specified by the retry policy of the settings, and
+// converts unsuccessful responses into errors
+func send(ctx context.Context, settings clientSettings, req *http.Request, auth Authenticator) (Response, error) {
+	req = req.WithContext(ctx)
 
-func requestWithBody(method, url string, body io.Reader, apiToken, mcUA, mcCookie string) (*http.Request, error) {
-	if mcUA != "" && mcCookie != "" {
-		if strings.Contains(url, "?") {
-			url += "&"
-		} else {
-			url += "?"
+	return settings.retry.execute(ctx, func() (Response, error) {
+		// every attempt is authenticated again, as access tokens may have been refreshed in the meantime
+		if err := auth.Authenticate(ctx, req); err != nil {
+			return Response{}, err
 		}
-		url += "Api-Token=" + apiToken
+
+		response, err := executeRequest(ctx, settings, req)
+		if err != nil {
+			return response, err
+		}
+
+		err = checkResponse(response)
+		var authErr *AuthenticationError
+		if expiring, ok := auth.(expiringAuthenticator); ok && errors.As(err, &authErr) {
+			// the credentials may have been revoked or expired early, so the request is sent once more with fresh ones
+			expiring.invalidate(req)
+			if err := auth.Authenticate(ctx, req); err != nil {
+				return Response{}, err
+			}
+			if response, err = executeRequest(ctx, settings, req); err != nil {
+				return response, err
+			}
+			err = checkResponse(response)
+		}
+
+		return response, err
+	})
+}
+
+// newRequest creates a request with an optional JSON body, which is authenticated when it is sent
+func newRequest(method, url string, body []byte) (*http.Request, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
 	}
-	req, err := http.NewRequest(method, url, body)
+
+	req, err := http.NewRequest(method, url, reader)
 	if err != nil {
 		return nil, err
 	}
-
-	if mcUA != "" && mcCookie != "" {
-		req.Header.Set("User-Agent", mcUA)
-		req.Header.Set("Cookie", mcCookie)
-	} else {
-		req.Header.Set("Authorization", "Api-Token "+apiToken)
-		req.Header.Set("User-Agent", "Dynatrace Error Analyser/"+version.ErrorAnalyser+" "+(runtime.GOOS+" "+runtime.GOARCH))
-	}
 	req.Header.Set("Content-type", "application/json")
 
 	return req, nil
 }
 
-func executeRequest(client *http.Client, request *http.Request) Response {
+// executeRequest sends the request with the HTTP client of the settings, within the rate limit of their strategy,
+// which waits on the clock of the settings
+func executeRequest(ctx context.Context, settings clientSettings, request *http.Request) (Response, error) {
 	var requestId string
 	if util.IsRequestLoggingActive() {
 		requestId = uuid.NewString()
@@ -85,18 +107,35 @@ func executeRequest(client *http.Client, request *http.Request) Response {
 		}
 	}
 
-	rateLimitStrategy := createRateLimitStrategy()
+	response, err := settings.rateLimiter.executeRequest(ctx, settings.clock, func() (Response, error) {
+		// requests with a body are sent again when retried, which needs a fresh copy of the body
+		if request.GetBody != nil {
+			body, err := request.GetBody()
+			if err != nil {
+				return Response{}, err
+			}
+			request.Body = body
+		}
 
-	response, err := rateLimitStrategy.executeRequest(util.NewTimelineProvider(), func() (Response, error) {
-		resp, err := client.Do(request)
+		resp, err := settings.client.Do(request)
 		if err != nil {
-			util.Log.Error("HTTP Request failed with Error: " + err.Error())
-			return Response{}, err
+			if ctx.Err() != nil {
+				return Response{}, ctx.Err()
+			}
+			// retrying doesn't help when no fixture matches the request
+			var unmatched *UnmatchedRequestError
+			if errors.As(err, &unmatched) {
+				return Response{}, unmatched
+			}
+			util.Log.Debug("HTTP Request failed with Error: %s", err)
+			return Response{}, &NetworkError{Err: err}
 		}
-		defer func() {
-			err = resp.Body.Close()
-		}()
+		defer resp.Body.Close()
+
 		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return Response{}, &NetworkError{Err: err}
+		}
 
 		if util.IsResponseLoggingActive() {
 			err := util.LogResponse(requestId, resp)
@@ -114,12 +153,11 @@ func executeRequest(client *http.Client, request *http.Request) Response {
 			StatusCode: resp.StatusCode,
 			Body:       body,
 			Headers:    resp.Header,
-		}, err
+		}, nil
 	})
 
 	if err != nil {
-		// TODO properly handle error
-		return Response{}
+		return Response{}, err
 	}
-	return response
+	return response, nil
 }
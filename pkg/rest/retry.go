@@ -0,0 +1,84 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+package rest
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/util"
+)
+
+// DefaultRetries is the number of times a request failing with a transient error is retried by default
+const DefaultRetries = 3
+
+// retryPolicy defines how requests failing with transient errors (network issues, server errors or a
+// rate limit that is still exceeded) are retried. The delay between attempts grows exponentially from
+// the base delay, up to the max delay, and is randomised to spread out the retries of parallel requests.
+type retryPolicy struct {
+	retries          int
+	baseDelay        time.Duration
+	maxDelay         time.Duration
+	timelineProvider util.TimelineProvider
+}
+
+// newRetryPolicy creates a retryPolicy which retries failed requests the given number of times
+func newRetryPolicy(retries int) retryPolicy {
+	if retries < 0 {
+		retries = 0
+	}
+
+	return retryPolicy{
+		retries:          retries,
+		baseDelay:        1 * time.Second,
+		maxDelay:         30 * time.Second,
+		timelineProvider: util.NewTimelineProvider(),
+	}
+}
+
+// execute calls the callback until it succeeds, fails with an error that is not transient, runs out of retries
+// or the context is done
+func (r retryPolicy) execute(ctx context.Context, callback func() (Response, error)) (Response, error) {
+	response, err := callback()
+
+	for attempt := 0; attempt < r.retries && err != nil && isTransient(err) && ctx.Err() == nil; attempt++ {
+		delay := r.backoff(attempt)
+		util.Log.Warn("Request failed with %s. Retrying in %.1f seconds (retry %d of %d)", err, delay.Seconds(), attempt+1, r.retries)
+		if err := r.timelineProvider.SleepContext(ctx, delay); err != nil {
+			return Response{}, err
+		}
+
+		response, err = callback()
+	}
+
+	return response, err
+}
+
+// backoff returns the delay before the given retry attempt. Half of the delay is fixed and the other half
+// is random (jitter), so that the delay grows exponentially but retries don't all happen at the same time.
+func (r retryPolicy) backoff(attempt int) time.Duration {
+	delay := r.baseDelay << uint(attempt)
+	if delay > r.maxDelay || delay <= 0 {
+		delay = r.maxDelay
+	}
+
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
@@ -0,0 +1,215 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+package rest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestResponsesMapToTypedErrors(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       int
+		unreachable  bool
+		wantErr      error
+		wantAttempts int
+	}{
+		{name: "ok", status: http.StatusOK, wantAttempts: 1},
+		{name: "bad query", status: http.StatusBadRequest, wantErr: &QueryError{}, wantAttempts: 1},
+		{name: "unauthenticated", status: http.StatusUnauthorized, wantErr: &AuthenticationError{}, wantAttempts: 1},
+		{name: "forbidden", status: http.StatusForbidden, wantErr: &PermissionError{}, wantAttempts: 1},
+		{name: "not found", status: http.StatusNotFound, wantErr: &ServerError{}, wantAttempts: 1},
+		{name: "internal server error", status: http.StatusInternalServerError, wantErr: &ServerError{}, wantAttempts: 3},
+		{name: "service unavailable", status: http.StatusServiceUnavailable, wantErr: &ServerError{}, wantAttempts: 3},
+		{name: "network", unreachable: true, wantErr: &NetworkError{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var mutex sync.Mutex
+			attempts := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mutex.Lock()
+				attempts++
+				mutex.Unlock()
+				w.WriteHeader(test.status)
+				fmt.Fprint(w, `{"error":{"code":0,"message":"failed"},"columnNames":[],"values":[]}`)
+			}))
+			if test.unreachable {
+				server.Close()
+			} else {
+				defer server.Close()
+			}
+
+			auth, err := NewApiTokenAuthenticator("dt0c01.fake.token")
+			if err != nil {
+				t.Fatal(err)
+			}
+			client, err := NewDynatraceClient(server.URL, auth, WithRetries(2), WithClock(newFakeTimeline()))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = client.(*dynatraceClientImpl).queryTable(context.Background(), "SELECT count(*) FROM usersession", 0, 1)
+			switch want := test.wantErr.(type) {
+			case nil:
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			case *QueryError:
+				if !errors.As(err, &want) {
+					t.Errorf("expected a QueryError, got %T: %v", err, err)
+				}
+			case *AuthenticationError:
+				if !errors.As(err, &want) {
+					t.Errorf("expected an AuthenticationError, got %T: %v", err, err)
+				}
+			case *PermissionError:
+				if !errors.As(err, &want) {
+					t.Errorf("expected a PermissionError, got %T: %v", err, err)
+				}
+			case *ServerError:
+				if !errors.As(err, &want) || want.StatusCode != test.status {
+					t.Errorf("expected a ServerError with status %d, got %T: %v", test.status, err, err)
+				}
+			case *NetworkError:
+				if !errors.As(err, &want) {
+					t.Errorf("expected a NetworkError, got %T: %v", err, err)
+				}
+			}
+			if !test.unreachable && attempts != test.wantAttempts {
+				t.Errorf("sent %d requests, expected %d", attempts, test.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	tests := []struct {
+		name         string
+		retries      int
+		failures     int
+		err          error
+		wantAttempts int
+		wantErr      bool
+	}{
+		{name: "succeeds at once", retries: 3, failures: 0, err: &NetworkError{Err: errors.New("reset")}, wantAttempts: 1},
+		{name: "succeeds after retries", retries: 3, failures: 2, err: &ServerError{StatusCode: 503}, wantAttempts: 3},
+		{name: "runs out of retries", retries: 3, failures: 10, err: &NetworkError{Err: errors.New("reset")}, wantAttempts: 4,
+			wantErr: true},
+		{name: "rate limit is retried", retries: 1, failures: 1, err: &RateLimitError{}, wantAttempts: 2},
+		{name: "no retries", retries: 0, failures: 10, err: &ServerError{StatusCode: 500}, wantAttempts: 1, wantErr: true},
+		{name: "negative retries", retries: -1, failures: 10, err: &ServerError{StatusCode: 500}, wantAttempts: 1, wantErr: true},
+		{name: "client errors aren't retried", retries: 3, failures: 10, err: &ServerError{StatusCode: 404}, wantAttempts: 1,
+			wantErr: true},
+		{name: "bad queries aren't retried", retries: 3, failures: 10, err: &QueryError{}, wantAttempts: 1, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clock := newFakeTimeline()
+			policy := newRetryPolicy(test.retries)
+			policy.timelineProvider = clock
+
+			attempts := 0
+			_, err := policy.execute(context.Background(), func() (Response, error) {
+				attempts++
+				if attempts <= test.failures {
+					return Response{}, test.err
+				}
+				return Response{StatusCode: http.StatusOK}, nil
+			})
+
+			if attempts != test.wantAttempts {
+				t.Errorf("made %d attempts, expected %d", attempts, test.wantAttempts)
+			}
+			if test.wantErr && err != test.err {
+				t.Errorf("returned %v, expected the error of the last attempt", err)
+			}
+			if !test.wantErr && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+
+			// each retry waits between half and all of a delay doubling from the base delay
+			var minSlept, maxSlept time.Duration
+			for attempt := 0; attempt < test.wantAttempts-1; attempt++ {
+				delay := policy.baseDelay << uint(attempt)
+				minSlept += delay / 2
+				maxSlept += delay
+			}
+			if slept := clock.takeSlept(); slept < minSlept || slept > maxSlept {
+				t.Errorf("slept %s between attempts, expected between %s and %s", slept, minSlept, maxSlept)
+			}
+		})
+	}
+}
+
+func TestRetryStopsWhenContextIsDone(t *testing.T) {
+	clock := newFakeTimeline()
+	policy := newRetryPolicy(3)
+	policy.timelineProvider = clock
+
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts := 0
+	_, err := policy.execute(ctx, func() (Response, error) {
+		attempts++
+		cancel()
+		return Response{}, &NetworkError{Err: errors.New("reset")}
+	})
+
+	if attempts != 1 {
+		t.Errorf("made %d attempts, expected 1", attempts)
+	}
+	if err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	policy := newRetryPolicy(10)
+
+	tests := []struct {
+		attempt int
+		delay   time.Duration
+	}{
+		{attempt: 0, delay: time.Second},
+		{attempt: 1, delay: 2 * time.Second},
+		{attempt: 3, delay: 8 * time.Second},
+		{attempt: 4, delay: 16 * time.Second},
+		{attempt: 5, delay: 30 * time.Second},
+		{attempt: 70, delay: 30 * time.Second},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("attempt %d", test.attempt), func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				if backoff := policy.backoff(test.attempt); backoff < test.delay/2 || backoff > test.delay {
+					t.Fatalf("backoff is %s, expected between %s and %s", backoff, test.delay/2, test.delay)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,388 @@
+/**
+ * @license
+ * Copyright (C) 2021  Radu Stefan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see: https://www.gnu.org/licenses/
+ **/
+
+// Package scaffold writes the environments file and config file of a new setup, asking for the details which
+// weren't given
+package scaffold
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/config"
+	"github.com/radu-stefan-dt/dynatrace-error-analyser/pkg/environment"
+	"github.com/spf13/afero"
+)
+
+// defaultGrailScope is the OAuth scope which Grail sessions are read with
+const defaultGrailScope = "storage:user.sessions:read"
+
+// variableChars matches the characters which can't be part of the name of an environment variable
+var variableChars = regexp.MustCompile(`[^A-Z0-9_]+`)
+
+// Answers holds the details of the environment and configuration to scaffold. Details left empty are asked for
+// in interactive mode, and otherwise take their default value.
+type Answers struct {
+	EnvironmentId  string
+	EnvironmentUrl string
+	DataSource     string
+	Auth           string
+	// TokenName, MCUserAgentName, MCCookieName and OAuthClientSecretName are the names of the environment
+	// variables holding the secrets, which are never written to the files
+	TokenName             string
+	MCUserAgentName       string
+	MCCookieName          string
+	OAuthClientId         string
+	OAuthClientSecretName string
+	OAuthScope            string
+	OAuthResource         string
+
+	ConfigId   string
+	ConfigName string
+	UseCases   []string
+	// Properties are the properties of the configuration, such as application or error_prop
+	Properties map[string]string
+}
+
+// Init writes an environments file and a config file for a single environment and configuration. In interactive
+// mode, the details missing from the answers are asked for on out and read from in. Mandatory properties of the
+// configuration left empty are marked in the config file, to be filled in later. Existing files are only
+// overwritten if forced.
+func Init(fs afero.Fs, environmentsFile string, configFile string, answers Answers, interactive bool, force bool,
+	in io.Reader, out io.Writer) error {
+
+	if !force {
+		for _, file := range []string{environmentsFile, configFile} {
+			if exists, err := afero.Exists(fs, file); err != nil {
+				return err
+			} else if exists {
+				return fmt.Errorf("%s already exists, use --force to overwrite it", file)
+			}
+		}
+	}
+
+	p := &prompter{in: bufio.NewScanner(in), out: out, interactive: interactive}
+	if interactive {
+		fmt.Fprintln(out, "Press enter to accept the [default] answers.")
+	}
+
+	details, err := askEnvironment(p, &answers)
+	if err != nil {
+		return err
+	}
+	environments, err := environment.MarshalEnvironments(map[string]map[string]string{answers.EnvironmentId: details})
+	if err != nil {
+		return err
+	}
+
+	scaffold, err := askConfig(p, &answers)
+	if err != nil {
+		return err
+	}
+	configs, err := config.MarshalScaffold(scaffold)
+	if err != nil {
+		return err
+	}
+	missing, _ := scaffold.MissingProperties()
+
+	if err := afero.WriteFile(fs, environmentsFile, environments, 0644); err != nil {
+		return err
+	}
+	if err := afero.WriteFile(fs, configFile, configs, 0644); err != nil {
+		return err
+	}
+
+	printNextSteps(out, environmentsFile, configFile, details, missing)
+	return nil
+}
+
+// askEnvironment asks for the details of the environment, returning its attributes in the environments file
+func askEnvironment(p *prompter, answers *Answers) (map[string]string, error) {
+	if err := p.ask(&answers.EnvironmentId, "ID of the environment", "prod"); err != nil {
+		return nil, err
+	}
+	if err := p.ask(&answers.EnvironmentUrl, "URL of the environment, e.g. https://abc12345.live.dynatrace.com", ""); err != nil {
+		return nil, err
+	}
+	if err := p.ask(&answers.DataSource, "Data source of user sessions", environment.DataSourceUSQL,
+		environment.DataSourceUSQL, environment.DataSourceGrail); err != nil {
+		return nil, err
+	}
+
+	auths := []string{environment.AuthApiToken, environment.AuthMissionControl}
+	if answers.DataSource == environment.DataSourceGrail {
+		auths = []string{environment.AuthPlatformToken, environment.AuthOAuth}
+	}
+	if err := p.ask(&answers.Auth, "Authentication", auths[0], auths...); err != nil {
+		return nil, err
+	}
+
+	prefix := "DT_" + variableChars.ReplaceAllString(strings.ToUpper(answers.EnvironmentId), "_")
+	details := map[string]string{
+		"name":        answers.EnvironmentId,
+		"env-url":     answers.EnvironmentUrl,
+		"data-source": answers.DataSource,
+		"auth":        answers.Auth,
+	}
+	if answers.DataSource == environment.DataSourceUSQL {
+		delete(details, "data-source")
+	}
+
+	if answers.Auth == environment.AuthOAuth {
+		if err := p.ask(&answers.OAuthClientId, "ID of the OAuth client", ""); err != nil {
+			return nil, err
+		}
+		if err := p.ask(&answers.OAuthClientSecretName, "Environment variable holding the secret of the OAuth client",
+			prefix+"_CLIENT_SECRET"); err != nil {
+			return nil, err
+		}
+		if err := p.ask(&answers.OAuthScope, "Scopes of the OAuth client", defaultGrailScope); err != nil {
+			return nil, err
+		}
+		if err := p.askOptional(&answers.OAuthResource, "Account or environment URN to request access for, if required"); err != nil {
+			return nil, err
+		}
+		details["oauth-client-id"] = answers.OAuthClientId
+		details["oauth-client-secret-name"] = answers.OAuthClientSecretName
+		details["oauth-scope"] = answers.OAuthScope
+		details["oauth-resource"] = answers.OAuthResource
+		return details, nil
+	}
+
+	if err := p.ask(&answers.TokenName, "Environment variable holding the token", prefix+"_TOKEN"); err != nil {
+		return nil, err
+	}
+	details["env-token-name"] = answers.TokenName
+
+	if answers.Auth == environment.AuthMissionControl {
+		if err := p.ask(&answers.MCUserAgentName, "Environment variable holding the user agent of your Mission Control session",
+			prefix+"_MC_UA"); err != nil {
+			return nil, err
+		}
+		if err := p.ask(&answers.MCCookieName, "Environment variable holding the cookie of your Mission Control session",
+			prefix+"_MC_COOKIE"); err != nil {
+			return nil, err
+		}
+		details["mc-ua"] = answers.MCUserAgentName
+		details["mc-cookie"] = answers.MCCookieName
+	}
+
+	return details, nil
+}
+
+// askConfig asks for the details of the configuration, including the properties mandatory for its use cases
+func askConfig(p *prompter, answers *Answers) (config.Scaffold, error) {
+	if err := p.ask(&answers.ConfigId, "ID of the configuration", answers.EnvironmentId+"-errors"); err != nil {
+		return config.Scaffold{}, err
+	}
+	if err := p.ask(&answers.ConfigName, "Name of the configuration", "Error analysis of "+answers.EnvironmentId); err != nil {
+		return config.Scaffold{}, err
+	}
+
+	for {
+		useCases := strings.Join(answers.UseCases, ", ")
+		if err := p.ask(&useCases, "Use cases, separated by commas: lost_basket, agent_hours, incurred_costs",
+			string(config.LostBasket)); err != nil {
+			return config.Scaffold{}, err
+		}
+		answers.UseCases = splitList(useCases)
+		_, err := config.MandatoryProperties(answers.UseCases, "")
+		if err == nil {
+			break
+		}
+		if !p.interactive {
+			return config.Scaffold{}, err
+		}
+		fmt.Fprintln(p.out, err)
+		answers.UseCases = nil
+	}
+
+	if answers.Properties == nil {
+		answers.Properties = make(map[string]string)
+	}
+	properties := answers.Properties
+
+	application := properties["application"]
+	if err := p.askOptional(&application, "Application to analyse, leave empty for all applications"); err != nil {
+		return config.Scaffold{}, err
+	}
+	errorSource := properties["error_source"]
+	if err := p.ask(&errorSource, "Source of errors", "session_property", "session_property", "javascript", "request",
+		"custom"); err != nil {
+		return config.Scaffold{}, err
+	}
+	properties["application"], properties["error_source"] = application, errorSource
+	if errorSource == "session_property" {
+		// the default source is left out
+		delete(properties, "error_source")
+	}
+
+	mandatory, err := config.MandatoryProperties(answers.UseCases, properties["error_source"])
+	if err != nil {
+		return config.Scaffold{}, err
+	}
+	for _, property := range mandatory {
+		question := fmt.Sprintf("%s, %s (leave empty to fill in later)", property, config.DescribeProperty(property))
+		value := properties[property]
+		for {
+			if err := p.askOptional(&value, question); err != nil {
+				return config.Scaffold{}, err
+			}
+			err := config.CheckPropertyValue(property, value)
+			if err == nil || !p.interactive {
+				break
+			}
+			fmt.Fprintln(p.out, err)
+			value = ""
+		}
+		properties[property] = value
+	}
+
+	return config.Scaffold{
+		Id:           answers.ConfigId,
+		Name:         answers.ConfigName,
+		UseCases:     answers.UseCases,
+		Properties:   properties,
+		Environments: []string{answers.EnvironmentId},
+	}, nil
+}
+
+// printNextSteps tells which environment variables to set and what is left to fill in before a first run
+func printNextSteps(out io.Writer, environmentsFile string, configFile string, details map[string]string, missing []string) {
+	fmt.Fprintf(out, "\nWrote %s and %s.\n", environmentsFile, configFile)
+
+	var variables []string
+	for _, attribute := range []string{"env-token-name", "mc-ua", "mc-cookie", "oauth-client-secret-name"} {
+		if details[attribute] != "" {
+			variables = append(variables, details[attribute])
+		}
+	}
+	if len(variables) == 1 {
+		fmt.Fprintf(out, "Set the environment variable %s before running derran.\n", variables[0])
+	} else if len(variables) > 1 {
+		fmt.Fprintf(out, "Set the environment variables %s before running derran.\n", strings.Join(variables, ", "))
+	}
+	if len(missing) > 0 {
+		fmt.Fprintf(out, "Fill in the properties marked TODO in %s: %s. derran discover can suggest values.\n", configFile,
+			strings.Join(missing, ", "))
+	}
+	fmt.Fprintf(out, "Then check the setup with: derran preflight -e %s -c %s\n", environmentsFile, configFile)
+}
+
+// ParseProperties parses properties given as key=value pairs
+func ParseProperties(pairs []string) (map[string]string, error) {
+	properties := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("property %q must be given as key=value", pair)
+		}
+		properties[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return properties, nil
+}
+
+// splitList splits a comma separated list, dropping empty values
+func splitList(text string) []string {
+	var values []string
+	for _, value := range strings.Split(text, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// prompter asks for answers which weren't given, in interactive mode
+type prompter struct {
+	in          *bufio.Scanner
+	out         io.Writer
+	interactive bool
+}
+
+// ask sets an empty answer to what is typed in interactive mode, or to the default value. An answer is required
+// and must be one of the allowed values, if any. In interactive mode, invalid answers are asked for again.
+func (p *prompter) ask(answer *string, question string, defaultValue string, allowed ...string) error {
+	if len(allowed) > 0 {
+		question = fmt.Sprintf("%s (%s)", question, strings.Join(allowed, ", "))
+	}
+
+	for {
+		if *answer == "" && p.interactive {
+			if defaultValue != "" {
+				fmt.Fprintf(p.out, "%s [%s]: ", question, defaultValue)
+			} else {
+				fmt.Fprintf(p.out, "%s: ", question)
+			}
+			if err := p.read(answer, question); err != nil {
+				return err
+			}
+		}
+		if *answer == "" {
+			*answer = defaultValue
+		}
+
+		var err error
+		if *answer == "" {
+			err = fmt.Errorf("an answer is required to: %s", question)
+		} else if len(allowed) > 0 && !contains(allowed, *answer) {
+			err = fmt.Errorf("%s must be one of %s", *answer, strings.Join(allowed, ", "))
+		}
+		if err == nil {
+			return nil
+		}
+		if !p.interactive {
+			return err
+		}
+		fmt.Fprintln(p.out, err)
+		*answer = ""
+	}
+}
+
+// askOptional sets an empty answer to what is typed in interactive mode, which may be empty as well
+func (p *prompter) askOptional(answer *string, question string) error {
+	if *answer != "" || !p.interactive {
+		return nil
+	}
+	fmt.Fprintf(p.out, "%s: ", question)
+	return p.read(answer, question)
+}
+
+// read reads the next line typed as the answer to a question
+func (p *prompter) read(answer *string, question string) error {
+	if !p.in.Scan() {
+		if err := p.in.Err(); err != nil {
+			return err
+		}
+		return fmt.Errorf("no answer given to: %s", question)
+	}
+	*answer = strings.TrimSpace(p.in.Text())
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
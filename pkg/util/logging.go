@@ -36,8 +36,17 @@ var responseLogFile *os.File
 
 // SetupLogging is used to initialize the shared file Logger once the necesary setup config is available
 func SetupLogging(verbose bool) error {
+	return setupLogging(verbose, lumber.NewConsoleLogger(lumber.INFO))
+}
+
+// SetupStderrLogging is SetupLogging for commands printing their results to stdout, which log to stderr instead
+// so that their results can be piped
+func SetupStderrLogging(verbose bool) error {
+	return setupLogging(verbose, lumber.NewBasicLogger(os.Stderr, lumber.INFO))
+}
+
+func setupLogging(verbose bool, consoleLog *lumber.ConsoleLogger) error {
 	multiLog := lumber.NewMultiLogger()
-	consoleLog := lumber.NewConsoleLogger(lumber.INFO)
 	if verbose {
 		consoleLog.Level(lumber.DEBUG)
 	}
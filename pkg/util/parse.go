@@ -20,6 +20,7 @@ package util
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"sort"
 	"strings"
@@ -33,12 +34,27 @@ func ReplacePathSeparators(path string) (newPath string) {
 	return newPath
 }
 
-// Safe way to extract the required details from a user session, in the correct format, avoiding nil panics
+// SessionWidth returns the number of columns of a user session as unpacked by UnpackSession, given whether it
+// holds the basket value and the number of error sources
+func SessionWidth(isLostBasket bool, errorSources int) int {
+	width := 7 + errorSources
+	if isLostBasket {
+		width++
+	}
+	return width
+}
+
+// Safe way to extract the required details from a user session, in the correct format, avoiding nil panics.
+// Sessions hold the user ID, start time, end time, user action names, the basket value (lost basket use case
+// only), browser type, OS family and user action applications, followed by one column for each error source.
+// Errors are unpacked per source, in the order of the sources. Sessions must be at least SessionWidth columns wide.
 func UnpackSession(isLostBasket bool, session []interface{}) (sessionDetails map[string]interface{}) {
 	var (
 		actions     []string
-		sErr        string
+		sErrs       [][]string
 		browserType string
+		osFamily    string
+		application string
 		userId      string
 		startTime   int64
 		basketValue float64
@@ -47,45 +63,85 @@ func UnpackSession(isLostBasket bool, session []interface{}) (sessionDetails map
 	if fmt.Sprintf("%T", session[0]) == "string" {
 		userId = session[0].(string)
 	}
-	if fmt.Sprintf("%T", session[1]) == "string" {
-		sErr = session[1].(string)
+	if fmt.Sprintf("%T", session[1]) == "float64" {
+		startTime = int64(session[1].(float64))
 	}
-	if fmt.Sprintf("%T", session[2]) == "float64" {
-		startTime = int64(session[2].(float64))
-	}
-	rawActions := session[4].([]interface{})
-	for i := 0; i < len(rawActions); i++ {
-		var action string
-		if fmt.Sprintf("%T", rawActions[i]) == "string" {
-			action = rawActions[i].(string)
+	if rawActions, ok := session[3].([]interface{}); ok {
+		for i := 0; i < len(rawActions); i++ {
+			var action string
+			if fmt.Sprintf("%T", rawActions[i]) == "string" {
+				action = rawActions[i].(string)
+			}
+			actions = append(actions, action)
 		}
-		actions = append(actions, action)
 	}
 
+	next := 4
 	if isLostBasket {
-		if fmt.Sprintf("%T", session[5]) == "float64" {
-			basketValue = session[5].(float64)
+		if fmt.Sprintf("%T", session[next]) == "float64" {
+			basketValue = session[next].(float64)
 		}
-		if fmt.Sprintf("%T", session[6]) == "string" {
-			browserType = session[6].(string)
+		next++
+	}
+	if fmt.Sprintf("%T", session[next]) == "string" {
+		browserType = session[next].(string)
+	}
+	if fmt.Sprintf("%T", session[next+1]) == "string" {
+		osFamily = session[next+1].(string)
+	}
+	// sessions carry the application of each user action, the first one known is used
+	if rawApplications, ok := session[next+2].([]interface{}); ok {
+		for _, rawApplication := range rawApplications {
+			if fmt.Sprintf("%T", rawApplication) == "string" && rawApplication.(string) != "" {
+				application = rawApplication.(string)
+				break
+			}
 		}
-	} else {
-		if fmt.Sprintf("%T", session[5]) == "string" {
-			browserType = session[5].(string)
+	}
+	next += 3
+
+	// errors read from a session property are a single string, those reported by the agent a list
+	for _, rawErrs := range session[next:] {
+		var errs []string
+		switch e := rawErrs.(type) {
+		case string:
+			errs = append(errs, e)
+		case []interface{}:
+			for _, rawErr := range e {
+				if fmt.Sprintf("%T", rawErr) == "string" {
+					errs = append(errs, rawErr.(string))
+				}
+			}
 		}
+		sErrs = append(sErrs, errs)
 	}
 
 	sessionDetails = make(map[string]interface{})
-	sessionDetails["error"] = sErr
+	sessionDetails["errors"] = sErrs
 	sessionDetails["userId"] = userId
 	sessionDetails["actions"] = actions
 	sessionDetails["startTime"] = startTime
 	sessionDetails["basketValue"] = basketValue
 	sessionDetails["browserType"] = browserType
+	sessionDetails["osFamily"] = osFamily
+	sessionDetails["application"] = application
 
 	return sessionDetails
 }
 
+// MatchesConversion checks whether a user action name matches the conversion action. The match mode can be
+// "starts_with" or "contains", otherwise the names must match exactly.
+func MatchesConversion(action string, conversion string, mode string) bool {
+	switch mode {
+	case "starts_with":
+		return strings.HasPrefix(action, conversion)
+	case "contains":
+		return strings.Contains(action, conversion)
+	default:
+		return action == conversion
+	}
+}
+
 // Sort a map by its values
 type Pair struct {
 	Key   string
@@ -130,3 +186,39 @@ func CheckUniqueYamlKey(data []byte, name string) (errs []error) {
 
 	return errs
 }
+
+// ParseIPRange parses an IP range given either as a single address, a CIDR block (10.0.0.0/8)
+// or a hyphenated range (10.0.0.1-10.0.0.20) and returns the first and last address in the range
+func ParseIPRange(ipRange string) (first net.IP, last net.IP, err error) {
+	ipRange = strings.TrimSpace(ipRange)
+
+	if strings.Contains(ipRange, "/") {
+		ip, network, err := net.ParseCIDR(ipRange)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%q is not a valid CIDR block", ipRange)
+		}
+		if ip.To4() != nil {
+			network.IP = network.IP.To4()
+		}
+
+		first = network.IP
+		last = make(net.IP, len(first))
+		for i := range first {
+			last[i] = first[i] | ^network.Mask[i]
+		}
+
+		return first, last, nil
+	}
+
+	bounds := strings.SplitN(ipRange, "-", 2)
+	first = net.ParseIP(strings.TrimSpace(bounds[0]))
+	last = first
+	if len(bounds) == 2 {
+		last = net.ParseIP(strings.TrimSpace(bounds[1]))
+	}
+	if first == nil || last == nil {
+		return nil, nil, fmt.Errorf("%q is not a valid IP address or range", ipRange)
+	}
+
+	return first, last, nil
+}
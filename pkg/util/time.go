@@ -19,6 +19,7 @@
 package util
 
 import (
+	"context"
 	"fmt"
 	"strconv"
 	"time"
@@ -40,6 +41,10 @@ type TimelineProvider interface {
 
 	// Sleep suspends the current goroutine for the specified duration
 	Sleep(duration time.Duration)
+
+	// SleepContext suspends the current goroutine for the specified duration, or until the context is done,
+	// in which case the context's error is returned
+	SleepContext(ctx context.Context, duration time.Duration) error
 }
 
 // NewTimelineProvider creates a new TimelineProvider
@@ -47,6 +52,12 @@ func NewTimelineProvider() TimelineProvider {
 	return &defaultTimelineProvider{}
 }
 
+// NewFixedTimelineProvider creates a TimelineProvider whose current time is fixed to the given time, so
+// that timeframes computed relative to it stay the same however long a run takes. Sleeping is not affected.
+func NewFixedTimelineProvider(now time.Time) TimelineProvider {
+	return &fixedTimelineProvider{now: now.UTC()}
+}
+
 // defaultTimelineProvider is the default implementation of interface TimelineProvider
 type defaultTimelineProvider struct{}
 
@@ -73,6 +84,24 @@ func (d *defaultTimelineProvider) GetDaysBeforeMillis(days int) int64 {
 	return utcNanos / 1_000_000
 }
 
+// fixedTimelineProvider is an implementation of interface TimelineProvider with a fixed current time
+type fixedTimelineProvider struct {
+	defaultTimelineProvider
+	now time.Time
+}
+
+func (f *fixedTimelineProvider) Now() time.Time {
+	return f.now
+}
+
+func (f *fixedTimelineProvider) NowMillis() int64 {
+	return f.now.UnixNano() / 1_000_000
+}
+
+func (f *fixedTimelineProvider) GetDaysBeforeMillis(days int) int64 {
+	return f.now.AddDate(0, 0, -days).UnixNano() / 1_000_000
+}
+
 func GetTodayDigitString() string {
 	nowInLocalTimeZone := time.Now()
 	return nowInLocalTimeZone.Format("20060102")
@@ -82,6 +111,18 @@ func (d *defaultTimelineProvider) Sleep(duration time.Duration) {
 	time.Sleep(duration)
 }
 
+func (d *defaultTimelineProvider) SleepContext(ctx context.Context, duration time.Duration) error {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // StringTimestampToHumanReadableFormat parses and sanity-checks a unix timestamp as string and returns it
 // as int64 and a human-readable representation of it
 func StringTimestampToHumanReadableFormat(unixTimestampAsString string) (humanReadable string, parsedTimestamp int64, err error) {